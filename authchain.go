@@ -3,6 +3,7 @@ package gomatrixserverlib
 import (
 	"context"
 	"fmt"
+	"sort"
 )
 
 // AuthChainProvider returns the requested list of auth events.
@@ -62,3 +63,124 @@ func VerifyEventAuthChain(ctx context.Context, eventToVerify *HeaderedEvent, pro
 	}
 	return nil
 }
+
+// AuthDifference returns the auth difference of two state sets, as used by
+// state resolution v2: the events that appear in the full auth chain of one
+// state set but not in the full auth chain of the other. The full auth chain
+// of a state set is the union of the auth chains of each event in it.
+//
+// Any auth events that are not already in either state set are requested
+// from `provideEvents`. Failing to provide all of the requested events will
+// fail this function. The returned events are sorted by event ID.
+func AuthDifference(a, b []*Event, provideEvents AuthChainProvider) ([]*Event, error) {
+	eventsByID := make(map[string]*Event, len(a)+len(b))
+	for _, events := range [][]*Event{a, b} {
+		for _, event := range events {
+			eventsByID[event.EventID()] = event
+		}
+	}
+	chainA, err := fullAuthChain(a, eventsByID, provideEvents)
+	if err != nil {
+		return nil, err
+	}
+	chainB, err := fullAuthChain(b, eventsByID, provideEvents)
+	if err != nil {
+		return nil, err
+	}
+	var difference []*Event
+	for eventID := range chainA {
+		if !chainB[eventID] {
+			difference = append(difference, eventsByID[eventID])
+		}
+	}
+	for eventID := range chainB {
+		if !chainA[eventID] {
+			difference = append(difference, eventsByID[eventID])
+		}
+	}
+	sort.Slice(difference, func(i, j int) bool {
+		return difference[i].EventID() < difference[j].EventID()
+	})
+	return difference, nil
+}
+
+// ChainsToCreate returns true if the auth chain of the event leads back to the
+// expected m.room.create event, and to no other create event. This can be used
+// to detect events which claim to be in a room but which were authorised by
+// the state of a different room. If the event is itself a create event then
+// it must be the expected one.
+//
+// Any auth events that are not already known are requested from
+// `provideEvents`. Failing to provide all of the requested events will fail
+// this function.
+func ChainsToCreate(event *Event, provideEvents AuthChainProvider, expectedCreateID string) (bool, error) {
+	if event.Type() == MRoomCreate && event.StateKeyEquals("") {
+		return event.EventID() == expectedCreateID, nil
+	}
+	eventsByID := map[string]*Event{event.EventID(): event}
+	chain, err := fullAuthChain([]*Event{event}, eventsByID, provideEvents)
+	if err != nil {
+		return false, err
+	}
+	if !chain[expectedCreateID] {
+		return false, nil
+	}
+	for eventID := range chain {
+		authEvent := eventsByID[eventID]
+		if authEvent.Type() != MRoomCreate || !authEvent.StateKeyEquals("") {
+			continue
+		}
+		if eventID != expectedCreateID {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// fullAuthChain returns the IDs of all of the events in the auth chains of
+// the given events. Events that are not already in eventsByID are requested
+// from `provideEvents` and added to eventsByID.
+func fullAuthChain(events []*Event, eventsByID map[string]*Event, provideEvents AuthChainProvider) (map[string]bool, error) {
+	chain := make(map[string]bool)
+	var need []string
+	for _, event := range events {
+		need = append(need, event.AuthEventIDs()...)
+	}
+	for len(need) > 0 {
+		var missing []string
+		var next []string
+		for _, eventID := range need {
+			if chain[eventID] {
+				continue
+			}
+			chain[eventID] = true
+			if event, ok := eventsByID[eventID]; ok {
+				next = append(next, event.AuthEventIDs()...)
+			} else {
+				missing = append(missing, eventID)
+			}
+		}
+		if len(missing) > 0 {
+			if provideEvents == nil {
+				return nil, fmt.Errorf("gomatrixserverlib: missing %d auth events and no way to fetch them", len(missing))
+			}
+			roomVersion := events[0].roomVersion
+			newEvents, err := provideEvents(roomVersion, missing)
+			if err != nil {
+				return nil, fmt.Errorf("gomatrixserverlib: failed to obtain auth events: %w", err)
+			}
+			for _, event := range newEvents {
+				eventsByID[event.EventID()] = event
+			}
+			for _, eventID := range missing {
+				event, ok := eventsByID[eventID]
+				if !ok {
+					return nil, fmt.Errorf("gomatrixserverlib: failed to obtain auth event %q", eventID)
+				}
+				next = append(next, event.AuthEventIDs()...)
+			}
+		}
+		need = next
+	}
+	return chain, nil
+}
@@ -2,6 +2,7 @@ package gomatrixserverlib_test
 
 import (
 	"context"
+	"reflect"
 	"testing"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -88,3 +89,90 @@ func provideEvents(t *testing.T, events [][]byte) gomatrixserverlib.AuthChainPro
 		return
 	}
 }
+
+// A state set which has diverged on the join rules. Each side's membership
+// event for @bob was authed by a different join rules event.
+func TestAuthDifference(t *testing.T) {
+	testEvents := [][]byte{
+		[]byte(`{"auth_events":[],"content":{"creator":"@alice:baba.is.you"},"depth":1,"event_id":"$create:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"room_id":"!roomid:baba.is.you","sender":"@alice:baba.is.you","state_key":"","type":"m.room.create"}`),
+		[]byte(`{"auth_events":[["$create:baba.is.you",{}]],"content":{"membership":"join"},"depth":2,"event_id":"$alice:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$create:baba.is.you",{}]],"room_id":"!roomid:baba.is.you","sender":"@alice:baba.is.you","state_key":"@alice:baba.is.you","type":"m.room.member"}`),
+		[]byte(`{"auth_events":[["$create:baba.is.you",{}],["$alice:baba.is.you",{}]],"content":{"users":{"@alice:baba.is.you":100}},"depth":3,"event_id":"$power:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$alice:baba.is.you",{}]],"room_id":"!roomid:baba.is.you","sender":"@alice:baba.is.you","state_key":"","type":"m.room.power_levels"}`),
+		[]byte(`{"auth_events":[["$create:baba.is.you",{}],["$alice:baba.is.you",{}],["$power:baba.is.you",{}]],"content":{"join_rule":"public"},"depth":4,"event_id":"$public:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$power:baba.is.you",{}]],"room_id":"!roomid:baba.is.you","sender":"@alice:baba.is.you","state_key":"","type":"m.room.join_rules"}`),
+		[]byte(`{"auth_events":[["$create:baba.is.you",{}],["$alice:baba.is.you",{}],["$power:baba.is.you",{}]],"content":{"join_rule":"invite"},"depth":4,"event_id":"$invite:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$power:baba.is.you",{}]],"room_id":"!roomid:baba.is.you","sender":"@alice:baba.is.you","state_key":"","type":"m.room.join_rules"}`),
+		[]byte(`{"auth_events":[["$create:baba.is.you",{}],["$power:baba.is.you",{}],["$public:baba.is.you",{}]],"content":{"membership":"join"},"depth":5,"event_id":"$bob1:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$public:baba.is.you",{}]],"room_id":"!roomid:baba.is.you","sender":"@bob:baba.is.you","state_key":"@bob:baba.is.you","type":"m.room.member"}`),
+		[]byte(`{"auth_events":[["$create:baba.is.you",{}],["$power:baba.is.you",{}],["$invite:baba.is.you",{}]],"content":{"membership":"join"},"depth":5,"event_id":"$bob2:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$invite:baba.is.you",{}]],"room_id":"!roomid:baba.is.you","sender":"@bob:baba.is.you","state_key":"@bob:baba.is.you","type":"m.room.member"}`),
+	}
+	provider := provideEvents(t, testEvents)
+	lookup := func(eventIDs ...string) []*gomatrixserverlib.Event {
+		events, err := provider(gomatrixserverlib.RoomVersionV1, eventIDs)
+		if err != nil || len(events) != len(eventIDs) {
+			t.Fatalf("failed to look up events %v: %v", eventIDs, err)
+		}
+		return events
+	}
+
+	// Only the state events are given, so the rest of the auth chains must
+	// be fetched from the provider.
+	a := lookup("$bob1:baba.is.you")
+	b := lookup("$bob2:baba.is.you")
+	difference, err := gomatrixserverlib.AuthDifference(a, b, provider)
+	if err != nil {
+		t.Fatalf("AuthDifference failed: %s", err)
+	}
+	var got []string
+	for _, event := range difference {
+		got = append(got, event.EventID())
+	}
+	want := []string{"$invite:baba.is.you", "$public:baba.is.you"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got auth difference %v, want %v", got, want)
+	}
+
+	// Identical state sets have no auth difference.
+	difference, err = gomatrixserverlib.AuthDifference(a, a, provider)
+	if err != nil {
+		t.Fatalf("AuthDifference failed: %s", err)
+	}
+	if len(difference) != 0 {
+		t.Fatalf("expected no auth difference for identical state sets, got %d events", len(difference))
+	}
+
+	// Failing to provide the auth events should fail.
+	if _, err = gomatrixserverlib.AuthDifference(a, b, provideEvents(t, testEvents[5:])); err == nil {
+		t.Fatal("expected AuthDifference to fail when auth events are missing")
+	}
+}
+
+func TestChainsToCreate(t *testing.T) {
+	testEvents := [][]byte{
+		[]byte(`{"auth_events":[],"content":{"creator":"@alice:baba.is.you"},"depth":1,"event_id":"$create:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"room_id":"!roomid:baba.is.you","sender":"@alice:baba.is.you","state_key":"","type":"m.room.create"}`),
+		[]byte(`{"auth_events":[["$create:baba.is.you",{}]],"content":{"membership":"join"},"depth":2,"event_id":"$alice:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$create:baba.is.you",{}]],"room_id":"!roomid:baba.is.you","sender":"@alice:baba.is.you","state_key":"@alice:baba.is.you","type":"m.room.member"}`),
+		[]byte(`{"auth_events":[],"content":{"creator":"@alice:baba.is.you"},"depth":1,"event_id":"$othercreate:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"room_id":"!otherroom:baba.is.you","sender":"@alice:baba.is.you","state_key":"","type":"m.room.create"}`),
+		[]byte(`{"auth_events":[["$othercreate:baba.is.you",{}]],"content":{"membership":"join"},"depth":2,"event_id":"$otheralice:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$othercreate:baba.is.you",{}]],"room_id":"!otherroom:baba.is.you","sender":"@alice:baba.is.you","state_key":"@alice:baba.is.you","type":"m.room.member"}`),
+		// These messages claim to be in the first room, but one is authorised
+		// by the other room's create event and the other by both.
+		[]byte(`{"auth_events":[["$create:baba.is.you",{}],["$alice:baba.is.you",{}]],"content":{"body":"hello"},"depth":3,"event_id":"$good:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$alice:baba.is.you",{}]],"room_id":"!roomid:baba.is.you","sender":"@alice:baba.is.you","type":"m.room.message"}`),
+		[]byte(`{"auth_events":[["$othercreate:baba.is.you",{}],["$otheralice:baba.is.you",{}]],"content":{"body":"hello"},"depth":3,"event_id":"$smuggled:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$otheralice:baba.is.you",{}]],"room_id":"!roomid:baba.is.you","sender":"@alice:baba.is.you","type":"m.room.message"}`),
+		[]byte(`{"auth_events":[["$create:baba.is.you",{}],["$otheralice:baba.is.you",{}]],"content":{"body":"hello"},"depth":3,"event_id":"$mixed:baba.is.you","origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$alice:baba.is.you",{}]],"room_id":"!roomid:baba.is.you","sender":"@alice:baba.is.you","type":"m.room.message"}`),
+	}
+	provider := provideEvents(t, testEvents)
+	for eventID, want := range map[string]bool{
+		"$create:baba.is.you":      true,
+		"$othercreate:baba.is.you": false,
+		"$good:baba.is.you":        true,
+		"$smuggled:baba.is.you":    false,
+		"$mixed:baba.is.you":       false,
+	} {
+		events, err := provider(gomatrixserverlib.RoomVersionV1, []string{eventID})
+		if err != nil || len(events) != 1 {
+			t.Fatalf("failed to look up event %s: %v", eventID, err)
+		}
+		got, err := gomatrixserverlib.ChainsToCreate(events[0], provider, "$create:baba.is.you")
+		if err != nil {
+			t.Fatalf("ChainsToCreate failed for %s: %s", eventID, err)
+		}
+		if got != want {
+			t.Errorf("ChainsToCreate for %s: got %v, want %v", eventID, got, want)
+		}
+	}
+}
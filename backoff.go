@@ -0,0 +1,154 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// A RetryPolicy controls how federation requests which fail with a transient
+// error are retried. Transient errors are network errors, HTTP 429 responses
+// and HTTP 5xx responses. Other errors, e.g. a 404, are never retried.
+type RetryPolicy struct {
+	// The maximum number of times to retry a request after the first attempt.
+	// Zero disables retries.
+	MaxRetries int
+	// How long to wait before the first retry. This doubles after each retry.
+	InitialBackoff time.Duration
+	// The maximum time to wait between retries.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy retries a failing request a couple of times, waiting
+// half a second and then a second between attempts.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:     2,
+	InitialBackoff: time.Millisecond * 500,
+	MaxBackoff:     time.Second * 10,
+}
+
+// backoff returns how long to wait before the given retry, starting at 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+// A BackoffStore tracks destinations which are failing, so that the
+// federation client can avoid sending requests to servers which are down.
+// Implementations must be safe to use from multiple goroutines.
+type BackoffStore interface {
+	// BackoffUntil returns the time until which requests to the destination
+	// should not be sent, or the zero time if the destination isn't backed off.
+	BackoffUntil(destination ServerName) time.Time
+	// RecordFailure is called when a request to the destination has failed
+	// with a transient error, after any retries.
+	RecordFailure(destination ServerName)
+	// RecordSuccess is called when the destination has responded to a request.
+	RecordSuccess(destination ServerName)
+}
+
+// BackoffError is returned by the federation client when a request isn't sent
+// because the destination is being backed off.
+type BackoffError struct {
+	Destination ServerName
+	Until       time.Time
+}
+
+func (e BackoffError) Error() string {
+	return fmt.Sprintf("gomatrixserverlib: backing off from %q until %s", e.Destination, e.Until.Format(time.RFC3339))
+}
+
+// InMemoryBackoffStore is a BackoffStore which backs off each destination
+// exponentially after consecutive failures. The zero value is not usable, use
+// NewInMemoryBackoffStore instead.
+type InMemoryBackoffStore struct {
+	mutex        sync.Mutex
+	destinations map[ServerName]*destinationBackoff
+	base         time.Duration
+	max          time.Duration
+}
+
+type destinationBackoff struct {
+	failures int
+	until    time.Time
+}
+
+// NewInMemoryBackoffStore returns a new InMemoryBackoffStore. After the first
+// failure a destination is backed off for the base duration, which doubles for
+// each consecutive failure up to the max duration.
+func NewInMemoryBackoffStore(base, max time.Duration) *InMemoryBackoffStore {
+	return &InMemoryBackoffStore{
+		destinations: make(map[ServerName]*destinationBackoff),
+		base:         base,
+		max:          max,
+	}
+}
+
+// BackoffUntil implements BackoffStore
+func (s *InMemoryBackoffStore) BackoffUntil(destination ServerName) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if d, ok := s.destinations[destination]; ok {
+		return d.until
+	}
+	return time.Time{}
+}
+
+// RecordFailure implements BackoffStore
+func (s *InMemoryBackoffStore) RecordFailure(destination ServerName) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	d, ok := s.destinations[destination]
+	if !ok {
+		d = &destinationBackoff{}
+		s.destinations[destination] = d
+	}
+	d.failures++
+	d.until = time.Now().Add(RetryPolicy{InitialBackoff: s.base, MaxBackoff: s.max}.backoff(d.failures))
+}
+
+// RecordSuccess implements BackoffStore
+func (s *InMemoryBackoffStore) RecordSuccess(destination ServerName) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.destinations, destination)
+}
+
+// isTransientError returns true if the error returned from a request is worth
+// retrying, i.e. the request didn't reach the remote server or the remote
+// server failed to handle it.
+func isTransientError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var httpErr gomatrix.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code == 429 || httpErr.Code/100 == 5
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// sleepContext waits for the given duration, returning early with the context
+// error if the context is done first.
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -23,6 +23,20 @@ import (
 	"strings"
 )
 
+// EncodeBase64StdUnpadded encodes the bytes as unpadded base64 using the
+// standard alphabet, which is how hashes, keys and signatures are encoded, as
+// well as the event IDs in room version 3.
+func EncodeBase64StdUnpadded(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+// EncodeBase64URLUnpadded encodes the bytes as unpadded base64 using the URL
+// safe alphabet, which is how the event IDs are encoded in room version 4 and
+// later.
+func EncodeBase64URLUnpadded(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
 // A Base64Bytes is a string of bytes (not base64 encoded) that are
 // base64 encoded when used in JSON.
 //
@@ -36,7 +50,7 @@ type Base64Bytes []byte
 
 // Encode encodes the bytes as base64
 func (b64 Base64Bytes) Encode() string {
-	return base64.RawStdEncoding.EncodeToString(b64)
+	return EncodeBase64StdUnpadded(b64)
 }
 
 // Decode decodes the given input into this Base64Bytes
@@ -187,3 +187,26 @@ func TestScanBase64(t *testing.T) {
 		t.Fatal("scanning from int should have failed but didn't")
 	}
 }
+
+func TestEncodeBase64Unpadded(t *testing.T) {
+	// The test vectors from RFC 4648, without the padding, and some bytes
+	// which are encoded differently by the standard and URL safe alphabets.
+	for input, want := range map[string][2]string{
+		"":                        {"", ""},
+		"f":                       {"Zg", "Zg"},
+		"fo":                      {"Zm8", "Zm8"},
+		"foo":                     {"Zm9v", "Zm9v"},
+		"foob":                    {"Zm9vYg", "Zm9vYg"},
+		"fooba":                   {"Zm9vYmE", "Zm9vYmE"},
+		"foobar":                  {"Zm9vYmFy", "Zm9vYmFy"},
+		"this\xffis\xffa\xfftest": {"dGhpc/9pc/9h/3Rlc3Q", "dGhpc_9pc_9h_3Rlc3Q"},
+		"\xfb\xef\xbe":            {"++++", "----"},
+	} {
+		if got := EncodeBase64StdUnpadded([]byte(input)); got != want[0] {
+			t.Errorf("EncodeBase64StdUnpadded(%q): wanted %q got %q", input, want[0], got)
+		}
+		if got := EncodeBase64URLUnpadded([]byte(input)); got != want[1] {
+			t.Errorf("EncodeBase64URLUnpadded(%q): wanted %q got %q", input, want[1], got)
+		}
+	}
+}
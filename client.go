@@ -42,8 +42,11 @@ const requestTimeout time.Duration = time.Duration(30) * time.Second
 // centralise a number of configurable options, such as DNS caching,
 // timeouts etc.
 type Client struct {
-	client    http.Client
-	userAgent string
+	client       http.Client
+	userAgent    string
+	retryPolicy  RetryPolicy
+	backoffStore BackoffStore
+	limiter      *destinationLimiter
 }
 
 // UserInfo represents information about a user.
@@ -58,6 +61,9 @@ type clientOptions struct {
 	skipVerify   bool
 	keepAlives   bool
 	wellKnownSRV bool
+	retryPolicy  RetryPolicy
+	backoffStore BackoffStore
+	maxPerDest   int
 }
 
 // ClientOption are supplied to NewClient or NewFederationClient.
@@ -86,6 +92,11 @@ func NewClient(options ...ClientOption) *Client {
 			Transport: clientOpts.transport,
 			Timeout:   clientOpts.timeout,
 		},
+		retryPolicy:  clientOpts.retryPolicy,
+		backoffStore: clientOpts.backoffStore,
+	}
+	if clientOpts.maxPerDest > 0 {
+		client.limiter = newDestinationLimiter(clientOpts.maxPerDest)
 	}
 	return client
 }
@@ -141,6 +152,36 @@ func WithWellKnownSRVLookups(wellKnownSRV bool) ClientOption {
 	}
 }
 
+// WithRetryPolicy is an option that can be supplied to either NewClient or
+// NewFederationClient. Federation requests which fail with a transient error
+// will be retried according to the policy. By default requests aren't retried.
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(options *clientOptions) {
+		options.retryPolicy = policy
+	}
+}
+
+// WithBackoffStore is an option that can be supplied to either NewClient or
+// NewFederationClient. The store is consulted before sending federation
+// requests, and requests to destinations which are backed off will fail with
+// a BackoffError without being sent.
+func WithBackoffStore(store BackoffStore) ClientOption {
+	return func(options *clientOptions) {
+		options.backoffStore = store
+	}
+}
+
+// WithMaxConcurrentRequestsPerDestination is an option that can be supplied
+// to either NewClient or NewFederationClient. At most the given number of
+// requests made through the client, including key requests, will be in
+// flight to any single destination at once, with further requests waiting
+// for one to complete. Zero or less means no limit, which is the default.
+func WithMaxConcurrentRequestsPerDestination(limit int) ClientOption {
+	return func(options *clientOptions) {
+		options.maxPerDest = limit
+	}
+}
+
 const destinationTripperLifetime = time.Minute * 5 // how long to keep an entry
 const destinationTripperReapInterval = time.Minute // how often to check for dead entries
 
@@ -496,7 +537,8 @@ func (fc *Client) CreateMediaDownloadRequest(
 //
 // If the HTTP response is not a 200, an attempt is made to parse the response
 // body into a gomatrix.RespError. In any case, a non-200 response will result
-// in a gomatrix.HTTPError.
+// in a gomatrix.HTTPError, which will wrap the RespError if there was one. Use
+// AsMatrixError to extract it along with the status code.
 //
 func (fc *Client) DoRequestAndParseResponse(
 	ctx context.Context,
@@ -551,7 +593,9 @@ func (fc *Client) DoRequestAndParseResponse(
 // before sending off the request and awaiting a response.
 //
 // If the returned error is nil, the Response will contain a non-nil
-// Body which the caller is expected to close.
+// Body which the caller is expected to close. If the client limits the
+// number of concurrent requests per destination, the request counts towards
+// the limit of its destination until the Body is closed.
 //
 func (fc *Client) DoHTTPRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
 	reqID := util.RandomString(12)
@@ -566,12 +610,27 @@ func (fc *Client) DoHTTPRequest(ctx context.Context, req *http.Request) (*http.R
 		req.Header.Set("User-Agent", fc.userAgent)
 	}
 
+	destination := ServerName(req.URL.Host)
+	if fc.limiter != nil {
+		if err := fc.limiter.acquire(ctx, destination); err != nil {
+			return nil, err
+		}
+	}
+
 	start := time.Now()
 	resp, err := fc.client.Do(req.WithContext(newCtx))
 	if err != nil {
+		if fc.limiter != nil {
+			fc.limiter.release(destination)
+		}
 		logger.WithContext(ctx).WithField("error", err).Debug("Outgoing request failed")
 		return nil, err
 	}
+	if fc.limiter != nil {
+		resp.Body = &limitedBody{ReadCloser: resp.Body, release: func() {
+			fc.limiter.release(destination)
+		}}
+	}
 
 	// we haven't yet read the body, so this is slightly premature, but it's the easiest place.
 	logger.WithFields(logrus.Fields{
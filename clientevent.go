@@ -66,8 +66,8 @@ func ToClientEvent(se *Event, format ClientEventFormat) ClientEvent {
 		Unsigned:       RawJSON(se.Unsigned()),
 		OriginServerTS: se.OriginServerTS(),
 		EventID:        se.EventID(),
-		Redacts:        se.Redacts(),
 	}
+	ce.Redacts, _ = se.Redacts()
 	if format == FormatAll {
 		ce.RoomID = se.RoomID()
 	}
@@ -84,8 +84,8 @@ func HeaderedToClientEvent(se *HeaderedEvent, format ClientEventFormat) ClientEv
 		Unsigned:       RawJSON(se.Unsigned()),
 		OriginServerTS: se.OriginServerTS(),
 		EventID:        se.EventID(),
-		Redacts:        se.Redacts(),
 	}
+	ce.Redacts, _ = se.Redacts()
 	if format == FormatAll {
 		ce.RoomID = se.RoomID()
 	}
@@ -0,0 +1,135 @@
+package gomatrixserverlib
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// A CreateRoomOption is an option for CreateRoom.
+type CreateRoomOption func(*createRoomOptions)
+
+type createRoomOptions struct {
+	joinRule string
+	federate *bool
+}
+
+// WithCreateRoomJoinRule configures CreateRoom to use the given join rule,
+// e.g. "public". By default rooms are invite only.
+func WithCreateRoomJoinRule(joinRule string) CreateRoomOption {
+	return func(options *createRoomOptions) {
+		options.joinRule = joinRule
+	}
+}
+
+// WithCreateRoomFederate configures CreateRoom to set the "m.federate" flag
+// of the create event. By default the flag is left out, which allows users
+// from other servers to join the room.
+func WithCreateRoomFederate(federate bool) CreateRoomOption {
+	return func(options *createRoomOptions) {
+		options.federate = &federate
+	}
+}
+
+// CreateRoom returns EventBuilders for the minimal set of events needed to
+// create a new room that the creator is joined to, in the order in which
+// they must be sent: the create event, the creator's join, the power levels,
+// which give the creator power level 100, and the join rules. The prev_events,
+// auth_events and depth of the builders aren't set, since from room version 3
+// they refer to events by their hashes, which aren't known until the events
+// before them are built. Use BuildRoomEvents to build the events in order with
+// the prev_events and auth_events filled in.
+func CreateRoom(roomID, creator string, version RoomVersion, opts ...CreateRoomOption) ([]*EventBuilder, error) {
+	if _, err := version.EventFormat(); err != nil {
+		return nil, err
+	}
+	if _, err := checkID(roomID, "room", '!'); err != nil {
+		return nil, err
+	}
+	if _, err := checkID(creator, "user", '@'); err != nil {
+		return nil, err
+	}
+	options := createRoomOptions{joinRule: Invite}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	powerLevels := PowerLevelContent{}
+	powerLevels.Defaults()
+	powerLevels.Users = map[string]int64{creator: 100}
+	powerLevels.Events = map[string]int64{}
+
+	// The create content is built as a map, since CreateContent would always
+	// include an empty predecessor.
+	createContent := map[string]interface{}{
+		"creator":      creator,
+		"room_version": version,
+	}
+	if options.federate != nil {
+		createContent["m.federate"] = *options.federate
+	}
+
+	emptyStateKey := ""
+	creatorStateKey := creator
+	builders := []*EventBuilder{
+		{Type: MRoomCreate, StateKey: &emptyStateKey},
+		{Type: MRoomMember, StateKey: &creatorStateKey},
+		{Type: MRoomPowerLevels, StateKey: &emptyStateKey},
+		{Type: MRoomJoinRules, StateKey: &emptyStateKey},
+	}
+	contents := []interface{}{
+		createContent,
+		MemberContent{Membership: Join},
+		powerLevels,
+		JoinRuleContent{JoinRule: options.joinRule},
+	}
+	for i, builder := range builders {
+		builder.Sender = creator
+		builder.RoomID = roomID
+		if err := builder.SetContent(contents[i]); err != nil {
+			return nil, err
+		}
+	}
+	return builders, nil
+}
+
+// BuildRoomEvents builds the given events in order, e.g. those returned by
+// CreateRoom, as a linear section of room history. Each event has the event
+// built before it as its prev_event, or no prev_events if it is the first,
+// and the auth events it needs from the state built up by the events before
+// it. The events aren't checked against the auth rules.
+func BuildRoomEvents(
+	builders []*EventBuilder, now time.Time, origin ServerName, keyID KeyID,
+	privateKey ed25519.PrivateKey, version RoomVersion,
+) ([]*Event, error) {
+	events := make([]*Event, 0, len(builders))
+	state := NewAuthEvents(nil)
+	for _, builder := range builders {
+		stateNeeded, err := StateNeededForEventBuilder(builder)
+		if err != nil {
+			return nil, err
+		}
+		authEvents, err := stateNeeded.AuthEventReferences(&state)
+		if err != nil {
+			return nil, err
+		}
+		builder.AuthEvents = authEvents
+		if len(events) == 0 {
+			builder.SetPrevEvents(nil)
+		} else {
+			builder.SetPrevEvents(events[len(events)-1:])
+		}
+		event, err := builder.Build(now, origin, keyID, privateKey, version)
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib: failed to build %s event: %w", builder.Type, err)
+		}
+		if event.StateKey() != nil {
+			if err = state.AddEvent(event); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
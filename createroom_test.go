@@ -0,0 +1,72 @@
+package gomatrixserverlib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCreateRoom(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	creator := "@alice:alice.test"
+	for _, roomVersion := range []RoomVersion{RoomVersionV1, RoomVersionV3, RoomVersionV10} {
+		builders, err := CreateRoom("!room:alice.test", creator, roomVersion, WithCreateRoomJoinRule(Public))
+		if err != nil {
+			t.Fatalf("room version %s: %s", roomVersion, err)
+		}
+		events, err := BuildRoomEvents(builders, time.Now(), alice.serverName, alice.keyID, alice.privateKey, roomVersion)
+		if err != nil {
+			t.Fatalf("room version %s: %s", roomVersion, err)
+		}
+		wantTypes := []string{MRoomCreate, MRoomMember, MRoomPowerLevels, MRoomJoinRules}
+		if len(events) != len(wantTypes) {
+			t.Fatalf("room version %s: got %d events, want %d", roomVersion, len(events), len(wantTypes))
+		}
+		for i, event := range events {
+			if event.Type() != wantTypes[i] {
+				t.Errorf("room version %s: got event %d of type %q, want %q", roomVersion, i, event.Type(), wantTypes[i])
+			}
+		}
+		if err = VerifyRoomDAG(events); err != nil {
+			t.Fatalf("room version %s: expected the events to form a valid DAG: %s", roomVersion, err)
+		}
+
+		// Each event must be allowed by the state before it, using the auth
+		// events it references.
+		byID := make(map[string]*Event, len(events))
+		for _, event := range events {
+			byID[event.EventID()] = event
+		}
+		for _, event := range events {
+			var authEvents []*Event
+			for _, authEventID := range event.AuthEventIDs() {
+				authEvents = append(authEvents, byID[authEventID])
+			}
+			provider := NewAuthEvents(authEvents)
+			if err = Allowed(event, &provider); err != nil {
+				t.Errorf("room version %s: %s event not allowed: %s", roomVersion, event.Type(), err)
+			}
+			if err = ValidateAuthEvents(event, authEvents); err != nil {
+				t.Errorf("room version %s: %s event has invalid auth events: %s", roomVersion, event.Type(), err)
+			}
+		}
+
+		joinRule, err := events[3].JoinRule()
+		if err != nil || joinRule != Public {
+			t.Errorf("room version %s: got join rule %q (%v), want %q", roomVersion, joinRule, err, Public)
+		}
+		powerLevels, err := NewPowerLevelContentFromEvent(events[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level := powerLevels.UserLevel(creator); level != 100 {
+			t.Errorf("room version %s: got creator power level %d, want 100", roomVersion, level)
+		}
+	}
+
+	if _, err := CreateRoom("!room:alice.test", "alice", RoomVersionV10); err == nil {
+		t.Error("expected an invalid creator to be rejected")
+	}
+	if _, err := CreateRoom("!room:alice.test", creator, "unknown"); err == nil {
+		t.Error("expected an unknown room version to be rejected")
+	}
+}
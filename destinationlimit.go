@@ -0,0 +1,83 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// destinationLimiter limits the number of requests which may be in flight to
+// each destination at once. Semaphores are created when a destination is first
+// used and removed again once nothing is waiting on them, so the limiter
+// doesn't grow with the number of destinations ever contacted.
+type destinationLimiter struct {
+	mutex        sync.Mutex
+	limit        int
+	destinations map[ServerName]*destinationSemaphore
+}
+
+type destinationSemaphore struct {
+	slots chan struct{}
+	users int // the number of callers holding or waiting for a slot
+}
+
+func newDestinationLimiter(limit int) *destinationLimiter {
+	return &destinationLimiter{
+		limit:        limit,
+		destinations: make(map[ServerName]*destinationSemaphore),
+	}
+}
+
+// acquire waits for a free slot for the destination, returning the context
+// error if the context is done first. If this returns nil then the caller
+// must call release once the request has completed.
+func (l *destinationLimiter) acquire(ctx context.Context, destination ServerName) error {
+	l.mutex.Lock()
+	sem, ok := l.destinations[destination]
+	if !ok {
+		sem = &destinationSemaphore{slots: make(chan struct{}, l.limit)}
+		l.destinations[destination] = sem
+	}
+	sem.users++
+	l.mutex.Unlock()
+
+	select {
+	case sem.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.done(destination, sem)
+		return ctx.Err()
+	}
+}
+
+// release frees the slot taken by a successful call to acquire.
+func (l *destinationLimiter) release(destination ServerName) {
+	l.mutex.Lock()
+	sem := l.destinations[destination]
+	l.mutex.Unlock()
+	<-sem.slots
+	l.done(destination, sem)
+}
+
+func (l *destinationLimiter) done(destination ServerName, sem *destinationSemaphore) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	sem.users--
+	if sem.users == 0 {
+		delete(l.destinations, destination)
+	}
+}
+
+// limitedBody is a response body which releases the slot taken for its request
+// when it is closed.
+type limitedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *limitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
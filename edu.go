@@ -13,7 +13,11 @@
 
 package gomatrixserverlib
 
-import "unsafe"
+import (
+	"encoding/json"
+	"fmt"
+	"unsafe"
+)
 
 // EDU represents a EDU received via federation
 // https://matrix.org/docs/spec/server_server/unstable.html#edus
@@ -31,3 +35,166 @@ func (e *EDU) CacheCost() int {
 		len(e.Destination) +
 		cap(e.Content)
 }
+
+// ParseEDU parses an EDU from its JSON encoding, e.g. from the "edus" list of
+// a federation transaction. The content of known EDU types is validated, but
+// EDUs of unknown types are preserved as-is so that they can be passed on.
+func ParseEDU(data []byte) (*EDU, error) {
+	var e EDU
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib: unparsable EDU: %w", err)
+	}
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Validate checks that the EDU has a type and, for the EDU types that are
+// known, that the content has the expected shape. EDUs of unknown types are
+// not rejected.
+func (e *EDU) Validate() (err error) {
+	if e.Type == "" {
+		return fmt.Errorf("gomatrixserverlib: EDU is missing an edu_type")
+	}
+	switch e.Type {
+	case MTyping:
+		_, err = e.TypingContent()
+	case MReceipt:
+		_, err = e.ReceiptContent()
+	case MPresence:
+		_, err = e.PresenceContent()
+	}
+	return
+}
+
+// TypingContent is the content of a m.typing EDU.
+// https://matrix.org/docs/spec/server_server/latest#typing-notifications
+type TypingContent struct {
+	// The room where the user's typing status has been updated.
+	RoomID string `json:"room_id"`
+	// The user ID that has had their typing status changed.
+	UserID string `json:"user_id"`
+	// Whether the user is typing in the room or not.
+	Typing bool `json:"typing"`
+}
+
+// TypingContent returns the content of a m.typing EDU.
+// Returns an error if the EDU is not a m.typing EDU or if the content is invalid.
+func (e *EDU) TypingContent() (c TypingContent, err error) {
+	if err = e.unmarshalContent(MTyping, &c); err != nil {
+		return
+	}
+	if c.RoomID == "" || c.UserID == "" {
+		err = fmt.Errorf("gomatrixserverlib: %s EDU must have a room_id and a user_id", MTyping)
+	}
+	return
+}
+
+// ReceiptContent is the content of a m.receipt EDU. It maps room IDs to the
+// receipts sent in that room.
+// https://matrix.org/docs/spec/server_server/latest#receipts
+type ReceiptContent map[string]RoomReceipts
+
+// RoomReceipts are the receipts for a single room. Currently the only receipt
+// type is m.read.
+type RoomReceipts struct {
+	// The read receipts for the room, keyed by user ID.
+	Read map[string]UserReadReceipt `json:"m.read"`
+}
+
+// UserReadReceipt is a read receipt sent by a single user.
+type UserReadReceipt struct {
+	// The extremity event IDs that the user has read up to.
+	EventIDs []string `json:"event_ids"`
+	// Metadata for the read receipt.
+	Data ReceiptData `json:"data"`
+}
+
+// ReceiptData is the metadata for a read receipt.
+type ReceiptData struct {
+	// When the receipt was sent in milliseconds.
+	TS Timestamp `json:"ts"`
+}
+
+// ReceiptContent returns the content of a m.receipt EDU.
+// Returns an error if the EDU is not a m.receipt EDU or if the content is invalid.
+func (e *EDU) ReceiptContent() (c ReceiptContent, err error) {
+	if err = e.unmarshalContent(MReceipt, &c); err != nil {
+		return
+	}
+	for roomID, receipts := range c {
+		for userID, receipt := range receipts.Read {
+			if len(receipt.EventIDs) == 0 {
+				err = fmt.Errorf(
+					"gomatrixserverlib: %s EDU has no event IDs for user %q in room %q",
+					MReceipt, userID, roomID,
+				)
+				return
+			}
+		}
+	}
+	return
+}
+
+// PresenceContent is the content of a m.presence EDU.
+// https://matrix.org/docs/spec/server_server/latest#m-presence-schema
+type PresenceContent struct {
+	// A list of presence updates that the receiving server is likely to be
+	// interested in.
+	Push []PresenceUpdate `json:"push"`
+}
+
+// PresenceUpdate is a single presence update within a m.presence EDU.
+type PresenceUpdate struct {
+	// The user ID this presence EDU is for.
+	UserID string `json:"user_id"`
+	// The presence of the user, one of "offline", "unavailable" or "online".
+	Presence string `json:"presence"`
+	// An optional description to accompany the presence.
+	StatusMsg *string `json:"status_msg,omitempty"`
+	// The number of milliseconds that have elapsed since the user last did
+	// something.
+	LastActiveAgo int64 `json:"last_active_ago"`
+	// True if the user is likely to be interacting with their client.
+	CurrentlyActive bool `json:"currently_active,omitempty"`
+}
+
+// PresenceContent returns the content of a m.presence EDU.
+// Returns an error if the EDU is not a m.presence EDU or if the content is invalid.
+func (e *EDU) PresenceContent() (c PresenceContent, err error) {
+	if err = e.unmarshalContent(MPresence, &c); err != nil {
+		return
+	}
+	for _, update := range c.Push {
+		if update.UserID == "" {
+			err = fmt.Errorf("gomatrixserverlib: %s EDU has an update without a user_id", MPresence)
+			return
+		}
+		switch update.Presence {
+		case "offline", "unavailable", "online":
+		default:
+			err = fmt.Errorf(
+				"gomatrixserverlib: %s EDU has an invalid presence %q for user %q",
+				MPresence, update.Presence, update.UserID,
+			)
+			return
+		}
+	}
+	return
+}
+
+// unmarshalContent checks that the EDU is of the expected type and
+// unmarshals the content into the given value.
+func (e *EDU) unmarshalContent(eduType string, content interface{}) error {
+	if e.Type != eduType {
+		return fmt.Errorf("gomatrixserverlib: EDU is %q, not %q", e.Type, eduType)
+	}
+	if len(e.Content) == 0 {
+		return fmt.Errorf("gomatrixserverlib: %s EDU has no content", eduType)
+	}
+	if err := json.Unmarshal(e.Content, content); err != nil {
+		return fmt.Errorf("gomatrixserverlib: unparsable %s EDU content: %w", eduType, err)
+	}
+	return nil
+}
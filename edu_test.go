@@ -0,0 +1,99 @@
+package gomatrixserverlib
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseEDUTyping(t *testing.T) {
+	e, err := ParseEDU([]byte(`{"edu_type":"m.typing","origin":"example.com","content":{"room_id":"!room:example.com","user_id":"@alice:example.com","typing":true}}`))
+	if err != nil {
+		t.Fatalf("failed to parse EDU: %s", err)
+	}
+	c, err := e.TypingContent()
+	if err != nil {
+		t.Fatalf("failed to get typing content: %s", err)
+	}
+	if c.RoomID != "!room:example.com" || c.UserID != "@alice:example.com" || !c.Typing {
+		t.Fatalf("unexpected typing content: %+v", c)
+	}
+	if _, err = e.PresenceContent(); err == nil {
+		t.Fatal("expected an error getting presence content of a typing EDU")
+	}
+
+	if _, err = ParseEDU([]byte(`{"edu_type":"m.typing","origin":"example.com","content":{"typing":true}}`)); err == nil {
+		t.Fatal("expected typing EDU without a room ID to be rejected")
+	}
+	if _, err = ParseEDU([]byte(`{"edu_type":"m.typing","origin":"example.com","content":{"room_id":"!room:example.com","user_id":"@alice:example.com","typing":"yes"}}`)); err == nil {
+		t.Fatal("expected typing EDU with a non-boolean typing field to be rejected")
+	}
+}
+
+func TestParseEDUReceipt(t *testing.T) {
+	e, err := ParseEDU([]byte(`{"edu_type":"m.receipt","origin":"example.com","content":{"!room:example.com":{"m.read":{"@alice:example.com":{"data":{"ts":1533358089009},"event_ids":["$read_this_event:example.com"]}}}}}`))
+	if err != nil {
+		t.Fatalf("failed to parse EDU: %s", err)
+	}
+	c, err := e.ReceiptContent()
+	if err != nil {
+		t.Fatalf("failed to get receipt content: %s", err)
+	}
+	receipt, ok := c["!room:example.com"].Read["@alice:example.com"]
+	if !ok {
+		t.Fatalf("expected a read receipt for alice, got %+v", c)
+	}
+	if receipt.Data.TS != 1533358089009 || len(receipt.EventIDs) != 1 || receipt.EventIDs[0] != "$read_this_event:example.com" {
+		t.Fatalf("unexpected read receipt: %+v", receipt)
+	}
+
+	if _, err = ParseEDU([]byte(`{"edu_type":"m.receipt","origin":"example.com","content":{"!room:example.com":{"m.read":{"@alice:example.com":{"data":{"ts":1533358089009},"event_ids":[]}}}}}`)); err == nil {
+		t.Fatal("expected receipt EDU without event IDs to be rejected")
+	}
+}
+
+func TestParseEDUPresence(t *testing.T) {
+	e, err := ParseEDU([]byte(`{"edu_type":"m.presence","origin":"example.com","content":{"push":[{"user_id":"@alice:example.com","presence":"online","status_msg":"Making cupcakes","last_active_ago":5000,"currently_active":true}]}}`))
+	if err != nil {
+		t.Fatalf("failed to parse EDU: %s", err)
+	}
+	c, err := e.PresenceContent()
+	if err != nil {
+		t.Fatalf("failed to get presence content: %s", err)
+	}
+	if len(c.Push) != 1 {
+		t.Fatalf("expected 1 presence update, got %d", len(c.Push))
+	}
+	update := c.Push[0]
+	if update.UserID != "@alice:example.com" || update.Presence != "online" || update.LastActiveAgo != 5000 || !update.CurrentlyActive {
+		t.Fatalf("unexpected presence update: %+v", update)
+	}
+	if update.StatusMsg == nil || *update.StatusMsg != "Making cupcakes" {
+		t.Fatalf("unexpected status message: %v", update.StatusMsg)
+	}
+
+	if _, err = ParseEDU([]byte(`{"edu_type":"m.presence","origin":"example.com","content":{"push":[{"user_id":"@alice:example.com","presence":"asleep"}]}}`)); err == nil {
+		t.Fatal("expected presence EDU with an invalid presence to be rejected")
+	}
+}
+
+func TestParseEDUUnknownType(t *testing.T) {
+	input := `{"edu_type":"org.example.custom","origin":"example.com","content":{"anything":["goes",1]}}`
+	e, err := ParseEDU([]byte(input))
+	if err != nil {
+		t.Fatalf("unknown EDU types should not be rejected: %s", err)
+	}
+	if e.Type != "org.example.custom" || string(e.Content) != `{"anything":["goes",1]}` {
+		t.Fatalf("unknown EDU was not preserved: %+v", e)
+	}
+	output, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != input {
+		t.Fatalf("unknown EDU did not round-trip:\n want: %s\n got: %s", input, output)
+	}
+
+	if _, err = ParseEDU([]byte(`{"origin":"example.com","content":{}}`)); err == nil {
+		t.Fatal("expected EDU without a type to be rejected")
+	}
+}
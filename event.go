@@ -17,6 +17,9 @@ package gomatrixserverlib
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -109,6 +112,67 @@ func (eb *EventBuilder) SetUnsigned(unsigned interface{}) (err error) {
 	return
 }
 
+// NewRedactionEvent returns an EventBuilder for a m.room.redaction event sent
+// by the sender which redacts the target event. The ID of the target event is
+// placed either at the top level of the event or in the content, depending on
+// the room version. The reason is optional. The prev_events, auth_events and
+// depth still need to be set on the builder before the event is built.
+func NewRedactionEvent(roomVersion RoomVersion, roomID, sender, targetEventID, reason string) (*EventBuilder, error) {
+	inContent, err := roomVersion.RedactsInContent()
+	if err != nil {
+		return nil, err
+	}
+	eb := &EventBuilder{
+		Sender: sender,
+		RoomID: roomID,
+		Type:   MRoomRedaction,
+	}
+	content := RedactionContent{Reason: reason}
+	if inContent {
+		content.Redacts = targetEventID
+	} else {
+		eb.Redacts = targetEventID
+	}
+	if err = eb.SetContent(content); err != nil {
+		return nil, err
+	}
+	return eb, nil
+}
+
+// MaxEventDepth is the largest depth that ComputeDepth will return. This is
+// the largest integer that can be represented in canonical JSON.
+// https://spec.matrix.org/v1.4/appendices/#canonical-json
+const MaxEventDepth int64 = 1<<53 - 1
+
+// ComputeDepth returns the depth for a new event with the given prev events,
+// which is one greater than the largest depth of the prev events. The depth
+// is capped at MaxEventDepth, so that a prev event with a huge depth can't
+// make the new event's depth overflow. If there are no prev events then the
+// depth is 1, as for a create event.
+func ComputeDepth(prevEvents []*Event) int64 {
+	var depth int64
+	for _, prevEvent := range prevEvents {
+		if d := prevEvent.Depth(); d > depth {
+			depth = d
+		}
+	}
+	if depth >= MaxEventDepth {
+		return MaxEventDepth
+	}
+	return depth + 1
+}
+
+// SetPrevEvents sets the prev_events of the event to references to the given
+// events, and sets the depth of the event using ComputeDepth.
+func (eb *EventBuilder) SetPrevEvents(prevEvents []*Event) {
+	references := make([]EventReference, 0, len(prevEvents))
+	for _, prevEvent := range prevEvents {
+		references = append(references, prevEvent.EventReference())
+	}
+	eb.PrevEvents = references
+	eb.Depth = ComputeDepth(prevEvents)
+}
+
 // An Event is a matrix event.
 // The event should always contain valid JSON.
 // If the event content hash is invalid then the event is redacted.
@@ -257,6 +321,15 @@ func (eb *EventBuilder) Build(
 		if event.AuthEvents == nil {
 			event.AuthEvents = []EventReference{}
 		}
+		// In this event format, prev_events and auth_events must include the
+		// hashes of the referenced events, which can't be worked out from a
+		// list of event IDs alone. An empty list is fine though.
+		if ids, ok := event.PrevEvents.([]string); ok && len(ids) > 0 {
+			return nil, fmt.Errorf("gomatrixserverlib: prev_events must be event references in room version %s", roomVersion)
+		}
+		if ids, ok := event.AuthEvents.([]string); ok && len(ids) > 0 {
+			return nil, fmt.Errorf("gomatrixserverlib: auth_events must be event references in room version %s", roomVersion)
+		}
 	case EventFormatV2:
 		// In this event format, prev_events and auth_events are lists of
 		// event IDs as a []string, rather than full-blown []EventReference.
@@ -329,6 +402,9 @@ func (eb *EventBuilder) Build(
 		return
 	}
 
+	// Catch builder bugs, such as an event that is too large to be sent,
+	// before the event goes anywhere. The full checks made by Validate aren't
+	// run here, as we've only just signed and hashed the event ourselves.
 	if err = result.CheckFields(); err != nil {
 		return
 	}
@@ -336,22 +412,117 @@ func (eb *EventBuilder) Build(
 	return
 }
 
+// untrustedEventOptions are the options that alter how untrusted events are parsed.
+type untrustedEventOptions struct {
+	strictTopLevelKeys bool
+}
+
+// An UntrustedEventOption is an option for NewEventFromUntrustedJSON.
+type UntrustedEventOption func(*untrustedEventOptions)
+
+// WithStrictTopLevelKeys configures NewEventFromUntrustedJSON to reject events
+// that have top-level keys which are not part of the PDU format. By default
+// unknown top-level keys are allowed, as required by the specification.
+func WithStrictTopLevelKeys(strict bool) UntrustedEventOption {
+	return func(options *untrustedEventOptions) {
+		options.strictTopLevelKeys = strict
+	}
+}
+
+// knownTopLevelKeys are the top-level keys that may appear in a PDU.
+var knownTopLevelKeys = map[string]struct{}{
+	"auth_events":      {},
+	"content":          {},
+	"depth":            {},
+	"event_id":         {},
+	"hashes":           {},
+	"membership":       {},
+	"origin":           {},
+	"origin_server_ts": {},
+	"prev_events":      {},
+	"prev_state":       {},
+	"redacts":          {},
+	"room_id":          {},
+	"sender":           {},
+	"signatures":       {},
+	"state_key":        {},
+	"type":             {},
+	"unsigned":         {},
+	// Synapse removes these keys from events before checking them, see below.
+	"outlier":      {},
+	"destinations": {},
+	"age_ts":       {},
+}
+
+// checkTopLevelKeys returns an error if the event has any top-level keys that
+// are not part of the PDU format.
+func checkTopLevelKeys(eventJSON []byte) (err error) {
+	gjson.ParseBytes(eventJSON).ForEach(func(key, _ gjson.Result) bool {
+		if _, ok := knownTopLevelKeys[key.Str]; !ok {
+			err = fmt.Errorf("gomatrixserverlib: event has unknown top-level key %q", key.Str)
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// checkEventReferenceFormat checks that the prev_events and auth_events of
+// the event JSON are in the format used by the event format: (event ID,
+// hashes) tuples for room versions 1 and 2, and plain event IDs for later
+// room versions. This gives a clearer error than failing to unmarshal them.
+func checkEventReferenceFormat(eventJSON []byte, eventFormat EventFormat) error {
+	for _, key := range []string{"prev_events", "auth_events"} {
+		references := gjson.GetBytes(eventJSON, key)
+		if !references.IsArray() {
+			continue
+		}
+		for _, reference := range references.Array() {
+			switch {
+			case eventFormat == EventFormatV1 && !reference.IsArray():
+				return fmt.Errorf("gomatrixserverlib: %s must contain [event_id, hashes] tuples in this room version, got %s", key, reference.Raw)
+			case eventFormat == EventFormatV2 && reference.Type != gjson.String:
+				return fmt.Errorf("gomatrixserverlib: %s must contain event IDs in this room version, got %s", key, reference.Raw)
+			}
+		}
+	}
+	return nil
+}
+
 // NewEventFromUntrustedJSON loads a new event from some JSON that may be invalid.
 // This checks that the event is valid JSON.
 // It also checks the content hashes to ensure the event has not been tampered with.
 // This should be used when receiving new events from remote servers.
-func NewEventFromUntrustedJSON(eventJSON []byte, roomVersion RoomVersion) (result *Event, err error) {
+func NewEventFromUntrustedJSON(eventJSON []byte, roomVersion RoomVersion, options ...UntrustedEventOption) (result *Event, err error) {
 	if ver, ok := SupportedRoomVersions()[roomVersion]; !ok || !ver.Supported {
 		return nil, UnsupportedRoomVersionError{
 			Version: roomVersion,
 		}
 	}
 
+	var opts untrustedEventOptions
+	for _, option := range options {
+		option(&opts)
+	}
+
+	// Check the nesting depth before anything else walks the JSON, since the
+	// canonical JSON checks below recurse into every object and array.
+	if jsonDepthExceeds(eventJSON, DefaultCanonicalJSONMaxDepth) {
+		err = BadJSONError{fmt.Errorf("%w: more than %d levels", ErrJSONTooDeep, DefaultCanonicalJSONMaxDepth)}
+		return
+	}
+
 	if r := gjson.GetBytes(eventJSON, "_*"); r.Exists() {
 		err = fmt.Errorf("gomatrixserverlib NewEventFromUntrustedJSON: %w", UnexpectedHeaderedEvent{})
 		return
 	}
 
+	if opts.strictTopLevelKeys {
+		if err = checkTopLevelKeys(eventJSON); err != nil {
+			return
+		}
+	}
+
 	var enforceCanonicalJSON bool
 	if enforceCanonicalJSON, err = roomVersion.EnforceCanonicalJSON(); err != nil {
 		return
@@ -381,6 +552,17 @@ func NewEventFromUntrustedJSON(eventJSON []byte, roomVersion RoomVersion) (resul
 		}
 	}
 
+	if err = checkEventReferenceFormat(eventJSON, eventFormat); err != nil {
+		return
+	}
+
+	// A negative timestamp would fail to unmarshal anyway, but would give a
+	// confusing error about the Go type.
+	if ts := gjson.GetBytes(eventJSON, "origin_server_ts"); ts.Exists() && (ts.Type != gjson.Number || strings.HasPrefix(ts.Raw, "-")) {
+		err = fmt.Errorf("gomatrixserverlib: origin_server_ts must be a non-negative integer, got %s", ts.Raw)
+		return
+	}
+
 	if err = result.populateFieldsFromJSON("", eventJSON); err != nil {
 		return
 	}
@@ -620,6 +802,8 @@ func (e *Event) updateUnsignedFields(unsigned []byte) error {
 
 // EventReference returns an EventReference for the event.
 // The reference can be used to refer to this event from other events.
+// The reference hash is computed over the redacted form of the event, but
+// the event itself keeps its full content and signatures.
 func (e *Event) EventReference() EventReference {
 	reference, err := referenceOfEvent(e.eventJSON, e.roomVersion)
 	if err != nil {
@@ -703,6 +887,9 @@ const (
 // Returns an error if the IDs have the wrong format or too long.
 // Returns an error if the total length of the event JSON is too long.
 // Returns an error if the event ID doesn't match the origin of the event.
+// Returns an error if the same auth event ID is referenced more than once.
+// The types and state keys of the auth events aren't known here, so they are
+// checked by ValidateAuthEvents when the event is authed instead.
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#size-limits
 func (e *Event) CheckFields() error { // nolint: gocyclo
 	var fields eventFields
@@ -742,6 +929,14 @@ func (e *Event) CheckFields() error { // nolint: gocyclo
 		}
 	}
 
+	seenAuthEvents := make(map[string]bool, len(e.AuthEventIDs()))
+	for _, authEventID := range e.AuthEventIDs() {
+		if seenAuthEvents[authEventID] {
+			return fmt.Errorf("gomatrixserverlib: auth event %q is referenced more than once", authEventID)
+		}
+		seenAuthEvents[authEventID] = true
+	}
+
 	_, err := checkID(fields.RoomID, "room", '!')
 	if err != nil {
 		return err
@@ -781,6 +976,87 @@ func (e *Event) CheckFields() error { // nolint: gocyclo
 	return nil
 }
 
+// Validate checks that an event is fit to be sent to other servers in the
+// given room version, e.g. before sending an event that this server built.
+// As well as the checks made by CheckFields, including the size of the event,
+// this checks that the event is in the right room version, that its JSON is
+// valid for the room version, that its content hash and signatures are
+// correct, using the verifier, and that it is allowed by the auth rules given
+// the auth events.
+func (e *Event) Validate(ctx context.Context, roomVersion RoomVersion, verifier JSONVerifier, authEvents AuthEventProvider) error {
+	if e.roomVersion != roomVersion {
+		return fmt.Errorf("gomatrixserverlib: event is in room version %q, expected %q", e.roomVersion, roomVersion)
+	}
+	if err := e.CheckFields(); err != nil {
+		return err
+	}
+	if _, err := EnforcedCanonicalJSON(e.eventJSON, roomVersion); err != nil {
+		return err
+	}
+	if err := VerifyEvent(ctx, e, verifier); err != nil {
+		return err
+	}
+	return Allowed(e, authEvents)
+}
+
+// ValidateEventContentJSON checks that the content of the event is a JSON
+// object which can be encoded as canonical JSON without loss, i.e. that it
+// contains no floating point numbers and no integers outside of the range
+// [-(2**53)+1, (2**53)-1]. This is stricter than the checks room versions
+// before v6 make on the whole event, and catches content which would change
+// when re-encoded and so break the event's signatures if it is relayed.
+// Returns a BadJSONError if the content isn't valid.
+func ValidateEventContentJSON(event *Event) error {
+	content := event.Content()
+	if !gjson.ValidBytes(content) {
+		return BadJSONError{fmt.Errorf("content of event %q is not valid JSON", event.EventID())}
+	}
+	res := gjson.ParseBytes(content)
+	if !res.IsObject() {
+		return BadJSONError{fmt.Errorf("content of event %q is not a JSON object", event.EventID())}
+	}
+	var err error
+	var iter func(key, value gjson.Result) bool
+	iter = func(_, value gjson.Result) bool {
+		switch {
+		case value.IsArray() || value.IsObject():
+			value.ForEach(iter)
+		case value.Type == gjson.Number:
+			if strings.ContainsAny(value.Raw, ".eE") {
+				err = fmt.Errorf("content of event %q contains the non-integer value %s", event.EventID(), value.Raw)
+			} else if value.Num < -9007199254740991 || value.Num > 9007199254740991 {
+				err = fmt.Errorf("content of event %q contains the integer %s: %w", event.EventID(), value.Raw, ErrCanonicalJSON)
+			}
+		}
+		return err == nil
+	}
+	res.ForEach(iter)
+	if err != nil {
+		return BadJSONError{err}
+	}
+	return nil
+}
+
+// ValidateStateKeyForType checks that the state key is valid for the well-known
+// state event types which the auth rules and state resolution depend on. The
+// create, power levels and join rules events must have an empty state key.
+// Membership and third party invite events must have a non-empty state key.
+// Any other event type is allowed any state key, or none at all. Events which
+// fail this check are still valid events, but are ignored by state resolution.
+func ValidateStateKeyForType(eventType string, stateKey *string) error {
+	switch eventType {
+	case MRoomCreate, MRoomPowerLevels, MRoomJoinRules:
+		if stateKey == nil || *stateKey != "" {
+			return fmt.Errorf("gomatrixserverlib: %q event must have an empty state key", eventType)
+		}
+	case MRoomMember, MRoomThirdPartyInvite:
+		if stateKey == nil || *stateKey == "" {
+			return fmt.Errorf("gomatrixserverlib: %q event must have a non-empty state key", eventType)
+		}
+	}
+	return nil
+}
+
 func checkID(id, kind string, sigil byte) (domain string, err error) {
 	domain, err = domainFromID(id)
 	if err != nil {
@@ -803,6 +1079,42 @@ func checkID(id, kind string, sigil byte) (domain string, err error) {
 	return
 }
 
+// ValidateEventID checks that the event ID is valid for the given room version.
+// Room versions 1 and 2 use event IDs of the form "$localpart:domain". Later
+// room versions use "$" followed by the unpadded base64 encoding of the 32 byte
+// reference hash of the event, using the URL-safe alphabet from room version 4.
+func ValidateEventID(id string, roomVersion RoomVersion) error {
+	format, err := roomVersion.EventIDFormat()
+	if err != nil {
+		return err
+	}
+	if len(id) == 0 || id[0] != '$' {
+		return fmt.Errorf("gomatrixserverlib: invalid event ID %q, wanted first byte to be '$'", id)
+	}
+	var encoding *base64.Encoding
+	switch format {
+	case EventIDFormatV1:
+		_, err = checkID(id, "event", '$')
+		return err
+	case EventIDFormatV2:
+		encoding = base64.RawStdEncoding
+	case EventIDFormatV3:
+		encoding = base64.RawURLEncoding
+	default:
+		return UnsupportedRoomVersionError{roomVersion}
+	}
+	if want := encoding.EncodedLen(sha256.Size); len(id)-1 != want {
+		return fmt.Errorf(
+			"gomatrixserverlib: invalid event ID %q, wanted %d characters after the sigil but got %d",
+			id, want, len(id)-1,
+		)
+	}
+	if _, err = encoding.Strict().DecodeString(id[1:]); err != nil {
+		return fmt.Errorf("gomatrixserverlib: invalid event ID %q for room version %s: %w", id, roomVersion, err)
+	}
+	return nil
+}
+
 // Origin returns the name of the server that sent the event
 func (e *Event) Origin() ServerName {
 	switch fields := e.fields.(type) {
@@ -815,6 +1127,54 @@ func (e *Event) Origin() ServerName {
 	}
 }
 
+// CheckEventOrigin checks that the "origin" of the event, if it has one,
+// matches the domain of the sender. Unlike CheckFields, this doesn't make an
+// exception for m.room.member events, so it can be used to reject events
+// where the origin has been spoofed. Events without an "origin" are allowed.
+func CheckEventOrigin(event *Event) error {
+	origin := event.Origin()
+	if origin == "" {
+		return nil
+	}
+	senderDomain, err := domainFromID(event.Sender())
+	if err != nil {
+		return err
+	}
+	if origin != ServerName(senderDomain) {
+		return fmt.Errorf(
+			"gomatrixserverlib: event origin doesn't match sender domain: %q != %q",
+			origin, senderDomain,
+		)
+	}
+	return nil
+}
+
+// CheckRoomIDDerivation checks that the room ID is consistent with the create
+// event of the room. For room versions which derive the room ID from the create
+// event, the room ID must be the event ID of the create event with the "$"
+// sigil replaced by "!". For all other room versions this is a no-op, since the
+// room ID is chosen by the server that created the room.
+func CheckRoomIDDerivation(createEvent *Event, roomID string, roomVersion RoomVersion) error {
+	derived, err := roomVersion.RoomIDDerivedFromCreateEvent()
+	if err != nil {
+		return err
+	}
+	if !derived {
+		return nil
+	}
+	if createEvent.Type() != MRoomCreate || !createEvent.StateKeyEquals("") {
+		return fmt.Errorf("gomatrixserverlib: event %q is not a create event", createEvent.EventID())
+	}
+	expected := "!" + strings.TrimPrefix(createEvent.EventID(), "$")
+	if roomID != expected {
+		return fmt.Errorf(
+			"gomatrixserverlib: room ID %q doesn't match the create event, expected %q",
+			roomID, expected,
+		)
+	}
+	return nil
+}
+
 func (e *Event) generateEventID() (eventID string, err error) {
 	var eventFormat EventFormat
 	eventFormat, err = e.roomVersion.EventFormat()
@@ -989,6 +1349,22 @@ func (e *Event) Membership() (string, error) {
 	return content.Membership, nil
 }
 
+// MembershipValue returns the value of the content.membership field if this
+// event is an "m.room.member" event, without unmarshalling the rest of the
+// content, which makes it cheaper than Membership for hot paths. Returns false
+// if the event is not a m.room.member event or if the content has no string
+// membership field.
+func (e *Event) MembershipValue() (string, bool) {
+	if e.Type() != MRoomMember || e.StateKey() == nil {
+		return "", false
+	}
+	membership := gjson.GetBytes(e.Content(), "membership")
+	if membership.Type != gjson.String {
+		return "", false
+	}
+	return membership.Str, true
+}
+
 // JoinRule returns the value of the content.join_rule field if this event
 // is an "m.room.join_rules" event.
 // Returns an error if the event is not a m.room.join_rules event or if the content
@@ -1016,7 +1392,35 @@ func (e *Event) HistoryVisibility() (HistoryVisibility, error) {
 	if err := e.extractContent(MRoomHistoryVisibility, &content); err != nil {
 		return "", err
 	}
-	return content.HistoryVisibility.Value(), nil
+	return content.Visibility(), nil
+}
+
+// RoomCreator returns the creator of the room if this event is an
+// "m.room.create" event. In room versions where the creator is the sender of
+// the create event this is the sender, otherwise it is the content.creator
+// field. Returns an error if the event is not a m.room.create event or if the
+// creator is missing.
+func (e *Event) RoomCreator(version RoomVersion) (string, error) {
+	if !e.StateKeyEquals("") {
+		return "", fmt.Errorf("gomatrixserverlib: RoomCreator() event is not a m.room.create event, bad state key")
+	}
+	var content struct {
+		Creator string `json:"creator"`
+	}
+	if err := e.extractContent(MRoomCreate, &content); err != nil {
+		return "", err
+	}
+	creatorIsSender, err := version.CreatorIsSender()
+	if err != nil {
+		return "", err
+	}
+	if creatorIsSender {
+		return e.Sender(), nil
+	}
+	if content.Creator == "" {
+		return "", fmt.Errorf("gomatrixserverlib: RoomCreator() create event has no creator")
+	}
+	return content.Creator, nil
 }
 
 // PowerLevels returns the power levels content if this event
@@ -1073,16 +1477,49 @@ func (e *Event) AuthEventIDs() []string {
 	}
 }
 
-// Redacts returns the event ID of the event this event redacts.
-func (e *Event) Redacts() string {
-	switch fields := e.fields.(type) {
-	case eventFormatV1Fields:
-		return fields.Redacts
-	case eventFormatV2Fields:
-		return fields.Redacts
-	default:
-		panic(e.invalidFieldType())
+// MissingReferences returns the IDs of the prev_events and auth_events of the
+// event that are not in the set of known event IDs, e.g. to work out which
+// events need to be requested with /get_missing_events or /event_auth.
+func MissingReferences(event *Event, known map[string]bool) (missingPrev, missingAuth []string) {
+	for _, eventID := range event.PrevEventIDs() {
+		if !known[eventID] {
+			missingPrev = append(missingPrev, eventID)
+		}
 	}
+	for _, eventID := range event.AuthEventIDs() {
+		if !known[eventID] {
+			missingAuth = append(missingAuth, eventID)
+		}
+	}
+	return
+}
+
+// Redacts returns the event ID of the event this event redacts. Depending on
+// the room version this is either the top-level "redacts" key or the "redacts"
+// key in the content. Returns false if the event isn't a m.room.redaction
+// event or doesn't say which event it redacts.
+func (e *Event) Redacts() (string, bool) {
+	if e.Type() != MRoomRedaction {
+		return "", false
+	}
+	var redacts string
+	if inContent, err := e.roomVersion.RedactsInContent(); err == nil && inContent {
+		var content RedactionContent
+		if err := json.Unmarshal(e.Content(), &content); err != nil {
+			return "", false
+		}
+		redacts = content.Redacts
+	} else {
+		switch fields := e.fields.(type) {
+		case eventFormatV1Fields:
+			redacts = fields.Redacts
+		case eventFormatV2Fields:
+			redacts = fields.Redacts
+		default:
+			panic(e.invalidFieldType())
+		}
+	}
+	return redacts, redacts != ""
 }
 
 // RoomID returns the room ID of the room the event is in.
@@ -1159,6 +1596,28 @@ func (er EventReference) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&tuple)
 }
 
+// FormatEventReference returns the JSON for a reference to the event with the
+// given ID and SHA256 reference hash, in the format used for prev_events and
+// auth_events by the given room version. For room versions 1 and 2 this is a
+// tuple of the event ID and its hashes. For later room versions it is just the
+// event ID, and the hash is ignored.
+func FormatEventReference(eventID string, hash []byte, roomVersion RoomVersion) (RawJSON, error) {
+	eventFormat, err := roomVersion.EventFormat()
+	if err != nil {
+		return nil, err
+	}
+	var reference interface{}
+	switch eventFormat {
+	case EventFormatV1:
+		reference = EventReference{EventID: eventID, EventSHA256: hash}
+	case EventFormatV2:
+		reference = eventID
+	default:
+		return nil, UnsupportedRoomVersionError{roomVersion}
+	}
+	return json.Marshal(reference)
+}
+
 // SplitID splits a matrix ID into a local part and a server name.
 func SplitID(sigil byte, id string) (local string, domain ServerName, err error) {
 	// IDs have the format: SIGIL LOCALPART ":" DOMAIN
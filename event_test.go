@@ -16,10 +16,18 @@
 package gomatrixserverlib
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 func benchmarkParse(b *testing.B, eventJSON string) {
@@ -116,6 +124,84 @@ func TestEventMembership(t *testing.T) {
 	}
 }
 
+func TestEventMembershipValue(t *testing.T) {
+	stateKey := "@userid:localhost"
+	newEvent := func(eventType string, stateKey *string, content string) *Event {
+		return &Event{roomVersion: RoomVersionV2, fields: eventFormatV1Fields{
+			EventID: "$event:localhost",
+			eventFields: eventFields{
+				RoomID:   "!roomid:localhost",
+				Type:     eventType,
+				Sender:   "@userid:localhost",
+				StateKey: stateKey,
+				Content:  RawJSON(content),
+			},
+		}}
+	}
+	tests := []struct {
+		name   string
+		event  *Event
+		want   string
+		wantOK bool
+	}{
+		{"join", newEvent(MRoomMember, &stateKey, `{"membership":"join"}`), "join", true},
+		{"other fields", newEvent(MRoomMember, &stateKey, `{"displayname":"membership","reason":{"membership":"ban"},"membership":"leave"}`), "leave", true},
+		{"escaped", newEvent(MRoomMember, &stateKey, `{"membership":"jo\u0069n"}`), "join", true},
+		{"missing membership", newEvent(MRoomMember, &stateKey, `{"displayname":"userid"}`), "", false},
+		{"non-string membership", newEvent(MRoomMember, &stateKey, `{"membership":1}`), "", false},
+		{"no state key", newEvent(MRoomMember, nil, `{"membership":"join"}`), "", false},
+		{"not a member event", newEvent(MRoomName, &stateKey, `{"membership":"join"}`), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.event.MembershipValue()
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("got (%q, %v), want (%q, %v)", got, ok, tt.want, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			// The result must agree with a full parse of the content.
+			membership, err := tt.event.Membership()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if membership != got {
+				t.Errorf("Membership() returned %q, but MembershipValue() returned %q", membership, got)
+			}
+		})
+	}
+}
+
+func benchmarkMemberEvent(b *testing.B) *Event {
+	eventJSON := `{"auth_events":[["$BqcTUuCsN3g6Rj1z:localhost",{"sha256":"QHTrdwE/XVTmAWlxFwHPW7fp3JioRu6OBBRs+FI/at8"}]],"content":{"avatar_url":"mxc://localhost/avatar","displayname":"A user with a long display name","is_direct":false,"membership":"join","reason":"Joining the room to test how fast the membership can be read"},"depth":1,"event_id":"$9fmIxbx4IX8w1JVo:localhost","hashes":{"sha256":"mXgoJxvMyI8ZTdhUMYwWzi0F3M50tiAQkmk0F08tQl4"},"origin":"localhost","origin_server_ts":0,"prev_events":[["$BqcTUuCsN3g6Rj1z:localhost",{"sha256":"QHTrdwE/XVTmAWlxFwHPW7fp3JioRu6OBBRs+FI/at8"}]],"prev_state":[],"room_id":"!roomid:localhost","sender":"@userid:localhost","signatures":{"localhost":{"ed25519:auto":"ndobFGFV9i2XExPHfYVI4rd10Vw6GKtmdz2Wv0WSFohtm/FqFNUnDYVTsY/qZ1vkuEjHqgb5nscKD/i7TyURBw"}},"state_key":"@userid:localhost","type":"m.room.member"}`
+	event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return event
+}
+
+func BenchmarkEventMembershipValue(b *testing.B) {
+	event := benchmarkMemberEvent(b)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, ok := event.MembershipValue(); !ok {
+			b.Fatal("no membership")
+		}
+	}
+}
+
+func BenchmarkNewMemberContentFromEvent(b *testing.B) {
+	event := benchmarkMemberEvent(b)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := NewMemberContentFromEvent(event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestEventJoinRule(t *testing.T) {
 	eventJSON := `{"auth_events":[["$BqcTUuCsN3g6Rj1z:localhost",{"sha256":"QHTrdwE/XVTmAWlxFwHPW7fp3JioRu6OBBRs+FI/at8"}],["$9fmIxbx4IX8w1JVo:localhost",{"sha256":"gee+f1VoNeYGGczs5lwnUO1qeKAh70Hw23ws+YfDYGY"}]],"content":{"join_rule":"public"},"depth":2,"event_id":"$5hL9YWgJCtDzjlAQ:localhost","hashes":{"sha256":"CetHe0Na5HKphg5iYmLThfwQyM19w3PMCrve3Bwv8rw"},"origin":"localhost","origin_server_ts":0,"prev_events":[["$9fmIxbx4IX8w1JVo:localhost",{"sha256":"gee+f1VoNeYGGczs5lwnUO1qeKAh70Hw23ws+YfDYGY"}]],"prev_state":[],"room_id":"!roomid:localhost","sender":"@userid:localhost","signatures":{"localhost":{"ed25519:auto":"dxwQWiH6ppF+VVFQ8IEAWeB30hrYiZWLsWNTrE1B0/vUWMp+qLhU+My65XhmE5XreHvgY3fOh4Le6OYUcxNTAw"}},"state_key":"","type":"m.room.join_rules"}`
 	event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
@@ -148,6 +234,21 @@ func TestEventHistoryVisibility(t *testing.T) {
 	}
 }
 
+func TestEventHistoryVisibilityMissingContent(t *testing.T) {
+	eventJSON := `{"content":{},"origin_server_ts":0,"room_id":"!roomid:localhost","sender":"@userid:localhost","event_id":"$hisvis:localhost","state_key":"","type":"m.room.history_visibility"}`
+	event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := event.HistoryVisibility()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != HistoryVisibilityShared {
+		t.Errorf("history visibility: got %s want %s", got, HistoryVisibilityShared)
+	}
+}
+
 func TestEventPowerLevels(t *testing.T) {
 	eventJSON := `{"auth_events":[["$BqcTUuCsN3g6Rj1z:localhost",{"sha256":"QHTrdwE/XVTmAWlxFwHPW7fp3JioRu6OBBRs+FI/at8"}],["$9fmIxbx4IX8w1JVo:localhost",{"sha256":"gee+f1VoNeYGGczs5lwnUO1qeKAh70Hw23ws+YfDYGY"}]],"content":{"ban":50,"events":null,"events_default":0,"invite":50,"kick":50,"redact":50,"state_default":50,"users":null,"users_default":0,"notifications":{"room":50}},"depth":4,"event_id":"$1570trwyGMovM5uU:localhost","hashes":{"sha256":"QvWo2OZufVTMUkPcYQinGVeeHEODWY6RUMaHRxdT31Y"},"origin":"localhost","origin_server_ts":0,"prev_events":[["$QAhQsLNIMdumtpOi:localhost",{"sha256":"RqoKwu8u8qL+wDoka23xvd7t9UoOXLRQse/bK3o9qLE"}]],"prev_state":[],"room_id":"!roomid:localhost","sender":"@userid:localhost","signatures":{"localhost":{"ed25519:auto":"0oPZsvPkbNNVwRrLAP+fEyxFRAIUh0Zn7NPH3LybNC8lMz0GyPtN1bKlTVQYMwZBTXCV795s+CEgoIX+M5gkAQ"}},"state_key":"","type":"m.room.power_levels"}`
 	event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
@@ -180,3 +281,732 @@ func TestHeaderedEventToNewEventFromUntrustedJSON(t *testing.T) {
 		t.Fatal("expected an UnexpectedHeaderedEvent error but got:", err)
 	}
 }
+
+func TestMissingReferences(t *testing.T) {
+	// Room version 1 uses event references for prev_events and auth_events.
+	v1Event, err := NewEventFromTrustedJSON([]byte(`{"auth_events":[["$create:localhost",{"sha256":"abjkiDSg1RkuZrbj2jZoGMlQaaj1Ue3Jhi7I7NlKfXY"}],["$power:localhost",{"sha256":"X7RUj46hM/8sUHNBIFkStbOauPvbDzjSdH4NibYWnko"}]],"content":{"body":"hello"},"depth":7,"event_id":"$message:localhost","origin":"localhost","origin_server_ts":1510854416361,"prev_events":[["$prev1:localhost",{"sha256":"upCsBqUhNUgT2/+zkzg8TbqdQpWWKQnZpGJc6KcbUC4"}],["$prev2:localhost",{"sha256":"k9eM6utkCH8vhLW9/oRsH74jOBS/6RVK42iGDFbylno"}]],"room_id":"!room:localhost","sender":"@test:localhost","type":"m.room.message"}`), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room version 3 uses event IDs for prev_events and auth_events.
+	v3Event, err := NewEventFromTrustedJSON([]byte(`{"auth_events":["$create","$power"],"content":{"body":"hello"},"depth":7,"origin":"localhost","origin_server_ts":1510854416361,"prev_events":["$prev1","$prev2"],"room_id":"!room:localhost","sender":"@test:localhost","type":"m.room.message"}`), false, RoomVersionV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		event    *Event
+		known    map[string]bool
+		wantPrev []string
+		wantAuth []string
+	}{
+		{
+			event:    v1Event,
+			known:    map[string]bool{"$prev1:localhost": true, "$create:localhost": true},
+			wantPrev: []string{"$prev2:localhost"},
+			wantAuth: []string{"$power:localhost"},
+		},
+		{
+			event:    v3Event,
+			known:    map[string]bool{"$prev2": true, "$power": true, "$other": true},
+			wantPrev: []string{"$prev1"},
+			wantAuth: []string{"$create"},
+		},
+		{
+			event: v3Event,
+			known: map[string]bool{"$prev1": true, "$prev2": true, "$create": true, "$power": true},
+		},
+	} {
+		missingPrev, missingAuth := MissingReferences(tc.event, tc.known)
+		if !reflect.DeepEqual(missingPrev, tc.wantPrev) {
+			t.Errorf("%s: missing prev_events: got %v want %v", tc.event.Version(), missingPrev, tc.wantPrev)
+		}
+		if !reflect.DeepEqual(missingAuth, tc.wantAuth) {
+			t.Errorf("%s: missing auth_events: got %v want %v", tc.event.Version(), missingAuth, tc.wantAuth)
+		}
+	}
+}
+
+func TestValidateEventID(t *testing.T) {
+	for _, tc := range []struct {
+		id          string
+		roomVersion RoomVersion
+		valid       bool
+	}{
+		{"$yvN1b43rlmcOs5fY:localhost", RoomVersionV1, true},
+		{"yvN1b43rlmcOs5fY:localhost", RoomVersionV1, false},
+		{"$yvN1b43rlmcOs5fY", RoomVersionV2, false},
+		{"$acR1l0raoZnm60CBwAVgqbZqoO/mYU81xysh1u7XcJk", RoomVersionV3, true},
+		{"$acR1l0raoZnm60CBwAVgqbZqoO_mYU81xysh1u7XcJk", RoomVersionV3, false},
+		{"$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5Zg", RoomVersionV4, true},
+		{"$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5Zg", RoomVersionV10, true},
+		// Wrong alphabet
+		{"$Rqnc+F+dvnEYJTyHq/iKxU2bZ1CI92+kuZq3a5lr5Zg", RoomVersionV4, false},
+		{"$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5Z!", RoomVersionV4, false},
+		// Missing sigil
+		{"Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5Zg", RoomVersionV4, false},
+		{"", RoomVersionV4, false},
+		// Wrong length
+		{"$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5", RoomVersionV4, false},
+		{"$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5ZgA", RoomVersionV4, false},
+		{"$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5Zg=", RoomVersionV4, false},
+		// Non-canonical encoding, the trailing bits must be zero
+		{"$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5Zh", RoomVersionV4, false},
+		// Server-style event IDs aren't valid in later room versions
+		{"$yvN1b43rlmcOs5fY:localhost", RoomVersionV4, false},
+		{"$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq3a5lr5Zg", "unknown", false},
+	} {
+		err := ValidateEventID(tc.id, tc.roomVersion)
+		if tc.valid && err != nil {
+			t.Errorf("event ID %q should be valid for room version %s but got: %s", tc.id, tc.roomVersion, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("event ID %q should not be valid for room version %s", tc.id, tc.roomVersion)
+		}
+	}
+}
+
+func TestNewEventFromUntrustedJSONStrictTopLevelKeys(t *testing.T) {
+	eventJSON := []byte(`{"auth_events":[["$oXL79cT7fFxR7dPH:localhost",{"sha256":"abjkiDSg1RkuZrbj2jZoGMlQaaj1Ue3Jhi7I7NlKfXY"}],["$IVUsaSkm1LBAZYYh:localhost",{"sha256":"X7RUj46hM/8sUHNBIFkStbOauPvbDzjSdH4NibYWnko"}],["$VS2QT0EeArZYi8wf:localhost",{"sha256":"k9eM6utkCH8vhLW9/oRsH74jOBS/6RVK42iGDFbylno"}]],"content":{"name":"test3"},"depth":7,"event_id":"$yvN1b43rlmcOs5fY:localhost","hashes":{"sha256":"Oh1mwI1jEqZ3tgJ+V1Dmu5nOEGpCE4RFUqyJv2gQXKs"},"origin":"localhost","origin_server_ts":1510854416361,"prev_events":[["$FqI6TVvWpcbcnJ97:localhost",{"sha256":"upCsBqUhNUgT2/+zkzg8TbqdQpWWKQnZpGJc6KcbUC4"}]],"prev_state":[],"room_id":"!19Mp0U9hjajeIiw1:localhost","sender":"@test:localhost","signatures":{"localhost":{"ed25519:u9kP":"5IzSuRXkxvbTp0vZhhXYZeOe+619iG3AybJXr7zfNn/4vHz4TH7qSJVQXSaHHvcTcDodAKHnTG1WDulgO5okAQ"}},"state_key":"","type":"m.room.name","unsigned":{"age":5}}`)
+	extraJSON, err := sjson.SetBytes(eventJSON, "org\\.example\\.extra", "surprise")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Known keys are accepted in both modes.
+	if _, err = NewEventFromUntrustedJSON(eventJSON, RoomVersionV1, WithStrictTopLevelKeys(true)); err != nil {
+		t.Fatalf("event with only known keys should be accepted in strict mode: %s", err)
+	}
+	// Unknown keys are accepted by default, which is the spec-compliant behaviour.
+	if _, err = NewEventFromUntrustedJSON(extraJSON, RoomVersionV1); err != nil {
+		t.Fatalf("event with unknown keys should be accepted by default: %s", err)
+	}
+	if _, err = NewEventFromUntrustedJSON(extraJSON, RoomVersionV1, WithStrictTopLevelKeys(false)); err != nil {
+		t.Fatalf("event with unknown keys should be accepted in lenient mode: %s", err)
+	}
+	// But rejected in strict mode.
+	if _, err = NewEventFromUntrustedJSON(extraJSON, RoomVersionV1, WithStrictTopLevelKeys(true)); err == nil {
+		t.Fatal("event with unknown keys should be rejected in strict mode")
+	}
+}
+
+func TestValidateStateKeyForType(t *testing.T) {
+	empty, nonEmpty := "", "@alice:localhost"
+	for _, tc := range []struct {
+		eventType string
+		stateKey  *string
+		valid     bool
+	}{
+		{MRoomCreate, &empty, true},
+		{MRoomCreate, &nonEmpty, false},
+		{MRoomCreate, nil, false},
+		{MRoomPowerLevels, &empty, true},
+		{MRoomPowerLevels, &nonEmpty, false},
+		{MRoomPowerLevels, nil, false},
+		{MRoomJoinRules, &empty, true},
+		{MRoomJoinRules, &nonEmpty, false},
+		{MRoomJoinRules, nil, false},
+		{MRoomMember, &nonEmpty, true},
+		{MRoomMember, &empty, false},
+		{MRoomMember, nil, false},
+		{MRoomThirdPartyInvite, &nonEmpty, true},
+		{MRoomThirdPartyInvite, &empty, false},
+		{MRoomThirdPartyInvite, nil, false},
+		{"m.room.topic", &empty, true},
+		{"m.room.topic", &nonEmpty, true},
+		{"m.room.message", nil, true},
+	} {
+		err := ValidateStateKeyForType(tc.eventType, tc.stateKey)
+		if tc.valid && err != nil {
+			t.Errorf("%s with state key %v: unexpected error: %s", tc.eventType, tc.stateKey, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s with state key %v: expected an error", tc.eventType, tc.stateKey)
+		}
+	}
+}
+
+func TestNewEventFromUntrustedJSONUnusualStateKey(t *testing.T) {
+	// A power levels event with a non-empty state key is valid, even though
+	// the auth rules and state resolution ignore it, so it must still parse.
+	eventJSON := []byte(`{"auth_events":[],"content":{"users":{"@userid:localhost":100}},"depth":1,"event_id":"$levels:localhost","hashes":{"sha256":"AAAA"},"origin":"localhost","origin_server_ts":0,"prev_events":[],"room_id":"!roomid:localhost","sender":"@userid:localhost","state_key":"notempty","type":"m.room.power_levels"}`)
+	if _, err := NewEventFromUntrustedJSON(eventJSON, RoomVersionV1); err != nil {
+		t.Fatalf("expected a power levels event with a non-empty state key to parse, got: %s", err)
+	}
+}
+
+func TestCheckEventOrigin(t *testing.T) {
+	alice := "@alice:local.test"
+	newMember := func(origin ServerName) *Event {
+		return &Event{
+			roomVersion: RoomVersionV1,
+			fields: eventFormatV1Fields{
+				EventID: "$member:remote.test",
+				eventFields: eventFields{
+					RoomID:   "!room:local.test",
+					Type:     MRoomMember,
+					Sender:   alice,
+					StateKey: &alice,
+					Origin:   origin,
+					Content:  []byte(`{"membership":"join"}`),
+				},
+			},
+		}
+	}
+	if err := CheckEventOrigin(newMember("local.test")); err != nil {
+		t.Fatalf("expected a matching origin to be allowed, got: %s", err)
+	}
+	if err := CheckEventOrigin(newMember("")); err != nil {
+		t.Fatalf("expected an event without an origin to be allowed, got: %s", err)
+	}
+	if err := CheckEventOrigin(newMember("remote.test")); err == nil {
+		t.Fatal("expected a mismatched origin to be rejected")
+	}
+}
+
+func TestComputeDepth(t *testing.T) {
+	withDepth := func(depth int64) *Event {
+		return &Event{
+			roomVersion: RoomVersionV1,
+			fields: eventFormatV1Fields{
+				eventFields: eventFields{
+					Depth: depth,
+				},
+			},
+		}
+	}
+	if got := ComputeDepth(nil); got != 1 {
+		t.Errorf("got depth %d with no prev events, want 1", got)
+	}
+	if got := ComputeDepth([]*Event{withDepth(3), withDepth(7), withDepth(5)}); got != 8 {
+		t.Errorf("got depth %d, want 8", got)
+	}
+	if got := ComputeDepth([]*Event{withDepth(2), withDepth(MaxEventDepth)}); got != MaxEventDepth {
+		t.Errorf("got depth %d, want it to be capped at %d", got, MaxEventDepth)
+	}
+	if got := ComputeDepth([]*Event{withDepth(math.MaxInt64)}); got != MaxEventDepth {
+		t.Errorf("got depth %d, want it to be capped at %d", got, MaxEventDepth)
+	}
+}
+
+func TestEventBuilderSetPrevEvents(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	roomID := "!room:alice.test"
+	first := alice.buildMessage(t, roomID, "first", RoomVersionV10)
+	second := alice.buildMessage(t, roomID, "second", RoomVersionV10)
+
+	eb := EventBuilder{
+		Sender:     "@alice:alice.test",
+		RoomID:     roomID,
+		Type:       "m.room.message",
+		AuthEvents: []string{},
+	}
+	eb.SetPrevEvents([]*Event{first, second})
+	if err := eb.SetContent(map[string]string{"body": "third"}); err != nil {
+		t.Fatal(err)
+	}
+	third, err := eb.Build(time.Now(), alice.serverName, alice.keyID, alice.privateKey, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Depth() != 2 {
+		t.Errorf("got depth %d, want 2", third.Depth())
+	}
+	want := []string{first.EventID(), second.EventID()}
+	if got := third.PrevEventIDs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got prev events %v, want %v", got, want)
+	}
+}
+
+func TestCheckRoomIDDerivation(t *testing.T) {
+	derivedVersion := testRoomVersionDerivedRoomIDs
+
+	alice := newTestSigningServer(t, "alice.test")
+	eb := EventBuilder{
+		Sender:     "@alice:alice.test",
+		RoomID:     "!placeholder:alice.test",
+		Type:       MRoomCreate,
+		StateKey:   &emptyStateKey,
+		PrevEvents: []string{},
+		AuthEvents: []string{},
+		Depth:      1,
+	}
+	if err := eb.SetContent(map[string]string{"creator": "@alice:alice.test"}); err != nil {
+		t.Fatal(err)
+	}
+	create, err := eb.Build(time.Now(), alice.serverName, alice.keyID, alice.privateKey, derivedVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derivedRoomID := "!" + create.EventID()[1:]
+
+	if err = CheckRoomIDDerivation(create, derivedRoomID, derivedVersion); err != nil {
+		t.Fatalf("expected the derived room ID to be accepted, got: %s", err)
+	}
+	if err = CheckRoomIDDerivation(create, "!other:alice.test", derivedVersion); err == nil {
+		t.Fatal("expected a room ID which doesn't match the create event to be rejected")
+	}
+	// For current room versions the room ID isn't derived, so any is fine.
+	if err = CheckRoomIDDerivation(create, "!other:alice.test", RoomVersionV10); err != nil {
+		t.Fatalf("expected the check to be a no-op for room version 10, got: %s", err)
+	}
+	if err = CheckRoomIDDerivation(create, derivedRoomID, "unknown"); err == nil {
+		t.Fatal("expected an unknown room version to be rejected")
+	}
+}
+
+func TestNewRedactionEvent(t *testing.T) {
+	contentVersion := testRoomVersionRedactsInContent
+
+	alice := newTestSigningServer(t, "alice.test")
+	target := "$target:alice.test"
+	for _, roomVersion := range []RoomVersion{RoomVersionV10, contentVersion} {
+		eb, err := NewRedactionEvent(roomVersion, "!room:alice.test", "@alice:alice.test", target, "spam")
+		if err != nil {
+			t.Fatalf("room version %s: %s", roomVersion, err)
+		}
+		eb.PrevEvents = []string{}
+		eb.AuthEvents = []string{}
+		eb.Depth = 1
+		event, err := eb.Build(time.Now(), alice.serverName, alice.keyID, alice.privateKey, roomVersion)
+		if err != nil {
+			t.Fatalf("room version %s: %s", roomVersion, err)
+		}
+		if event.Type() != MRoomRedaction {
+			t.Errorf("room version %s: got type %q, want %q", roomVersion, event.Type(), MRoomRedaction)
+		}
+		if got, ok := event.Redacts(); !ok || got != target {
+			t.Errorf("room version %s: got redacts %q, want %q", roomVersion, got, target)
+		}
+		topLevel := gjson.GetBytes(event.JSON(), "redacts").String()
+		inContent := gjson.GetBytes(event.Content(), "redacts").String()
+		if roomVersion == contentVersion {
+			if topLevel != "" || inContent != target {
+				t.Errorf("room version %s: expected redacts only in content, got top level %q and content %q", roomVersion, topLevel, inContent)
+			}
+		} else {
+			if topLevel != target || inContent != "" {
+				t.Errorf("room version %s: expected redacts only at top level, got top level %q and content %q", roomVersion, topLevel, inContent)
+			}
+		}
+		if reason := gjson.GetBytes(event.Content(), "reason").String(); reason != "spam" {
+			t.Errorf("room version %s: got reason %q, want %q", roomVersion, reason, "spam")
+		}
+	}
+
+	if _, err := NewRedactionEvent("unknown", "!room:alice.test", "@alice:alice.test", target, ""); err == nil {
+		t.Fatal("expected an unknown room version to be rejected")
+	}
+}
+
+func TestRedactsPlacement(t *testing.T) {
+	contentVersion := testRoomVersionRedactsInContent
+
+	// The event has a different "redacts" at the top level and in the content,
+	// so that we can tell which one was used.
+	eventJSON := `{"auth_events":[],"content":{"redacts":"$content:test"},"depth":1,"hashes":{"sha256":"abc"},"origin":"test","origin_server_ts":0,"prev_events":[],"redacts":"$toplevel:test","room_id":"!room:test","sender":"@alice:test","signatures":{},"type":"m.room.redaction"}`
+	for roomVersion, want := range map[RoomVersion]string{
+		RoomVersionV10: "$toplevel:test",
+		contentVersion: "$content:test",
+	} {
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, roomVersion)
+		if err != nil {
+			t.Fatalf("room version %s: %s", roomVersion, err)
+		}
+		if got, ok := event.Redacts(); !ok || got != want {
+			t.Errorf("room version %s: got redacts %q (%v), want %q", roomVersion, got, ok, want)
+		}
+	}
+
+	// Events which aren't redactions don't redact anything, even if they
+	// happen to have a "redacts" key.
+	eventJSON = `{"auth_events":[],"content":{"body":"hello"},"depth":1,"hashes":{"sha256":"abc"},"origin":"test","origin_server_ts":0,"prev_events":[],"redacts":"$toplevel:test","room_id":"!room:test","sender":"@alice:test","signatures":{},"type":"m.room.message"}`
+	event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := event.Redacts(); ok {
+		t.Errorf("expected a message event not to redact anything, got %q", got)
+	}
+}
+
+func TestUntrustedEventWithDuplicateAuthEvents(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	message := alice.buildMessage(t, "!room:alice.test", "hello", RoomVersionV10)
+	eventJSON, err := sjson.SetBytes(message.JSON(), "auth_events", []string{"$auth:alice.test", "$auth:alice.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewEventFromUntrustedJSON(eventJSON, RoomVersionV10); err == nil {
+		t.Fatal("expected an event referencing the same auth event twice to be rejected")
+	}
+	eventJSON, err = sjson.SetBytes(message.JSON(), "auth_events", []string{"$auth:alice.test", "$other:alice.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewEventFromUntrustedJSON(eventJSON, RoomVersionV10); err != nil {
+		t.Fatalf("expected an event with distinct auth events to be accepted, got: %s", err)
+	}
+}
+
+func TestFormatEventReference(t *testing.T) {
+	hash := []byte("0123456789abcdef0123456789abcdef")
+	v1, err := FormatEventReference("$event:test", hash, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `["$event:test",{"sha256":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY"}]`; string(v1) != want {
+		t.Errorf("room version 1: got %s, want %s", v1, want)
+	}
+	v3, err := FormatEventReference("$event", hash, RoomVersionV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"$event"`; string(v3) != want {
+		t.Errorf("room version 3: got %s, want %s", v3, want)
+	}
+	if _, err = FormatEventReference("$event", hash, "unknown"); err == nil {
+		t.Error("expected an unknown room version to be rejected")
+	}
+}
+
+func TestEventBuilderReferenceFormat(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	build := func(roomVersion RoomVersion, authEvents interface{}) (*Event, error) {
+		eb := EventBuilder{
+			Sender:     "@alice:alice.test",
+			RoomID:     "!room:alice.test",
+			Type:       "m.room.message",
+			PrevEvents: authEvents,
+			AuthEvents: authEvents,
+			Depth:      2,
+		}
+		if err := eb.SetContent(map[string]string{"body": "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		return eb.Build(time.Now(), alice.serverName, alice.keyID, alice.privateKey, roomVersion)
+	}
+	references := []EventReference{{EventID: "$create:alice.test", EventSHA256: []byte("hash")}}
+
+	// Event references are written as tuples in room version 1.
+	event, err := build(RoomVersionV1, references)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gjson.GetBytes(event.JSON(), "auth_events").Raw; got != `[["$create:alice.test",{"sha256":"aGFzaA"}]]` {
+		t.Errorf("room version 1: got auth_events %s", got)
+	}
+	// Event IDs alone aren't enough in room version 1 as the hashes are needed.
+	if _, err = build(RoomVersionV1, []string{"$create:alice.test"}); err == nil {
+		t.Error("room version 1: expected event IDs without hashes to be rejected")
+	}
+	// Event references are written as plain event IDs in room version 3.
+	event, err = build(RoomVersionV3, references)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gjson.GetBytes(event.JSON(), "auth_events").Raw; got != `["$create:alice.test"]` {
+		t.Errorf("room version 3: got auth_events %s", got)
+	}
+}
+
+func TestEventMarshalJSONPreservesSignedBytes(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	eb := EventBuilder{
+		Sender:     "@alice:alice.test",
+		RoomID:     "!room:alice.test",
+		Type:       "m.room.message",
+		PrevEvents: []EventReference{{EventID: "$prev:alice.test", EventSHA256: []byte("prev")}},
+		AuthEvents: []EventReference{{EventID: "$create:alice.test", EventSHA256: []byte("create")}},
+		Depth:      2,
+	}
+	// The key order of the content isn't canonical, and must be kept as it
+	// was signed rather than being re-serialised.
+	if err := eb.SetContent(RawJSON(`{"msgtype":"m.text","body":"hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+	event, err := eb.Build(time.Now(), alice.serverName, alice.keyID, alice.privateKey, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Marshalling the event on its own, or as part of something else, must
+	// give the stored bytes.
+	marshalled, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshalled, event.JSON()) {
+		t.Errorf("json.Marshal gave %s, want %s", marshalled, event.JSON())
+	}
+	wrapped, err := json.Marshal(struct {
+		Events []*Event `json:"events"`
+	}{[]*Event{event}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"events":[` + string(event.JSON()) + `]}`; string(wrapped) != want {
+		t.Errorf("json.Marshal of a wrapper gave %s, want %s", wrapped, want)
+	}
+
+	// The reference hash must survive the round trip, both without and
+	// with the room version header.
+	roundTripped, err := NewEventFromUntrustedJSON(marshalled, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roundTripped.EventReference(), event.EventReference()) {
+		t.Errorf("got reference %v after round trip, want %v", roundTripped.EventReference(), event.EventReference())
+	}
+	headered, err := json.Marshal(event.Headered(RoomVersionV1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalled HeaderedEvent
+	if err = json.Unmarshal(headered, &unmarshalled); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unmarshalled.EventReference(), event.EventReference()) {
+		t.Errorf("got reference %v after headered round trip, want %v", unmarshalled.EventReference(), event.EventReference())
+	}
+}
+
+func TestEventValidate(t *testing.T) {
+	ctx := context.Background()
+	alice := newTestSigningServer(t, "alice.test")
+	keyRing := testKeyRingForServers(alice)
+	authEvents := &testAuthEvents{
+		CreateJSON: json.RawMessage(`{"type":"m.room.create","state_key":"","sender":"@alice:alice.test",` +
+			`"room_id":"!room:alice.test","event_id":"$create:alice.test","content":{"creator":"@alice:alice.test"}}`),
+		MemberJSON: map[string]json.RawMessage{
+			"@alice:alice.test": json.RawMessage(`{"type":"m.room.member","state_key":"@alice:alice.test",` +
+				`"sender":"@alice:alice.test","room_id":"!room:alice.test","event_id":"$join:alice.test",` +
+				`"content":{"membership":"join"}}`),
+		},
+	}
+	build := func(sender string, content interface{}) (*Event, error) {
+		eb := EventBuilder{
+			Sender: sender,
+			RoomID: "!room:alice.test",
+			Type:   "m.room.message",
+			Depth:  2,
+		}
+		if err := eb.SetContent(content); err != nil {
+			t.Fatal(err)
+		}
+		return eb.Build(time.Now(), alice.serverName, alice.keyID, alice.privateKey, RoomVersionV10)
+	}
+
+	event, err := build("@alice:alice.test", map[string]string{"body": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = event.Validate(ctx, RoomVersionV10, keyRing, authEvents); err != nil {
+		t.Errorf("expected a built event to be valid: %s", err)
+	}
+	if err = event.Validate(ctx, RoomVersionV9, keyRing, authEvents); err == nil {
+		t.Error("expected an event to be invalid in a different room version")
+	}
+
+	// A builder bug that puts too much into the event must be caught before
+	// the event is sent anywhere.
+	_, err = build("@alice:alice.test", map[string]string{"body": strings.Repeat("a", maxEventLength)})
+	if verr, ok := err.(EventValidationError); !ok || verr.Code != EventValidationTooLarge {
+		t.Errorf("expected an oversized event to fail to build, got %v", err)
+	}
+
+	// Changing the content after the event has been built breaks the hash.
+	tampered := *event
+	if tampered.eventJSON, err = sjson.SetBytes(event.JSON(), "content.body", "goodbye"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tampered.Validate(ctx, RoomVersionV10, keyRing, authEvents); err == nil {
+		t.Error("expected an event with a bad content hash to be invalid")
+	}
+
+	// An event that hasn't been signed by its origin isn't fit to be sent.
+	unsigned := *event
+	if unsigned.eventJSON, err = sjson.DeleteBytes(event.JSON(), "signatures"); err != nil {
+		t.Fatal(err)
+	}
+	if err = unsigned.Validate(ctx, RoomVersionV10, keyRing, authEvents); err == nil {
+		t.Error("expected an unsigned event to be invalid")
+	}
+
+	// Nor is an event whose signature can't be verified with the origin's key.
+	if err = event.Validate(ctx, RoomVersionV10, testKeyRingForServers(newTestSigningServer(t, "alice.test")), authEvents); err == nil {
+		t.Error("expected an event with a bad signature to be invalid")
+	}
+
+	// Nor is an event which isn't allowed by the auth rules.
+	notJoined, err := build("@bob:alice.test", map[string]string{"body": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = notJoined.Validate(ctx, RoomVersionV10, keyRing, authEvents); err == nil {
+		t.Error("expected an event from a user who isn't in the room to be invalid")
+	}
+}
+
+func TestValidateEventContentJSON(t *testing.T) {
+	event := func(content string) *Event {
+		eventJSON := `{"auth_events":[],"content":` + content + `,"depth":1,"event_id":"$test:localhost",` +
+			`"origin":"localhost","origin_server_ts":1,"prev_events":[],"room_id":"!room:localhost",` +
+			`"sender":"@alice:localhost","type":"m.room.message","unsigned":{"age":1.5}}`
+		// Room version 1 doesn't enforce canonical JSON, so the event can be
+		// parsed even with bad content.
+		e, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to parse event with content %s: %s", content, err)
+		}
+		return e
+	}
+
+	for _, content := range []string{
+		`{}`,
+		`{"body":"hello","count":3,"negative":-9007199254740991,"max":9007199254740991}`,
+		`{"nested":{"list":[1,2,{"deep":0}]},"text":"1.5"}`,
+	} {
+		if err := ValidateEventContentJSON(event(content)); err != nil {
+			t.Errorf("unexpected error for content %s: %s", content, err)
+		}
+	}
+
+	for _, content := range []string{
+		`{"value":1.5}`,
+		`{"value":1e3}`,
+		`{"nested":{"list":[1,2,{"deep":0.1}]}}`,
+		`{"big":9007199254740992}`,
+		`{"small":-9007199254740992}`,
+		`[]`,
+		`"string"`,
+	} {
+		err := ValidateEventContentJSON(event(content))
+		if _, ok := err.(BadJSONError); !ok {
+			t.Errorf("expected a BadJSONError for content %s, got %v", content, err)
+		}
+	}
+}
+
+func TestUntrustedEventReferenceFormat(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	tuples := json.RawMessage(`[["$prev:alice.test",{"sha256":"ZXhhbXBsZQ"}]]`)
+	ids := json.RawMessage(`["$prev:alice.test"]`)
+
+	for _, tc := range []struct {
+		roomVersion RoomVersion
+		valid       json.RawMessage
+		invalid     json.RawMessage
+	}{
+		// Room versions 1 and 2 reference events with (event ID, hashes) tuples.
+		{RoomVersionV1, tuples, ids},
+		{RoomVersionV2, tuples, ids},
+		// Later room versions reference events with just their event IDs.
+		{RoomVersionV3, ids, tuples},
+		{RoomVersionV10, ids, tuples},
+	} {
+		message := alice.buildMessage(t, "!room:alice.test", "hello", tc.roomVersion)
+		for _, key := range []string{"prev_events", "auth_events"} {
+			eventJSON, err := sjson.SetRawBytes(message.JSON(), key, tc.valid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = NewEventFromUntrustedJSON(eventJSON, tc.roomVersion); err != nil {
+				t.Errorf("room version %s: expected %s in the %s format to be accepted: %s", tc.roomVersion, key, tc.roomVersion, err)
+			}
+			eventJSON, err = sjson.SetRawBytes(message.JSON(), key, tc.invalid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = NewEventFromUntrustedJSON(eventJSON, tc.roomVersion); err == nil {
+				t.Errorf("room version %s: expected %s %s in the wrong format to be rejected", tc.roomVersion, key, tc.invalid)
+			} else if !strings.Contains(err.Error(), "in this room version") {
+				t.Errorf("room version %s: expected an error about the %s format, got: %s", tc.roomVersion, key, err)
+			}
+		}
+	}
+}
+
+func TestUntrustedEventNegativeOriginServerTS(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	message := alice.buildMessage(t, "!room:alice.test", "hello", RoomVersionV10)
+	for _, ts := range []string{`-1`, `-1643017369993`, `"1643017369993"`} {
+		eventJSON, err := sjson.SetRawBytes(message.JSON(), "origin_server_ts", []byte(ts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = NewEventFromUntrustedJSON(eventJSON, RoomVersionV10); err == nil {
+			t.Errorf("expected an event with origin_server_ts %s to be rejected", ts)
+		} else if !strings.Contains(err.Error(), "origin_server_ts") {
+			t.Errorf("expected an error about origin_server_ts %s, got: %s", ts, err)
+		}
+	}
+	eventJSON, err := sjson.SetRawBytes(message.JSON(), "origin_server_ts", []byte(`0`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewEventFromUntrustedJSON(eventJSON, RoomVersionV10); err != nil {
+		t.Errorf("expected an event with origin_server_ts 0 to be accepted: %s", err)
+	}
+}
+
+func TestUntrustedEventNestedTooDeeply(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	message := alice.buildMessage(t, "!room:alice.test", "hello", RoomVersionV10)
+	// The event itself is one level, so content nested n levels deep makes
+	// the event n+1 levels deep.
+	withContentDepth := func(n int) []byte {
+		content := strings.Repeat(`{"a":`, n) + `1` + strings.Repeat(`}`, n)
+		eventJSON, err := sjson.SetRawBytes(message.JSON(), "content", []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return eventJSON
+	}
+
+	_, err := NewEventFromUntrustedJSON(withContentDepth(DefaultCanonicalJSONMaxDepth), RoomVersionV10)
+	if !errors.Is(err, ErrJSONTooDeep) {
+		t.Fatalf("expected ErrJSONTooDeep for an event nested %d levels deep, got %v", DefaultCanonicalJSONMaxDepth+1, err)
+	}
+	if _, ok := err.(BadJSONError); !ok {
+		t.Errorf("expected a BadJSONError, got %T", err)
+	}
+	if _, err = NewEventFromUntrustedJSON(withContentDepth(DefaultCanonicalJSONMaxDepth-1), RoomVersionV10); errors.Is(err, ErrJSONTooDeep) {
+		t.Errorf("expected an event nested %d levels deep to be allowed, got %s", DefaultCanonicalJSONMaxDepth, err)
+	}
+}
+
+func TestRoomCreator(t *testing.T) {
+	senderVersion := testRoomVersionCreatorIsSender
+
+	parse := func(content string, roomVersion RoomVersion) *Event {
+		eventJSON := `{"auth_events":[],"content":` + content + `,"depth":1,"origin_server_ts":0,"prev_events":[],"room_id":"!room:test","sender":"@alice:test","state_key":"","type":"m.room.create"}`
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	v10 := parse(`{"creator":"@bob:test","room_version":"10"}`, RoomVersionV10)
+	if creator, err := v10.RoomCreator(RoomVersionV10); err != nil || creator != "@bob:test" {
+		t.Errorf("room version 10: got creator %q (%v), want %q", creator, err, "@bob:test")
+	}
+	if _, err := parse(`{"room_version":"10"}`, RoomVersionV10).RoomCreator(RoomVersionV10); err == nil {
+		t.Error("room version 10: expected an error for a create event without a creator")
+	}
+
+	v11 := parse(`{"room_version":"org.matrix.test.creator_is_sender"}`, senderVersion)
+	if creator, err := v11.RoomCreator(senderVersion); err != nil || creator != "@alice:test" {
+		t.Errorf("room version %s: got creator %q (%v), want %q", senderVersion, creator, err, "@alice:test")
+	}
+	// The creator used by the auth rules must agree.
+	provider := NewAuthEvents([]*Event{v11})
+	create, err := NewCreateContentFromAuthEvents(&provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if create.Creator != "@alice:test" {
+		t.Errorf("room version %s: got auth creator %q, want %q", senderVersion, create.Creator, "@alice:test")
+	}
+}
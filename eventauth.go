@@ -18,7 +18,6 @@ package gomatrixserverlib
 import (
 	"encoding/json"
 	"fmt"
-	"strings"
 
 	"golang.org/x/crypto/ed25519"
 
@@ -47,6 +46,10 @@ const (
 	Public = "public"
 	// WorldReadable is the string constant "world_readable"
 	WorldReadable = "world_readable"
+	// CanJoin is the string constant "can_join"
+	CanJoin = "can_join"
+	// Forbidden is the string constant "forbidden"
+	Forbidden = "forbidden"
 	// MRoomCreate https://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-create
 	MRoomCreate = "m.room.create"
 	// MRoomJoinRules https://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-join-rules
@@ -75,6 +78,14 @@ const (
 	MRoomEncryption = "m.room.encryption"
 	// MRoomRedaction https://matrix.org/docs/spec/client_server/r0.2.0.html#id21
 	MRoomRedaction = "m.room.redaction"
+	// MRoomTombstone https://spec.matrix.org/v1.4/client-server-api/#mroomtombstone
+	MRoomTombstone = "m.room.tombstone"
+	// MRoomServerACL https://spec.matrix.org/v1.4/client-server-api/#mroomserver_acl
+	MRoomServerACL = "m.room.server_acl"
+	// MRoomMessage https://spec.matrix.org/v1.4/client-server-api/#mroommessage
+	MRoomMessage = "m.room.message"
+	// MMessage https://github.com/matrix-org/matrix-spec-proposals/blob/main/proposals/1767-extensible-events.md
+	MMessage = "m.message"
 	// MTyping https://matrix.org/docs/spec/client_server/r0.3.0.html#m-typing
 	MTyping = "m.typing"
 	// MDirectToDevice https://matrix.org/docs/spec/server_server/r0.1.3#send-to-device-messaging
@@ -216,6 +227,106 @@ func StateNeededForAuth(events []*Event) (result StateNeeded) {
 	return
 }
 
+// AuthEventsByType returns the events from the provider which are needed to
+// auth the event, keyed by their type and state key. These are the state
+// events which Allowed looks at: the create event, the power levels, the
+// sender's membership, and for membership events, the join rules, the
+// target's membership and any third party invite or user authorising a
+// restricted join. Events which the provider doesn't have are left out, so
+// the result may be missing events that are needed for the event to be
+// allowed. Returns an error if the provider returns an error.
+func (e *Event) AuthEventsByType(provider AuthEventProvider) (map[StateKeyTuple]*Event, error) {
+	tuples := StateNeededForAuth([]*Event{e}).Tuples()
+	result := make(map[StateKeyTuple]*Event, len(tuples))
+	for _, tuple := range tuples {
+		var event *Event
+		var err error
+		switch tuple.EventType {
+		case MRoomCreate:
+			event, err = provider.Create()
+		case MRoomJoinRules:
+			event, err = provider.JoinRules()
+		case MRoomPowerLevels:
+			event, err = provider.PowerLevels()
+		case MRoomMember:
+			event, err = provider.Member(tuple.StateKey)
+		case MRoomThirdPartyInvite:
+			event, err = provider.ThirdPartyInvite(tuple.StateKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if event != nil {
+			result[tuple] = event
+		}
+	}
+	return result, nil
+}
+
+// CheckAuthEventsRoom checks that each of the events from the provider which
+// are needed to auth the event, as returned by AuthEventsByType, is in the
+// same room as the event, so that state from one room can't be used to auth
+// events in another. Returns an error naming the first auth event in another
+// room, or if the provider returns an error.
+func CheckAuthEventsRoom(event *Event, provider AuthEventProvider) error {
+	authEvents, err := event.AuthEventsByType(provider)
+	if err != nil {
+		return err
+	}
+	for _, tuple := range StateNeededForAuth([]*Event{event}).Tuples() {
+		authEvent, ok := authEvents[tuple]
+		if !ok {
+			continue
+		}
+		if authEvent.RoomID() != event.RoomID() {
+			return fmt.Errorf(
+				"gomatrixserverlib: auth event %q is in room %q, not %q",
+				authEvent.EventID(), authEvent.RoomID(), event.RoomID(),
+			)
+		}
+	}
+	return nil
+}
+
+// ValidateAuthEvents checks the auth events of an event against the event,
+// as required by the auth rules. The auth events must not contain more than
+// one event with the same type and state key, must all be state events, and
+// must only be for state that is used to auth the event: the create event,
+// the power levels, the sender's membership, and for membership events, the
+// join rules, the target's membership and any third party invite or user
+// authorising a restricted join.
+func ValidateAuthEvents(event *Event, authEvents []*Event) error {
+	allowed := map[StateKeyTuple]bool{
+		{MRoomCreate, ""}:             true,
+		{MRoomPowerLevels, ""}:        true,
+		{MRoomMember, event.Sender()}: true,
+	}
+	for _, tuple := range StateNeededForAuth([]*Event{event}).Tuples() {
+		allowed[tuple] = true
+	}
+	seen := make(map[StateKeyTuple]string, len(authEvents))
+	for _, authEvent := range authEvents {
+		if authEvent.StateKey() == nil {
+			return errorf("auth event %q is not a state event", authEvent.EventID())
+		}
+		tuple := StateKeyTuple{authEvent.Type(), *authEvent.StateKey()}
+		if otherID, ok := seen[tuple]; ok {
+			return errorf(
+				"auth events %q and %q both have type %q and state key %q",
+				otherID, authEvent.EventID(), tuple.EventType, tuple.StateKey,
+			)
+		}
+		seen[tuple] = authEvent.EventID()
+		if !allowed[tuple] {
+			return errorf(
+				"auth event %q with type %q and state key %q is not needed to auth event %q",
+				authEvent.EventID(), tuple.EventType, tuple.StateKey, event.EventID(),
+			)
+		}
+	}
+	return nil
+}
+
 func accumulateStateNeeded(result *StateNeeded, eventType, sender string, stateKey *string, content *membershipContent) (err error) {
 	switch eventType {
 	case MRoomCreate:
@@ -365,6 +476,25 @@ func errorf(message string, args ...interface{}) error {
 	return &NotAllowed{Message: fmt.Sprintf(message, args...)}
 }
 
+// GuestJoinAllowed checks whether a guest user is allowed to join a room with
+// the given m.room.guest_access event, which may be nil if the room has none.
+// Guest access isn't part of the event auth rules, so servers need to check
+// this themselves before letting a guest join a room. Returns a NotAllowed
+// error if guests are forbidden from joining.
+func GuestJoinAllowed(guestAccess *Event) error {
+	if guestAccess == nil {
+		return errorf("guests are forbidden from joining a room without guest access")
+	}
+	content, err := NewGuestAccessContentFromEvent(guestAccess)
+	if err != nil {
+		return err
+	}
+	if content.GuestAccess != CanJoin {
+		return errorf("guests are forbidden from joining the room as guest access is %q", content.GuestAccess)
+	}
+	return nil
+}
+
 // allowerContext allows auth checks to be run using cached create,
 // power level and join rule events. This can help when authing a large
 // state set for a specific room.
@@ -391,29 +521,99 @@ func newAllowerContext(provider AuthEventProvider) *allowerContext {
 	}
 }
 
-// Allowed checks whether an event is allowed by the auth events, using the
-// create, power level and join events from the allowerContext. This is a
-// quick path designed to speed up state resolution.
-// It returns a NotAllowed error if the event is not allowed.
-// If there was an error loading the auth events then it returns that error.
-func (a *allowerContext) allowed(event *Event) error {
-	switch event.Type() {
+// An authRule checks whether an event of a specific type is allowed.
+type authRule func(a *allowerContext, event *Event) error
+
+// AuthRules are the event authorisation rules used by a room version. They
+// are selected by room version but are independent of the event format, so
+// a new room version can override specific checks and inherit the rest. Any
+// check which isn't set, including all of them in the zero value, falls back
+// to the check from the room version 1 auth rules.
+type AuthRules struct {
+	create      authRule
+	aliases     authRule
+	member      authRule
+	powerLevels authRule
+	redaction   authRule
+	other       authRule
+}
+
+// The auth rules used by the room versions. These are set up in init rather
+// than in their declarations, since the checks look up room version details
+// in roomVersionMeta, which refers to these in turn.
+var (
+	// authRulesV1 are the auth rules used by room versions 1 to 9. The
+	// behaviour that differs between those room versions, e.g. knocking or
+	// restricted joins, is further controlled by the room version description.
+	authRulesV1 AuthRules
+	// authRulesV10 are the auth rules used by room version 10 and others which
+	// only allow integer power levels.
+	authRulesV10 AuthRules
+)
+
+func init() {
+	authRulesV1 = AuthRules{
+		create:      (*allowerContext).createEventAllowed,
+		aliases:     (*allowerContext).aliasEventAllowed,
+		member:      (*allowerContext).memberEventAllowed,
+		powerLevels: (*allowerContext).powerLevelsEventAllowed,
+		redaction:   (*allowerContext).redactEventAllowed,
+		other:       (*allowerContext).defaultEventAllowed,
+	}
+	authRulesV10 = authRulesV1
+	authRulesV10.powerLevels = (*allowerContext).integerPowerLevelsEventAllowed
+}
+
+// rule returns the check in the auth rules for the given event type.
+func (r AuthRules) rule(eventType string) authRule {
+	switch eventType {
 	case MRoomCreate:
-		return a.createEventAllowed(event)
+		return r.create
 	case MRoomAliases:
-		return a.aliasEventAllowed(event)
+		return r.aliases
 	case MRoomMember:
-		return a.memberEventAllowed(event)
+		return r.member
 	case MRoomPowerLevels:
-		return a.powerLevelsEventAllowed(event)
+		return r.powerLevels
 	case MRoomRedaction:
-		return a.redactEventAllowed(event)
+		return r.redaction
 	default:
-		return a.defaultEventAllowed(event)
+		return r.other
+	}
+}
+
+// Allowed checks whether an event is allowed by the auth events using
+// these auth rules, regardless of the room version of the event.
+// It returns a NotAllowed error if the event is not allowed.
+// If there was an error loading the auth events then it returns that error.
+func (r AuthRules) Allowed(event *Event, authEvents AuthEventProvider) error {
+	return newAllowerContext(authEvents).allowedByRules(r, event)
+}
+
+// Allowed checks whether an event is allowed by the auth events, using the
+// create, power level and join events from the allowerContext. This is a
+// quick path designed to speed up state resolution.
+// It returns a NotAllowed error if the event is not allowed.
+// If there was an error loading the auth events then it returns that error.
+func (a *allowerContext) allowed(event *Event) error {
+	rules, err := event.roomVersion.AuthRules()
+	if err != nil {
+		return err
 	}
+	return a.allowedByRules(rules, event)
 }
 
-// Allowed checks whether an event is allowed by the auth events.
+// allowedByRules dispatches the event to the matching check in the auth rules.
+func (a *allowerContext) allowedByRules(rules AuthRules, event *Event) error {
+	rule := rules.rule(event.Type())
+	if rule == nil {
+		rule = authRulesV1.rule(event.Type())
+	}
+	return rule(a, event)
+}
+
+// Allowed checks whether an event is allowed by the auth events, using the
+// auth rules for the room version of the event.
 // It returns a NotAllowed error if the event is not allowed.
 // If there was an error loading the auth events then it returns that error.
 func Allowed(event *Event, authEvents AuthEventProvider) error {
@@ -537,6 +737,18 @@ func (a *allowerContext) powerLevelsEventAllowed(event *Event) error {
 	return checkUserLevels(senderLevel, event.Sender(), oldPowerLevels, newPowerLevels)
 }
 
+// integerPowerLevelsEventAllowed checks whether the m.room.power_levels event
+// is allowed in a room version which only allows integer power levels. Levels
+// given as strings, which earlier room versions accept, are rejected whatever
+// the room version of the event itself.
+func (a *allowerContext) integerPowerLevelsEventAllowed(event *Event) error {
+	var content PowerLevelContent
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		return errorf("power levels must be integers: %s", err.Error())
+	}
+	return a.powerLevelsEventAllowed(event)
+}
+
 // checkEventLevels checks that the changes in event levels are allowed.
 func checkEventLevels(senderLevel int64, oldPowerLevels, newPowerLevels PowerLevelContent) error {
 	type levelPair struct {
@@ -776,7 +988,11 @@ func (a *allowerContext) redactEventAllowed(event *Event) error {
 		return err
 	}
 
-	redactDomain, err := domainFromID(event.Redacts())
+	redacts, ok := event.Redacts()
+	if !ok {
+		return errorf("redaction event %q doesn't say which event it redacts", event.EventID())
+	}
+	redactDomain, err := domainFromID(redacts)
 	if err != nil {
 		return err
 	}
@@ -1059,7 +1275,7 @@ func (m *membershipAllower) membershipAllowedFromThirdPartyInvite() error {
 	for _, publicKey := range m.thirdPartyInvite.PublicKeys {
 		for domain, signatures := range m.newMember.ThirdPartyInvite.Signed.Signatures {
 			for keyID := range signatures {
-				if strings.HasPrefix(keyID, "ed25519") {
+				if KeyID(keyID).Algorithm() == "ed25519" {
 					if err = VerifyJSON(
 						domain, KeyID(keyID),
 						ed25519.PublicKey(publicKey.PublicKey),
@@ -1118,7 +1334,9 @@ func (m *membershipAllower) membershipAllowedSelf() error { // nolint: gocyclo
 		}
 
 	case Join:
-		if m.oldMember.Membership == Leave && m.joinRule.JoinRule == Restricted {
+		// The "knock_restricted" join rule allows restricted joins in the
+		// same way as the "restricted" join rule does.
+		if m.oldMember.Membership == Leave && (m.joinRule.JoinRule == Restricted || m.joinRule.JoinRule == KnockRestricted) {
 			if err := m.membershipAllowedSelfForRestrictedJoin(); err != nil {
 				return err
 			}
@@ -1176,41 +1394,8 @@ func (m *membershipAllower) membershipAllowedOther() error { // nolint: gocyclo
 	}
 
 	switch m.newMember.Membership {
-	case Ban:
-		// A user may ban another user if their level is high enough
-		// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L463
-		if senderLevel >= m.powerLevels.Ban && senderLevel > targetLevel {
-			return nil
-		}
-		return m.membershipFailed(
-			"sender has insufficient power to ban (sender level %d, target level %d, ban level %d)",
-			senderLevel, targetLevel, m.powerLevels.Ban,
-		)
-
-	case Leave:
-		// A user may unban another user if their level is high enough.
-		// This is doesn't require the same power_level checks as banning.
-		// You can unban someone with higher power_level than you.
-		// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L451
-		if m.oldMember.Membership == Ban {
-			if senderLevel >= m.powerLevels.Ban {
-				return nil
-			}
-			return m.membershipFailed(
-				"sender has insufficient power to unban (sender level %d, target level %d, ban level %d)",
-				senderLevel, targetLevel, m.powerLevels.Ban,
-			)
-		}
-		// A user may kick another user if their level is high enough.
-		// TODO: You can kick a user that was already kicked, or has left the room, or was
-		// never in the room in the first place. Do we want to allow these redundant kicks?
-		if senderLevel >= m.powerLevels.Kick && senderLevel > targetLevel {
-			return nil
-		}
-		return m.membershipFailed(
-			"sender has insufficient power to kick (sender level %d, target level %d, kick level %d)",
-			senderLevel, targetLevel, m.powerLevels.Kick,
-		)
+	case Ban, Leave:
+		return m.membershipAllowedKickOrBan(senderLevel, targetLevel, m.powerLevels.Kick, m.powerLevels.Ban)
 
 	case Invite:
 		// A user may invite another user if the user has left the room.
@@ -1258,6 +1443,83 @@ func (m *membershipAllower) membershipAllowedOther() error { // nolint: gocyclo
 	}
 }
 
+// membershipAllowedKickOrBan checks whether the sender has the power to ban,
+// unban or kick the target user.
+func (m *membershipAllower) membershipAllowedKickOrBan(senderLevel, targetLevel, kickLevel, banLevel int64) error {
+	switch m.newMember.Membership {
+	case Ban:
+		// A user may ban another user if their level is high enough
+		// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L463
+		if senderLevel >= banLevel && senderLevel > targetLevel {
+			return nil
+		}
+		return m.membershipFailed(
+			"sender has insufficient power to ban (sender level %d, target level %d, ban level %d)",
+			senderLevel, targetLevel, banLevel,
+		)
+
+	case Leave:
+		// A user may unban another user if their level is high enough.
+		// This is doesn't require the same power_level checks as banning.
+		// You can unban someone with higher power_level than you.
+		// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L451
+		if m.oldMember.Membership == Ban {
+			if senderLevel >= banLevel {
+				return nil
+			}
+			return m.membershipFailed(
+				"sender has insufficient power to unban (sender level %d, target level %d, ban level %d)",
+				senderLevel, targetLevel, banLevel,
+			)
+		}
+		// A user may kick another user if their level is high enough.
+		// TODO: You can kick a user that was already kicked, or has left the room, or was
+		// never in the room in the first place. Do we want to allow these redundant kicks?
+		if senderLevel >= kickLevel && senderLevel > targetLevel {
+			return nil
+		}
+		return m.membershipFailed(
+			"sender has insufficient power to kick (sender level %d, target level %d, kick level %d)",
+			senderLevel, targetLevel, kickLevel,
+		)
+
+	default:
+		return m.membershipFailed("membership %q is not a kick or a ban", m.newMember.Membership)
+	}
+}
+
+// CheckMembershipTarget checks whether the sender of a m.room.member event which
+// kicks, bans or unbans another user has the power to do so, given the current
+// membership of the target and the power levels of the sender and the target.
+// A user can only kick or ban users with a lower power level than their own,
+// but can unban any user. The sender must also be joined to the room, which
+// isn't checked here. Returns a NotAllowed error if the sender doesn't have the
+// power, or if the event isn't a kick, ban or unban.
+func CheckMembershipTarget(event *Event, targetCurrentMembership string, senderPower, targetPower, kickLevel, banLevel int64) error {
+	if event.Type() != MRoomMember || event.StateKey() == nil {
+		return errorf("event %q is not a m.room.member event", event.EventID())
+	}
+	newMember, err := NewMemberContentFromEvent(event)
+	if err != nil {
+		return err
+	}
+	switch targetCurrentMembership {
+	case Join, Invite, Leave, Ban, Knock:
+	default:
+		return errorf("target has unknown membership %q", targetCurrentMembership)
+	}
+	m := membershipAllower{
+		targetID:  *event.StateKey(),
+		senderID:  event.Sender(),
+		oldMember: MemberContent{Membership: targetCurrentMembership},
+		newMember: newMember,
+	}
+	if m.senderID == m.targetID {
+		return m.membershipFailed("the sender is the target")
+	}
+	return m.membershipAllowedKickOrBan(senderPower, targetPower, kickLevel, banLevel)
+}
+
 // membershipFailed returns a error explaining why the membership change was disallowed.
 func (m *membershipAllower) membershipFailed(format string, args ...interface{}) error {
 	if m.senderID == m.targetID {
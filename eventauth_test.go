@@ -17,6 +17,7 @@ package gomatrixserverlib
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 )
 
@@ -1137,3 +1138,550 @@ func newMemberContent(
 		ThirdPartyInvite: thirdPartyInvite,
 	}
 }
+
+func TestAllowedStringPowerLevelsByRoomVersion(t *testing.T) {
+	// Room version 10 only allows integer power levels, whereas
+	// earlier room versions also accept string-encoded levels.
+	powerChange := RawJSON(`{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"content": {
+			"users_default": "50",
+			"users": {
+				"@u1:a": "100"
+			},
+			"redact": 100
+		}
+	}`)
+	for roomVersion, wantAllowed := range map[RoomVersion]bool{
+		RoomVersionV9:  true,
+		RoomVersionV10: false,
+	} {
+		event, err := NewEventFromTrustedJSON(powerChange, false, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Allowed(event, powerLevelTestRoom)
+		if wantAllowed && err != nil {
+			t.Errorf("room version %s: string power levels should have been allowed but weren't: %s", roomVersion, err)
+		}
+		if !wantAllowed && err == nil {
+			t.Errorf("room version %s: string power levels should have been rejected but weren't", roomVersion)
+		}
+	}
+}
+
+func TestAuthRulesForRoomVersion(t *testing.T) {
+	for roomVersion := range RoomVersions() {
+		if _, err := roomVersion.AuthRules(); err != nil {
+			t.Errorf("room version %s has no auth rules: %s", roomVersion, err)
+		}
+	}
+	if _, err := RoomVersion("unknown").AuthRules(); err == nil {
+		t.Error("expected an error for auth rules of an unknown room version")
+	}
+}
+
+func TestAuthRulesIndependentOfEventFormat(t *testing.T) {
+	// The room version 10 auth rules reject string power levels even for an
+	// event in a room version which would otherwise accept them, and the zero
+	// value falls back to the room version 1 rules rather than panicking.
+	powerChange, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"content": {
+			"users": {
+				"@u1:a": "100"
+			}
+		}
+	}`), false, RoomVersionV9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v10, err := RoomVersionV10.AuthRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v10.Allowed(powerChange, powerLevelTestRoom); err == nil {
+		t.Error("string power levels should have been rejected by the room version 10 auth rules")
+	}
+	if err = (AuthRules{}).Allowed(powerChange, powerLevelTestRoom); err != nil {
+		t.Errorf("string power levels should have been allowed by the zero value auth rules: %s", err)
+	}
+}
+
+func TestAuthRulesOverride(t *testing.T) {
+	// Overriding a single check in a set of auth rules should only
+	// affect the events that the check applies to.
+	rules := authRulesV1
+	rules.powerLevels = func(a *allowerContext, event *Event) error {
+		return errorf("power level changes are forbidden")
+	}
+	powerChange, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e5:a",
+		"content": {
+			"users": {
+				"@u1:a": 100
+			}
+		}
+	}`), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = authRulesV1.Allowed(powerChange, powerLevelTestRoom); err != nil {
+		t.Errorf("power level change should have been allowed by the default rules: %s", err)
+	}
+	if err = rules.Allowed(powerChange, powerLevelTestRoom); err == nil {
+		t.Error("power level change should have been rejected by the overridden rules")
+	}
+	message, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.message",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e6:a",
+		"content": {
+			"body": "hello"
+		}
+	}`), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rules.Allowed(message, powerLevelTestRoom); err != nil {
+		t.Errorf("message should have been allowed by the overridden rules: %s", err)
+	}
+}
+
+func TestValidateAuthEvents(t *testing.T) {
+	parse := func(eventJSON string) *Event {
+		event, err := NewEventFromTrustedJSON(RawJSON(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	create := parse(`{"type":"m.room.create","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e1:a","content":{"creator":"@u1:a"}}`)
+	member := parse(`{"type":"m.room.member","state_key":"@u1:a","sender":"@u1:a","room_id":"!r1:a","event_id":"$e2:a","content":{"membership":"join"}}`)
+	powerLevels := parse(`{"type":"m.room.power_levels","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e3:a","content":{"users":{"@u1:a":100}}}`)
+	otherPowerLevels := parse(`{"type":"m.room.power_levels","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e4:a","content":{"users":{"@u1:a":50}}}`)
+	joinRules := parse(`{"type":"m.room.join_rules","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e5:a","content":{"join_rule":"public"}}`)
+	message := parse(`{"type":"m.room.message","sender":"@u1:a","room_id":"!r1:a","event_id":"$e6:a","content":{"body":"hello"}}`)
+
+	if err := ValidateAuthEvents(message, []*Event{create, member, powerLevels}); err != nil {
+		t.Errorf("expected the auth events to be valid, got: %s", err)
+	}
+	if err := ValidateAuthEvents(message, []*Event{create, member, powerLevels, otherPowerLevels}); err == nil {
+		t.Error("expected two power level auth events to be rejected")
+	}
+	if err := ValidateAuthEvents(message, []*Event{create, member, powerLevels, joinRules}); err == nil {
+		t.Error("expected join rules to be rejected as an auth event for a message")
+	}
+	if err := ValidateAuthEvents(message, []*Event{create, message}); err == nil {
+		t.Error("expected a non-state auth event to be rejected")
+	}
+}
+
+func TestAllowedRestrictedJoin(t *testing.T) {
+	restrictedRoom := func(joinRule string) *testAuthEvents {
+		member := func(userID, membership string) json.RawMessage {
+			return json.RawMessage(`{
+				"type": "m.room.member",
+				"state_key": "` + userID + `",
+				"sender": "` + userID + `",
+				"room_id": "!r1:a",
+				"content": {"membership": "` + membership + `"}
+			}`)
+		}
+		return &testAuthEvents{
+			CreateJSON: json.RawMessage(`{
+				"type": "m.room.create",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"content": {"creator": "@u1:a"}
+			}`),
+			JoinRulesJSON: json.RawMessage(`{
+				"type": "m.room.join_rules",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"content": {
+					"join_rule": "` + joinRule + `",
+					"allow": [{"type": "m.room_membership", "room_id": "!r2:a"}]
+				}
+			}`),
+			PowerLevelsJSON: json.RawMessage(`{
+				"type": "m.room.power_levels",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"content": {
+					"invite": 50,
+					"users": {"@u1:a": 100}
+				}
+			}`),
+			MemberJSON: map[string]json.RawMessage{
+				"@u1:a": member("@u1:a", Join),
+				"@u3:a": member("@u3:a", Join),
+				"@u4:a": member("@u4:a", Leave),
+			},
+		}
+	}
+	join := func(authorisedVia string) RawJSON {
+		content := `{"membership": "join"}`
+		if authorisedVia != "" {
+			content = `{"membership": "join", "join_authorised_via_users_server": "` + authorisedVia + `"}`
+		}
+		return RawJSON(`{
+			"type": "m.room.member",
+			"state_key": "@u2:b",
+			"sender": "@u2:b",
+			"room_id": "!r1:a",
+			"content": ` + content + `
+		}`)
+	}
+
+	for joinRule, roomVersion := range map[string]RoomVersion{
+		Restricted:      RoomVersionV8,
+		KnockRestricted: RoomVersionV10,
+	} {
+		for _, tc := range []struct {
+			name          string
+			authorisedVia string
+			wantAllowed   bool
+		}{
+			{"authorised by a joined user with invite power", "@u1:a", true},
+			{"not authorised by anyone", "", false},
+			{"authorising user absent from the auth events", "@u5:a", false},
+			{"authorising user without invite power", "@u3:a", false},
+			{"authorising user not joined", "@u4:a", false},
+			{"invalid authorising user ID", "u1", false},
+		} {
+			event, err := NewEventFromTrustedJSON(join(tc.authorisedVia), false, roomVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Allowed(event, restrictedRoom(joinRule))
+			if tc.wantAllowed && err != nil {
+				t.Errorf("%s join %s: expected to be allowed but wasn't: %s", joinRule, tc.name, err)
+			}
+			if !tc.wantAllowed && err == nil {
+				t.Errorf("%s join %s: expected to be rejected but wasn't", joinRule, tc.name)
+			}
+		}
+	}
+
+	// Restricted joins aren't supported before room version 8.
+	event, err := NewEventFromTrustedJSON(join("@u1:a"), false, RoomVersionV7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Allowed(event, restrictedRoom(Restricted)); err == nil {
+		t.Error("expected a restricted join to be rejected in room version 7")
+	}
+}
+
+func TestGuestJoinAllowed(t *testing.T) {
+	guestAccess := func(value string) *Event {
+		event, err := NewEventFromTrustedJSON(RawJSON(`{
+			"type": "m.room.guest_access",
+			"state_key": "",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e1:a",
+			"content": {"guest_access": "`+value+`"}
+		}`), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	if err := GuestJoinAllowed(guestAccess(CanJoin)); err != nil {
+		t.Errorf("expected guests to be allowed to join: %s", err)
+	}
+	if err := GuestJoinAllowed(guestAccess(Forbidden)); err == nil {
+		t.Error("expected guests to be forbidden from joining")
+	} else if _, ok := err.(*NotAllowed); !ok {
+		t.Errorf("expected a NotAllowed error, got %T", err)
+	}
+	if err := GuestJoinAllowed(nil); err == nil {
+		t.Error("expected guests to be forbidden from joining a room without guest access")
+	}
+}
+
+func TestCheckMembershipTarget(t *testing.T) {
+	member := func(sender, target, membership string) *Event {
+		event, err := NewEventFromTrustedJSON(RawJSON(`{
+			"type": "m.room.member",
+			"state_key": "`+target+`",
+			"sender": "`+sender+`",
+			"room_id": "!r1:a",
+			"event_id": "$e1:a",
+			"content": {"membership": "`+membership+`"}
+		}`), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	kick := member("@u1:a", "@u2:a", Leave)
+	ban := member("@u1:a", "@u2:a", Ban)
+
+	for _, tc := range []struct {
+		name         string
+		event        *Event
+		target       string
+		senderLevel  int64
+		targetLevel  int64
+		kickBanLevel int64
+		wantAllowed  bool
+	}{
+		{"kick with equal power", kick, Join, 50, 50, 50, false},
+		{"kick with lower power", kick, Join, 50, 0, 50, true},
+		{"kick below the kick level", kick, Join, 25, 0, 50, false},
+		{"ban with equal power", ban, Join, 50, 50, 50, false},
+		{"ban with lower power", ban, Join, 50, 0, 50, true},
+		{"ban below the ban level", ban, Join, 25, 0, 50, false},
+		// Unbanning doesn't depend on the power level of the target.
+		{"unban with lower power", kick, Ban, 50, 100, 50, true},
+		{"unban below the ban level", kick, Ban, 25, 0, 50, false},
+		{"unknown target membership", kick, "bogus", 50, 0, 50, false},
+		{"invite", member("@u1:a", "@u2:a", Invite), Leave, 100, 0, 50, false},
+		{"leaving", member("@u2:a", "@u2:a", Leave), Join, 100, 0, 50, false},
+	} {
+		err := CheckMembershipTarget(tc.event, tc.target, tc.senderLevel, tc.targetLevel, tc.kickBanLevel, tc.kickBanLevel)
+		if tc.wantAllowed && err != nil {
+			t.Errorf("%s: expected to be allowed but wasn't: %s", tc.name, err)
+		}
+		if !tc.wantAllowed && err == nil {
+			t.Errorf("%s: expected to be rejected but wasn't", tc.name)
+		}
+	}
+}
+
+func TestAuthEventsByType(t *testing.T) {
+	member := func(userID, membership string) json.RawMessage {
+		return json.RawMessage(`{
+			"type": "m.room.member",
+			"state_key": "` + userID + `",
+			"sender": "` + userID + `",
+			"room_id": "!r1:a",
+			"content": {"membership": "` + membership + `"}
+		}`)
+	}
+	provider := &testAuthEvents{
+		CreateJSON: json.RawMessage(`{
+			"type": "m.room.create",
+			"state_key": "",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"content": {"creator": "@u1:a"}
+		}`),
+		JoinRulesJSON: json.RawMessage(`{
+			"type": "m.room.join_rules",
+			"state_key": "",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"content": {"join_rule": "restricted"}
+		}`),
+		PowerLevelsJSON: json.RawMessage(`{
+			"type": "m.room.power_levels",
+			"state_key": "",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"content": {"users": {"@u1:a": 100}}
+		}`),
+		MemberJSON: map[string]json.RawMessage{
+			"@u1:a": member("@u1:a", Join),
+			"@u2:b": member("@u2:b", Leave),
+			"@u3:a": member("@u3:a", Join),
+		},
+	}
+
+	// A restricted join needs the membership of the user authorising it as
+	// well as the joining user's own membership. Other members aren't needed.
+	event, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.member",
+		"state_key": "@u2:b",
+		"sender": "@u2:b",
+		"room_id": "!r1:a",
+		"content": {"membership": "join", "join_authorised_via_users_server": "@u1:a"}
+	}`), false, RoomVersionV8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := event.AuthEventsByType(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StateKeyTuple{
+		{MRoomCreate, ""},
+		{MRoomJoinRules, ""},
+		{MRoomPowerLevels, ""},
+		{MRoomMember, "@u1:a"},
+		{MRoomMember, "@u2:b"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d auth events, want %d: %v", len(got), len(want), got)
+	}
+	for _, tuple := range want {
+		e := got[tuple]
+		if e == nil {
+			t.Errorf("missing auth event %v", tuple)
+			continue
+		}
+		if e.Type() != tuple.EventType || !e.StateKeyEquals(tuple.StateKey) {
+			t.Errorf("got event (%q, %q) for %v", e.Type(), *e.StateKey(), tuple)
+		}
+	}
+
+	// Events which the provider doesn't have are left out: a message only
+	// needs the create event, the power levels and the sender's membership.
+	event, err = NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.message",
+		"sender": "@u4:a",
+		"room_id": "!r1:a",
+		"content": {"body": "hello"}
+	}`), false, RoomVersionV8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err = event.AuthEventsByType(provider); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[StateKeyTuple{MRoomCreate, ""}] == nil || got[StateKeyTuple{MRoomPowerLevels, ""}] == nil {
+		t.Fatalf("expected only the create and power levels events, got %v", got)
+	}
+}
+
+func TestAllowedInviteOnlyJoin(t *testing.T) {
+	inviteOnlyRoom := func(targetMembership json.RawMessage) *testAuthEvents {
+		room := &testAuthEvents{
+			CreateJSON: json.RawMessage(`{
+				"type": "m.room.create",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"content": {"creator": "@u1:a"}
+			}`),
+			JoinRulesJSON: json.RawMessage(`{
+				"type": "m.room.join_rules",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"content": {"join_rule": "invite"}
+			}`),
+			PowerLevelsJSON: json.RawMessage(`{
+				"type": "m.room.power_levels",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"content": {"users": {"@u1:a": 100}}
+			}`),
+			MemberJSON: map[string]json.RawMessage{
+				"@u1:a": json.RawMessage(`{
+					"type": "m.room.member",
+					"state_key": "@u1:a",
+					"sender": "@u1:a",
+					"room_id": "!r1:a",
+					"content": {"membership": "join"}
+				}`),
+			},
+		}
+		if targetMembership != nil {
+			room.MemberJSON["@u2:a"] = targetMembership
+		}
+		return room
+	}
+	priorMembership := func(sender, membership string) json.RawMessage {
+		return json.RawMessage(`{
+			"type": "m.room.member",
+			"state_key": "@u2:a",
+			"sender": "` + sender + `",
+			"room_id": "!r1:a",
+			"content": {"membership": "` + membership + `"}
+		}`)
+	}
+	join, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.member",
+		"state_key": "@u2:a",
+		"sender": "@u2:a",
+		"room_id": "!r1:a",
+		"content": {"membership": "join"}
+	}`), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		prior       json.RawMessage
+		wantAllowed bool
+	}{
+		{"never in the room", nil, false},
+		{"left the room", priorMembership("@u2:a", Leave), false},
+		{"banned", priorMembership("@u1:a", Ban), false},
+		{"knocked", priorMembership("@u2:a", Knock), false},
+		{"invited", priorMembership("@u1:a", Invite), true},
+		{"already joined", priorMembership("@u2:a", Join), true},
+	} {
+		err := Allowed(join, inviteOnlyRoom(tc.prior))
+		if tc.wantAllowed && err != nil {
+			t.Errorf("%s: expected the join to be allowed but it wasn't: %s", tc.name, err)
+		}
+		if !tc.wantAllowed && err == nil {
+			t.Errorf("%s: expected the join to be rejected but it wasn't", tc.name)
+		}
+	}
+}
+
+func TestCheckAuthEventsRoom(t *testing.T) {
+	stateEvent := func(eventType, stateKey, roomID, content string) json.RawMessage {
+		return json.RawMessage(`{
+			"type": "` + eventType + `",
+			"state_key": "` + stateKey + `",
+			"sender": "@u1:a",
+			"room_id": "` + roomID + `",
+			"event_id": "$` + eventType + `:` + roomID + `",
+			"content": ` + content + `
+		}`)
+	}
+	provider := &testAuthEvents{
+		CreateJSON:      stateEvent(MRoomCreate, "", "!r1:a", `{"creator": "@u1:a"}`),
+		PowerLevelsJSON: stateEvent(MRoomPowerLevels, "", "!r1:a", `{"users": {"@u1:a": 100}}`),
+		MemberJSON: map[string]json.RawMessage{
+			"@u1:a": stateEvent(MRoomMember, "@u1:a", "!r1:a", `{"membership": "join"}`),
+		},
+	}
+	event, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.message",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$message:a",
+		"content": {"body": "hello"}
+	}`), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckAuthEventsRoom(event, provider); err != nil {
+		t.Fatalf("expected auth events in the same room to be accepted, got %s", err)
+	}
+
+	// The power levels from another room give the sender the power they need,
+	// but mustn't be used to auth the event.
+	provider.PowerLevelsJSON = stateEvent(MRoomPowerLevels, "", "!r2:a", `{"users": {"@u1:a": 100}}`)
+	err = CheckAuthEventsRoom(event, provider)
+	if err == nil {
+		t.Fatal("expected an auth event from another room to be rejected")
+	}
+	if !strings.Contains(err.Error(), "!r2:a") {
+		t.Errorf("expected the error to name the other room, got %s", err)
+	}
+}
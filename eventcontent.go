@@ -17,6 +17,9 @@ package gomatrixserverlib
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -62,6 +65,9 @@ func NewCreateContentFromAuthEvents(authEvents AuthEventProvider) (c CreateConte
 		err = errorf("unparsable create event content: %s", err.Error())
 		return
 	}
+	if creatorIsSender, _ := createEvent.roomVersion.CreatorIsSender(); creatorIsSender {
+		c.Creator = createEvent.Sender()
+	}
 	c.roomID = createEvent.RoomID()
 	c.eventID = createEvent.EventID()
 	if c.senderDomain, err = domainFromID(createEvent.Sender()); err != nil {
@@ -119,8 +125,9 @@ type MemberContent struct {
 	Membership  string `json:"membership"`
 	DisplayName string `json:"displayname,omitempty"`
 	AvatarURL   string `json:"avatar_url,omitempty"`
-	Reason      string `json:"reason,omitempty"`
-	IsDirect    bool   `json:"is_direct,omitempty"`
+	// The reason given for the membership change, e.g. for a kick or a ban.
+	Reason   string `json:"reason,omitempty"`
+	IsDirect bool   `json:"is_direct,omitempty"`
 	// We use the third_party_invite key to special case thirdparty invites.
 	ThirdPartyInvite *MemberThirdPartyInvite `json:"third_party_invite,omitempty"`
 	// Restricted join rules require a user with invite permission to be nominated,
@@ -213,6 +220,13 @@ type HistoryVisibilityContent struct {
 	HistoryVisibility HistoryVisibility `json:"history_visibility"`
 }
 
+// Visibility returns the history visibility of the room. If the content has
+// no history visibility, or an unknown one, then this returns the default of
+// "shared".
+func (c HistoryVisibilityContent) Visibility() HistoryVisibility {
+	return c.HistoryVisibility.Value()
+}
+
 type HistoryVisibility string
 
 const (
@@ -264,6 +278,351 @@ func HistoryVisibilityFromInt(n uint8) HistoryVisibility {
 	return vis
 }
 
+// CanonicalAliasContent is the JSON content of a m.room.canonical_alias event.
+// See https://spec.matrix.org/v1.4/client-server-api/#mroomcanonical_alias for descriptions of the fields.
+type CanonicalAliasContent struct {
+	Alias      string   `json:"alias,omitempty"`
+	AltAliases []string `json:"alt_aliases,omitempty"`
+}
+
+// NewCanonicalAliasContentFromEvent loads the canonical alias content from an
+// event. Returns an error if any of the aliases aren't valid room aliases.
+// There is no way to check here that the aliases actually point at the room.
+func NewCanonicalAliasContentFromEvent(event *Event) (c CanonicalAliasContent, err error) {
+	if event.Type() != MRoomCanonicalAlias || !event.StateKeyEquals("") {
+		err = fmt.Errorf("gomatrixserverlib: event %q is not a m.room.canonical_alias event", event.EventID())
+		return
+	}
+	if err = json.Unmarshal(event.Content(), &c); err != nil {
+		err = fmt.Errorf("gomatrixserverlib: unparsable canonical alias event content: %w", err)
+		return
+	}
+	aliases := c.AltAliases
+	if c.Alias != "" {
+		aliases = append([]string{c.Alias}, aliases...)
+	}
+	for _, alias := range aliases {
+		if _, err = checkID(alias, "room alias", '#'); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// RedactionContent is the JSON content of a m.room.redaction event.
+type RedactionContent struct {
+	// The event ID of the redacted event, for room versions which put it in
+	// the content rather than at the top level of the event.
+	Redacts string `json:"redacts,omitempty"`
+	// The reason for the redaction, if any.
+	Reason string `json:"reason,omitempty"`
+}
+
+// MegolmV1AESSHA2 is the "m.megolm.v1.aes-sha2" encryption algorithm.
+const MegolmV1AESSHA2 = "m.megolm.v1.aes-sha2"
+
+// EncryptionContent is the JSON content of a m.room.encryption event.
+// See https://spec.matrix.org/v1.4/client-server-api/#mroomencryption for descriptions of the fields.
+type EncryptionContent struct {
+	Algorithm          string `json:"algorithm"`
+	RotationPeriodMS   int64  `json:"rotation_period_ms"`
+	RotationPeriodMsgs int64  `json:"rotation_period_msgs"`
+}
+
+// NewEncryptionContentFromEvent loads the encryption content from an event.
+// The rotation periods default to one week and 100 messages if they aren't
+// set in the event.
+func NewEncryptionContentFromEvent(event *Event) (c EncryptionContent, err error) {
+	if event.Type() != MRoomEncryption || !event.StateKeyEquals("") {
+		err = fmt.Errorf("gomatrixserverlib: event %q is not a m.room.encryption event", event.EventID())
+		return
+	}
+	c.RotationPeriodMS = 604800000
+	c.RotationPeriodMsgs = 100
+	if err = json.Unmarshal(event.Content(), &c); err != nil {
+		err = fmt.Errorf("gomatrixserverlib: unparsable encryption event content: %w", err)
+		return
+	}
+	if c.Algorithm == "" {
+		err = fmt.Errorf("gomatrixserverlib: encryption event %q has no algorithm", event.EventID())
+	}
+	return
+}
+
+// GuestAccessContent is the JSON content of a m.room.guest_access event.
+// See https://spec.matrix.org/v1.4/client-server-api/#mroomguest_access for descriptions of the fields.
+type GuestAccessContent struct {
+	// Either "can_join" or "forbidden".
+	GuestAccess string `json:"guest_access"`
+}
+
+// NewGuestAccessContentFromEvent loads the guest access content from an event.
+// Any value other than "can_join" is treated as "forbidden".
+func NewGuestAccessContentFromEvent(event *Event) (c GuestAccessContent, err error) {
+	if event.Type() != MRoomGuestAccess || !event.StateKeyEquals("") {
+		err = fmt.Errorf("gomatrixserverlib: event %q is not a m.room.guest_access event", event.EventID())
+		return
+	}
+	if err = json.Unmarshal(event.Content(), &c); err != nil {
+		err = fmt.Errorf("gomatrixserverlib: unparsable guest access event content: %w", err)
+		return
+	}
+	if c.GuestAccess != CanJoin {
+		c.GuestAccess = Forbidden
+	}
+	return
+}
+
+// TombstoneContent is the JSON content of a m.room.tombstone event, which
+// is sent when a room is upgraded to point to the replacement room.
+// See https://spec.matrix.org/v1.4/client-server-api/#mroomtombstone for descriptions of the fields.
+type TombstoneContent struct {
+	// A message for users explaining why the room was replaced.
+	Body string `json:"body"`
+	// The room ID of the room which replaces this one.
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// NewTombstoneContentFromEvent loads the tombstone content from an event.
+// Returns an error if the event doesn't name a replacement room.
+func NewTombstoneContentFromEvent(event *Event) (c TombstoneContent, err error) {
+	if event.Type() != MRoomTombstone || !event.StateKeyEquals("") {
+		err = fmt.Errorf("gomatrixserverlib: event %q is not a m.room.tombstone event", event.EventID())
+		return
+	}
+	if err = json.Unmarshal(event.Content(), &c); err != nil {
+		err = fmt.Errorf("gomatrixserverlib: unparsable tombstone event content: %w", err)
+		return
+	}
+	if c.ReplacementRoom == "" {
+		err = fmt.Errorf("gomatrixserverlib: tombstone event %q has no replacement room", event.EventID())
+		return
+	}
+	return
+}
+
+// ServerACLContent is the JSON content of a m.room.server_acl event, which
+// controls which servers may participate in the room.
+// See https://spec.matrix.org/v1.4/client-server-api/#mroomserver_acl for descriptions of the fields.
+type ServerACLContent struct {
+	// Glob patterns, using * and ?, for the server names which are allowed.
+	Allow []string `json:"allow"`
+	// Glob patterns for the server names which are denied, even if allowed.
+	Deny []string `json:"deny"`
+	// Whether servers named by an IP address literal are allowed.
+	AllowIPLiterals bool `json:"allow_ip_literals"`
+}
+
+// NewServerACLContentFromEvent loads the server ACL content from an event.
+// IP literals are allowed if the event doesn't say otherwise.
+func NewServerACLContentFromEvent(event *Event) (c ServerACLContent, err error) {
+	if event.Type() != MRoomServerACL || !event.StateKeyEquals("") {
+		err = fmt.Errorf("gomatrixserverlib: event %q is not a m.room.server_acl event", event.EventID())
+		return
+	}
+	c.AllowIPLiterals = true
+	if err = json.Unmarshal(event.Content(), &c); err != nil {
+		err = fmt.Errorf("gomatrixserverlib: unparsable server ACL event content: %w", err)
+	}
+	return
+}
+
+// Allowed returns true if the ACL allows the server to participate in the
+// room. The port of the server name is ignored, and the server must match one
+// of the allow patterns and none of the deny patterns, compared without regard
+// to case. An ACL with no allow patterns therefore denies every server.
+func (c *ServerACLContent) Allowed(serverName ServerName) bool {
+	host, _ := splitServerName(serverName)
+	if !c.AllowIPLiterals && (strings.HasPrefix(host, "[") || net.ParseIP(host) != nil) {
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range c.Deny {
+		if matchServerACLGlob(strings.ToLower(pattern), host) {
+			return false
+		}
+	}
+	for _, pattern := range c.Allow {
+		if matchServerACLGlob(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchServerACLGlob returns true if the glob pattern matches the whole of
+// the name, where * matches any number of characters and ? matches one.
+func matchServerACLGlob(pattern, name string) bool {
+	p, n := 0, 0
+	// The positions to go back to if the rest of the pattern fails to match
+	// after the last *, which then matches one more character of the name.
+	starP, starN := -1, 0
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			starP, starN = p, n
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case starP >= 0:
+			starN++
+			p, n = starP+1, starN
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// ValidateUpgradeLink checks that the tombstone event of an old room and the
+// create event of the room which replaces it point at each other, i.e. that
+// the tombstone names the new room as its replacement and that the create
+// event names the old room as its predecessor. The event ID of the
+// predecessor isn't checked, as it is only the last event the upgrading
+// server knew of in the old room, which may not be the tombstone.
+func ValidateUpgradeLink(oldTombstone, newCreate *Event) error {
+	tombstone, err := NewTombstoneContentFromEvent(oldTombstone)
+	if err != nil {
+		return err
+	}
+	if newCreate.Type() != MRoomCreate || !newCreate.StateKeyEquals("") {
+		return fmt.Errorf("gomatrixserverlib: event %q is not a m.room.create event", newCreate.EventID())
+	}
+	var create CreateContent
+	if err = json.Unmarshal(newCreate.Content(), &create); err != nil {
+		return fmt.Errorf("gomatrixserverlib: unparsable create event content: %w", err)
+	}
+	if tombstone.ReplacementRoom != newCreate.RoomID() {
+		return fmt.Errorf(
+			"gomatrixserverlib: tombstone replaces room %q with %q, not %q",
+			oldTombstone.RoomID(), tombstone.ReplacementRoom, newCreate.RoomID(),
+		)
+	}
+	if create.Predecessor.RoomID != oldTombstone.RoomID() {
+		return fmt.Errorf(
+			"gomatrixserverlib: room %q has predecessor %q, not %q",
+			newCreate.RoomID(), create.Predecessor.RoomID, oldTombstone.RoomID(),
+		)
+	}
+	return nil
+}
+
+// CheckCreateRoomVersion checks that the "room_version" of the create event,
+// which is treated as "1" if it is missing, is the expected room version, e.g.
+// the version used to parse the events of the room. A mismatch means that the
+// events of the room may have been parsed and authed with the wrong rules.
+func CheckCreateRoomVersion(createEvent *Event, expected RoomVersion) error {
+	if createEvent.Type() != MRoomCreate || !createEvent.StateKeyEquals("") {
+		return fmt.Errorf("gomatrixserverlib: event %q is not a m.room.create event", createEvent.EventID())
+	}
+	var create CreateContent
+	if err := json.Unmarshal(createEvent.Content(), &create); err != nil {
+		return fmt.Errorf("gomatrixserverlib: unparsable create event content: %w", err)
+	}
+	version := RoomVersionV1
+	if create.RoomVersion != nil {
+		version = *create.RoomVersion
+	}
+	if version != expected {
+		return fmt.Errorf(
+			"gomatrixserverlib: create event %q has room version %q, expected %q",
+			createEvent.EventID(), version, expected,
+		)
+	}
+	return nil
+}
+
+// MessageContent is the text of a message event, which is parsed from either
+// a m.room.message event or, in room versions which use extensible events, a
+// m.message event.
+type MessageContent struct {
+	// The message type of a m.room.message event, e.g. "m.text". Extensible
+	// events don't have a message type, so this is empty for m.message events.
+	MsgType string
+	// The plain text of the message.
+	Body string
+	// The HTML of the message, if there is any.
+	FormattedBody string
+}
+
+// messageTextRepresentation is one of the representations of the text of an
+// extensible event, in the "m.text" key of the content.
+type messageTextRepresentation struct {
+	Body     string `json:"body"`
+	MimeType string `json:"mimetype,omitempty"`
+}
+
+// messageTextFromRepresentations picks out the plain text and the HTML of an
+// extensible event. The first representation of each kind wins, and a
+// representation without a mimetype is plain text.
+func messageTextFromRepresentations(c *MessageContent, representations []messageTextRepresentation) {
+	for _, representation := range representations {
+		switch representation.MimeType {
+		case "", "text/plain":
+			if c.Body == "" {
+				c.Body = representation.Body
+			}
+		case "text/html":
+			if c.FormattedBody == "" {
+				c.FormattedBody = representation.Body
+			}
+		}
+	}
+}
+
+// NewMessageContentFromEvent loads the text of a message event. In room versions
+// which use extensible events the message must be a m.message event, and in all
+// other room versions it must be a m.room.message event. Clients may already
+// add the extensible "m.text" representations to a m.room.message event, which
+// are used if the event doesn't have a body.
+func NewMessageContentFromEvent(event *Event) (c MessageContent, err error) {
+	if event.roomVersion.Supports(RoomFeatureExtensibleEvents) {
+		if event.Type() != MMessage || event.StateKey() != nil {
+			err = fmt.Errorf("gomatrixserverlib: event %q is not a m.message event", event.EventID())
+			return
+		}
+		var content struct {
+			Text []messageTextRepresentation `json:"m.text"`
+		}
+		if err = json.Unmarshal(event.Content(), &content); err != nil {
+			err = fmt.Errorf("gomatrixserverlib: unparsable message event content: %w", err)
+			return
+		}
+		messageTextFromRepresentations(&c, content.Text)
+	} else {
+		if event.Type() != MRoomMessage || event.StateKey() != nil {
+			err = fmt.Errorf("gomatrixserverlib: event %q is not a m.room.message event", event.EventID())
+			return
+		}
+		var content struct {
+			MsgType       string                      `json:"msgtype"`
+			Body          string                      `json:"body"`
+			Format        string                      `json:"format"`
+			FormattedBody string                      `json:"formatted_body"`
+			Text          []messageTextRepresentation `json:"m.text"`
+		}
+		if err = json.Unmarshal(event.Content(), &content); err != nil {
+			err = fmt.Errorf("gomatrixserverlib: unparsable message event content: %w", err)
+			return
+		}
+		c.MsgType, c.Body = content.MsgType, content.Body
+		if content.Format == "org.matrix.custom.html" {
+			c.FormattedBody = content.FormattedBody
+		}
+		if c.Body == "" {
+			messageTextFromRepresentations(&c, content.Text)
+		}
+	}
+	if c.Body == "" {
+		err = fmt.Errorf("gomatrixserverlib: message event %q has no plain text body", event.EventID())
+	}
+	return
+}
+
 // JoinRuleContent is the JSON content of a m.room.join_rules event needed for auth checks.
 // See  https://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-join-rules for descriptions of the fields.
 type JoinRuleContent struct {
@@ -326,6 +685,12 @@ func (c *PowerLevelContent) UserLevel(userID string) int64 {
 	return c.UsersDefault
 }
 
+// IsExempt returns true if the user's power level in the room is at least the
+// given threshold, e.g. so that moderators can be exempted from rate limits.
+func (c *PowerLevelContent) IsExempt(userID string, exemptThreshold int64) bool {
+	return c.UserLevel(userID) >= exemptThreshold
+}
+
 // EventLevel returns the power level needed to send an event in the room.
 func (c *PowerLevelContent) EventLevel(eventType string, isState bool) int64 {
 	if eventType == MRoomThirdPartyInvite {
@@ -344,6 +709,17 @@ func (c *PowerLevelContent) EventLevel(eventType string, isState bool) int64 {
 	return c.EventsDefault
 }
 
+// CanSendEvent returns true if the user's power level is high enough to send
+// an event of the given type into the room. The level needed is the level for
+// the event type in "events" if there is one, otherwise "state_default" for
+// state events or "events_default" for other events. The power levels should
+// come from NewPowerLevelContentFromAuthEvents or NewPowerLevelContentFromEvent
+// so that the defaults are filled in. Membership changes have further rules,
+// see Allowed.
+func CanSendEvent(userID, eventType string, isState bool, power *PowerLevelContent) bool {
+	return power.UserLevel(userID) >= power.EventLevel(eventType, isState)
+}
+
 // UserLevel returns the power level a user has in the room.
 func (c *PowerLevelContent) NotificationLevel(notification string) int64 {
 	level, ok := c.Notifications[notification]
@@ -355,6 +731,93 @@ func (c *PowerLevelContent) NotificationLevel(notification string) int64 {
 	return 50
 }
 
+// A PowerLevelChange is the old and new value of a single power level.
+type PowerLevelChange struct {
+	Old int64
+	New int64
+}
+
+// A PowerLevelDiff describes the differences between two sets of power levels.
+// Only levels which have changed are included in the maps.
+type PowerLevelDiff struct {
+	// The effective power level of each user listed in either "users" map.
+	// Users missing from one of the maps are compared at "users_default".
+	Users map[string]PowerLevelChange
+	// The level needed to send each event type listed in either "events" map.
+	// Event types missing from one of the maps are compared at "events_default".
+	Events map[string]PowerLevelChange
+	// The level needed for each notification listed in either "notifications"
+	// map.
+	Notifications map[string]PowerLevelChange
+	// The top-level levels, keyed by their name in the event content, e.g.
+	// "ban" or "users_default".
+	Defaults map[string]PowerLevelChange
+}
+
+// IsEmpty returns true if none of the power levels have changed.
+func (d PowerLevelDiff) IsEmpty() bool {
+	return len(d.Users) == 0 && len(d.Events) == 0 && len(d.Notifications) == 0 && len(d.Defaults) == 0
+}
+
+// DiffPowerLevels returns the changes between the old and new power levels.
+func DiffPowerLevels(old, new *PowerLevelContent) PowerLevelDiff {
+	diff := PowerLevelDiff{
+		Users:         map[string]PowerLevelChange{},
+		Events:        map[string]PowerLevelChange{},
+		Notifications: map[string]PowerLevelChange{},
+		Defaults:      map[string]PowerLevelChange{},
+	}
+	add := func(changes map[string]PowerLevelChange, key string, oldLevel, newLevel int64) {
+		if oldLevel != newLevel {
+			changes[key] = PowerLevelChange{Old: oldLevel, New: newLevel}
+		}
+	}
+	for _, users := range []map[string]int64{old.Users, new.Users} {
+		for userID := range users {
+			add(diff.Users, userID, old.UserLevel(userID), new.UserLevel(userID))
+		}
+	}
+	eventLevel := func(c *PowerLevelContent, eventType string) int64 {
+		if level, ok := c.Events[eventType]; ok {
+			return level
+		}
+		return c.EventsDefault
+	}
+	for _, events := range []map[string]int64{old.Events, new.Events} {
+		for eventType := range events {
+			add(diff.Events, eventType, eventLevel(old, eventType), eventLevel(new, eventType))
+		}
+	}
+	for _, notifications := range []map[string]int64{old.Notifications, new.Notifications} {
+		for notification := range notifications {
+			add(diff.Notifications, notification, old.NotificationLevel(notification), new.NotificationLevel(notification))
+		}
+	}
+	add(diff.Defaults, "ban", old.Ban, new.Ban)
+	add(diff.Defaults, "invite", old.Invite, new.Invite)
+	add(diff.Defaults, "kick", old.Kick, new.Kick)
+	add(diff.Defaults, "redact", old.Redact, new.Redact)
+	add(diff.Defaults, "users_default", old.UsersDefault, new.UsersDefault)
+	add(diff.Defaults, "events_default", old.EventsDefault, new.EventsDefault)
+	add(diff.Defaults, "state_default", old.StateDefault, new.StateDefault)
+	return diff
+}
+
+// UsersWithChangedPower returns the users whose power level differs between
+// the old and new power levels, sorted by user ID. Only users listed in the
+// users map of either power levels can be found, so a change to users_default
+// also affects all of the other users in the room, which the caller will need
+// to check for separately using DiffPowerLevels.
+func UsersWithChangedPower(old, new *PowerLevelContent) []string {
+	changes := DiffPowerLevels(old, new).Users
+	users := make([]string, 0, len(changes))
+	for userID := range changes {
+		users = append(users, userID)
+	}
+	sort.Strings(users)
+	return users
+}
+
 // NewPowerLevelContentFromAuthEvents loads the power level content from the
 // power level event in the auth events or returns the default values if there
 // is no power level event.
@@ -424,7 +887,7 @@ func NewPowerLevelContentFromEvent(event *Event) (c PowerLevelContent, err error
 			UsersDefaultLevel  levelJSONValue            `json:"users_default"`
 			EventLevels        map[string]levelJSONValue `json:"events"`
 			StateDefaultLevel  levelJSONValue            `json:"state_default"`
-			EventDefaultLevel  levelJSONValue            `json:"event_default"`
+			EventDefaultLevel  levelJSONValue            `json:"events_default"`
 			NotificationLevels map[string]levelJSONValue `json:"notifications"`
 		}
 		if err = json.Unmarshal(event.Content(), &content); err != nil {
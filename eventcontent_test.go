@@ -17,6 +17,7 @@ package gomatrixserverlib
 
 import (
 	"encoding/json"
+	"reflect"
 	"testing"
 )
 
@@ -94,6 +95,52 @@ func TestStrictPowerLevelContent(t *testing.T) {
 	}
 }
 
+func TestPowerLevelContentRoomVersions(t *testing.T) {
+	// Room version 10 requires that power levels are integers, whereas
+	// earlier room versions allow string-encoded power levels.
+	eventJSON := `{"content":{"ban":"50","events":{"m.room.name":"50"},"events_default":"10","invite":0,"kick":50,"notifications":{"room":"50"},"redact":50,"state_default":"50","users":{"@alice:example.com":"100"},"users_default":0},"origin_server_ts":1643017369993,"sender":"@alice:example.com","state_key":"","type":"m.room.power_levels","room_id":"!room:example.com"}`
+	for _, roomVersion := range []RoomVersion{RoomVersionV1, RoomVersionV9} {
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewPowerLevelContentFromEvent(event)
+		if err != nil {
+			t.Fatalf("room version %s: string power levels should have been accepted but weren't: %s", roomVersion, err)
+		}
+		if c.Ban != 50 || c.EventsDefault != 10 || c.StateDefault != 50 {
+			t.Errorf("room version %s: unexpected levels: ban %d, events_default %d, state_default %d", roomVersion, c.Ban, c.EventsDefault, c.StateDefault)
+		}
+		if c.Users["@alice:example.com"] != 100 || c.Events["m.room.name"] != 50 || c.Notifications["room"] != 50 {
+			t.Errorf("room version %s: unexpected levels: %+v", roomVersion, c)
+		}
+	}
+
+	event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewPowerLevelContentFromEvent(event); err == nil {
+		t.Fatal("room version 10: string power levels should have been rejected but weren't")
+	}
+
+	intJSON := `{"content":{"ban":50,"events":{"m.room.name":50},"events_default":10,"users":{"@alice:example.com":100}},"origin_server_ts":1643017369993,"sender":"@alice:example.com","state_key":"","type":"m.room.power_levels","room_id":"!room:example.com"}`
+	event, err = NewEventFromTrustedJSON([]byte(intJSON), false, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewPowerLevelContentFromEvent(event)
+	if err != nil {
+		t.Fatalf("room version 10: integer power levels should have been accepted but weren't: %s", err)
+	}
+	if c.Ban != 50 || c.EventsDefault != 10 || c.Users["@alice:example.com"] != 100 {
+		t.Errorf("room version 10: unexpected levels: %+v", c)
+	}
+	if c.Kick != 50 || c.StateDefault != 50 {
+		t.Errorf("room version 10: missing levels should have their defaults: %+v", c)
+	}
+}
+
 func TestHistoryVisibilityFromInt(t *testing.T) {
 	tests := []struct {
 		name string
@@ -120,6 +167,41 @@ func TestHistoryVisibilityFromInt(t *testing.T) {
 	}
 }
 
+func TestHistoryVisibilityContent_Visibility(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    HistoryVisibility
+	}{
+		{
+			name:    "missing history visibility defaults to shared",
+			content: `{}`,
+			want:    HistoryVisibilityShared,
+		},
+		{
+			name:    "unknown history visibility defaults to shared",
+			content: `{"history_visibility":"doesNotExist"}`,
+			want:    HistoryVisibilityShared,
+		},
+		{
+			name:    "history visibility returns correct value",
+			content: `{"history_visibility":"joined"}`,
+			want:    HistoryVisibilityJoined,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c HistoryVisibilityContent
+			if err := json.Unmarshal([]byte(tt.content), &c); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Visibility(); got != tt.want {
+				t.Errorf("Visibility() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestHistoryVisibility_NumericValue(t *testing.T) {
 	tests := []struct {
 		name string
@@ -150,3 +232,391 @@ func TestHistoryVisibility_NumericValue(t *testing.T) {
 		})
 	}
 }
+
+func TestDiffPowerLevels(t *testing.T) {
+	var old, new PowerLevelContent
+	old.Defaults()
+	new.Defaults()
+	old.Users = map[string]int64{"@alice:test": 100, "@bob:test": 50}
+	new.Users = map[string]int64{"@alice:test": 100, "@charlie:test": 50}
+	old.Events = map[string]int64{"m.room.name": 50}
+	new.Events = map[string]int64{"m.room.name": 50, "m.room.topic": 100}
+	new.Ban = 75
+	new.UsersDefault = 10
+
+	if diff := DiffPowerLevels(&old, &old); !diff.IsEmpty() {
+		t.Fatalf("expected no differences between identical power levels, got %+v", diff)
+	}
+
+	diff := DiffPowerLevels(&old, &new)
+	wantUsers := map[string]PowerLevelChange{
+		// Bob was removed from the users map so falls back to the new default.
+		"@bob:test": {Old: 50, New: 10},
+		// Charlie was added to the users map.
+		"@charlie:test": {Old: 0, New: 50},
+	}
+	if !reflect.DeepEqual(diff.Users, wantUsers) {
+		t.Errorf("got user changes %+v, want %+v", diff.Users, wantUsers)
+	}
+	wantEvents := map[string]PowerLevelChange{
+		"m.room.topic": {Old: 0, New: 100},
+	}
+	if !reflect.DeepEqual(diff.Events, wantEvents) {
+		t.Errorf("got event changes %+v, want %+v", diff.Events, wantEvents)
+	}
+	wantDefaults := map[string]PowerLevelChange{
+		"ban":           {Old: 50, New: 75},
+		"users_default": {Old: 0, New: 10},
+	}
+	if !reflect.DeepEqual(diff.Defaults, wantDefaults) {
+		t.Errorf("got default changes %+v, want %+v", diff.Defaults, wantDefaults)
+	}
+	if len(diff.Notifications) != 0 {
+		t.Errorf("expected no notification changes, got %+v", diff.Notifications)
+	}
+}
+
+func TestNewEncryptionContentFromEvent(t *testing.T) {
+	eventJSON := `{"content":{"algorithm":"m.megolm.v1.aes-sha2","rotation_period_ms":86400000,"rotation_period_msgs":50},"origin_server_ts":1643017369993,"sender":"@alice:test","state_key":"","type":"m.room.encryption","event_id":"$encryption:test","room_id":"!room:test"}`
+	event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := NewEncryptionContentFromEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := EncryptionContent{
+		Algorithm:          MegolmV1AESSHA2,
+		RotationPeriodMS:   86400000,
+		RotationPeriodMsgs: 50,
+	}
+	if content != want {
+		t.Errorf("got %+v, want %+v", content, want)
+	}
+
+	// The rotation periods fall back to the defaults if they aren't given.
+	eventJSON = `{"content":{"algorithm":"m.megolm.v1.aes-sha2"},"origin_server_ts":1643017369993,"sender":"@alice:test","state_key":"","type":"m.room.encryption","event_id":"$encryption2:test","room_id":"!room:test"}`
+	event, err = NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err = NewEncryptionContentFromEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = EncryptionContent{
+		Algorithm:          MegolmV1AESSHA2,
+		RotationPeriodMS:   604800000,
+		RotationPeriodMsgs: 100,
+	}
+	if content != want {
+		t.Errorf("got %+v, want %+v", content, want)
+	}
+}
+
+func TestNewCanonicalAliasContentFromEvent(t *testing.T) {
+	eventJSON := `{"content":{"alias":"#main:test","alt_aliases":["#other:test","#another:elsewhere.test"]},"origin_server_ts":1643017369993,"sender":"@alice:test","state_key":"","type":"m.room.canonical_alias","event_id":"$alias:test","room_id":"!room:test"}`
+	event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := NewCanonicalAliasContentFromEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CanonicalAliasContent{
+		Alias:      "#main:test",
+		AltAliases: []string{"#other:test", "#another:elsewhere.test"},
+	}
+	if !reflect.DeepEqual(content, want) {
+		t.Errorf("got %+v, want %+v", content, want)
+	}
+
+	// The alt aliases must be valid room aliases too.
+	eventJSON = `{"content":{"alias":"#main:test","alt_aliases":["!notanalias:test"]},"origin_server_ts":1643017369993,"sender":"@alice:test","state_key":"","type":"m.room.canonical_alias","event_id":"$alias2:test","room_id":"!room:test"}`
+	event, err = NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewCanonicalAliasContentFromEvent(event); err == nil {
+		t.Fatal("expected an invalid alt alias to be rejected")
+	}
+}
+
+func TestUsersWithChangedPower(t *testing.T) {
+	var old, new PowerLevelContent
+	old.Defaults()
+	new.Defaults()
+	old.Users = map[string]int64{"@alice:test": 100, "@bob:test": 50, "@dave:test": 0}
+	new.Users = map[string]int64{"@alice:test": 100, "@charlie:test": 50, "@evelyn:test": 75}
+	new.Ban = 75
+
+	if users := UsersWithChangedPower(&old, &old); len(users) != 0 {
+		t.Errorf("expected no users to have changed power, got %v", users)
+	}
+	// Alice has the same level and Dave is still at the default level, so
+	// neither of them has changed power.
+	want := []string{"@bob:test", "@charlie:test", "@evelyn:test"}
+	if got := UsersWithChangedPower(&old, &new); !reflect.DeepEqual(got, want) {
+		t.Errorf("got users %v, want %v", got, want)
+	}
+}
+
+func TestNewGuestAccessContentFromEvent(t *testing.T) {
+	for content, want := range map[string]string{
+		`{"guest_access":"can_join"}`:  CanJoin,
+		`{"guest_access":"forbidden"}`: Forbidden,
+		`{"guest_access":"sometimes"}`: Forbidden,
+		`{}`:                           Forbidden,
+	} {
+		eventJSON := `{"content":` + content + `,"origin_server_ts":1643017369993,"sender":"@alice:test","state_key":"","type":"m.room.guest_access","event_id":"$guest:test","room_id":"!room:test"}`
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := NewGuestAccessContentFromEvent(event)
+		if err != nil {
+			t.Fatalf("%s: %s", content, err)
+		}
+		if got.GuestAccess != want {
+			t.Errorf("%s: got guest access %q, want %q", content, got.GuestAccess, want)
+		}
+	}
+
+	event, err := NewEventFromTrustedJSON([]byte(`{"content":{"guest_access":"can_join"},"origin_server_ts":1643017369993,"sender":"@alice:test","state_key":"","type":"m.room.join_rules","event_id":"$join_rules:test","room_id":"!room:test"}`), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewGuestAccessContentFromEvent(event); err == nil {
+		t.Error("expected an error for an event of the wrong type")
+	}
+}
+
+func TestNewMessageContentFromEvent(t *testing.T) {
+	extensibleVersion := testRoomVersionExtensibleEvents
+
+	parse := func(roomVersion RoomVersion, eventType, content string) (MessageContent, error) {
+		eventJSON := `{"content":` + content + `,"origin_server_ts":1643017369993,"sender":"@alice:test","type":"` + eventType + `","room_id":"!room:test","auth_events":[],"prev_events":[],"depth":1}`
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewMessageContentFromEvent(event)
+	}
+
+	extensible := `{"m.text":[{"mimetype":"text/html","body":"<b>hello</b>"},{"body":"hello"}]}`
+	got, err := parse(extensibleVersion, MMessage, extensible)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (MessageContent{Body: "hello", FormattedBody: "<b>hello</b>"}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	legacy := `{"msgtype":"m.text","body":"hello","format":"org.matrix.custom.html","formatted_body":"<b>hello</b>"}`
+	got, err = parse(RoomVersionV10, MRoomMessage, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (MessageContent{MsgType: "m.text", Body: "hello", FormattedBody: "<b>hello</b>"}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A m.room.message event may carry the extensible representations too,
+	// which are used if there is no body.
+	got, err = parse(RoomVersionV10, MRoomMessage, `{"msgtype":"m.text","m.text":[{"body":"hello"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (MessageContent{MsgType: "m.text", Body: "hello"}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Each type of message event is only allowed in the right room versions.
+	if _, err = parse(RoomVersionV10, MMessage, extensible); err == nil {
+		t.Error("expected a m.message event to be rejected in room version 10")
+	}
+	if _, err = parse(extensibleVersion, MRoomMessage, legacy); err == nil {
+		t.Error("expected a m.room.message event to be rejected in an extensible events room version")
+	}
+	if _, err = parse(extensibleVersion, MMessage, `{"m.text":[{"mimetype":"text/html","body":"<b>hello</b>"}]}`); err == nil {
+		t.Error("expected a message without a plain text body to be rejected")
+	}
+}
+
+func TestValidateUpgradeLink(t *testing.T) {
+	event := func(roomID, eventType, content string) *Event {
+		eventJSON := `{"content":` + content + `,"origin_server_ts":1643017369993,"sender":"@alice:test","state_key":"","type":"` + eventType + `","event_id":"$` + eventType + roomID + `","room_id":"` + roomID + `"}`
+		e, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	tombstone := event("!old:test", MRoomTombstone, `{"body":"This room has been replaced","replacement_room":"!new:test"}`)
+	create := event("!new:test", MRoomCreate, `{"creator":"@alice:test","room_version":"6","predecessor":{"room_id":"!old:test","event_id":"$tombstone"}}`)
+
+	content, err := NewTombstoneContentFromEvent(tombstone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.Body != "This room has been replaced" || content.ReplacementRoom != "!new:test" {
+		t.Fatalf("got unexpected tombstone content %+v", content)
+	}
+	if err = ValidateUpgradeLink(tombstone, create); err != nil {
+		t.Fatalf("expected a valid upgrade link, got %s", err)
+	}
+
+	for name, pair := range map[string][2]*Event{
+		"tombstone points elsewhere": {
+			event("!old:test", MRoomTombstone, `{"replacement_room":"!other:test"}`), create,
+		},
+		"create has another predecessor": {
+			tombstone, event("!new:test", MRoomCreate, `{"creator":"@alice:test","predecessor":{"room_id":"!other:test","event_id":"$x"}}`),
+		},
+		"create has no predecessor": {
+			tombstone, event("!new:test", MRoomCreate, `{"creator":"@alice:test"}`),
+		},
+		"tombstone has no replacement room": {
+			event("!old:test", MRoomTombstone, `{"body":"gone"}`), create,
+		},
+		"not a tombstone": {
+			event("!old:test", MRoomTopic, `{"replacement_room":"!new:test"}`), create,
+		},
+		"not a create event": {
+			tombstone, event("!new:test", MRoomTopic, `{"predecessor":{"room_id":"!old:test"}}`),
+		},
+	} {
+		if err := ValidateUpgradeLink(pair[0], pair[1]); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCheckCreateRoomVersion(t *testing.T) {
+	event := func(eventType, content string) *Event {
+		eventJSON := `{"content":` + content + `,"origin_server_ts":1643017369993,"sender":"@alice:test","state_key":"","type":"` + eventType + `","event_id":"$` + eventType + `","room_id":"!room:test"}`
+		e, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	create := event(MRoomCreate, `{"creator":"@alice:test","room_version":"6"}`)
+	if err := CheckCreateRoomVersion(create, RoomVersionV6); err != nil {
+		t.Errorf("expected matching room versions to be accepted, got %s", err)
+	}
+	if err := CheckCreateRoomVersion(create, RoomVersionV5); err == nil {
+		t.Error("expected mismatched room versions to be rejected")
+	}
+	// A create event without a room_version is a version 1 room.
+	legacy := event(MRoomCreate, `{"creator":"@alice:test"}`)
+	if err := CheckCreateRoomVersion(legacy, RoomVersionV1); err != nil {
+		t.Errorf("expected a missing room_version to be treated as version 1, got %s", err)
+	}
+	if err := CheckCreateRoomVersion(legacy, RoomVersionV6); err == nil {
+		t.Error("expected a missing room_version not to match version 6")
+	}
+	if err := CheckCreateRoomVersion(event(MRoomTopic, `{"room_version":"6"}`), RoomVersionV6); err == nil {
+		t.Error("expected an event which isn't a create event to be rejected")
+	}
+}
+
+func TestPowerLevelContentIsExempt(t *testing.T) {
+	var c PowerLevelContent
+	c.Defaults()
+	c.Users = map[string]int64{"@admin:test": 100, "@mod:test": 50}
+	for userID, want := range map[string]bool{
+		"@admin:test": true,
+		"@mod:test":   true,
+		"@user:test":  false,
+	} {
+		if got := c.IsExempt(userID, 50); got != want {
+			t.Errorf("IsExempt(%q, 50): got %v, want %v", userID, got, want)
+		}
+	}
+	// Users without an explicit level get the users_default level.
+	c.UsersDefault = 50
+	if !c.IsExempt("@user:test", 50) {
+		t.Error("expected a user at the default level to be exempt when the default meets the threshold")
+	}
+}
+
+func TestServerACLContentAllowed(t *testing.T) {
+	eventJSON := `{"content":{"allow":["*.example.com","matrix.org","?.test"],"deny":["evil.example.com"],"allow_ip_literals":false},"origin_server_ts":1643017369993,"sender":"@alice:test","state_key":"","type":"m.room.server_acl","event_id":"$acl:test","room_id":"!room:test"}`
+	event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := NewServerACLContentFromEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for serverName, want := range map[ServerName]bool{
+		"matrix.org":           true,
+		"MATRIX.org:8448":      true,
+		"a.example.com":        true,
+		"a.b.example.com":      true,
+		"example.com":          false,
+		"evil.example.com":     false,
+		"evil.example.com:443": false,
+		"a.test":               true,
+		"ab.test":              false,
+		"matrix.org.evil":      false,
+		"1.2.3.4":              false,
+		"[::1]:8448":           false,
+	} {
+		if got := acl.Allowed(serverName); got != want {
+			t.Errorf("Allowed(%q): got %v, want %v", serverName, got, want)
+		}
+	}
+
+	// IP literals are allowed unless the ACL says otherwise.
+	event, err = NewEventFromTrustedJSON([]byte(`{"content":{"allow":["*"]},"origin_server_ts":1643017369993,"sender":"@alice:test","state_key":"","type":"m.room.server_acl","event_id":"$acl2:test","room_id":"!room:test"}`), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl, err = NewServerACLContentFromEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.Allowed("1.2.3.4") {
+		t.Error("expected IP literals to be allowed by default")
+	}
+	// An ACL which allows nothing denies everything.
+	if (&ServerACLContent{AllowIPLiterals: true}).Allowed("matrix.org") {
+		t.Error("expected an ACL with no allow patterns to deny every server")
+	}
+}
+
+func TestCanSendEvent(t *testing.T) {
+	power := PowerLevelContent{}
+	power.Defaults()
+	power.Users = map[string]int64{"@admin:test": 100, "@mod:test": 50, "@muted:test": -1}
+	power.Events = map[string]int64{MRoomPowerLevels: 100, "m.room.topic": 0, "m.reaction": 10}
+
+	tests := []struct {
+		name      string
+		userID    string
+		eventType string
+		isState   bool
+		want      bool
+	}{
+		{"message uses events_default", "@user:test", "m.room.message", false, true},
+		{"muted user below events_default", "@muted:test", "m.room.message", false, false},
+		{"state uses state_default", "@user:test", "m.room.name", true, false},
+		{"moderator meets state_default", "@mod:test", "m.room.name", true, true},
+		{"events overrides state_default", "@user:test", "m.room.topic", true, true},
+		{"events overrides events_default", "@user:test", "m.reaction", false, false},
+		{"events applies to state and non-state", "@mod:test", MRoomPowerLevels, false, false},
+		{"admin can send power levels", "@admin:test", MRoomPowerLevels, true, true},
+		{"moderator can't send power levels", "@mod:test", MRoomPowerLevels, true, false},
+		{"third party invites use the invite level", "@mod:test", MRoomThirdPartyInvite, true, true},
+		{"user below the invite level", "@user:test", MRoomThirdPartyInvite, true, false},
+	}
+	for _, tt := range tests {
+		if got := CanSendEvent(tt.userID, tt.eventType, tt.isState, &power); got != tt.want {
+			t.Errorf("%s: CanSendEvent(%q, %q, %v): got %v, want %v", tt.name, tt.userID, tt.eventType, tt.isState, got, tt.want)
+		}
+	}
+}
@@ -19,7 +19,6 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 
@@ -36,6 +35,80 @@ func VerifyAllEventSignatures(ctx context.Context, events []*Event, verifier JSO
 	return errors
 }
 
+// VerifyAllEvents is the same as VerifyAllEventSignatures, but each event is
+// checked with VerifyEvent, so events with an invalid content hash are caught
+// without verifying their signatures.
+func VerifyAllEvents(ctx context.Context, events []*Event, verifier JSONVerifier) []error {
+	errors := make([]error, 0, len(events))
+	for _, e := range events {
+		errors = append(errors, VerifyEvent(ctx, e, verifier))
+	}
+	return errors
+}
+
+// VerifyEvent checks the content hash of the event and then its signatures.
+// The content hash is checked first, since it is much cheaper to check than
+// the ed25519 signatures and catches most tampering with the event, in which
+// case the signatures aren't checked at all. Redacted events are only checked
+// for signatures, as their content no longer matches the content hash. The
+// reference hash doesn't need to be checked, as it's either worked out from
+// the event, or isn't used to identify the event in early room versions.
+// A create event must also be signed by the server of the room creator.
+func VerifyEvent(ctx context.Context, event *Event, verifier JSONVerifier) error {
+	if !event.Redacted() {
+		if err := checkEventContentHash(event.eventJSON); err != nil {
+			return fmt.Errorf("gomatrixserverlib: event %q has an invalid content hash: %w", event.EventID(), err)
+		}
+	}
+	if err := event.VerifyEventSignatures(ctx, verifier); err != nil {
+		return err
+	}
+	return verifyCreatorSignature(ctx, event, verifier)
+}
+
+// verifyCreatorSignature checks that a create event was signed by the server
+// of the room creator, who is usually, but not necessarily, the sender. Other
+// events, and create events without a "creator" in their content, as later
+// room versions allow, aren't checked.
+func verifyCreatorSignature(ctx context.Context, e *Event, verifier JSONVerifier) error {
+	if e.Type() != MRoomCreate || !e.StateKeyEquals("") {
+		return nil
+	}
+	creator := gjson.GetBytes(e.Content(), "creator")
+	if creator.Type != gjson.String {
+		return nil
+	}
+	_, creatorServer, err := SplitID('@', creator.Str)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to split creator of create event %q: %w", e.EventID(), err)
+	}
+	if _, senderServer, err := SplitID('@', e.Sender()); err == nil && senderServer == creatorServer {
+		// The sender's server has already been checked.
+		return nil
+	}
+	strictValidityChecking, err := e.roomVersion.StrictValidityChecking()
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to check strict validity checking: %w", err)
+	}
+	redactedJSON, err := RedactEventJSON(e.eventJSON, e.roomVersion)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to redact event: %w", err)
+	}
+	results, err := verifier.VerifyJSONs(ctx, []VerifyJSONRequest{{
+		Message:                redactedJSON,
+		AtTS:                   e.OriginServerTS(),
+		ServerName:             creatorServer,
+		StrictValidityChecking: strictValidityChecking,
+	}})
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to verify JSONs: %w", err)
+	}
+	if results[0].Error != nil {
+		return fmt.Errorf("gomatrixserverlib: create event %q isn't signed by the creator's server %q: %w", e.EventID(), creatorServer, results[0].Error)
+	}
+	return nil
+}
+
 func (e *Event) VerifyEventSignatures(ctx context.Context, verifier JSONVerifier) error {
 	needed := map[ServerName]struct{}{}
 
@@ -178,6 +251,49 @@ func addContentHashesToEvent(eventJSON []byte) ([]byte, error) {
 	return json.Marshal(event)
 }
 
+// VerifyContentHash checks the content hash of the event, under the
+// "hashes.sha256" key. The content hash is the SHA-256 of the full, unredacted
+// event without its "hashes", "signatures" and "unsigned" keys, so it covers
+// all of the content of the event. This is different to the reference hash,
+// see VerifyReferenceHash, and to the signatures, which both cover only the
+// redacted form of the event. The content hash of an event which has been
+// redacted can't be checked, so an error is returned for redacted events.
+func VerifyContentHash(event *Event) error {
+	if event.Redacted() {
+		return fmt.Errorf("gomatrixserverlib: event %q has been redacted, so its content hash can't be checked", event.EventID())
+	}
+	if err := checkEventContentHash(event.eventJSON); err != nil {
+		return fmt.Errorf("gomatrixserverlib: event %q has an invalid content hash: %w", event.EventID(), err)
+	}
+	return nil
+}
+
+// VerifyReferenceHash checks that the event matches a reference to it, e.g.
+// one of the prev_events of another event. The reference hash is the SHA-256
+// of the redacted event without its "signatures" and "unsigned" keys, which
+// is the same as the bytes that are signed, see SigningBytes. Since it only
+// covers the redacted form of the event, the reference hash is unchanged by
+// redaction, unlike the content hash checked by VerifyContentHash. From room
+// version 3 the event ID is worked out from the reference hash. If the
+// reference has no hash, as in later room versions, only the event ID is
+// compared.
+func VerifyReferenceHash(event *Event, reference EventReference) error {
+	computed, err := referenceOfEvent(event.eventJSON, event.roomVersion)
+	if err != nil {
+		return err
+	}
+	if computed.EventID != reference.EventID {
+		return fmt.Errorf("gomatrixserverlib: event %q doesn't match the reference to %q", computed.EventID, reference.EventID)
+	}
+	if len(reference.EventSHA256) > 0 && !bytes.Equal(computed.EventSHA256, reference.EventSHA256) {
+		return fmt.Errorf(
+			"gomatrixserverlib: event %q has the reference hash %q, expected %q",
+			computed.EventID, computed.EventSHA256.Encode(), reference.EventSHA256.Encode(),
+		)
+	}
+	return nil
+}
+
 // checkEventContentHash checks if the unredacted content of the event matches the SHA-256 hash under the "hashes" key.
 // Assumes that eventJSON has been canonicalised already.
 func checkEventContentHash(eventJSON []byte) error {
@@ -206,28 +322,12 @@ func checkEventContentHash(eventJSON []byte) error {
 	return nil
 }
 
-// ReferenceSha256HashOfEvent returns the SHA-256 hash of the redacted event content.
-// This is used when referring to this event from other events.
+// referenceOfEvent returns the SHA-256 hash of the redacted event content.
+// This is used when referring to this event from other events. The hash is
+// computed over a redacted copy of the event JSON, with the signatures and
+// unsigned keys removed, so the given JSON is never modified.
 func referenceOfEvent(eventJSON []byte, roomVersion RoomVersion) (EventReference, error) {
-	redactedJSON, err := RedactEventJSON(eventJSON, roomVersion)
-	if err != nil {
-		return EventReference{}, err
-	}
-
-	var event map[string]RawJSON
-	if err = json.Unmarshal(redactedJSON, &event); err != nil {
-		return EventReference{}, err
-	}
-
-	delete(event, "signatures")
-	delete(event, "unsigned")
-
-	hashableEventJSON, err := json.Marshal(event)
-	if err != nil {
-		return EventReference{}, err
-	}
-
-	hashableEventJSON, err = CanonicalJSON(hashableEventJSON)
+	hashableEventJSON, err := signingBytes(eventJSON, roomVersion)
 	if err != nil {
 		return EventReference{}, err
 	}
@@ -246,22 +346,18 @@ func referenceOfEvent(eventJSON []byte, roomVersion RoomVersion) (EventReference
 
 	switch eventFormat {
 	case EventFormatV1:
-		if err = json.Unmarshal(event["event_id"], &eventID); err != nil {
+		if err = json.Unmarshal([]byte(gjson.GetBytes(hashableEventJSON, "event_id").Raw), &eventID); err != nil {
 			return EventReference{}, err
 		}
 	case EventFormatV2:
-		var encoder *base64.Encoding
 		switch eventIDFormat {
 		case EventIDFormatV2:
-			encoder = base64.RawStdEncoding.WithPadding(base64.NoPadding)
+			eventID = "$" + EncodeBase64StdUnpadded(sha256Hash[:])
 		case EventIDFormatV3:
-			encoder = base64.RawURLEncoding.WithPadding(base64.NoPadding)
+			eventID = "$" + EncodeBase64URLUnpadded(sha256Hash[:])
 		default:
 			return EventReference{}, UnsupportedRoomVersionError{Version: roomVersion}
 		}
-		if encoder != nil {
-			eventID = fmt.Sprintf("$%s", encoder.EncodeToString(sha256Hash[:]))
-		}
 	default:
 		return EventReference{}, UnsupportedRoomVersionError{Version: roomVersion}
 	}
@@ -269,6 +365,48 @@ func referenceOfEvent(eventJSON []byte, roomVersion RoomVersion) (EventReference
 	return EventReference{eventID, sha256Hash[:]}, nil
 }
 
+// SigningBytes returns the bytes which are signed by the servers which sign
+// the event, and which are hashed to make its reference hash. This is the
+// canonical JSON of the event after it has been redacted according to the
+// room version and had its "signatures" and "unsigned" keys removed. It is
+// mostly useful for debugging signature mismatches, as it shows exactly what
+// a remote server must have signed for a signature to be valid. The event
+// itself is never modified, so its signatures can still be checked afterwards.
+func SigningBytes(event *Event, roomVersion RoomVersion) ([]byte, error) {
+	return signingBytes(event.eventJSON, roomVersion)
+}
+
+// StrippedForSigning is an alias of SigningBytes, for callers preparing an
+// event to be signed again: it returns the event with the fields which aren't
+// covered by signatures stripped, while the signatures on the event are kept
+// intact.
+func StrippedForSigning(event *Event, roomVersion RoomVersion) ([]byte, error) {
+	return SigningBytes(event, roomVersion)
+}
+
+// signingBytes returns the redacted canonical JSON of the event without the
+// signatures and unsigned keys. The given JSON is never modified.
+func signingBytes(eventJSON []byte, roomVersion RoomVersion) ([]byte, error) {
+	redactedJSON, err := RedactEventJSON(eventJSON, roomVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	var event map[string]RawJSON
+	if err = json.Unmarshal(redactedJSON, &event); err != nil {
+		return nil, err
+	}
+
+	delete(event, "signatures")
+	delete(event, "unsigned")
+
+	unsorted, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return CanonicalJSON(unsorted)
+}
+
 // SignEvent adds a ED25519 signature to the event for the given key.
 func signEvent(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, eventJSON []byte, roomVersion RoomVersion) ([]byte, error) {
 	// Redact the event before signing so signature that will remain valid even if the event is redacted.
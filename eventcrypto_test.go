@@ -19,9 +19,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"sort"
 	"testing"
+	"time"
 
+	"github.com/tidwall/sjson"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -476,3 +480,406 @@ func TestVerifyAllEventSignaturesForInvite(t *testing.T) {
 		t.Errorf("Verify server 1: got %s, want %s", servers[1], "bobserver")
 	}
 }
+
+func TestEventReferenceDoesNotModifyEvent(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	for _, roomVersion := range []RoomVersion{RoomVersionV1, RoomVersionV10} {
+		event := alice.buildMessage(t, "!room:alice.test", "secret message", roomVersion)
+		originalJSON := append([]byte(nil), event.JSON()...)
+		originalContent := append([]byte(nil), event.Content()...)
+
+		reference := event.EventReference()
+
+		if !bytes.Equal(event.JSON(), originalJSON) {
+			t.Fatalf("room version %s: event JSON changed after computing reference:\n before: %s\n after: %s", roomVersion, originalJSON, event.JSON())
+		}
+		if !bytes.Equal(event.Content(), originalContent) {
+			t.Fatalf("room version %s: event content changed after computing reference:\n before: %s\n after: %s", roomVersion, originalContent, event.Content())
+		}
+		if event.Redacted() {
+			t.Fatalf("room version %s: event was marked as redacted after computing reference", roomVersion)
+		}
+
+		// The reference should be the same as the reference of the redacted
+		// event, since the hash is computed over the redacted form.
+		redactedJSON, err := RedactEventJSON(event.JSON(), roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		redacted, err := NewEventFromTrustedJSON(redactedJSON, true, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := redacted.EventReference(); got.EventID != reference.EventID || !bytes.Equal(got.EventSHA256, reference.EventSHA256) {
+			t.Fatalf("room version %s: got reference %+v for redacted event, want %+v", roomVersion, got, reference)
+		}
+		if bytes.Contains(redacted.JSON(), []byte("secret message")) {
+			t.Fatalf("room version %s: expected redacted JSON not to contain the content", roomVersion)
+		}
+	}
+}
+
+// testServerKeysFetcher is a KeyFetcher which serves the published keys of
+// servers, in the same way that a server's /key/v2/server response would be.
+type testServerKeysFetcher struct {
+	keys []ServerKeys
+}
+
+func (f *testServerKeysFetcher) FetcherName() string {
+	return "testServerKeysFetcher"
+}
+
+func (f *testServerKeysFetcher) FetchKeys(
+	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	for _, keys := range f.keys {
+		mapServerKeysToPublicKeyLookupResult(keys, results)
+	}
+	return results, nil
+}
+
+func TestVerifyEventSignaturesWithRotatedKey(t *testing.T) {
+	oldPublic, oldPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPublic, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rotated := now.Add(-time.Hour * 24 * 180)
+
+	// The server rotated its key six months ago, so the old key is only
+	// published as an old verify key.
+	fetcher := &testServerKeysFetcher{keys: []ServerKeys{{
+		ServerKeyFields: ServerKeyFields{
+			ServerName: "alice.test",
+			VerifyKeys: map[KeyID]VerifyKey{
+				"ed25519:new": {Key: Base64Bytes(newPublic)},
+			},
+			ValidUntilTS: AsTimestamp(now.Add(time.Hour)),
+			OldVerifyKeys: map[KeyID]OldVerifyKey{
+				"ed25519:old": {
+					VerifyKey: VerifyKey{Key: Base64Bytes(oldPublic)},
+					ExpiredTS: AsTimestamp(rotated),
+				},
+			},
+		},
+	}}}
+	keyRing := &KeyRing{
+		KeyFetchers: []KeyFetcher{fetcher},
+		KeyDatabase: &testMemoryKeyDatabase{keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{}},
+	}
+
+	buildAt := func(ts time.Time) *Event {
+		eb := EventBuilder{
+			Sender:     "@alice:alice.test",
+			RoomID:     "!room:alice.test",
+			Type:       "m.room.message",
+			PrevEvents: []string{},
+			AuthEvents: []string{},
+			Depth:      1,
+		}
+		if err = eb.SetContent(map[string]string{"body": "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		event, err := eb.Build(ts, "alice.test", "ed25519:old", oldPrivate, RoomVersionV10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	// An event from a year ago, when the old key was still in use, should
+	// be verified using the old key.
+	if err = buildAt(now.Add(-time.Hour*24*365)).VerifyEventSignatures(context.Background(), keyRing); err != nil {
+		t.Fatalf("expected the year-old event to verify with the rotated key, got: %s", err)
+	}
+	// An event signed with the old key after it was rotated should fail.
+	if err = buildAt(now).VerifyEventSignatures(context.Background(), keyRing); err == nil {
+		t.Fatal("expected an event signed with the old key after it expired to fail")
+	}
+}
+
+// countingVerifier is a JSONVerifier which checks signatures against a fixed
+// set of public keys, counting the number of signatures that it verifies.
+type countingVerifier struct {
+	publicKeys map[ServerName]ed25519.PublicKey
+	verified   int
+}
+
+func (v *countingVerifier) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest) ([]VerifyJSONResult, error) {
+	results := make([]VerifyJSONResult, len(requests))
+	for i, request := range requests {
+		v.verified++
+		results[i].Error = VerifyJSON(string(request.ServerName), "ed25519:test", v.publicKeys[request.ServerName], request.Message)
+	}
+	return results, nil
+}
+
+// testVerifyEvents returns n signed events, every other one of which has had
+// its content tampered with after it was signed.
+func testVerifyEvents(tb testing.TB, n int) ([]*Event, *countingVerifier) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	events := make([]*Event, n)
+	for i := range events {
+		eb := EventBuilder{
+			Sender:     "@alice:alice.test",
+			RoomID:     "!room:alice.test",
+			Type:       "m.room.message",
+			PrevEvents: []string{},
+			AuthEvents: []string{},
+			Depth:      int64(i + 1),
+		}
+		if err = eb.SetContent(map[string]string{"body": fmt.Sprintf("hello %d", i)}); err != nil {
+			tb.Fatal(err)
+		}
+		event, err := eb.Build(time.Now(), "alice.test", "ed25519:test", privateKey, RoomVersionV10)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if i%2 == 1 {
+			if event.eventJSON, err = sjson.SetBytes(event.eventJSON, "content.body", "tampered"); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		events[i] = event
+	}
+	return events, &countingVerifier{publicKeys: map[ServerName]ed25519.PublicKey{"alice.test": publicKey}}
+}
+
+func TestVerifyEvent(t *testing.T) {
+	events, verifier := testVerifyEvents(t, 2)
+	if err := VerifyEvent(context.Background(), events[0], verifier); err != nil {
+		t.Errorf("expected the untampered event to verify: %s", err)
+	}
+	if verifier.verified != 1 {
+		t.Errorf("expected one signature to be verified for the untampered event, got %d", verifier.verified)
+	}
+
+	// The tampered event still has valid signatures, as they only cover the
+	// redacted event, but the content hash doesn't match.
+	verifier.verified = 0
+	if err := events[1].VerifyEventSignatures(context.Background(), verifier); err != nil {
+		t.Errorf("expected the tampered event to have valid signatures: %s", err)
+	}
+	verifier.verified = 0
+	if err := VerifyEvent(context.Background(), events[1], verifier); err == nil {
+		t.Error("expected the tampered event to fail verification")
+	}
+	if verifier.verified != 0 {
+		t.Errorf("expected no signatures to be verified for the tampered event, got %d", verifier.verified)
+	}
+
+	// Once redacted, the event no longer has the content that the hash covers.
+	events[1].Redact()
+	if err := VerifyEvent(context.Background(), events[1], verifier); err != nil {
+		t.Errorf("expected the redacted event to verify: %s", err)
+	}
+}
+
+func BenchmarkVerifyAllEventSignaturesTampered(b *testing.B) {
+	events, verifier := testVerifyEvents(b, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		VerifyAllEventSignatures(context.Background(), events, verifier)
+	}
+	b.ReportMetric(float64(verifier.verified)/float64(b.N), "signatures/op")
+}
+
+func BenchmarkVerifyAllEventsTampered(b *testing.B) {
+	events, verifier := testVerifyEvents(b, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		VerifyAllEvents(context.Background(), events, verifier)
+	}
+	b.ReportMetric(float64(verifier.verified)/float64(b.N), "signatures/op")
+}
+
+func TestSigningBytes(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	event := alice.buildMessage(t, "!room:alice.test", "hello", RoomVersionV10)
+
+	signingBytes, err := SigningBytes(event, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The signing bytes are the redacted form of the event, so the body of
+	// the message isn't covered by them, and neither are the signatures.
+	if bytes.Contains(signingBytes, []byte("hello")) {
+		t.Errorf("expected the content to be redacted from the signing bytes: %s", signingBytes)
+	}
+	if bytes.Contains(signingBytes, []byte(`"signatures"`)) {
+		t.Errorf("expected the signatures to be removed from the signing bytes: %s", signingBytes)
+	}
+	var signed struct {
+		Signatures map[ServerName]map[KeyID]Base64Bytes `json:"signatures"`
+	}
+	if err = json.Unmarshal(event.JSON(), &signed); err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(alice.publicKey, signingBytes, signed.Signatures[alice.serverName][alice.keyID]) {
+		t.Errorf("expected the signature to be valid over the signing bytes: %s", signingBytes)
+	}
+
+	// Adding unsigned data mustn't change what was signed.
+	withUnsigned, err := event.SetUnsigned(map[string]interface{}{"age": 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsignedSigningBytes, err := SigningBytes(withUnsigned, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signingBytes, unsignedSigningBytes) {
+		t.Errorf("signing bytes changed after adding unsigned data\nbefore: %s\nafter:  %s", signingBytes, unsignedSigningBytes)
+	}
+}
+
+func TestStrippedForSigningKeepsSignatures(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	event := alice.buildMessage(t, "!room:alice.test", "hello", RoomVersionV10)
+	original := append([]byte(nil), event.JSON()...)
+
+	stripped, err := StrippedForSigning(event, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingBytes, err := SigningBytes(event, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, signingBytes) {
+		t.Errorf("expected StrippedForSigning to match SigningBytes\ngot:  %s\nwant: %s", stripped, signingBytes)
+	}
+	if bytes.Contains(stripped, []byte(`"signatures"`)) {
+		t.Errorf("expected the signatures to be stripped: %s", stripped)
+	}
+
+	// The source event must be untouched, and still carry its signatures.
+	if !bytes.Equal(event.JSON(), original) {
+		t.Errorf("event was modified\nbefore: %s\nafter:  %s", original, event.JSON())
+	}
+	var signed struct {
+		Signatures map[ServerName]map[KeyID]Base64Bytes `json:"signatures"`
+	}
+	if err = json.Unmarshal(event.JSON(), &signed); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := signed.Signatures[alice.serverName][alice.keyID]; !ok {
+		t.Fatalf("expected the event to keep its signature from %s, got %s", alice.serverName, event.JSON())
+	}
+	if err = VerifyEvent(context.Background(), event, testKeyRingForServers(alice)); err != nil {
+		t.Errorf("expected the event to still verify: %s", err)
+	}
+}
+
+func TestVerifyContentHashAndReferenceHash(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	for _, roomVersion := range []RoomVersion{RoomVersionV1, RoomVersionV10} {
+		event := alice.buildMessage(t, "!room:alice.test", "hello", roomVersion)
+		reference := event.EventReference()
+		if err := VerifyContentHash(event); err != nil {
+			t.Fatalf("room version %s: unexpected content hash error: %s", roomVersion, err)
+		}
+		if err := VerifyReferenceHash(event, reference); err != nil {
+			t.Fatalf("room version %s: unexpected reference hash error: %s", roomVersion, err)
+		}
+
+		// Changing the body of the message changes the full event, so the
+		// content hash no longer matches, but the body isn't part of the
+		// redacted event, so the reference hash is unchanged.
+		tamperedJSON, err := sjson.SetBytes(event.JSON(), "content.body", "tampered")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tampered, err := NewEventFromTrustedJSON(tamperedJSON, false, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = VerifyContentHash(tampered); err == nil {
+			t.Errorf("room version %s: expected the content hash of the tampered event to be invalid", roomVersion)
+		}
+		if err = VerifyReferenceHash(tampered, reference); err != nil {
+			t.Errorf("room version %s: expected the reference hash of the tampered event to be valid: %s", roomVersion, err)
+		}
+
+		// The same is true of redacting the event.
+		redacted, err := NewEventFromTrustedJSON(event.JSON(), false, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		redacted.Redact()
+		if err = VerifyContentHash(redacted); err == nil {
+			t.Errorf("room version %s: expected the content hash of the redacted event not to be checked", roomVersion)
+		}
+		if err = VerifyReferenceHash(redacted, reference); err != nil {
+			t.Errorf("room version %s: expected the reference hash of the redacted event to be valid: %s", roomVersion, err)
+		}
+
+		// Changing a key which is kept by redaction changes the reference hash.
+		tamperedJSON, err = sjson.SetBytes(event.JSON(), "origin_server_ts", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tampered, err = NewEventFromTrustedJSON(tamperedJSON, false, roomVersion); err != nil {
+			t.Fatal(err)
+		}
+		if err = VerifyReferenceHash(tampered, reference); err == nil {
+			t.Errorf("room version %s: expected the reference hash of the event with a changed timestamp to be invalid", roomVersion)
+		}
+	}
+}
+
+func TestVerifyEventCreateSignedByCreator(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	bob := newTestSigningServer(t, "bob.test")
+	keyRing := testKeyRingForServers(alice, bob)
+
+	buildCreate := func(creator string) *Event {
+		stateKey := ""
+		eb := EventBuilder{
+			Sender:     "@alice:alice.test",
+			RoomID:     "!room:alice.test",
+			Type:       MRoomCreate,
+			StateKey:   &stateKey,
+			PrevEvents: []string{},
+			AuthEvents: []string{},
+			Depth:      1,
+		}
+		content := map[string]string{"room_version": string(RoomVersionV10)}
+		if creator != "" {
+			content["creator"] = creator
+		}
+		if err := eb.SetContent(content); err != nil {
+			t.Fatal(err)
+		}
+		event, err := eb.Build(time.Now(), alice.serverName, alice.keyID, alice.privateKey, RoomVersionV10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	if err := VerifyEvent(context.Background(), buildCreate("@alice:alice.test"), keyRing); err != nil {
+		t.Fatalf("expected a create event signed by the creator's server to verify, got %s", err)
+	}
+	// The creator is on bob.test, but only alice.test has signed the event.
+	if err := VerifyEvent(context.Background(), buildCreate("@bob:bob.test"), keyRing); err == nil {
+		t.Fatal("expected a create event not signed by the creator's server to fail verification")
+	}
+	// Only the create event path checks the creator, not the general
+	// signature checks.
+	if err := buildCreate("@bob:bob.test").VerifyEventSignatures(context.Background(), keyRing); err != nil {
+		t.Fatalf("expected the general signature checks not to check the creator, got %s", err)
+	}
+	// Create events without a creator are allowed in later room versions.
+	if err := VerifyEvent(context.Background(), buildCreate(""), keyRing); err != nil {
+		t.Fatalf("expected a create event without a creator to verify, got %s", err)
+	}
+}
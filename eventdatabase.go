@@ -0,0 +1,88 @@
+package gomatrixserverlib
+
+// An EventDatabase looks up events, e.g. from a server's database. It is used
+// by state resolution to look up auth events, and can be used as the auth
+// events for event auth with NewAuthEventsFromDatabase.
+type EventDatabase interface {
+	// GetEvent returns the event with the given ID, or nil if there is no
+	// such event.
+	GetEvent(eventID string) (*Event, error)
+	// GetStateEvent returns the current state event with the given type and
+	// state key, or nil if there is no such event.
+	GetStateEvent(eventType, stateKey string) (*Event, error)
+	// GetEventsByID returns the events with the given IDs. Events which aren't
+	// known are skipped, so fewer events than IDs may be returned.
+	GetEventsByID(eventIDs []string) ([]*Event, error)
+}
+
+// MemoryEventDatabase is an EventDatabase backed by a map of events.
+type MemoryEventDatabase struct {
+	events map[string]*Event
+	state  StateSnapshot
+}
+
+// NewMemoryEventDatabase returns a MemoryEventDatabase containing the given
+// events. If more than one state event has the same (type, state_key) then the
+// last one is returned by GetStateEvent.
+func NewMemoryEventDatabase(events []*Event) *MemoryEventDatabase {
+	return &MemoryEventDatabase{
+		events: eventMapFromEvents(events),
+		state:  NewStateSnapshot(events),
+	}
+}
+
+// GetEvent implements EventDatabase
+func (d *MemoryEventDatabase) GetEvent(eventID string) (*Event, error) {
+	return d.events[eventID], nil
+}
+
+// GetStateEvent implements EventDatabase
+func (d *MemoryEventDatabase) GetStateEvent(eventType, stateKey string) (*Event, error) {
+	return d.state.Event(eventType, stateKey), nil
+}
+
+// GetEventsByID implements EventDatabase
+func (d *MemoryEventDatabase) GetEventsByID(eventIDs []string) ([]*Event, error) {
+	events := make([]*Event, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		if event, ok := d.events[eventID]; ok {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// NewAuthEventsFromDatabase returns an AuthEventProvider which looks up the
+// auth events as state events in the given database.
+func NewAuthEventsFromDatabase(db EventDatabase) AuthEventProvider {
+	return databaseAuthEvents{db}
+}
+
+type databaseAuthEvents struct {
+	db EventDatabase
+}
+
+// Create implements AuthEventProvider
+func (a databaseAuthEvents) Create() (*Event, error) {
+	return a.db.GetStateEvent(MRoomCreate, "")
+}
+
+// JoinRules implements AuthEventProvider
+func (a databaseAuthEvents) JoinRules() (*Event, error) {
+	return a.db.GetStateEvent(MRoomJoinRules, "")
+}
+
+// PowerLevels implements AuthEventProvider
+func (a databaseAuthEvents) PowerLevels() (*Event, error) {
+	return a.db.GetStateEvent(MRoomPowerLevels, "")
+}
+
+// Member implements AuthEventProvider
+func (a databaseAuthEvents) Member(stateKey string) (*Event, error) {
+	return a.db.GetStateEvent(MRoomMember, stateKey)
+}
+
+// ThirdPartyInvite implements AuthEventProvider
+func (a databaseAuthEvents) ThirdPartyInvite(stateKey string) (*Event, error) {
+	return a.db.GetStateEvent(MRoomThirdPartyInvite, stateKey)
+}
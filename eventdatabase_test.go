@@ -0,0 +1,132 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// recordingEventDatabase wraps an EventDatabase and records which events
+// were requested from it.
+type recordingEventDatabase struct {
+	EventDatabase
+	events      []string
+	stateEvents []StateKeyTuple
+}
+
+func (d *recordingEventDatabase) GetEvent(eventID string) (*Event, error) {
+	d.events = append(d.events, eventID)
+	return d.EventDatabase.GetEvent(eventID)
+}
+
+func (d *recordingEventDatabase) GetStateEvent(eventType, stateKey string) (*Event, error) {
+	d.stateEvents = append(d.stateEvents, StateKeyTuple{eventType, stateKey})
+	return d.EventDatabase.GetStateEvent(eventType, stateKey)
+}
+
+func TestMemoryEventDatabase(t *testing.T) {
+	events := getBaseStateResV2Graph()
+	db := NewMemoryEventDatabase(events)
+
+	if event, err := db.GetEvent("$IPOWER:example.com"); err != nil || event == nil || event.Type() != MRoomPowerLevels {
+		t.Fatalf("expected to find the power levels event, got %v (%v)", event, err)
+	}
+	if event, err := db.GetEvent("$MISSING:example.com"); err != nil || event != nil {
+		t.Fatalf("expected no event for an unknown event ID, got %v (%v)", event, err)
+	}
+	if event, err := db.GetStateEvent(MRoomMember, BOB); err != nil || event == nil || event.EventID() != "$IMB:example.com" {
+		t.Fatalf("expected to find the member event for %s, got %v (%v)", BOB, event, err)
+	}
+	got, err := db.GetEventsByID([]string{"$CREATE:example.com", "$MISSING:example.com", "$IJR:example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].EventID() != "$CREATE:example.com" || got[1].EventID() != "$IJR:example.com" {
+		t.Fatalf("expected to get the two known events, got %v", got)
+	}
+}
+
+func TestStateResolutionV2WithEventDatabase(t *testing.T) {
+	input := getBaseStateResV2Graph()
+	conflicted, unconflicted := separate(input)
+	db := &recordingEventDatabase{EventDatabase: NewMemoryEventDatabase(input)}
+
+	result, err := ResolveStateConflictsV2WithOptions(
+		context.Background(), conflicted, unconflicted, input, nil,
+		StateResolutionV2Options{AuthEventDatabase: db},
+	)
+	if err != nil {
+		t.Fatalf("ResolveStateConflictsV2WithOptions failed: %s", err)
+	}
+	if expected := ResolveStateConflictsV2(conflicted, unconflicted, input, nil); len(result) != len(expected) {
+		t.Fatalf("got %d resolved events but expected %d", len(result), len(expected))
+	}
+	if len(db.events) == 0 {
+		t.Fatal("expected the resolver to look up auth events in the database")
+	}
+	known := eventMapFromEvents(input)
+	for _, eventID := range db.events {
+		if _, ok := known[eventID]; !ok {
+			t.Fatalf("resolver looked up unexpected event %q", eventID)
+		}
+	}
+}
+
+// failingEventDatabase is an EventDatabase whose GetEvent always fails.
+type failingEventDatabase struct {
+	EventDatabase
+	err error
+}
+
+func (d *failingEventDatabase) GetEvent(eventID string) (*Event, error) {
+	return nil, d.err
+}
+
+func TestStateResolutionV2EventDatabaseError(t *testing.T) {
+	input := getBaseStateResV2Graph()
+	conflicted, unconflicted := separate(input)
+	dbErr := errors.New("database is unavailable")
+	db := &failingEventDatabase{EventDatabase: NewMemoryEventDatabase(input), err: dbErr}
+
+	result, err := ResolveStateConflictsV2WithOptions(
+		context.Background(), conflicted, unconflicted, input, nil,
+		StateResolutionV2Options{AuthEventDatabase: db},
+	)
+	if !errors.Is(err, dbErr) {
+		t.Fatalf("expected the database error to be returned, got %v", err)
+	}
+	if result != nil {
+		t.Errorf("expected no resolved state alongside the error, got %d events", len(result))
+	}
+}
+
+func TestAuthEventsFromDatabase(t *testing.T) {
+	input := getBaseStateResV2Graph()
+	db := &recordingEventDatabase{EventDatabase: NewMemoryEventDatabase(input)}
+
+	// Bob is joined to the public room, so can send a message.
+	message := &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$MSG:example.com",
+			eventFields: eventFields{
+				RoomID:  "!ROOM:example.com",
+				Type:    "m.room.message",
+				Sender:  BOB,
+				Content: []byte(`{"body":"hello"}`),
+			},
+		},
+	}
+	if err := Allowed(message, NewAuthEventsFromDatabase(db)); err != nil {
+		t.Fatalf("expected the message to be allowed, got: %s", err)
+	}
+	asked := map[StateKeyTuple]bool{}
+	for _, tuple := range db.stateEvents {
+		asked[tuple] = true
+	}
+	for _, want := range []StateKeyTuple{{MRoomCreate, ""}, {MRoomPowerLevels, ""}, {MRoomMember, BOB}} {
+		if !asked[want] {
+			t.Errorf("expected event auth to look up %v, looked up %v", want, db.stateEvents)
+		}
+	}
+}
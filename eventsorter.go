@@ -0,0 +1,25 @@
+package gomatrixserverlib
+
+// An EventSorter sorts events by ascending depth, then by ascending
+// origin_server_ts, then by event ID, using sort.Sort. Since event IDs are
+// unique this always sorts the same set of events into the same order,
+// regardless of the order they were given in.
+type EventSorter []*Event
+
+func (s EventSorter) Len() int {
+	return len(s)
+}
+
+func (s EventSorter) Less(i, j int) bool {
+	if s[i].Depth() != s[j].Depth() {
+		return s[i].Depth() < s[j].Depth()
+	}
+	if s[i].OriginServerTS() != s[j].OriginServerTS() {
+		return s[i].OriginServerTS() < s[j].OriginServerTS()
+	}
+	return s[i].EventID() < s[j].EventID()
+}
+
+func (s EventSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
@@ -0,0 +1,48 @@
+package gomatrixserverlib
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestEventSorter(t *testing.T) {
+	newEvent := func(eventID string, depth int64, ts Timestamp) *Event {
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: eventID,
+				eventFields: eventFields{
+					RoomID:         "!room:test",
+					Type:           "m.room.message",
+					Sender:         "@alice:test",
+					Depth:          depth,
+					OriginServerTS: ts,
+				},
+			},
+		}
+	}
+	events := []*Event{
+		newEvent("$d:test", 2, 100),
+		newEvent("$b:test", 1, 200),
+		// $c and $a have the same depth and timestamp, so they are ordered
+		// by event ID.
+		newEvent("$c:test", 1, 100),
+		newEvent("$a:test", 1, 100),
+		newEvent("$e:test", 2, 50),
+	}
+	want := []string{"$a:test", "$c:test", "$b:test", "$e:test", "$d:test"}
+
+	// Sorting any permutation of the events should give the same order.
+	for i := 0; i < len(events); i++ {
+		shuffled := append(append([]*Event{}, events[i:]...), events[:i]...)
+		sort.Sort(EventSorter(shuffled))
+		got := make([]string, len(shuffled))
+		for j, event := range shuffled {
+			got[j] = event.EventID()
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("rotation %d: got order %v, want %v", i, got, want)
+		}
+	}
+}
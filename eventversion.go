@@ -1,6 +1,10 @@
 package gomatrixserverlib
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 // RoomVersion refers to the room version for a specific room.
 type RoomVersion string
@@ -25,6 +29,10 @@ type JoinRulesPermittingKnockInEventAuth int
 // a room to be joined via a space.
 type JoinRulesPermittingRestrictedJoinInEventAuth int
 
+// RoomFeature refers to a feature of the room format or auth rules which
+// is only available in some room versions.
+type RoomFeature int
+
 // Room version constants. These are strings because the version grammar
 // allows for future expansion.
 // https://matrix.org/docs/spec/#room-version-grammar
@@ -82,6 +90,16 @@ const (
 	RestrictedOrKnockRestricted                                                         // rooms with join_rule "restricted" or "knock_restricted" can be joined via a space
 )
 
+// Room features which can be queried with RoomVersion.Supports.
+const (
+	RoomFeatureKnocking              RoomFeature = iota + 1 // the "knock" membership and join rule
+	RoomFeatureRestrictedJoins                              // the "restricted" join rule
+	RoomFeatureIntegerPowerLevels                           // power levels must be integers, not strings
+	RoomFeatureStateResV2                                   // state resolution v2
+	RoomFeatureUpdatedRedactionRules                        // m.room.aliases content is no longer kept on redaction
+	RoomFeatureExtensibleEvents                             // extensible events (MSC1767)
+)
+
 var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 	RoomVersionV1: {
 		Supported:                       true,
@@ -96,6 +114,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnocksForbidden,
 		allowRestrictedJoinsInEventAuth: NoRestrictedJoins,
 		requireIntegerPowerLevels:       false,
+		authRules:                       &authRulesV1,
 	},
 	RoomVersionV2: {
 		Supported:                       true,
@@ -110,6 +129,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnocksForbidden,
 		allowRestrictedJoinsInEventAuth: NoRestrictedJoins,
 		requireIntegerPowerLevels:       false,
+		authRules:                       &authRulesV1,
 	},
 	RoomVersionV3: {
 		Supported:                       true,
@@ -124,6 +144,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnocksForbidden,
 		allowRestrictedJoinsInEventAuth: NoRestrictedJoins,
 		requireIntegerPowerLevels:       false,
+		authRules:                       &authRulesV1,
 	},
 	RoomVersionV4: {
 		Supported:                       true,
@@ -138,6 +159,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnocksForbidden,
 		allowRestrictedJoinsInEventAuth: NoRestrictedJoins,
 		requireIntegerPowerLevels:       false,
+		authRules:                       &authRulesV1,
 	},
 	RoomVersionV5: {
 		Supported:                       true,
@@ -152,6 +174,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnocksForbidden,
 		allowRestrictedJoinsInEventAuth: NoRestrictedJoins,
 		requireIntegerPowerLevels:       false,
+		authRules:                       &authRulesV1,
 	},
 	RoomVersionV6: {
 		Supported:                       true,
@@ -166,6 +189,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnocksForbidden,
 		allowRestrictedJoinsInEventAuth: NoRestrictedJoins,
 		requireIntegerPowerLevels:       false,
+		authRules:                       &authRulesV1,
 	},
 	RoomVersionV7: {
 		Supported:                       true,
@@ -180,6 +204,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnockOnly,
 		allowRestrictedJoinsInEventAuth: NoRestrictedJoins,
 		requireIntegerPowerLevels:       false,
+		authRules:                       &authRulesV1,
 	},
 	RoomVersionV8: {
 		Supported:                       true,
@@ -194,6 +219,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnocksForbidden,
 		allowRestrictedJoinsInEventAuth: RestrictedOnly,
 		requireIntegerPowerLevels:       false,
+		authRules:                       &authRulesV1,
 	},
 	RoomVersionV9: {
 		Supported:                       true,
@@ -208,6 +234,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnocksForbidden,
 		allowRestrictedJoinsInEventAuth: RestrictedOnly,
 		requireIntegerPowerLevels:       false,
+		authRules:                       &authRulesV1,
 	},
 	RoomVersionV10: {
 		Supported:                       true,
@@ -222,6 +249,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnockOrKnockRestricted,
 		allowRestrictedJoinsInEventAuth: RestrictedOrKnockRestricted,
 		requireIntegerPowerLevels:       true,
+		authRules:                       &authRulesV10,
 	},
 	"org.matrix.msc3667": { // based on room version 7
 		Supported:                       true,
@@ -236,6 +264,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnockOnly,
 		allowRestrictedJoinsInEventAuth: NoRestrictedJoins,
 		requireIntegerPowerLevels:       true,
+		authRules:                       &authRulesV10,
 	},
 	"org.matrix.msc3787": { // roughly, the union of v7 and v9
 		Supported:                       true,
@@ -250,6 +279,7 @@ var roomVersionMeta = map[RoomVersion]RoomVersionDescription{
 		allowKnockingInEventAuth:        KnockOrKnockRestricted,
 		allowRestrictedJoinsInEventAuth: RestrictedOrKnockRestricted,
 		requireIntegerPowerLevels:       false,
+		authRules:                       &authRulesV1,
 	},
 }
 
@@ -283,6 +313,60 @@ func StableRoomVersions() map[RoomVersion]RoomVersionDescription {
 	return versions
 }
 
+// maxRoomVersionLength is the longest that a room version identifier can be.
+// https://spec.matrix.org/v1.4/rooms/#room-version-grammar
+const maxRoomVersionLength = 32
+
+// IsValid returns true if the room version identifier matches the room
+// version grammar, i.e. it is between 1 and 32 characters made up of lower
+// case letters, digits, dots and hyphens. A valid room version isn't
+// necessarily one which is implemented here.
+func (v RoomVersion) IsValid() bool {
+	if len(v) == 0 || len(v) > maxRoomVersionLength {
+		return false
+	}
+	for _, c := range v {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '.' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// IsStable returns true if the room version is implemented here, supported
+// and marked as stable. Unknown room versions are never stable.
+func (v RoomVersion) IsStable() bool {
+	r, ok := roomVersionMeta[v]
+	return ok && r.Supported && r.Stable
+}
+
+// Compare compares two room versions, returning -1 if v sorts before other,
+// 1 if v sorts after other and 0 if they are the same. Numeric room versions
+// are compared numerically, so "2" sorts before "10", and sort before any
+// non-numeric room versions, e.g. unstable ones like "org.matrix.msc3667",
+// which are compared lexicographically.
+func (v RoomVersion) Compare(other RoomVersion) int {
+	a, aErr := strconv.ParseUint(string(v), 10, 64)
+	b, bErr := strconv.ParseUint(string(other), 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		default:
+			return 0
+		}
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	default:
+		return strings.Compare(string(v), string(other))
+	}
+}
+
 // RoomVersionDescription contains information about a given room version, e.g. which
 // state resolution algorithm or event ID format to use.
 // RoomVersionDescription contains information about a room version,
@@ -306,6 +390,11 @@ type RoomVersionDescription struct {
 	enforceCanonicalJSON            bool
 	powerLevelsIncludeNotifications bool
 	requireIntegerPowerLevels       bool
+	extensibleEvents                bool
+	roomIDFromCreateEvent           bool
+	redactsInContent                bool
+	creatorIsSender                 bool
+	authRules                       *AuthRules
 	Supported                       bool
 	Stable                          bool
 }
@@ -426,6 +515,74 @@ func (v RoomVersion) RequireIntegerPowerLevels() (bool, error) {
 	return false, UnsupportedRoomVersionError{v}
 }
 
+// Supports returns true if the given room version supports the feature, or
+// false otherwise. Unknown room versions don't support any features.
+func (v RoomVersion) Supports(feature RoomFeature) bool {
+	r, ok := roomVersionMeta[v]
+	if !ok {
+		return false
+	}
+	switch feature {
+	case RoomFeatureKnocking:
+		return r.allowKnockingInEventAuth != KnocksForbidden
+	case RoomFeatureRestrictedJoins:
+		return r.allowRestrictedJoinsInEventAuth != NoRestrictedJoins
+	case RoomFeatureIntegerPowerLevels:
+		return r.requireIntegerPowerLevels
+	case RoomFeatureStateResV2:
+		return r.stateResAlgorithm == StateResV2
+	case RoomFeatureUpdatedRedactionRules:
+		return r.redactionAlgorithm >= RedactionAlgorithmV2
+	case RoomFeatureExtensibleEvents:
+		return r.extensibleEvents
+	default:
+		return false
+	}
+}
+
+// RoomIDDerivedFromCreateEvent returns true if the given room version derives
+// the room ID from the event ID of the create event, rather than the room ID
+// being chosen by the server which created the room. No room versions which
+// are implemented here do this yet.
+func (v RoomVersion) RoomIDDerivedFromCreateEvent() (bool, error) {
+	if r, ok := roomVersionMeta[v]; ok {
+		return r.roomIDFromCreateEvent, nil
+	}
+	return false, UnsupportedRoomVersionError{v}
+}
+
+// RedactsInContent returns true if redaction events in the given room version
+// carry the ID of the redacted event in the "redacts" key of the content,
+// rather than in the top-level "redacts" key. No room versions which are
+// implemented here do this yet.
+func (v RoomVersion) RedactsInContent() (bool, error) {
+	if r, ok := roomVersionMeta[v]; ok {
+		return r.redactsInContent, nil
+	}
+	return false, UnsupportedRoomVersionError{v}
+}
+
+// CreatorIsSender returns true if the creator of a room in the given room
+// version is the sender of the create event, rather than the "creator" key of
+// its content. No room versions which are implemented here do this yet.
+func (v RoomVersion) CreatorIsSender() (bool, error) {
+	if r, ok := roomVersionMeta[v]; ok {
+		return r.creatorIsSender, nil
+	}
+	return false, UnsupportedRoomVersionError{v}
+}
+
+// AuthRules returns the event auth rules for the given room version.
+func (v RoomVersion) AuthRules() (AuthRules, error) {
+	if r, ok := roomVersionMeta[v]; ok {
+		if r.authRules == nil {
+			return AuthRules{}, nil
+		}
+		return *r.authRules, nil
+	}
+	return AuthRules{}, UnsupportedRoomVersionError{v}
+}
+
 // UnsupportedRoomVersionError occurs when a call has been made with a room
 // version that is not supported by this version of gomatrixserverlib.
 type UnsupportedRoomVersionError struct {
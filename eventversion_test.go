@@ -4,6 +4,36 @@ import (
 	"testing"
 )
 
+// Test room versions for features which none of the implemented room
+// versions have yet. They are registered when the package is initialised,
+// before any tests run, so that tests never write to roomVersionMeta while
+// other tests may be reading from it.
+var (
+	testRoomVersionDerivedRoomIDs = registerTestRoomVersion("org.matrix.test.derived_room_ids", func(d *RoomVersionDescription) {
+		d.roomIDFromCreateEvent = true
+	})
+	testRoomVersionRedactsInContent = registerTestRoomVersion("org.matrix.test.redacts_in_content", func(d *RoomVersionDescription) {
+		d.redactsInContent = true
+	})
+	testRoomVersionCreatorIsSender = registerTestRoomVersion("org.matrix.test.creator_is_sender", func(d *RoomVersionDescription) {
+		d.creatorIsSender = true
+	})
+	testRoomVersionExtensibleEvents = registerTestRoomVersion("org.matrix.test.extensible_events", func(d *RoomVersionDescription) {
+		d.extensibleEvents = true
+	})
+)
+
+// registerTestRoomVersion registers an unstable room version which is a copy
+// of room version 10 changed by the given function. It must only be called
+// while initialising the package.
+func registerTestRoomVersion(version RoomVersion, change func(*RoomVersionDescription)) RoomVersion {
+	description := roomVersionMeta[RoomVersionV10]
+	description.Stable = false
+	change(&description)
+	roomVersionMeta[version] = description
+	return version
+}
+
 func TestEventIDForRoomVersionV1(t *testing.T) {
 	initialEventJSON := `{"auth_events":[["$oXL79cT7fFxR7dPH:localhost",{"sha256":"abjkiDSg1RkuZrbj2jZoGMlQaaj1Ue3Jhi7I7NlKfXY"}],["$IVUsaSkm1LBAZYYh:localhost",{"sha256":"X7RUj46hM/8sUHNBIFkStbOauPvbDzjSdH4NibYWnko"}],["$VS2QT0EeArZYi8wf:localhost",{"sha256":"k9eM6utkCH8vhLW9/oRsH74jOBS/6RVK42iGDFbylno"}]],"content":{"name":"test3"},"depth":7,"event_id":"$yvN1b43rlmcOs5fY:localhost","hashes":{"sha256":"Oh1mwI1jEqZ3tgJ+V1Dmu5nOEGpCE4RFUqyJv2gQXKs"},"origin":"localhost","origin_server_ts":1510854416361,"prev_events":[["$FqI6TVvWpcbcnJ97:localhost",{"sha256":"upCsBqUhNUgT2/+zkzg8TbqdQpWWKQnZpGJc6KcbUC4"}]],"prev_state":[],"room_id":"!19Mp0U9hjajeIiw1:localhost","sender":"@test:localhost","signatures":{"localhost":{"ed25519:u9kP":"5IzSuRXkxvbTp0vZhhXYZeOe+619iG3AybJXr7zfNn/4vHz4TH7qSJVQXSaHHvcTcDodAKHnTG1WDulgO5okAQ"}},"state_key":"","type":"m.room.name"}`
 	expectedEventID := "$yvN1b43rlmcOs5fY:localhost"
@@ -45,3 +75,87 @@ func TestEventIDForRoomVersionV4(t *testing.T) {
 		t.Fatalf("event ID '%s' does not match expected '%s'", event.EventID(), expectedEventID)
 	}
 }
+
+func TestRoomVersionSupports(t *testing.T) {
+	features := []RoomFeature{
+		RoomFeatureKnocking,
+		RoomFeatureRestrictedJoins,
+		RoomFeatureIntegerPowerLevels,
+		RoomFeatureStateResV2,
+		RoomFeatureUpdatedRedactionRules,
+		RoomFeatureExtensibleEvents,
+	}
+	// Each row is in the same order as the features above.
+	matrix := map[RoomVersion][]bool{
+		RoomVersionV1:  {false, false, false, false, false, false},
+		RoomVersionV2:  {false, false, false, true, false, false},
+		RoomVersionV6:  {false, false, false, true, true, false},
+		RoomVersionV7:  {true, false, false, true, true, false},
+		RoomVersionV8:  {false, true, false, true, true, false},
+		RoomVersionV9:  {false, true, false, true, true, false},
+		RoomVersionV10: {true, true, true, true, true, false},
+		"unknown":      {false, false, false, false, false, false},
+	}
+	for roomVersion, want := range matrix {
+		for i, feature := range features {
+			if got := roomVersion.Supports(feature); got != want[i] {
+				t.Errorf("room version %q: Supports(%d) = %v, want %v", roomVersion, feature, got, want[i])
+			}
+		}
+	}
+}
+
+func TestRoomVersionValidity(t *testing.T) {
+	for version, want := range map[RoomVersion]bool{
+		RoomVersionV1:                        true,
+		RoomVersionV10:                       true,
+		"org.matrix.msc3667":                 true,
+		"com.example.custom-version":         true,
+		"":                                   false,
+		"Org.Matrix.MSC3667":                 false,
+		"has space":                          false,
+		"a.very.long.custom.room.version.id": false,
+	} {
+		if got := version.IsValid(); got != want {
+			t.Errorf("room version %q: got IsValid() %v, want %v", version, got, want)
+		}
+	}
+
+	if !RoomVersionV10.IsStable() {
+		t.Error("expected room version 10 to be stable")
+	}
+	if RoomVersion("org.matrix.msc3667").IsStable() {
+		t.Error("expected the unstable room version org.matrix.msc3667 not to be stable")
+	}
+	if RoomVersion("com.example.custom-version").IsStable() {
+		t.Error("expected an unknown room version not to be stable")
+	}
+
+	// Unknown room versions are rejected when parsing events, rather than
+	// causing a panic.
+	eventJSON := []byte(`{"auth_events":[],"content":{},"depth":1,"origin_server_ts":0,"prev_events":[],"room_id":"!room:test","sender":"@alice:test","type":"m.room.message"}`)
+	if _, err := NewEventFromUntrustedJSON(eventJSON, "com.example.custom-version"); err == nil {
+		t.Error("expected an unknown room version to be rejected")
+	} else if _, ok := err.(UnsupportedRoomVersionError); !ok {
+		t.Errorf("expected an UnsupportedRoomVersionError, got %T: %s", err, err)
+	}
+}
+
+func TestRoomVersionCompare(t *testing.T) {
+	tests := []struct {
+		a, b RoomVersion
+		want int
+	}{
+		{RoomVersionV1, RoomVersionV1, 0},
+		{RoomVersionV2, RoomVersionV10, -1},
+		{RoomVersionV10, RoomVersionV9, 1},
+		{RoomVersionV10, "org.matrix.msc3667", -1},
+		{"org.matrix.msc3787", RoomVersionV1, 1},
+		{"org.matrix.msc3667", "org.matrix.msc3787", -1},
+	}
+	for _, test := range tests {
+		if got := test.a.Compare(test.b); got != test.want {
+			t.Errorf("%q.Compare(%q): got %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/gomatrix"
 	"golang.org/x/crypto/ed25519"
@@ -44,12 +46,42 @@ func (ac *FederationClient) doRequest(ctx context.Context, r FederationRequest,
 		return err
 	}
 
-	req, err := r.HTTPRequest()
-	if err != nil {
-		return err
+	destination := r.Destination()
+	if ac.backoffStore != nil {
+		if until := ac.backoffStore.BackoffUntil(destination); time.Now().Before(until) {
+			return BackoffError{Destination: destination, Until: until}
+		}
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if err = sleepContext(ctx, ac.retryPolicy.backoff(attempt)); err != nil {
+				return err
+			}
+		}
+		var req *http.Request
+		if req, err = r.HTTPRequest(); err != nil {
+			return err
+		}
+		err = ac.Client.DoRequestAndParseResponse(ctx, req, resBody)
+		if err == nil || !isTransientError(ctx, err) {
+			break
+		}
+		if attempt >= ac.retryPolicy.MaxRetries {
+			if ac.backoffStore != nil {
+				ac.backoffStore.RecordFailure(destination)
+			}
+			return err
+		}
 	}
 
-	return ac.Client.DoRequestAndParseResponse(ctx, req, resBody)
+	// The destination responded, even if it was with an error, so it doesn't
+	// need to be backed off.
+	if ac.backoffStore != nil && ctx.Err() == nil {
+		ac.backoffStore.RecordSuccess(destination)
+	}
+	return err
 }
 
 var federationPathPrefixV1 = "/_matrix/federation/v1"
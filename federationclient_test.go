@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"golang.org/x/crypto/ed25519"
 )
@@ -147,3 +151,245 @@ func jsonify(x interface{}) string {
 	b, _ := json.Marshal(x)
 	return string(b)
 }
+
+// The purpose of this test is to make sure that a Matrix error returned by the
+// remote server can be inspected by the caller, so that they can branch on the
+// errcode.
+func TestMatrixErrorFromResponse(t *testing.T) {
+	serverName := gomatrixserverlib.ServerName("local.server.name")
+	targetServerName := gomatrixserverlib.ServerName("target.server.name")
+	keyID := gomatrixserverlib.KeyID("ed25519:auto")
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+
+	fc := gomatrixserverlib.NewFederationClient(
+		serverName, keyID, privateKey,
+		gomatrixserverlib.WithSkipVerify(true),
+	)
+	fc.Client = *gomatrixserverlib.NewClient(gomatrixserverlib.WithTransport(
+		&roundTripper{
+			fn: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: 403,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"errcode":"M_FORBIDDEN","error":"You are not invited to this room"}`)),
+				}, nil
+			},
+		},
+	))
+
+	_, err := fc.MakeJoin(
+		context.Background(), targetServerName, "!roomid:target.server.name",
+		"@userid:local.server.name", []gomatrixserverlib.RoomVersion{gomatrixserverlib.RoomVersionV1},
+	)
+	if err == nil {
+		t.Fatal("expected MakeJoin to return an error")
+	}
+	matrixErr, ok := gomatrixserverlib.AsMatrixError(err)
+	if !ok {
+		t.Fatalf("expected a MatrixError, got %T: %s", err, err)
+	}
+	if matrixErr.StatusCode != 403 {
+		t.Errorf("got status code %d, want 403", matrixErr.StatusCode)
+	}
+	if matrixErr.ErrCode != gomatrixserverlib.MatrixErrorForbidden {
+		t.Errorf("got errcode %q, want %q", matrixErr.ErrCode, gomatrixserverlib.MatrixErrorForbidden)
+	}
+	if matrixErr.Err != "You are not invited to this room" {
+		t.Errorf("got error message %q", matrixErr.Err)
+	}
+
+	// Callers which assert the wrapped error directly must keep working.
+	var httpErr gomatrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("expected a gomatrix.HTTPError, got %T: %s", err, err)
+	}
+	respErr, ok := httpErr.WrappedError.(gomatrix.RespError)
+	if !ok {
+		t.Fatalf("expected the HTTP error to wrap a gomatrix.RespError, got %T", httpErr.WrappedError)
+	}
+	if respErr.ErrCode != gomatrixserverlib.MatrixErrorForbidden {
+		t.Errorf("got errcode %q from the RespError, want %q", respErr.ErrCode, gomatrixserverlib.MatrixErrorForbidden)
+	}
+
+	// Errors which don't come from a Matrix error response should not be
+	// mistaken for one.
+	if _, ok := gomatrixserverlib.AsMatrixError(fmt.Errorf("something else")); ok {
+		t.Error("expected a plain error not to be a MatrixError")
+	}
+}
+
+// The purpose of this test is to make sure that transient failures are retried
+// according to the retry policy, and that a destination which keeps failing is
+// backed off.
+func TestFederationClientRetryAndBackoff(t *testing.T) {
+	serverName := gomatrixserverlib.ServerName("local.server.name")
+	targetServerName := gomatrixserverlib.ServerName("target.server.name")
+	keyID := gomatrixserverlib.KeyID("ed25519:auto")
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+
+	var requests, failures int
+	backoffStore := gomatrixserverlib.NewInMemoryBackoffStore(time.Hour, time.Hour)
+	fc := gomatrixserverlib.NewFederationClient(serverName, keyID, privateKey)
+	fc.Client = *gomatrixserverlib.NewClient(
+		gomatrixserverlib.WithRetryPolicy(gomatrixserverlib.RetryPolicy{
+			MaxRetries:     2,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond * 5,
+		}),
+		gomatrixserverlib.WithBackoffStore(backoffStore),
+		gomatrixserverlib.WithTransport(&roundTripper{
+			fn: func(req *http.Request) (*http.Response, error) {
+				requests++
+				if requests <= failures {
+					return &http.Response{
+						StatusCode: 503,
+						Body:       ioutil.NopCloser(strings.NewReader("service unavailable")),
+					}, nil
+				}
+				return &http.Response{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"pdus":{}}`)),
+				}, nil
+			},
+		}),
+	)
+	txn := gomatrixserverlib.Transaction{
+		TransactionID: "retry",
+		Origin:        serverName,
+		Destination:   targetServerName,
+	}
+
+	// Fail twice then succeed, which is within the retry policy.
+	failures = 2
+	if _, err := fc.SendTransaction(context.Background(), txn); err != nil {
+		t.Fatalf("SendTransaction returned an error: %s", err)
+	}
+	if requests != 3 {
+		t.Fatalf("expected 3 requests, got %d", requests)
+	}
+	if until := backoffStore.BackoffUntil(targetServerName); !until.IsZero() {
+		t.Fatalf("expected the destination not to be backed off, got %s", until)
+	}
+
+	// Fail more times than the retry policy allows, which should back off the
+	// destination so that the next request isn't sent at all.
+	requests, failures = 0, 10
+	if _, err := fc.SendTransaction(context.Background(), txn); err == nil {
+		t.Fatal("expected SendTransaction to fail")
+	}
+	if requests != 3 {
+		t.Fatalf("expected 3 requests, got %d", requests)
+	}
+	_, err := fc.SendTransaction(context.Background(), txn)
+	if _, ok := err.(gomatrixserverlib.BackoffError); !ok {
+		t.Fatalf("expected a BackoffError, got %v", err)
+	}
+	if requests != 3 {
+		t.Fatalf("expected no request to a backed off destination, got %d requests", requests)
+	}
+}
+
+// The purpose of this test is to make sure that concurrent requests to the same
+// destination never exceed the configured per-destination limit.
+func TestFederationClientLimitsConcurrentRequestsPerDestination(t *testing.T) {
+	serverName := gomatrixserverlib.ServerName("local.server.name")
+	targetServerName := gomatrixserverlib.ServerName("target.server.name")
+	keyID := gomatrixserverlib.KeyID("ed25519:auto")
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+
+	const limit = 2
+	var mutex sync.Mutex
+	var inFlight, maxInFlight int
+	fc := gomatrixserverlib.NewFederationClient(serverName, keyID, privateKey)
+	fc.Client = *gomatrixserverlib.NewClient(
+		gomatrixserverlib.WithMaxConcurrentRequestsPerDestination(limit),
+		gomatrixserverlib.WithTransport(&roundTripper{
+			fn: func(req *http.Request) (*http.Response, error) {
+				mutex.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mutex.Unlock()
+				time.Sleep(time.Millisecond * 10)
+				mutex.Lock()
+				inFlight--
+				mutex.Unlock()
+				return &http.Response{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"pdus":{}}`)),
+				}, nil
+			},
+		}),
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := fc.SendTransaction(context.Background(), gomatrixserverlib.Transaction{
+				TransactionID: gomatrixserverlib.TransactionID(fmt.Sprintf("limit%d", i)),
+				Origin:        serverName,
+				Destination:   targetServerName,
+			})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("SendTransaction returned an error: %s", err)
+		}
+	}
+	if maxInFlight > limit {
+		t.Fatalf("expected at most %d concurrent requests, got %d", limit, maxInFlight)
+	}
+	if maxInFlight < limit {
+		t.Fatalf("expected requests to run concurrently up to the limit of %d, got %d", limit, maxInFlight)
+	}
+
+	// A request which can't get a slot before its context is done should fail
+	// with the context error rather than waiting forever.
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	fc.Client = *gomatrixserverlib.NewClient(
+		gomatrixserverlib.WithMaxConcurrentRequestsPerDestination(1),
+		gomatrixserverlib.WithTransport(&roundTripper{
+			fn: func(req *http.Request) (*http.Response, error) {
+				started <- struct{}{}
+				<-block
+				return &http.Response{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"pdus":{}}`)),
+				}, nil
+			},
+		}),
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = fc.SendTransaction(context.Background(), gomatrixserverlib.Transaction{
+			TransactionID: "blocking", Origin: serverName, Destination: targetServerName,
+		})
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err := fc.SendTransaction(ctx, gomatrixserverlib.Transaction{
+		TransactionID: "waiting", Origin: serverName, Destination: targetServerName,
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Key requests share the same limit as federation requests.
+	keyCtx, keyCancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer keyCancel()
+	if _, err = fc.GetServerKeys(keyCtx, targetServerName); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded for a key request, got %v", err)
+	}
+	close(block)
+	<-done
+}
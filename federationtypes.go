@@ -492,6 +492,73 @@ func (r RespSendJoin) ToRespState() RespState {
 	}
 }
 
+// BuildSendJoinResponse builds a response to a /send_join request from the
+// state of the room before the join event and the auth chain of that state.
+// The join event is included in the response, as is needed for restricted
+// joins. Returns an error if the auth chain is not complete for the state
+// and the join event, since the joining server would have no way to
+// authenticate the state otherwise.
+func BuildSendJoinResponse(origin ServerName, state, authChain []*Event, joinEvent *Event) (RespSendJoin, error) {
+	if err := CheckAuthChainComplete(append([]*Event{joinEvent}, state...), authChain); err != nil {
+		return RespSendJoin{}, err
+	}
+	return RespSendJoin{
+		StateEvents: NewEventJSONsFromEvents(state),
+		AuthEvents:  NewEventJSONsFromEvents(authChain),
+		Origin:      origin,
+		Event:       joinEvent.JSON(),
+	}, nil
+}
+
+// CheckAuthChainComplete checks that every auth event referenced by the given
+// events, or by the events in the auth chain, is either one of the events or
+// is in the auth chain. Returns an error naming the first missing auth event.
+func CheckAuthChainComplete(events, authChain []*Event) error {
+	known := make(map[string]bool, len(events)+len(authChain))
+	for _, list := range [][]*Event{events, authChain} {
+		for _, event := range list {
+			known[event.EventID()] = true
+		}
+	}
+	for _, list := range [][]*Event{events, authChain} {
+		for _, event := range list {
+			if _, missingAuth := MissingReferences(event, known); len(missingAuth) > 0 {
+				return fmt.Errorf(
+					"gomatrixserverlib: auth chain is missing auth event %q of event %q",
+					missingAuth[0], event.EventID(),
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyResolvedState checks that the given state, e.g. the state returned in
+// a response to /send_join, is consistent with the auth chain: every state
+// event must be in the given room version and be allowed by the auth events it
+// references, which are looked up in the state and the auth chain. Signatures
+// aren't checked. Returns an error describing the first event that fails.
+func VerifyResolvedState(state, authChain []*Event, version RoomVersion) error {
+	eventsByID := make(map[string]*Event, len(state)+len(authChain))
+	for _, list := range [][]*Event{state, authChain} {
+		for _, event := range list {
+			eventsByID[event.EventID()] = event
+		}
+	}
+	for _, event := range state {
+		if event.Version() != version {
+			return fmt.Errorf(
+				"gomatrixserverlib: state event %q has room version %q, expected %q",
+				event.EventID(), event.Version(), version,
+			)
+		}
+		if err := checkAllowedByAuthEvents(event, eventsByID, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Check that a response to /send_join is valid. If it is then it
 // returns a reference to the RespState that contains the room state
 // excluding any events that failed signature checks.
@@ -590,6 +657,7 @@ type RespProfile struct {
 
 func checkAllowedByAuthEvents(event *Event, eventsByID map[string]*Event, missingAuth AuthChainProvider) error {
 	authEvents := NewAuthEvents(nil)
+	found := make([]*Event, 0, len(event.AuthEventIDs()))
 
 	for _, ae := range event.AuthEventIDs() {
 	retryEvent:
@@ -628,6 +696,7 @@ func checkAllowedByAuthEvents(event *Event, eventsByID map[string]*Event, missin
 			if err := authEvents.AddEvent(authEvent); err != nil {
 				return err
 			}
+			found = append(found, authEvent)
 		} else {
 			// We had an entry in the map but it contains nil, which means that we tried
 			// to use the AuthChainProvider to retrieve it and failed, so at this point
@@ -637,7 +706,15 @@ func checkAllowedByAuthEvents(event *Event, eventsByID map[string]*Event, missin
 	}
 
 	// If we made it this far then we've successfully got as many of the auth events as
-	// as described by AuthEventIDs(). Check if they allow the event.
+	// as described by AuthEventIDs(). Check that they are the right events to
+	// auth the event with, since the provider only keeps one event for each
+	// type and state key, and then check if they allow the event.
+	if err := ValidateAuthEvents(event, found); err != nil {
+		return fmt.Errorf(
+			"gomatrixserverlib: event with ID %q has invalid auth_events: %w",
+			event.EventID(), err,
+		)
+	}
 	if err := Allowed(event, &authEvents); err != nil {
 		return fmt.Errorf(
 			"gomatrixserverlib: event with ID %q is not allowed by its auth_events: %s",
@@ -159,3 +159,95 @@ func TestRespSendJoinMarshalJSONPartialState(t *testing.T) {
 		t.Errorf("json.Marshal(%+v):\n  wanted: '%s'\n     got: '%s'", input, wantJSON, got)
 	}
 }
+
+func TestBuildSendJoinResponse(t *testing.T) {
+	parse := func(eventJSON string) *Event {
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	create := parse(`{"auth_events":[],"content":{"creator":"@alice:test"},"depth":1,"event_id":"$create:test","origin":"test","origin_server_ts":0,"prev_events":[],"room_id":"!room:test","sender":"@alice:test","state_key":"","type":"m.room.create"}`)
+	alice := parse(`{"auth_events":[["$create:test",{}]],"content":{"membership":"join"},"depth":2,"event_id":"$alice:test","origin":"test","origin_server_ts":0,"prev_events":[["$create:test",{}]],"room_id":"!room:test","sender":"@alice:test","state_key":"@alice:test","type":"m.room.member"}`)
+	power := parse(`{"auth_events":[["$create:test",{}],["$alice:test",{}]],"content":{"users":{"@alice:test":100}},"depth":3,"event_id":"$power:test","origin":"test","origin_server_ts":0,"prev_events":[["$alice:test",{}]],"room_id":"!room:test","sender":"@alice:test","state_key":"","type":"m.room.power_levels"}`)
+	bob := parse(`{"auth_events":[["$create:test",{}],["$power:test",{}]],"content":{"membership":"join"},"depth":4,"event_id":"$bob:test","origin":"other","origin_server_ts":0,"prev_events":[["$power:test",{}]],"room_id":"!room:test","sender":"@bob:other","state_key":"@bob:other","type":"m.room.member"}`)
+
+	state := []*Event{create, alice, power}
+	res, err := BuildSendJoinResponse("test", state, []*Event{create, alice}, bob)
+	if err != nil {
+		t.Fatalf("expected a complete auth chain to be accepted, got: %s", err)
+	}
+	if len(res.StateEvents) != 3 || len(res.AuthEvents) != 2 {
+		t.Errorf("got %d state events and %d auth events, want 3 and 2", len(res.StateEvents), len(res.AuthEvents))
+	}
+	if res.Origin != "test" || string(res.Event) != string(bob.JSON()) {
+		t.Errorf("got origin %q and event %s, want %q and the join event", res.Origin, res.Event, "test")
+	}
+
+	// Without the create event the auth references of the state events, and
+	// of the join event, can't be satisfied.
+	if _, err = BuildSendJoinResponse("test", []*Event{alice, power}, []*Event{alice}, bob); err == nil {
+		t.Fatal("expected an auth chain missing the create event to be rejected")
+	}
+	// The join event's auth events must be covered too.
+	if _, err = BuildSendJoinResponse("test", []*Event{create, alice}, []*Event{create}, bob); err == nil {
+		t.Fatal("expected an auth chain missing the join event's auth events to be rejected")
+	}
+}
+
+func TestVerifyResolvedState(t *testing.T) {
+	parse := func(eventJSON string) *Event {
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	create := parse(`{"auth_events":[],"content":{"creator":"@alice:test"},"depth":1,"event_id":"$create:test","origin":"test","origin_server_ts":0,"prev_events":[],"room_id":"!room:test","sender":"@alice:test","state_key":"","type":"m.room.create"}`)
+	alice := parse(`{"auth_events":[["$create:test",{}]],"content":{"membership":"join"},"depth":2,"event_id":"$alice:test","origin":"test","origin_server_ts":0,"prev_events":[["$create:test",{}]],"room_id":"!room:test","sender":"@alice:test","state_key":"@alice:test","type":"m.room.member"}`)
+	power := parse(`{"auth_events":[["$create:test",{}],["$alice:test",{}]],"content":{"users":{"@alice:test":100}},"depth":3,"event_id":"$power:test","origin":"test","origin_server_ts":0,"prev_events":[["$alice:test",{}]],"room_id":"!room:test","sender":"@alice:test","state_key":"","type":"m.room.power_levels"}`)
+	// Bob has never joined the room, so isn't allowed to set the topic.
+	topic := parse(`{"auth_events":[["$create:test",{}],["$power:test",{}]],"content":{"topic":"hijacked"},"depth":4,"event_id":"$topic:test","origin":"other","origin_server_ts":0,"prev_events":[["$power:test",{}]],"room_id":"!room:test","sender":"@bob:other","state_key":"","type":"m.room.topic"}`)
+
+	authChain := []*Event{create, alice}
+	if err := VerifyResolvedState([]*Event{create, alice, power}, authChain, RoomVersionV1); err != nil {
+		t.Fatalf("expected consistent state to be accepted, got: %s", err)
+	}
+	err := VerifyResolvedState([]*Event{create, alice, power, topic}, authChain, RoomVersionV1)
+	if err == nil {
+		t.Fatal("expected state containing an unauthorised event to be rejected")
+	}
+	if !strings.Contains(err.Error(), topic.EventID()) {
+		t.Errorf("expected the error to name %q, got: %s", topic.EventID(), err)
+	}
+	if err = VerifyResolvedState([]*Event{create, alice, power}, authChain, RoomVersionV2); err == nil {
+		t.Fatal("expected state in the wrong room version to be rejected")
+	}
+}
+
+func TestCheckAllowedByAuthEventsDuplicatePowerLevels(t *testing.T) {
+	eventsByID := map[string]*Event{}
+	parse := func(eventJSON string) *Event {
+		event, err := NewEventFromTrustedJSON(RawJSON(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventsByID[event.EventID()] = event
+		return event
+	}
+	parse(`{"type":"m.room.create","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e1:a","content":{"creator":"@u1:a"}}`)
+	parse(`{"type":"m.room.member","state_key":"@u1:a","sender":"@u1:a","room_id":"!r1:a","event_id":"$e2:a","content":{"membership":"join"}}`)
+	parse(`{"type":"m.room.power_levels","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e3:a","content":{"users":{"@u1:a":100}}}`)
+	parse(`{"type":"m.room.power_levels","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e4:a","content":{"users":{"@u1:a":50}}}`)
+	message := parse(`{"type":"m.room.message","sender":"@u1:a","room_id":"!r1:a","event_id":"$e5:a","content":{"body":"hello"},"auth_events":[["$e1:a",{}],["$e2:a",{}],["$e3:a",{}]]}`)
+	duplicate := parse(`{"type":"m.room.message","sender":"@u1:a","room_id":"!r1:a","event_id":"$e6:a","content":{"body":"hello"},"auth_events":[["$e1:a",{}],["$e2:a",{}],["$e3:a",{}],["$e4:a",{}]]}`)
+
+	if err := checkAllowedByAuthEvents(message, eventsByID, nil); err != nil {
+		t.Errorf("expected the message to be allowed by its auth events, got: %s", err)
+	}
+	err := checkAllowedByAuthEvents(duplicate, eventsByID, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid auth_events") {
+		t.Errorf("expected a message with two power level auth events to be rejected, got: %v", err)
+	}
+}
@@ -1,8 +1,10 @@
 package gomatrixserverlib
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 
 	"github.com/tidwall/gjson"
 )
@@ -74,12 +76,86 @@ func (i *InviteV2Request) RoomVersion() RoomVersion {
 	return i.fields.RoomVersion
 }
 
+// CheckInviteRoomVersion checks that the room version of the invite is one of
+// the given supported room versions, returning an UnsupportedRoomVersionError
+// if it isn't, so that invites to rooms which the server can't participate in
+// can be rejected early. If supported is nil then all of the room versions
+// supported by gomatrixserverlib are allowed.
+func CheckInviteRoomVersion(req InviteV2Request, supported []RoomVersion) error {
+	version := req.RoomVersion()
+	if supported == nil {
+		if ver, ok := SupportedRoomVersions()[version]; ok && ver.Supported {
+			return nil
+		}
+		return UnsupportedRoomVersionError{Version: version}
+	}
+	for _, v := range supported {
+		if v == version {
+			return nil
+		}
+	}
+	return UnsupportedRoomVersionError{Version: version}
+}
+
 // InviteRoomState returns stripped state events for the room, containing
 // enough information for the client to identify the room.
 func (i *InviteV2Request) InviteRoomState() []InviteV2StrippedState {
 	return i.fields.InviteRoomState
 }
 
+// VerifyInviteV2Response checks the invite event returned by the invited
+// server in response to a v2 /invite request. The event must be an invite
+// sent by a user on the inviting server to a user on the invited server, and
+// must carry valid signatures from both servers at the time of the event.
+func VerifyInviteV2Response(ctx context.Context, event *Event, inviter, invitee ServerName, verifier JSONVerifier) error {
+	if event.Type() != MRoomMember || event.StateKey() == nil {
+		return fmt.Errorf("gomatrixserverlib: invite event %q is not a m.room.member event", event.EventID())
+	}
+	if membership, err := event.Membership(); err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to get membership of invite event: %w", err)
+	} else if membership != Invite {
+		return fmt.Errorf("gomatrixserverlib: invite event %q has membership %q", event.EventID(), membership)
+	}
+	if _, senderDomain, err := SplitID('@', event.Sender()); err != nil {
+		return err
+	} else if senderDomain != inviter {
+		return fmt.Errorf("gomatrixserverlib: invite event %q was sent from %q, expected %q", event.EventID(), senderDomain, inviter)
+	}
+	if _, targetDomain, err := SplitID('@', *event.StateKey()); err != nil {
+		return err
+	} else if targetDomain != invitee {
+		return fmt.Errorf("gomatrixserverlib: invite event %q is for a user on %q, expected %q", event.EventID(), targetDomain, invitee)
+	}
+
+	strictValidityChecking, err := event.roomVersion.StrictValidityChecking()
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to check strict validity checking: %w", err)
+	}
+	redactedJSON, err := RedactEventJSON(event.eventJSON, event.roomVersion)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to redact event: %w", err)
+	}
+	requests := make([]VerifyJSONRequest, 0, 2)
+	for _, serverName := range []ServerName{inviter, invitee} {
+		requests = append(requests, VerifyJSONRequest{
+			ServerName:             serverName,
+			AtTS:                   event.OriginServerTS(),
+			Message:                redactedJSON,
+			StrictValidityChecking: strictValidityChecking,
+		})
+	}
+	results, err := verifier.VerifyJSONs(ctx, requests)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to verify invite signatures: %w", err)
+	}
+	for i, result := range results {
+		if result.Error != nil {
+			return fmt.Errorf("gomatrixserverlib: invite event %q has no valid signature from %q: %w", event.EventID(), requests[i].ServerName, result.Error)
+		}
+	}
+	return nil
+}
+
 // InviteV2StrippedState is a cut-down set of fields from room state
 // events that allow the invited server to identify the room.
 type InviteV2StrippedState struct {
@@ -101,6 +177,37 @@ func NewInviteV2StrippedState(event *Event) (ss InviteV2StrippedState) {
 	return
 }
 
+// DefaultStrippedStateTypes are the state events which are included in the
+// stripped state of an invite by StrippedState when no types are given. These
+// are enough for a client to display the room to the invited user.
+var DefaultStrippedStateTypes = []StateKeyTuple{
+	{MRoomCreate, ""},
+	{MRoomName, ""},
+	{MRoomAvatar, ""},
+	{MRoomTopic, ""},
+	{MRoomJoinRules, ""},
+	{MRoomCanonicalAlias, ""},
+	{MRoomEncryption, ""},
+}
+
+// StrippedState returns stripped state events for each of the given types
+// which are present in the room state, in the order that the types are given.
+// If types is nil then DefaultStrippedStateTypes is used. Callers can include
+// other state, e.g. m.room.pinned_events or space state, by passing their own
+// list of types.
+func StrippedState(state StateSnapshot, types []StateKeyTuple) []InviteV2StrippedState {
+	if types == nil {
+		types = DefaultStrippedStateTypes
+	}
+	stripped := make([]InviteV2StrippedState, 0, len(types))
+	for _, tuple := range types {
+		if event, ok := state[tuple]; ok && event != nil {
+			stripped = append(stripped, NewInviteV2StrippedState(event))
+		}
+	}
+	return stripped
+}
+
 // MarshalJSON implements json.Marshaller
 func (i InviteV2StrippedState) MarshalJSON() ([]byte, error) {
 	return json.Marshal(i.fields)
@@ -1,8 +1,12 @@
 package gomatrixserverlib
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"reflect"
 	"testing"
+	"time"
 )
 
 const TestInviteV2ExampleEvent = `{"_room_version":"1","auth_events":[["$oXL79cT7fFxR7dPH:localhost",{"sha256":"abjkiDSg1RkuZrbj2jZoGMlQaaj1Ue3Jhi7I7NlKfXY"}],["$IVUsaSkm1LBAZYYh:localhost",{"sha256":"X7RUj46hM/8sUHNBIFkStbOauPvbDzjSdH4NibYWnko"}],["$VS2QT0EeArZYi8wf:localhost",{"sha256":"k9eM6utkCH8vhLW9/oRsH74jOBS/6RVK42iGDFbylno"}]],"content":{"name":"test3"},"depth":7,"event_id":"$yvN1b43rlmcOs5fY:localhost","hashes":{"sha256":"Oh1mwI1jEqZ3tgJ+V1Dmu5nOEGpCE4RFUqyJv2gQXKs"},"origin":"localhost","origin_server_ts":1510854416361,"prev_events":[["$FqI6TVvWpcbcnJ97:localhost",{"sha256":"upCsBqUhNUgT2/+zkzg8TbqdQpWWKQnZpGJc6KcbUC4"}]],"prev_state":[],"room_id":"!19Mp0U9hjajeIiw1:localhost","sender":"@test:localhost","signatures":{"localhost":{"ed25519:u9kP":"5IzSuRXkxvbTp0vZhhXYZeOe+619iG3AybJXr7zfNn/4vHz4TH7qSJVQXSaHHvcTcDodAKHnTG1WDulgO5okAQ"}},"state_key":"","type":"m.room.name"}`
@@ -55,3 +59,148 @@ func TestStrippedState(t *testing.T) {
 		t.Fatalf("got %q, expected %q", string(j), expected)
 	}
 }
+
+func TestStrippedStateTypes(t *testing.T) {
+	events := getBaseStateResV2Graph()
+	events = append(events, &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$PINNED:example.com",
+			eventFields: eventFields{
+				RoomID:         "!ROOM:example.com",
+				Type:           "m.room.pinned_events",
+				OriginServerTS: 7,
+				Sender:         ALICE,
+				StateKey:       &emptyStateKey,
+				Content:        []byte(`{"pinned": ["$IMA:example.com"]}`),
+			},
+		},
+	})
+	snapshot := NewStateSnapshot(events)
+
+	typesOf := func(stripped []InviteV2StrippedState) []string {
+		var types []string
+		for _, s := range stripped {
+			types = append(types, s.Type())
+		}
+		return types
+	}
+
+	// The base graph only has a create event and join rules from the default set.
+	got := typesOf(StrippedState(snapshot, nil))
+	want := []string{MRoomCreate, MRoomJoinRules}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got default stripped state %v, want %v", got, want)
+	}
+
+	// A custom list should be returned in order, skipping missing state.
+	got = typesOf(StrippedState(snapshot, []StateKeyTuple{
+		{"m.room.pinned_events", ""},
+		{MRoomName, ""},
+		{MRoomCreate, ""},
+		{MRoomMember, BOB},
+	}))
+	want = []string{"m.room.pinned_events", MRoomCreate, MRoomMember}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got custom stripped state %v, want %v", got, want)
+	}
+
+	// An empty, non-nil list includes nothing.
+	if stripped := StrippedState(snapshot, []StateKeyTuple{}); len(stripped) != 0 {
+		t.Fatalf("expected no stripped state for an empty type list, got %v", typesOf(stripped))
+	}
+}
+
+func TestVerifyInviteV2Response(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	bob := newTestSigningServer(t, "bob.test")
+	keyRing := testKeyRingForServers(alice, bob)
+
+	bobID := "@bob:bob.test"
+	eb := EventBuilder{
+		Sender:     "@alice:alice.test",
+		RoomID:     "!room:alice.test",
+		Type:       MRoomMember,
+		StateKey:   &bobID,
+		PrevEvents: []string{},
+		AuthEvents: []string{},
+		Depth:      1,
+	}
+	if err := eb.SetContent(map[string]string{"membership": Invite}); err != nil {
+		t.Fatal(err)
+	}
+	invite, err := eb.Build(time.Now(), alice.serverName, alice.keyID, alice.privateKey, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := invite.Sign(string(bob.serverName), bob.keyID, bob.privateKey)
+
+	ctx := context.Background()
+	if err = VerifyInviteV2Response(ctx, &signed, alice.serverName, bob.serverName, keyRing); err != nil {
+		t.Fatalf("expected the double-signed invite to be accepted, got: %s", err)
+	}
+	// The invite hasn't been signed by the invited server yet.
+	if err = VerifyInviteV2Response(ctx, invite, alice.serverName, bob.serverName, keyRing); err == nil {
+		t.Fatal("expected an invite without the invited server's signature to be rejected")
+	}
+	// The invite isn't for a user on the given server.
+	if err = VerifyInviteV2Response(ctx, &signed, alice.serverName, "charlie.test", keyRing); err == nil {
+		t.Fatal("expected an invite for a user on a different server to be rejected")
+	}
+}
+
+func TestStrippedStateMemberReason(t *testing.T) {
+	ban, err := NewEventFromTrustedJSON([]byte(`{"auth_events":[],"content":{"membership":"ban","reason":"spamming"},"depth":5,"event_id":"$ban:test","origin":"test","origin_server_ts":0,"prev_events":[],"room_id":"!room:test","sender":"@alice:test","state_key":"@bob:other","type":"m.room.member"}`), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := NewMemberContentFromEvent(ban)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.Membership != Ban || content.Reason != "spamming" {
+		t.Fatalf("got membership %q with reason %q, want %q with reason %q", content.Membership, content.Reason, Ban, "spamming")
+	}
+
+	// The reason must survive a round trip through stripped state.
+	j, err := json.Marshal(NewInviteV2StrippedState(ban))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stripped InviteV2StrippedState
+	if err = json.Unmarshal(j, &stripped); err != nil {
+		t.Fatal(err)
+	}
+	var strippedContent MemberContent
+	if err = json.Unmarshal(stripped.Content(), &strippedContent); err != nil {
+		t.Fatal(err)
+	}
+	if strippedContent.Membership != Ban || strippedContent.Reason != "spamming" {
+		t.Errorf("got stripped membership %q with reason %q, want %q with reason %q", strippedContent.Membership, strippedContent.Reason, Ban, "spamming")
+	}
+}
+
+func TestCheckInviteRoomVersion(t *testing.T) {
+	var event Event
+	if err := json.Unmarshal([]byte(TestInviteV2ExampleEvent), &event); err != nil {
+		t.Fatal(err)
+	}
+	req, err := NewInviteV2Request(event.Headered(RoomVersionV1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckInviteRoomVersion(req, nil); err != nil {
+		t.Errorf("expected room version 1 to be supported by default, got %s", err)
+	}
+	if err = CheckInviteRoomVersion(req, []RoomVersion{RoomVersionV1, RoomVersionV6}); err != nil {
+		t.Errorf("expected room version 1 to be supported, got %s", err)
+	}
+	err = CheckInviteRoomVersion(req, []RoomVersion{RoomVersionV6, RoomVersionV10})
+	var unsupported UnsupportedRoomVersionError
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("expected an UnsupportedRoomVersionError, got %v", err)
+	}
+	if unsupported.Version != RoomVersionV1 {
+		t.Errorf("got unsupported version %q, want %q", unsupported.Version, RoomVersionV1)
+	}
+}
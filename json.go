@@ -18,8 +18,10 @@ package gomatrixserverlib
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"sort"
 	"strings"
+	"unicode/utf16"
 	"unicode/utf8"
 
 	"github.com/tidwall/gjson"
@@ -80,18 +82,70 @@ func NewEventJSONsFromEvents(he []*Event) EventJSONs {
 // At present this function performs:
 // * shortest encoding, sorted lexicographically by UTF-8 codepoint:
 //   https://matrix.org/docs/spec/appendices#canonical-json
-// Returns a gomatrixserverlib.BadJSONError if JSON validation fails.
+// Returns a gomatrixserverlib.BadJSONError if JSON validation fails, or if the
+// JSON is nested more than DefaultCanonicalJSONMaxDepth levels deep.
 func CanonicalJSON(input []byte) ([]byte, error) {
+	return CanonicalJSONWithMaxDepth(input, DefaultCanonicalJSONMaxDepth)
+}
+
+// DefaultCanonicalJSONMaxDepth is the maximum number of nested objects and
+// arrays allowed in the input to CanonicalJSON.
+const DefaultCanonicalJSONMaxDepth = 100
+
+// ErrJSONTooDeep is wrapped in the BadJSONError returned when the input to
+// CanonicalJSON or NewEventFromUntrustedJSON is nested too deeply.
+var ErrJSONTooDeep = errors.New("JSON is nested too deeply")
+
+// CanonicalJSONWithMaxDepth is the same as CanonicalJSON, but allows the JSON
+// to be nested at most maxDepth levels deep. Canonicalising the JSON recurses
+// into each nested object and array, so limiting the depth stops deeply
+// nested input from exhausting the stack.
+func CanonicalJSONWithMaxDepth(input []byte, maxDepth int) ([]byte, error) {
 	if !gjson.Valid(string(input)) {
 		return nil, BadJSONError{errors.New("gjson validation failed")}
 	}
+	if jsonDepthExceeds(input, maxDepth) {
+		return nil, BadJSONError{fmt.Errorf("%w: more than %d levels", ErrJSONTooDeep, maxDepth)}
+	}
 
 	return CanonicalJSONAssumeValid(input), nil
 }
 
+// jsonDepthExceeds returns true if the objects and arrays in the JSON are
+// nested more than maxDepth levels deep. The input doesn't have to be valid
+// JSON, since it is only scanned for brackets outside of strings.
+func jsonDepthExceeds(input []byte, maxDepth int) bool {
+	depth := 0
+	inString := false
+	for i := 0; i < len(input); i++ {
+		if inString {
+			switch input[i] {
+			case '\\':
+				i++ // Skip the escaped character.
+			case '"':
+				inString = false
+			}
+			continue
+		}
+		switch input[i] {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > maxDepth {
+				return true
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return false
+}
+
 // Returns a gomatrixserverlib.BadJSONError if the canonical JSON fails enforced
 // checks or if JSON validation fails. At present this function performs:
-// * integer bounds checking for room version 6 and above:
+// * integer bounds checking, and rejecting numbers which aren't written as
+//   integers, for room version 6 and above:
 //   https://matrix.org/docs/spec/rooms/v6#canonical-json
 // * shortest encoding, sorted lexicographically by UTF-8 codepoint:
 //   https://matrix.org/docs/spec/appendices#canonical-json
@@ -125,6 +179,14 @@ func verifyEnforcedCanonicalJSON(input []byte) error {
 			valid = false
 			return false
 		}
+		// Numbers written with an exponent, e.g. 1e10, or as -0 aren't
+		// canonical integers. They are rejected rather than rewritten, as
+		// rewriting them would change the canonical JSON of events which are
+		// already signed.
+		if value.Type == gjson.Number && (strings.ContainsAny(value.Raw, "eE") || value.Raw == "-0") {
+			valid = false
+			return false
+		}
 		return true
 	}
 	res.ForEach(iter)
@@ -135,12 +197,24 @@ func verifyEnforcedCanonicalJSON(input []byte) error {
 }
 
 // CanonicalJSONAssumeValid is the same as CanonicalJSON, but assumes the
-// input is valid JSON
+// input is valid JSON. This skips the validation pass, so it should only be
+// used for bytes that are already known to be valid, e.g. because they were
+// produced by json.Marshal. The output for invalid input is undefined.
 func CanonicalJSONAssumeValid(input []byte) []byte {
 	input = CompactJSON(input, make([]byte, 0, len(input)))
 	return SortJSON(input, make([]byte, 0, len(input)))
 }
 
+// MustCanonicalJSON is the same as CanonicalJSON, but panics if the input
+// is not valid JSON. It is intended for tests and for encoding constant JSON.
+func MustCanonicalJSON(input []byte) []byte {
+	output, err := CanonicalJSON(input)
+	if err != nil {
+		panic(err)
+	}
+	return output
+}
+
 // SortJSON reencodes the JSON with the object keys sorted by lexicographically
 // by codepoint. The input must be valid JSON.
 func SortJSON(input, output []byte) []byte {
@@ -307,6 +381,21 @@ func compactUnicodeEscape(input, output []byte, index int) ([]byte, int) {
 	// Decode the 4 hex digits.
 	c := readHexDigits(input[index : index+4])
 	index += 4
+	if utf16.IsSurrogate(rune(c)) {
+		// Characters outside of the basic multilingual plane are escaped as
+		// a UTF-16 surrogate pair, e.g. "\ud83d\ude00", which must be decoded
+		// together. Lone surrogates can't be encoded as UTF-8 so we leave the
+		// escape in place.
+		if len(input)-index >= 6 && input[index] == '\\' && input[index+1] == 'u' {
+			c2 := readHexDigits(input[index+2 : index+6])
+			if r := utf16.DecodeRune(rune(c), rune(c2)); r != utf8.RuneError {
+				var buffer [4]byte
+				n := utf8.EncodeRune(buffer[:], r)
+				return append(output, buffer[:n]...), index + 6
+			}
+		}
+		return append(output, input[index-6:index]...), index
+	}
 	if c < ' ' {
 		// If the character is less than SPACE 0x20 then it will need escaping.
 		escape := ESCAPES[c]
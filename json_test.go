@@ -17,7 +17,9 @@ package gomatrixserverlib
 
 import (
 	"encoding/json"
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -112,6 +114,173 @@ func TestCompactJSON(t *testing.T) {
 	testCompactJSON(t, `["\"\\\/"]`, `["\"\\/"]`)
 }
 
+func testCanonicalJSON(t *testing.T, input, want string) {
+	got, err := CanonicalJSON([]byte(input))
+	if err != nil {
+		t.Errorf("CanonicalJSON(%q): unexpected error: %s", input, err)
+		return
+	}
+	if string(got) != want {
+		t.Errorf("CanonicalJSON(%q):\n want: %q\n got: %q", input, want, string(got))
+	}
+}
+
+func TestCanonicalJSONSpecVectors(t *testing.T) {
+	// The examples from https://spec.matrix.org/v1.4/appendices/#canonical-json
+	testCanonicalJSON(t, `{}`, `{}`)
+	testCanonicalJSON(t, `{
+		"one": 1,
+		"two": "Two"
+	}`, `{"one":1,"two":"Two"}`)
+	testCanonicalJSON(t, `{
+		"b": "2",
+		"a": "1"
+	}`, `{"a":"1","b":"2"}`)
+	testCanonicalJSON(t, `{"b":"2","a":"1"}`, `{"a":"1","b":"2"}`)
+	testCanonicalJSON(t, `{
+		"auth": {
+			"success": true,
+			"mxid": "@john.doe:example.com",
+			"profile": {
+				"display_name": "John Doe",
+				"three_pids": [
+					{
+						"medium": "email",
+						"address": "john.doe@example.org"
+					},
+					{
+						"medium": "msisdn",
+						"address": "123456789"
+					}
+				]
+			}
+		}
+	}`, `{"auth":{"mxid":"@john.doe:example.com","profile":{"display_name":"John Doe","three_pids":[{"address":"john.doe@example.org","medium":"email"},{"address":"123456789","medium":"msisdn"}]},"success":true}}`)
+	testCanonicalJSON(t, `{
+		"a": "日本語"
+	}`, `{"a":"日本語"}`)
+	testCanonicalJSON(t, `{
+		"本": 2,
+		"日": 1
+	}`, `{"日":1,"本":2}`)
+	testCanonicalJSON(t, `{
+		"a": "\u65E5"
+	}`, `{"a":"日"}`)
+	testCanonicalJSON(t, `{
+		"a": null
+	}`, `{"a":null}`)
+	// The spec also gives {"a": -0, "b": 1e10} as {"a":0,"b":10000000000}.
+	// Numbers aren't rewritten, so that the canonical JSON of events which
+	// are already signed doesn't change, see TestCanonicalJSONNumbers.
+}
+
+func TestCanonicalJSONUnicode(t *testing.T) {
+	// Characters outside of the basic multilingual plane are escaped as UTF-16
+	// surrogate pairs and must be decoded as a single character.
+	testCanonicalJSON(t, `{"a":"\ud83d\ude00"}`, `{"a":"😀"}`)
+	testCanonicalJSON(t, `{"a":"\uD83D\uDE00x"}`, `{"a":"😀x"}`)
+	testCanonicalJSON(t, `{"a":"😀"}`, `{"a":"😀"}`)
+	// Lone surrogates can't be encoded as UTF-8 so are left escaped.
+	testCanonicalJSON(t, `{"a":"\ud83d"}`, `{"a":"\ud83d"}`)
+	testCanonicalJSON(t, `{"a":"\ud83dx"}`, `{"a":"\ud83dx"}`)
+	// Keys are sorted by codepoint, which is the same as sorting by UTF-8 bytes.
+	testCanonicalJSON(t, `{"😀":1,"日":2,"a":3}`, `{"a":3,"日":2,"😀":1}`)
+}
+
+func TestCanonicalJSONNumbers(t *testing.T) {
+	// Numbers are left as they are, since rewriting them would break the
+	// signatures and hashes of existing events which contain them.
+	testCanonicalJSON(t, `[1E2,-1e+2,2.5e1,1e-2,1.5,-0,0,-1]`, `[1E2,-1e+2,2.5e1,1e-2,1.5,-0,0,-1]`)
+	testCanonicalJSON(t, `[1e300]`, `[1e300]`)
+
+	// Room versions which enforce canonical JSON reject numbers which aren't
+	// written as canonical integers instead.
+	for _, input := range []string{`{"a":1e10}`, `{"a":1E2}`, `{"a":1e-2}`, `{"a":-0}`} {
+		if _, err := EnforcedCanonicalJSON([]byte(input), RoomVersionV5); err != nil {
+			t.Errorf("EnforcedCanonicalJSON(%q) in room version 5: unexpected error: %s", input, err)
+		}
+		if _, err := EnforcedCanonicalJSON([]byte(input), RoomVersionV6); err == nil {
+			t.Errorf("EnforcedCanonicalJSON(%q) in room version 6: expected an error", input)
+		}
+	}
+	if _, err := EnforcedCanonicalJSON([]byte(`{"a":0,"b":-1,"c":10000000000}`), RoomVersionV6); err != nil {
+		t.Errorf("EnforcedCanonicalJSON: unexpected error for canonical integers: %s", err)
+	}
+}
+
+var canonicalJSONTestInputs = []string{
+	`{}`,
+	`{"b":"2","a":"1"}`,
+	`{ "one" : 1, "two" : [ true, false, null ] }`,
+	`{"a":"\u65E5","b":{"d":-0,"c":1e10}}`,
+	`{"a":"\ud83d\ude00","😀":1,"日":2}`,
+	`[1E2,-1e+2,2.5e1,1e-2,1.5]`,
+}
+
+func TestCanonicalJSONAssumeValid(t *testing.T) {
+	for _, input := range canonicalJSONTestInputs {
+		want, err := CanonicalJSON([]byte(input))
+		if err != nil {
+			t.Fatalf("CanonicalJSON(%q): unexpected error: %s", input, err)
+		}
+		if got := CanonicalJSONAssumeValid([]byte(input)); string(got) != string(want) {
+			t.Errorf("CanonicalJSONAssumeValid(%q):\n want: %q\n got: %q", input, string(want), string(got))
+		}
+		if got := MustCanonicalJSON([]byte(input)); string(got) != string(want) {
+			t.Errorf("MustCanonicalJSON(%q):\n want: %q\n got: %q", input, string(want), string(got))
+		}
+	}
+}
+
+func TestMustCanonicalJSONPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected MustCanonicalJSON to panic on invalid JSON")
+		}
+	}()
+	MustCanonicalJSON([]byte(`{"a":`))
+}
+
+func TestCanonicalJSONMaxDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		return []byte(strings.Repeat(`{"a":[`, depth) + `1` + strings.Repeat(`]}`, depth))
+	}
+	// Each level of nesting here is an object and an array.
+	if _, err := CanonicalJSON(nested(DefaultCanonicalJSONMaxDepth / 2)); err != nil {
+		t.Fatalf("expected JSON at the maximum depth to be accepted, got %s", err)
+	}
+	_, err := CanonicalJSON(nested(DefaultCanonicalJSONMaxDepth/2 + 1))
+	if !errors.Is(err, ErrJSONTooDeep) {
+		t.Fatalf("expected ErrJSONTooDeep for JSON beyond the maximum depth, got %v", err)
+	}
+	if _, ok := err.(BadJSONError); !ok {
+		t.Errorf("expected a BadJSONError, got %T", err)
+	}
+	if _, err = CanonicalJSONWithMaxDepth(nested(2), 3); err == nil {
+		t.Error("expected JSON beyond a custom maximum depth to be rejected")
+	}
+	// Brackets inside strings, including after escaped quotes, don't count.
+	if _, err = CanonicalJSONWithMaxDepth([]byte(`{"a":"[[[\"[[[{{{"}`), 1); err != nil {
+		t.Errorf("expected brackets in strings to be ignored, got %s", err)
+	}
+}
+
+func BenchmarkCanonicalJSON(b *testing.B) {
+	input := []byte(canonicalJSONTestInputs[3])
+	for i := 0; i < b.N; i++ {
+		if _, err := CanonicalJSON(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCanonicalJSONAssumeValid(b *testing.B) {
+	input := []byte(canonicalJSONTestInputs[3])
+	for i := 0; i < b.N; i++ {
+		CanonicalJSONAssumeValid(input)
+	}
+}
+
 func testReadHex(t *testing.T, input string, want uint32) {
 	got := readHexDigits([]byte(input))
 	if want != got {
@@ -126,6 +126,41 @@ type KeyRing struct {
 	KeyDatabase KeyDatabase
 }
 
+// KeyRingMetrics can be used with KeyRing.WithMetrics to observe how often the
+// keys needed to verify JSON are found in the key database, and how often they
+// have to be fetched from other servers instead.
+type KeyRingMetrics interface {
+	// CacheHits is called with the number of keys that were found in the key
+	// database and didn't need to be fetched again.
+	CacheHits(count int)
+	// CacheMisses is called with the number of keys that weren't in the key
+	// database, or that were out of date, and so had to be fetched.
+	CacheMisses(count int)
+	// KeysFetched is called with the name of a key fetcher and the number of
+	// keys it fetched. The notary flag is true if the keys were fetched from
+	// a notary server rather than directly from the servers they belong to.
+	KeysFetched(fetcher string, notary bool, count int)
+	// FetchError is called with the name of a key fetcher which failed to
+	// fetch keys, along with the error.
+	FetchError(fetcher string, notary bool, err error)
+}
+
+// A NotaryKeyFetcher is a KeyFetcher which reports whether it fetches keys
+// from a notary server rather than from the servers the keys belong to. Key
+// fetchers which don't implement it are treated as fetching keys directly.
+type NotaryKeyFetcher interface {
+	KeyFetcher
+	// IsNotary returns true if the fetcher fetches keys from a notary server.
+	IsNotary() bool
+}
+
+// isNotaryFetcher returns true if the fetcher fetches keys from a notary
+// server rather than from the servers the keys belong to.
+func isNotaryFetcher(fetcher KeyFetcher) bool {
+	notary, ok := fetcher.(NotaryKeyFetcher)
+	return ok && notary.IsNotary()
+}
+
 // A VerifyJSONRequest is a request to check for a signature on a JSON message.
 // A JSON message is valid for a server if the message has at least one valid
 // signature from that server.
@@ -159,7 +194,30 @@ type JSONVerifier interface {
 }
 
 // VerifyJSONs implements JSONVerifier.
-func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest) ([]VerifyJSONResult, error) { // nolint: gocyclo
+func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest) ([]VerifyJSONResult, error) {
+	return k.verifyJSONs(ctx, requests, nil)
+}
+
+// WithMetrics returns a JSONVerifier which verifies JSON using the key ring,
+// reporting how the keys were found to the metrics hooks.
+func (k KeyRing) WithMetrics(metrics KeyRingMetrics) JSONVerifier {
+	return meteredKeyRing{k, metrics}
+}
+
+// meteredKeyRing is a KeyRing which reports to metrics hooks.
+type meteredKeyRing struct {
+	keyRing KeyRing
+	metrics KeyRingMetrics
+}
+
+// VerifyJSONs implements JSONVerifier.
+func (m meteredKeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest) ([]VerifyJSONResult, error) {
+	return m.keyRing.verifyJSONs(ctx, requests, m.metrics)
+}
+
+// verifyJSONs verifies the JSON messages, reporting how the keys were found
+// to the metrics hooks if they aren't nil.
+func (k KeyRing) verifyJSONs(ctx context.Context, requests []VerifyJSONRequest, metrics KeyRingMetrics) ([]VerifyJSONResult, error) { // nolint: gocyclo
 	logger := util.GetLogger(ctx)
 	results := make([]VerifyJSONResult, len(requests))
 	keyIDs := make([][]KeyID, len(requests))
@@ -201,6 +259,7 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 		// This will happen if all the objects are missing supported signatures.
 		return results, nil
 	}
+	numKeyRequests := len(keyRequests)
 	keysFromDatabase, err := k.KeyDatabase.FetchKeys(ctx, keyRequests)
 	if err != nil {
 		return nil, err
@@ -223,6 +282,10 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 			delete(keyRequests, req)
 		}
 	}
+	if metrics != nil {
+		metrics.CacheHits(numKeyRequests - len(keyRequests))
+		metrics.CacheMisses(len(keyRequests))
+	}
 
 	if len(keysFetched) == numRequests {
 		// If our key requests are all satisfied then we can try performing
@@ -261,8 +324,14 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 		fetched, err := fetcher.FetchKeys(ctx, keyRequests)
 		if err != nil {
 			fetcherLogger.WithError(err).Warn("Failed to request keys from fetcher")
+			if metrics != nil {
+				metrics.FetchError(fetcher.FetcherName(), isNotaryFetcher(fetcher), err)
+			}
 			continue
 		}
+		if metrics != nil {
+			metrics.KeysFetched(fetcher.FetcherName(), isNotaryFetcher(fetcher), len(fetched))
+		}
 
 		if len(fetched) == 0 {
 			fetcherLogger.Warn("Failed to retrieve any keys")
@@ -380,6 +449,11 @@ func (p PerspectiveKeyFetcher) FetcherName() string {
 	return fmt.Sprintf("perspective server %s", p.PerspectiveServerName)
 }
 
+// IsNotary implements NotaryKeyFetcher
+func (p PerspectiveKeyFetcher) IsNotary() bool {
+	return true
+}
+
 // FetchKeys implements KeyFetcher
 func (p *PerspectiveKeyFetcher) FetchKeys(
 	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
@@ -489,9 +563,9 @@ func (d *DirectKeyFetcher) FetchKeys(
 	worker := func(ch <-chan ServerName) {
 		defer wait.Done()
 		for server := range ch {
-			serverResults, err := d.fetchKeysForServer(ctx, server)
+			serverResults, err := d.fetchKeysForServer(ctx, server, byServer[server])
 			if err != nil {
-				serverResults, err = d.fetchNotaryKeysForServer(ctx, server)
+				serverResults, err = d.fetchNotaryKeysForServer(ctx, server, byServer[server])
 				if err != nil {
 					// TODO: Should we actually be erroring here? or should we just drop those keys from the result map?
 					fetcherLogger.WithError(err).Error("Failed to fetch key for server")
@@ -518,7 +592,7 @@ func (d *DirectKeyFetcher) FetchKeys(
 }
 
 func (d *DirectKeyFetcher) fetchKeysForServer(
-	ctx context.Context, serverName ServerName,
+	ctx context.Context, serverName ServerName, requests map[PublicKeyLookupRequest]Timestamp,
 ) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
 	defer cancel()
@@ -534,6 +608,9 @@ func (d *DirectKeyFetcher) fetchKeysForServer(
 	if !checks.AllChecksOK {
 		return nil, fmt.Errorf("gomatrixserverlib: key response direct from %q failed checks", serverName)
 	}
+	if err = checkRequestedKeyIDs(keys, requests); err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib: key response direct from %q: %w", serverName, err)
+	}
 
 	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
 
@@ -545,7 +622,7 @@ func (d *DirectKeyFetcher) fetchKeysForServer(
 }
 
 func (d *DirectKeyFetcher) fetchNotaryKeysForServer(
-	ctx context.Context, serverName ServerName,
+	ctx context.Context, serverName ServerName, requests map[PublicKeyLookupRequest]Timestamp,
 ) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
 	defer cancel()
@@ -573,6 +650,9 @@ func (d *DirectKeyFetcher) fetchNotaryKeysForServer(
 	if !checks.AllChecksOK {
 		return nil, fmt.Errorf("gomatrixserverlib: notary key response direct from %q failed checks", serverName)
 	}
+	if err = checkRequestedKeyIDs(keys, requests); err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib: notary key response direct from %q: %w", serverName, err)
+	}
 
 	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
 
@@ -583,6 +663,26 @@ func (d *DirectKeyFetcher) fetchNotaryKeysForServer(
 	return results, nil
 }
 
+// checkRequestedKeyIDs checks that the server keys include each of the key IDs
+// that were requested, either as a current key or as an old key. CheckKeys has
+// already checked that the response is signed by each of the current keys.
+// Requests with an empty key ID are for any key, so they aren't checked.
+func checkRequestedKeyIDs(keys ServerKeys, requests map[PublicKeyLookupRequest]Timestamp) error {
+	for req := range requests {
+		if req.KeyID == "" {
+			continue
+		}
+		if _, ok := keys.VerifyKeys[req.KeyID]; ok {
+			continue
+		}
+		if _, ok := keys.OldVerifyKeys[req.KeyID]; ok {
+			continue
+		}
+		return fmt.Errorf("response doesn't contain the requested key %q", req.KeyID)
+	}
+	return nil
+}
+
 // mapServerKeysToPublicKeyLookupResult takes the (verified) result from a
 // /key/v2/query call and inserts it into a PublicKeyLookupRequest->PublicKeyLookupResult
 // map.
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 var privateKeySeed1 = `QJvXAPj0D9MUb1exkD8pIWmCvT1xajlsB8jRYz/G5HE`
@@ -351,3 +353,176 @@ func (e *erroringKeyDatabase) StoreKeys(
 ) error {
 	return &testErrorStore
 }
+
+// testKeyClient is a KeyClient which serves the same keys both directly and
+// through the notary lookup.
+type testKeyClient struct {
+	keys ServerKeys
+}
+
+func (c *testKeyClient) GetServerKeys(ctx context.Context, matrixServer ServerName) (ServerKeys, error) {
+	return c.keys, nil
+}
+
+func (c *testKeyClient) LookupServerKeys(
+	ctx context.Context, matrixServer ServerName, keyRequests map[PublicKeyLookupRequest]Timestamp,
+) ([]ServerKeys, error) {
+	return []ServerKeys{c.keys}, nil
+}
+
+func TestDirectKeyFetcherChecksRequestedKeyIDs(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := SignServerKeys(ServerKeys{
+		ServerKeyFields: ServerKeyFields{
+			ServerName:   "alice.test",
+			VerifyKeys:   map[KeyID]VerifyKey{"ed25519:new": {Key: Base64Bytes(publicKey)}},
+			ValidUntilTS: AsTimestamp(time.Now().Add(time.Hour)),
+		},
+	}, "alice.test", "ed25519:new", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := &DirectKeyFetcher{Client: &testKeyClient{keys: keys}}
+	now := AsTimestamp(time.Now())
+
+	requested := PublicKeyLookupRequest{ServerName: "alice.test", KeyID: "ed25519:new"}
+	results, err := fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{requested: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := results[requested]; !ok {
+		t.Errorf("expected the requested key to be fetched, got %v", results)
+	}
+
+	// The server no longer has the key that we asked for, so the response
+	// must be rejected rather than trusted for the keys it does have.
+	missing := PublicKeyLookupRequest{ServerName: "alice.test", KeyID: "ed25519:old"}
+	results, err = fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{missing: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Errorf("expected no keys from a response missing the requested key, got %v", results)
+	}
+}
+
+// testKeyRingMetrics records the calls made to the KeyRingMetrics hooks.
+type testKeyRingMetrics struct {
+	hits, misses int
+	fetched      map[string]int
+	notary       map[string]bool
+	errors       map[string]error
+}
+
+func (m *testKeyRingMetrics) CacheHits(count int)   { m.hits += count }
+func (m *testKeyRingMetrics) CacheMisses(count int) { m.misses += count }
+
+func (m *testKeyRingMetrics) KeysFetched(fetcher string, notary bool, count int) {
+	m.fetched[fetcher] += count
+	m.notary[fetcher] = notary
+}
+
+func (m *testKeyRingMetrics) FetchError(fetcher string, notary bool, err error) {
+	m.errors[fetcher] = err
+	m.notary[fetcher] = notary
+}
+
+// testNotaryKeyFetcher wraps a KeyFetcher and reports it as a notary.
+type testNotaryKeyFetcher struct {
+	KeyFetcher
+}
+
+func (f testNotaryKeyFetcher) IsNotary() bool { return true }
+
+func TestIsNotaryFetcher(t *testing.T) {
+	perspective := &PerspectiveKeyFetcher{PerspectiveServerName: "notary.test"}
+	for _, tc := range []struct {
+		name    string
+		fetcher KeyFetcher
+		want    bool
+	}{
+		{"perspective fetcher", perspective, true},
+		{"direct fetcher", &DirectKeyFetcher{}, false},
+		{"wrapped fetcher reporting a notary", testNotaryKeyFetcher{&DirectKeyFetcher{}}, true},
+		{"wrapped fetcher not reporting a notary", struct{ KeyFetcher }{perspective}, false},
+	} {
+		if got := isNotaryFetcher(tc.fetcher); got != tc.want {
+			t.Errorf("%s: got notary %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestKeyRingMetrics(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := SignServerKeys(ServerKeys{
+		ServerKeyFields: ServerKeyFields{
+			ServerName:   "alice.test",
+			VerifyKeys:   map[KeyID]VerifyKey{"ed25519:new": {Key: Base64Bytes(publicKey)}},
+			ValidUntilTS: AsTimestamp(time.Now().Add(time.Hour)),
+		},
+	}, "alice.test", "ed25519:new", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := SignJSON("alice.test", "ed25519:new", privateKey, []byte(`{"hello":"world"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The notary doesn't have any keys that we trust, so its responses are
+	// rejected and the keys have to be fetched directly instead.
+	notary := &PerspectiveKeyFetcher{
+		PerspectiveServerName: "notary.test",
+		Client:                &testKeyClient{keys: keys},
+	}
+	direct := &DirectKeyFetcher{Client: &testKeyClient{keys: keys}}
+	metrics := &testKeyRingMetrics{
+		fetched: map[string]int{},
+		notary:  map[string]bool{},
+		errors:  map[string]error{},
+	}
+	k := KeyRing{
+		KeyFetchers: []KeyFetcher{notary, direct},
+		KeyDatabase: &testMemoryKeyDatabase{keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{}},
+	}
+	verifier := k.WithMetrics(metrics)
+	verify := func() {
+		results, err := verifier.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
+			ServerName: "alice.test",
+			Message:    message,
+			AtTS:       AsTimestamp(time.Now()),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Error != nil {
+			t.Fatalf("expected the message to verify, got %s", results[0].Error)
+		}
+	}
+
+	verify()
+	if metrics.hits != 0 || metrics.misses != 1 {
+		t.Errorf("got %d cache hits and %d misses, want 0 and 1", metrics.hits, metrics.misses)
+	}
+	if metrics.errors[notary.FetcherName()] == nil || !metrics.notary[notary.FetcherName()] {
+		t.Errorf("expected a notary fetch error for %q, got %v", notary.FetcherName(), metrics.errors)
+	}
+	if metrics.fetched[direct.FetcherName()] != 1 || metrics.notary[direct.FetcherName()] {
+		t.Errorf("expected 1 key to be fetched directly by %q, got %v", direct.FetcherName(), metrics.fetched)
+	}
+
+	// The key is now in the database, so it doesn't need to be fetched again.
+	verify()
+	if metrics.hits != 1 || metrics.misses != 1 {
+		t.Errorf("got %d cache hits and %d misses, want 1 and 1", metrics.hits, metrics.misses)
+	}
+	if metrics.fetched[direct.FetcherName()] != 1 {
+		t.Errorf("expected no more keys to be fetched, got %v", metrics.fetched)
+	}
+}
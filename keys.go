@@ -17,8 +17,9 @@ package gomatrixserverlib
 
 import (
 	"encoding/json"
-	"strings"
 	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 // ServerKeys are the ed25519 signing keys published by a matrix server.
@@ -88,6 +89,27 @@ func (keys ServerKeys) PublicKey(keyID KeyID, atTS Timestamp) []byte {
 	return nil
 }
 
+// SignServerKeys signs the server keys published by another server with the
+// given key, e.g. when acting as a notary server. The existing signatures on
+// the keys are preserved so that the result carries both the signatures of the
+// origin server and of the notary.
+// https://matrix.org/docs/spec/server_server/latest#querying-keys-through-another-server
+func SignServerKeys(keys ServerKeys, serverName ServerName, keyID KeyID, key ed25519.PrivateKey) (ServerKeys, error) {
+	raw, err := keys.MarshalJSON()
+	if err != nil {
+		return ServerKeys{}, err
+	}
+	signed, err := SignJSON(string(serverName), keyID, key, raw)
+	if err != nil {
+		return ServerKeys{}, err
+	}
+	var result ServerKeys
+	if err = json.Unmarshal(signed, &result); err != nil {
+		return ServerKeys{}, err
+	}
+	return result, nil
+}
+
 // Ed25519Checks are the checks that are applied to Ed25519 keys in ServerKey responses.
 type Ed25519Checks struct {
 	ValidEd25519      bool // The verify key is valid Ed25519 keys.
@@ -131,7 +153,7 @@ func checkVerifyKeys(keys ServerKeys, checks *KeyChecks) map[KeyID]Base64Bytes {
 	checks.Ed25519Checks = map[KeyID]Ed25519Checks{}
 	verifyKeys := map[KeyID]Base64Bytes{}
 	for keyID, keyData := range keys.VerifyKeys {
-		algorithm := strings.SplitN(string(keyID), ":", 2)[0]
+		algorithm := keyID.Algorithm()
 		publicKey := keyData.Key
 		if algorithm == "ed25519" {
 			checks.HasEd25519Key = true
@@ -0,0 +1,67 @@
+package gomatrixserverlib
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestSignServerKeys(t *testing.T) {
+	originPublic, originPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notaryPublic, notaryPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build and sign the keys as the origin server would publish them.
+	fields := ServerKeyFields{
+		ServerName:   "origin.test",
+		VerifyKeys:   map[KeyID]VerifyKey{"ed25519:origin": {Key: Base64Bytes(originPublic)}},
+		ValidUntilTS: AsTimestamp(time.Now().Add(time.Hour)),
+	}
+	unsigned, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignJSON("origin.test", "ed25519:origin", originPrivate, unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys ServerKeys
+	if err = json.Unmarshal(signed, &keys); err != nil {
+		t.Fatal(err)
+	}
+
+	notarised, err := SignServerKeys(keys, "notary.test", "ed25519:notary", notaryPrivate)
+	if err != nil {
+		t.Fatalf("failed to sign server keys: %s", err)
+	}
+	if err = VerifyJSON("origin.test", "ed25519:origin", originPublic, notarised.Raw); err != nil {
+		t.Errorf("origin signature is not valid on notarised keys: %s", err)
+	}
+	if err = VerifyJSON("notary.test", "ed25519:notary", notaryPublic, notarised.Raw); err != nil {
+		t.Errorf("notary signature is not valid on notarised keys: %s", err)
+	}
+	if notarised.ServerName != "origin.test" || notarised.ValidUntilTS != fields.ValidUntilTS {
+		t.Errorf("notarised keys have different fields: %+v", notarised.ServerKeyFields)
+	}
+	if _, ok := notarised.VerifyKeys["ed25519:origin"]; !ok {
+		t.Errorf("notarised keys are missing the origin verify key")
+	}
+
+	// The notarised keys should still pass the checks a receiving server makes.
+	checks, _ := CheckKeys("origin.test", time.Now(), notarised)
+	if !checks.AllChecksOK {
+		t.Errorf("notarised keys failed checks: %+v", checks)
+	}
+
+	// The original keys should not have been modified.
+	if err = VerifyJSON("notary.test", "ed25519:notary", notaryPublic, keys.Raw); err == nil {
+		t.Errorf("original keys should not have a notary signature")
+	}
+}
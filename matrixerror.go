@@ -0,0 +1,64 @@
+package gomatrixserverlib
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// Standard error codes returned by Matrix servers.
+// https://spec.matrix.org/v1.4/client-server-api/#standard-error-response
+const (
+	MatrixErrorForbidden         = "M_FORBIDDEN"
+	MatrixErrorNotFound          = "M_NOT_FOUND"
+	MatrixErrorUnknown           = "M_UNKNOWN"
+	MatrixErrorUnauthorized      = "M_UNAUTHORIZED"
+	MatrixErrorBadJSON           = "M_BAD_JSON"
+	MatrixErrorNotJSON           = "M_NOT_JSON"
+	MatrixErrorLimitExceeded     = "M_LIMIT_EXCEEDED"
+	MatrixErrorUnrecognized      = "M_UNRECOGNIZED"
+	MatrixErrorIncompatibleRoom  = "M_INCOMPATIBLE_ROOM_VERSION"
+	MatrixErrorUnsupportedRoom   = "M_UNSUPPORTED_ROOM_VERSION"
+	MatrixErrorMissingParam      = "M_MISSING_PARAM"
+	MatrixErrorInvalidParam      = "M_INVALID_PARAM"
+	MatrixErrorUnableToAuthorise = "M_UNABLE_TO_AUTHORISE_JOIN"
+)
+
+// A MatrixError is the standard error response returned by a Matrix server,
+// along with the HTTP status code of the response. Federation client methods
+// return a gomatrix.HTTPError wrapping a gomatrix.RespError when the remote
+// server responds with a standard error, which can be extracted along with the
+// status code as a MatrixError with AsMatrixError.
+type MatrixError struct {
+	// The HTTP status code of the response.
+	StatusCode int `json:"-"`
+	// The Matrix error code, e.g. "M_FORBIDDEN".
+	ErrCode string `json:"errcode"`
+	// A human readable description of the error.
+	Err string `json:"error"`
+}
+
+// Error implements error
+func (e MatrixError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s: %s", e.StatusCode, e.ErrCode, e.Err)
+}
+
+// AsMatrixError extracts a MatrixError from the error returned by a client
+// method, if the remote server returned a standard Matrix error response.
+// Returns false if the error doesn't contain a Matrix error response.
+func AsMatrixError(err error) (MatrixError, bool) {
+	var matrixErr MatrixError
+	if errors.As(err, &matrixErr) {
+		return matrixErr, true
+	}
+	var httpErr gomatrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return MatrixError{}, false
+	}
+	var respErr gomatrix.RespError
+	if !errors.As(httpErr.WrappedError, &respErr) {
+		return MatrixError{}, false
+	}
+	return MatrixError{StatusCode: httpErr.Code, ErrCode: respErr.ErrCode, Err: respErr.Err}, true
+}
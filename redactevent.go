@@ -101,6 +101,12 @@ func RedactEventJSON(eventJSON []byte, roomVersion RoomVersion) ([]byte, error)
 		HistoryVisibility RawJSON `json:"history_visibility,omitempty"`
 	}
 
+	// redactionContent keeps the fields needed in a m.room.redaction event
+	// for room versions which put the redacted event ID in the content.
+	type redactionContent struct {
+		Redacts RawJSON `json:"redacts,omitempty"`
+	}
+
 	// allContent keeps the union of all the content fields needed across all the event types.
 	// All the content JSON keys we are keeping are distinct across the different event types.
 	type allContent struct {
@@ -110,6 +116,7 @@ func RedactEventJSON(eventJSON []byte, roomVersion RoomVersion) ([]byte, error)
 		memberContent
 		aliasesContent
 		historyVisibilityContent
+		redactionContent
 	}
 
 	// eventFields keeps the top level keys needed by all event types.
@@ -168,6 +175,12 @@ func RedactEventJSON(eventJSON []byte, roomVersion RoomVersion) ([]byte, error)
 		newContent.powerLevelContent = event.Content.powerLevelContent
 	case MRoomHistoryVisibility:
 		newContent.historyVisibilityContent = event.Content.historyVisibilityContent
+	case MRoomRedaction:
+		if inContent, err := roomVersion.RedactsInContent(); err != nil {
+			return nil, err
+		} else if inContent {
+			newContent.redactionContent = event.Content.redactionContent
+		}
 	case MRoomAliases:
 		if algo, err := roomVersion.RedactionAlgorithm(); err != nil {
 			return nil, err
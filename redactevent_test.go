@@ -3,6 +3,9 @@ package gomatrixserverlib
 import (
 	"bytes"
 	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
 )
 
 func TestRedactionAlgorithmV4(t *testing.T) {
@@ -32,3 +35,80 @@ func TestRedactionAlgorithmV4(t *testing.T) {
 		t.Fatalf("room version 9 redaction produced unexpected result\nexpected: %s\ngot: %s", string(expectedv9), string(redactedv9))
 	}
 }
+
+func TestRedactionKeepsRedactsInContent(t *testing.T) {
+	contentVersion := testRoomVersionRedactsInContent
+
+	input := []byte(`{"content":{"reason":"spam","redacts":"$target:somewhere.org"},"origin_server_ts":1633108629915,"sender":"@someone:somewhere.org","type":"m.room.redaction","room_id":"!someroom:matrix.org"}`)
+	expectedv10 := []byte(`{"sender":"@someone:somewhere.org","room_id":"!someroom:matrix.org","content":{},"type":"m.room.redaction","origin_server_ts":1633108629915}`)
+	expectedContent := []byte(`{"sender":"@someone:somewhere.org","room_id":"!someroom:matrix.org","content":{"redacts":"$target:somewhere.org"},"type":"m.room.redaction","origin_server_ts":1633108629915}`)
+
+	redactedv10, err := RedactEventJSON(input, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redactedContent, err := RedactEventJSON(input, contentVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(redactedv10, expectedv10) {
+		t.Fatalf("room version 10 redaction produced unexpected result\nexpected: %s\ngot: %s", string(expectedv10), string(redactedv10))
+	}
+	if !bytes.Equal(redactedContent, expectedContent) {
+		t.Fatalf("redacts in content redaction produced unexpected result\nexpected: %s\ngot: %s", string(expectedContent), string(redactedContent))
+	}
+}
+
+func TestRedactRedactionEvent(t *testing.T) {
+	contentVersion := testRoomVersionRedactsInContent
+
+	alice := newTestSigningServer(t, "alice.test")
+	target := "$target:alice.test"
+	for _, roomVersion := range []RoomVersion{RoomVersionV10, contentVersion} {
+		eb, err := NewRedactionEvent(roomVersion, "!room:alice.test", "@alice:alice.test", target, "spam")
+		if err != nil {
+			t.Fatalf("room version %s: %s", roomVersion, err)
+		}
+		eb.PrevEvents = []string{}
+		eb.AuthEvents = []string{}
+		eb.Depth = 1
+		event, err := eb.Build(time.Now(), alice.serverName, alice.keyID, alice.privateKey, roomVersion)
+		if err != nil {
+			t.Fatalf("room version %s: %s", roomVersion, err)
+		}
+		eventID := event.EventID()
+
+		event.Redact()
+		if !event.Redacted() {
+			t.Fatalf("room version %s: expected the event to be redacted", roomVersion)
+		}
+		if event.EventID() != eventID {
+			t.Errorf("room version %s: redaction changed the event ID from %q to %q", roomVersion, eventID, event.EventID())
+		}
+		if reason := gjson.GetBytes(event.Content(), "reason"); reason.Exists() {
+			t.Errorf("room version %s: expected the reason to be redacted, got %s", roomVersion, reason.Raw)
+		}
+		got, ok := event.Redacts()
+		if roomVersion == contentVersion {
+			// The "redacts" key in the content is protected from redaction, so
+			// the redacted redaction still points at its target.
+			if !ok || got != target {
+				t.Errorf("room version %s: got redacts %q after redaction, want %q", roomVersion, got, target)
+			}
+			if inContent := gjson.GetBytes(event.Content(), "redacts").String(); inContent != target {
+				t.Errorf("room version %s: got content redacts %q after redaction, want %q", roomVersion, inContent, target)
+			}
+		} else {
+			// The top level "redacts" key isn't protected from redaction.
+			if ok {
+				t.Errorf("room version %s: expected redacts to be removed by redaction, got %q", roomVersion, got)
+			}
+		}
+		// The signature covers the redacted form of the event, so it must
+		// still be valid once the redaction is redacted.
+		if err = VerifyJSON(string(alice.serverName), alice.keyID, alice.publicKey, event.JSON()); err != nil {
+			t.Errorf("room version %s: signature invalid after redaction: %s", roomVersion, err)
+		}
+	}
+}
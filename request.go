@@ -13,6 +13,7 @@ import (
 	"unicode/utf8"
 
 	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -210,8 +211,13 @@ func VerifyHTTPRequest(
 		return nil, util.MessageResponse(400, "Bad Request")
 	}
 	if request.fields.Destination != "" && request.fields.Destination != destination {
+		// The destination is covered by the signature, so a request signed for
+		// another server can't be replayed against us by rewriting it.
 		message := "Unrecognised server name for Destination"
-		util.GetLogger(req.Context()).WithError(err).Print(message)
+		util.GetLogger(req.Context()).WithFields(logrus.Fields{
+			"destination": request.fields.Destination,
+			"expected":    destination,
+		}).Print(message)
 		return nil, util.MessageResponse(400, message)
 	} else if request.fields.Destination == "" {
 		request.fields.Destination = destination
@@ -285,57 +291,153 @@ func readHTTPRequest(req *http.Request) (*FederationRequest, error) { // nolint:
 	}
 
 	for _, authorization := range req.Header["Authorization"] {
-		scheme, origin, destination, key, sig := ParseAuthorization(authorization)
-		if scheme != "X-Matrix" {
+		if !strings.EqualFold(authorizationScheme(authorization), "X-Matrix") {
 			// Ignore unknown types of Authorization.
 			continue
 		}
-		if origin == "" || key == "" || sig == "" {
-			return nil, fmt.Errorf("gomatrixserverlib: invalid X-Matrix authorization header")
+		origin, key, sig, destination, err := ParseXMatrixAuth(authorization)
+		if err != nil {
+			return nil, err
 		}
 		if result.fields.Origin != "" && result.fields.Origin != origin {
 			return nil, fmt.Errorf("gomatrixserverlib: different origins in X-Matrix authorization headers")
 		}
+		if result.fields.Signatures != nil && result.fields.Destination != destination {
+			return nil, fmt.Errorf("gomatrixserverlib: different destinations in X-Matrix authorization headers")
+		}
 		result.fields.Origin = origin
 		result.fields.Destination = destination
 		if result.fields.Signatures == nil {
-			result.fields.Signatures = map[ServerName]map[KeyID]string{origin: {key: sig}}
+			result.fields.Signatures = map[ServerName]map[KeyID]string{origin: {key: sig.Encode()}}
 		} else {
-			result.fields.Signatures[origin][key] = sig
+			result.fields.Signatures[origin][key] = sig.Encode()
 		}
 	}
 
 	return &result, nil
 }
 
+// ParseAuthorization parses the value of an "Authorization" HTTP header with
+// ParseXMatrixAuth. The scheme is always returned, but the other values are
+// empty if the scheme isn't X-Matrix or the header isn't valid.
+//
+// Deprecated: Use ParseXMatrixAuth, which reports why a header isn't valid.
 func ParseAuthorization(header string) (scheme string, origin, destination ServerName, key KeyID, sig string) {
-	parts := strings.SplitN(header, " ", 2)
-	scheme = parts[0]
-	if scheme != "X-Matrix" {
+	scheme = authorizationScheme(header)
+	origin, key, decoded, destination, err := ParseXMatrixAuth(header)
+	if err != nil {
+		return scheme, "", "", "", ""
+	}
+	return scheme, origin, destination, key, decoded.Encode()
+}
+
+// authorizationScheme returns the scheme of an "Authorization" HTTP header.
+func authorizationScheme(header string) string {
+	return strings.SplitN(strings.TrimSpace(header), " ", 2)[0]
+}
+
+// ParseXMatrixAuth parses and validates the value of an
+// "Authorization: X-Matrix ..." HTTP header. Both the legacy format, in which
+// the parameter values may be unquoted, and the newer format, in which values
+// are quoted strings and may be separated by whitespace, are accepted.
+// The origin, key and sig parameters are required and the signature must be
+// valid base64. The destination parameter is optional, and is empty if it was
+// not given. Unknown parameters are ignored, as the specification requires.
+// https://spec.matrix.org/v1.4/server-server-api/#request-authentication
+func ParseXMatrixAuth(header string) (origin ServerName, keyID KeyID, sig Base64Bytes, destination ServerName, err error) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if !strings.EqualFold(parts[0], "X-Matrix") {
+		err = fmt.Errorf("gomatrixserverlib: authorization scheme %q is not X-Matrix", parts[0])
 		return
 	}
 	if len(parts) != 2 {
+		err = fmt.Errorf("gomatrixserverlib: X-Matrix authorization header has no parameters")
 		return
 	}
-	for _, data := range strings.Split(parts[1], ",") {
-		pair := strings.SplitN(data, "=", 2)
-		if len(pair) != 2 {
-			continue
+	params, err := parseXMatrixParams(parts[1])
+	if err != nil {
+		return
+	}
+	if params["origin"] == "" {
+		err = fmt.Errorf("gomatrixserverlib: X-Matrix authorization header is missing the origin")
+		return
+	}
+	if params["key"] == "" {
+		err = fmt.Errorf("gomatrixserverlib: X-Matrix authorization header is missing the key")
+		return
+	}
+	if params["sig"] == "" {
+		err = fmt.Errorf("gomatrixserverlib: X-Matrix authorization header is missing the sig")
+		return
+	}
+	if _, _, valid := ParseAndValidateServerName(ServerName(params["origin"])); !valid {
+		err = fmt.Errorf("gomatrixserverlib: X-Matrix authorization header has an invalid origin %q", params["origin"])
+		return
+	}
+	if d, ok := params["destination"]; ok {
+		if _, _, valid := ParseAndValidateServerName(ServerName(d)); !valid {
+			err = fmt.Errorf("gomatrixserverlib: X-Matrix authorization header has an invalid destination %q", d)
+			return
 		}
-		name := pair[0]
-		value := strings.Trim(pair[1], "\"")
-		if name == "origin" {
-			origin = ServerName(value)
+	}
+	if !strings.Contains(params["key"], ":") {
+		err = fmt.Errorf("gomatrixserverlib: X-Matrix authorization header has an invalid key ID %q", params["key"])
+		return
+	}
+	if err = sig.Decode(params["sig"]); err != nil {
+		err = fmt.Errorf("gomatrixserverlib: X-Matrix authorization header has an invalid sig: %w", err)
+		return
+	}
+	return ServerName(params["origin"]), KeyID(params["key"]), sig, ServerName(params["destination"]), nil
+}
+
+// parseXMatrixParams splits the comma separated name=value parameters of an
+// X-Matrix authorization header. Parameter names are case-insensitive and
+// values may be quoted strings, in which a backslash escapes the following
+// character.
+func parseXMatrixParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return params, nil
 		}
-		if name == "key" {
-			key = KeyID(value)
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("gomatrixserverlib: malformed X-Matrix authorization parameter %q", s)
 		}
-		if name == "sig" {
-			sig = value
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("gomatrixserverlib: unterminated quoted string in X-Matrix authorization parameter %q", name)
+			}
+			value = b.String()
+			s = strings.TrimLeft(s[i+1:], " \t")
+			if s != "" && s[0] != ',' {
+				return nil, fmt.Errorf("gomatrixserverlib: unexpected data after X-Matrix authorization parameter %q", name)
+			}
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
 		}
-		if name == "destination" {
-			destination = ServerName(value)
+		if _, ok := params[name]; ok {
+			return nil, fmt.Errorf("gomatrixserverlib: duplicate X-Matrix authorization parameter %q", name)
 		}
+		params[name] = value
+		s = strings.TrimPrefix(s, ",")
 	}
-	return
 }
@@ -175,3 +175,124 @@ func mustLoadPrivateKey(seed string) ed25519.PrivateKey {
 	}
 	return privateKey
 }
+
+func TestParseXMatrixAuth(t *testing.T) {
+	const sig = "7vt4vP/w8zYB3Zg77nuTPwie3TxEy2OHZQMsSa4nsXZzL4/qw+DguXbyMy3BF77XvSJmBt+Gw+fU6T4HId7fBg"
+	var wantSig Base64Bytes
+	if err := wantSig.Decode(sig); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, header := range []string{
+		// The legacy format with unquoted values.
+		`X-Matrix origin=localhost:8800,key="ed25519:a_Obwu",sig="` + sig + `",destination=localhost:44033`,
+		// The newer format with quoted values separated by whitespace.
+		`X-Matrix origin="localhost:8800", key="ed25519:a_Obwu", sig="` + sig + `", destination="localhost:44033"`,
+		// Parameter names are case-insensitive, quoted strings may contain
+		// escapes and unknown parameters are ignored.
+		`X-Matrix Origin="local\host:8800",KEY="ed25519:a_Obwu",sig="` + sig + `",unknown="a,b",destination="localhost:44033"`,
+	} {
+		origin, keyID, gotSig, destination, err := ParseXMatrixAuth(header)
+		if err != nil {
+			t.Errorf("ParseXMatrixAuth(%q): unexpected error: %s", header, err)
+			continue
+		}
+		if origin != "localhost:8800" || keyID != "ed25519:a_Obwu" || destination != "localhost:44033" {
+			t.Errorf("ParseXMatrixAuth(%q): got origin %q, key %q, destination %q", header, origin, keyID, destination)
+		}
+		if !bytes.Equal(gotSig, wantSig) {
+			t.Errorf("ParseXMatrixAuth(%q): got sig %q, want %q", header, gotSig.Encode(), sig)
+		}
+	}
+
+	// The destination is optional.
+	_, _, _, destination, err := ParseXMatrixAuth(`X-Matrix origin="localhost:8800",key="ed25519:a_Obwu",sig="` + sig + `"`)
+	if err != nil {
+		t.Fatalf("unexpected error without a destination: %s", err)
+	}
+	if destination != "" {
+		t.Fatalf("expected an empty destination, got %q", destination)
+	}
+
+	for _, header := range []string{
+		``,
+		`Bearer abcdef`,
+		`X-Matrix`,
+		`X-Matrix key="ed25519:a_Obwu",sig="` + sig + `"`,
+		`X-Matrix origin="localhost:8800",sig="` + sig + `"`,
+		`X-Matrix origin="localhost:8800",key="ed25519:a_Obwu"`,
+		`X-Matrix origin="localhost:8800",key="ed25519:a_Obwu",sig="not base64!"`,
+		`X-Matrix origin="localhost:8800",key="a_Obwu",sig="` + sig + `"`,
+		`X-Matrix origin="local host",key="ed25519:a_Obwu",sig="` + sig + `"`,
+		`X-Matrix origin="localhost:8800",key="ed25519:a_Obwu",sig="` + sig + `",destination="bad host"`,
+		`X-Matrix origin="localhost:8800",origin="other",key="ed25519:a_Obwu",sig="` + sig + `"`,
+		`X-Matrix origin="localhost:8800,key="ed25519:a_Obwu",sig="` + sig,
+		`X-Matrix origin="localhost:8800"key="ed25519:a_Obwu",sig="` + sig + `"`,
+		`X-Matrix origin`,
+	} {
+		if _, _, _, _, err := ParseXMatrixAuth(header); err == nil {
+			t.Errorf("ParseXMatrixAuth(%q): expected an error", header)
+		}
+	}
+}
+
+func TestVerifyRequestAuthorizationFormats(t *testing.T) {
+	const sig = "7vt4vP/w8zYB3Zg77nuTPwie3TxEy2OHZQMsSa4nsXZzL4/qw+DguXbyMy3BF77XvSJmBt+Gw+fU6T4HId7fBg"
+	for header, wantValid := range map[string]bool{
+		// The newer format with whitespace between the parameters.
+		`X-Matrix origin="localhost:8800", key="ed25519:a_Obwu", sig="` + sig + `", destination="localhost:44033"`: true,
+		// The legacy format with unquoted values.
+		`X-Matrix origin=localhost:8800,key=ed25519:a_Obwu,sig=` + sig + `,destination=localhost:44033`:         true,
+		`X-Matrix origin="localhost:8800",key="ed25519:a_Obwu",destination="localhost:44033"`:                   false,
+		`X-Matrix origin="localhost:8800",key="ed25519:a_Obwu",sig="not base64!",destination="localhost:44033"`: false,
+	} {
+		hr, err := http.ReadRequest(bufio.NewReader(bytes.NewReader([]byte(exampleGetRequest))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hr.Header.Set("Authorization", header)
+		request, jsonResp := VerifyHTTPRequest(
+			hr, time.Unix(1493142432, 96400), "localhost:44033", KeyRing{KeyDatabase: &testKeyDatabase{}},
+		)
+		if wantValid && request == nil {
+			t.Errorf("%s: wanted the request to be verified, got response %#v", header, jsonResp)
+		}
+		if !wantValid && request != nil {
+			t.Errorf("%s: wanted the request to be rejected", header)
+		}
+	}
+}
+
+func TestVerifyRequestRejectsOtherDestination(t *testing.T) {
+	hr, err := http.ReadRequest(bufio.NewReader(bytes.NewReader([]byte(exampleGetRequest))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The request was signed for localhost:44033, so it must not be accepted
+	// by any other server.
+	request, jsonResp := VerifyHTTPRequest(
+		hr, time.Unix(1493142432, 96400), "other.server", KeyRing{KeyDatabase: &testKeyDatabase{}},
+	)
+	if request != nil {
+		t.Fatalf("Wanted nil request for the wrong destination, got %#v", request)
+	}
+	if jsonResp.Code != 400 {
+		t.Fatalf("Wanted a 400 response for the wrong destination, got %d", jsonResp.Code)
+	}
+
+	// Authorization headers which disagree on the destination are rejected.
+	hr, err = http.ReadRequest(bufio.NewReader(bytes.NewReader([]byte(exampleGetRequest))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hr.Header.Add("Authorization", `X-Matrix origin="localhost:8800",key="ed25519:other",sig="abcd",destination="other.server"`)
+	request, jsonResp = VerifyHTTPRequest(
+		hr, time.Unix(1493142432, 96400), "localhost:44033", KeyRing{KeyDatabase: &testKeyDatabase{}},
+	)
+	if request != nil {
+		t.Fatalf("Wanted nil request for conflicting destinations, got %#v", request)
+	}
+	if jsonResp.Code != 400 {
+		t.Fatalf("Wanted a 400 response for conflicting destinations, got %d", jsonResp.Code)
+	}
+}
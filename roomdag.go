@@ -0,0 +1,166 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomatrixserverlib
+
+import (
+	"fmt"
+	"sort"
+)
+
+// VerifyRoomDAG checks that the given events form a complete and consistent
+// room DAG, e.g. a full dump of the events in a room. The checks made are:
+//   - there is exactly one m.room.create event and it has no prev_events or
+//     auth_events, so that it is the root of the DAG
+//   - all of the events are in the same room as the create event
+//   - every event other than the create event has prev_events
+//   - every prev_event and auth_event referenced by an event is present
+//   - there are no cycles through the prev_events or auth_events
+//
+// Returns an error describing the first inconsistency found, or nil if the
+// events form a consistent DAG.
+func VerifyRoomDAG(events []*Event) error {
+	known := make(map[string]bool, len(events))
+	var create *Event
+	for _, event := range events {
+		if known[event.EventID()] {
+			return fmt.Errorf("gomatrixserverlib: event %q appears more than once", event.EventID())
+		}
+		known[event.EventID()] = true
+		if event.Type() == MRoomCreate && event.StateKeyEquals("") {
+			if create != nil {
+				return fmt.Errorf(
+					"gomatrixserverlib: found more than one create event: %q and %q",
+					create.EventID(), event.EventID(),
+				)
+			}
+			create = event
+		}
+	}
+	if create == nil {
+		return fmt.Errorf("gomatrixserverlib: no create event found")
+	}
+	if len(create.PrevEventIDs()) > 0 || len(create.AuthEventIDs()) > 0 {
+		return fmt.Errorf("gomatrixserverlib: create event %q must not have any prev_events or auth_events", create.EventID())
+	}
+
+	for _, event := range events {
+		if event.RoomID() != create.RoomID() {
+			return fmt.Errorf(
+				"gomatrixserverlib: event %q is in room %q, expected %q",
+				event.EventID(), event.RoomID(), create.RoomID(),
+			)
+		}
+		if event != create && len(event.PrevEventIDs()) == 0 {
+			return fmt.Errorf("gomatrixserverlib: event %q has no prev_events but is not the create event", event.EventID())
+		}
+		missingPrev, missingAuth := MissingReferences(event, known)
+		if len(missingPrev) > 0 {
+			return fmt.Errorf("gomatrixserverlib: event %q references missing prev_event %q", event.EventID(), missingPrev[0])
+		}
+		if len(missingAuth) > 0 {
+			return fmt.Errorf("gomatrixserverlib: event %q references missing auth_event %q", event.EventID(), missingAuth[0])
+		}
+	}
+
+	// Topologically sort the events using Kahn's algorithm, treating both the
+	// prev_events and the auth_events as parents. If any events can't be
+	// sorted then they must be part of, or descend from, a cycle.
+	parents := make(map[string]int, len(events))
+	children := make(map[string][]string, len(events))
+	for _, event := range events {
+		seen := make(map[string]bool)
+		for _, parentIDs := range [][]string{event.PrevEventIDs(), event.AuthEventIDs()} {
+			for _, parentID := range parentIDs {
+				if seen[parentID] {
+					continue
+				}
+				seen[parentID] = true
+				parents[event.EventID()]++
+				children[parentID] = append(children[parentID], event.EventID())
+			}
+		}
+	}
+	queue := []string{create.EventID()}
+	sorted := 0
+	for len(queue) > 0 {
+		eventID := queue[0]
+		queue = queue[1:]
+		sorted++
+		for _, childID := range children[eventID] {
+			parents[childID]--
+			if parents[childID] == 0 {
+				queue = append(queue, childID)
+			}
+		}
+	}
+	if sorted != len(events) {
+		var unsorted []string
+		for _, event := range events {
+			if parents[event.EventID()] > 0 {
+				unsorted = append(unsorted, event.EventID())
+			}
+		}
+		sort.Strings(unsorted)
+		return fmt.Errorf("gomatrixserverlib: found a cycle in the room DAG involving event %q", unsorted[0])
+	}
+
+	return nil
+}
+
+// AreForks returns true if the two events are forks in the room DAG, i.e. if
+// they share at least one prev_event but neither of them references the other
+// as a prev_event. Only the direct prev_events of the events are considered,
+// so two events on branches which split further back aren't counted, and an
+// event is never a fork of itself.
+func AreForks(a, b *Event) bool {
+	if a.EventID() == b.EventID() {
+		return false
+	}
+	aPrevs := make(map[string]struct{}, len(a.PrevEventIDs()))
+	for _, prevEventID := range a.PrevEventIDs() {
+		if prevEventID == b.EventID() {
+			return false
+		}
+		aPrevs[prevEventID] = struct{}{}
+	}
+	shared := false
+	for _, prevEventID := range b.PrevEventIDs() {
+		if prevEventID == a.EventID() {
+			return false
+		}
+		if _, ok := aPrevs[prevEventID]; ok {
+			shared = true
+		}
+	}
+	return shared
+}
+
+// ValidatePrevEvents checks that the prev_events of the event are well formed:
+// the event must not reference itself and must not reference the same event
+// more than once. Whether the prev_events are the right ones, i.e. the forward
+// extremities of the room when the event was created, can't be checked.
+func ValidatePrevEvents(event *Event) error {
+	seen := make(map[string]bool, len(event.PrevEventIDs()))
+	for _, prevEventID := range event.PrevEventIDs() {
+		if prevEventID == event.EventID() {
+			return fmt.Errorf("gomatrixserverlib: event %q references itself as a prev_event", event.EventID())
+		}
+		if seen[prevEventID] {
+			return fmt.Errorf("gomatrixserverlib: event %q references prev_event %q more than once", event.EventID(), prevEventID)
+		}
+		seen[prevEventID] = true
+	}
+	return nil
+}
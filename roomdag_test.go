@@ -0,0 +1,134 @@
+package gomatrixserverlib
+
+import (
+	"strings"
+	"testing"
+)
+
+func roomDAGTestMessage(eventID string, prevEventIDs ...string) *Event {
+	prevEvents := make([]EventReference, 0, len(prevEventIDs))
+	for _, prevEventID := range prevEventIDs {
+		prevEvents = append(prevEvents, EventReference{EventID: prevEventID})
+	}
+	return &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: eventID,
+			eventFields: eventFields{
+				RoomID:         "!ROOM:example.com",
+				Type:           "m.room.message",
+				OriginServerTS: 10,
+				Sender:         ALICE,
+				Content:        []byte(`{"body": "hello"}`),
+			},
+			PrevEvents: prevEvents,
+			AuthEvents: []EventReference{
+				{EventID: "$CREATE:example.com"},
+				{EventID: "$IPOWER:example.com"},
+				{EventID: "$IMA:example.com"},
+			},
+		},
+	}
+}
+
+func TestVerifyRoomDAG(t *testing.T) {
+	if err := VerifyRoomDAG(getBaseStateResV2Graph()); err != nil {
+		t.Fatalf("expected the base graph to be a consistent DAG, got: %s", err)
+	}
+	events := append(
+		getBaseStateResV2Graph(),
+		roomDAGTestMessage("$M1:example.com", "$IMC:example.com"),
+		roomDAGTestMessage("$M2:example.com", "$M1:example.com", "$IMB:example.com"),
+	)
+	if err := VerifyRoomDAG(events); err != nil {
+		t.Fatalf("expected the graph to be a consistent DAG, got: %s", err)
+	}
+}
+
+func TestVerifyRoomDAGMissingParent(t *testing.T) {
+	events := append(
+		getBaseStateResV2Graph(),
+		roomDAGTestMessage("$M1:example.com", "$MISSING:example.com"),
+	)
+	err := VerifyRoomDAG(events)
+	if err == nil {
+		t.Fatal("expected an error for a missing prev_event")
+	}
+	if !strings.Contains(err.Error(), "$MISSING:example.com") {
+		t.Fatalf("expected the error to name the missing event, got: %s", err)
+	}
+}
+
+func TestVerifyRoomDAGCycle(t *testing.T) {
+	events := append(
+		getBaseStateResV2Graph(),
+		roomDAGTestMessage("$M1:example.com", "$IMC:example.com", "$M2:example.com"),
+		roomDAGTestMessage("$M2:example.com", "$M1:example.com"),
+	)
+	err := VerifyRoomDAG(events)
+	if err == nil {
+		t.Fatal("expected an error for a cycle")
+	}
+	if !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("expected a cycle error, got: %s", err)
+	}
+}
+
+func TestVerifyRoomDAGCreate(t *testing.T) {
+	events := getBaseStateResV2Graph()
+	if err := VerifyRoomDAG(events[1:]); err == nil {
+		t.Fatal("expected an error when the create event is missing")
+	}
+	events = append(events, roomDAGTestMessage("$ORPHAN:example.com"))
+	if err := VerifyRoomDAG(events); err == nil {
+		t.Fatal("expected an error for a second root event")
+	}
+}
+
+func TestAreForks(t *testing.T) {
+	forkA := roomDAGTestMessage("$A:example.com", "$IMC:example.com")
+	forkB := roomDAGTestMessage("$B:example.com", "$IMC:example.com", "$IMB:example.com")
+	child := roomDAGTestMessage("$C:example.com", "$A:example.com", "$IMC:example.com")
+	other := roomDAGTestMessage("$D:example.com", "$IMB:example.com")
+
+	for _, tc := range []struct {
+		name string
+		a, b *Event
+		want bool
+	}{
+		{"fork", forkA, forkB, true},
+		{"fork reversed", forkB, forkA, true},
+		{"fork on another shared parent", forkB, other, true},
+		// The child shares $IMC with $A but also references it, so it's
+		// linear history rather than a fork.
+		{"linear", forkA, child, false},
+		{"linear reversed", child, forkA, false},
+		{"no shared parent", forkA, other, false},
+		{"same event", forkA, forkA, false},
+	} {
+		if got := AreForks(tc.a, tc.b); got != tc.want {
+			t.Errorf("%s: AreForks(%s, %s) = %v, want %v", tc.name, tc.a.EventID(), tc.b.EventID(), got, tc.want)
+		}
+	}
+}
+
+func TestValidatePrevEvents(t *testing.T) {
+	for _, event := range []*Event{
+		roomDAGTestMessage("$M1:example.com"),
+		roomDAGTestMessage("$M1:example.com", "$A:example.com"),
+		roomDAGTestMessage("$M1:example.com", "$A:example.com", "$B:example.com"),
+	} {
+		if err := ValidatePrevEvents(event); err != nil {
+			t.Errorf("expected prev_events %v to be valid, got: %s", event.PrevEventIDs(), err)
+		}
+	}
+	for _, event := range []*Event{
+		roomDAGTestMessage("$M1:example.com", "$M1:example.com"),
+		roomDAGTestMessage("$M1:example.com", "$A:example.com", "$M1:example.com"),
+		roomDAGTestMessage("$M1:example.com", "$A:example.com", "$A:example.com"),
+	} {
+		if err := ValidatePrevEvents(event); err == nil {
+			t.Errorf("expected prev_events %v to be rejected", event.PrevEventIDs())
+		}
+	}
+}
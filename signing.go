@@ -18,6 +18,7 @@ package gomatrixserverlib
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/tidwall/sjson"
 	"golang.org/x/crypto/ed25519"
@@ -29,9 +30,54 @@ import (
 // prefix used.
 type KeyID string
 
+// Algorithm returns the signing algorithm of the key, i.e. the part of the key
+// ID before the first ":", e.g. "ed25519".
+func (k KeyID) Algorithm() string {
+	algorithm, _ := k.split()
+	return algorithm
+}
+
+// Name returns the name of the key, i.e. the part of the key ID after the
+// first ":". Returns an empty string if the key ID has no ":".
+func (k KeyID) Name() string {
+	_, name := k.split()
+	return name
+}
+
+// Validate checks that the key ID is for an ed25519 key and that its name is
+// made up of the characters [0-9A-Za-z_]. Key IDs for other algorithms are
+// rejected so that an ed25519 key can't be used as another kind of key.
+func (k KeyID) Validate() error {
+	algorithm, name := k.split()
+	if algorithm != "ed25519" {
+		return fmt.Errorf("gomatrixserverlib: unsupported algorithm %q in key ID %q", algorithm, k)
+	}
+	if name == "" {
+		return fmt.Errorf("gomatrixserverlib: key ID %q has no name", k)
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '_') {
+			return fmt.Errorf("gomatrixserverlib: invalid character %q in key ID %q", c, k)
+		}
+	}
+	return nil
+}
+
+func (k KeyID) split() (algorithm, name string) {
+	parts := strings.SplitN(string(k), ":", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
 // SignJSON signs a JSON object returning a copy signed with the given key.
+// Returns an error if the key ID isn't a valid ed25519 key ID.
 // https://matrix.org/docs/spec/server_server/unstable.html#signing-json
 func SignJSON(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, message []byte) (signed []byte, err error) {
+	if err = keyID.Validate(); err != nil {
+		return nil, err
+	}
 	preserve := struct {
 		Signatures map[string]map[KeyID]Base64Bytes `json:"signatures"`
 		Unsigned   RawJSON                          `json:"unsigned"`
@@ -93,7 +139,13 @@ func ListKeyIDs(signingName string, message []byte) ([]KeyID, error) {
 }
 
 // VerifyJSON checks that the entity has signed the message using a particular key.
+// Returns an error if the key ID isn't for an ed25519 key. Unlike SignJSON, the
+// rest of the key ID isn't checked, since other servers may have chosen key
+// names which Validate doesn't allow.
 func VerifyJSON(signingName string, keyID KeyID, publicKey ed25519.PublicKey, message []byte) error {
+	if algorithm := keyID.Algorithm(); algorithm != "ed25519" {
+		return fmt.Errorf("gomatrixserverlib: unsupported algorithm %q in key ID %q", algorithm, keyID)
+	}
 	// Unpack the top-level key of the JSON object without unpacking the contents of the keys.
 	// This allows us to add and remove the top-level keys from the JSON object.
 	// It also ensures that the JSON is actually a valid JSON object.
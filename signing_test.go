@@ -221,3 +221,66 @@ func TestSignJSONWithUnsigned(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestKeyID(t *testing.T) {
+	keyID := KeyID("ed25519:a_Obwu")
+	if got := keyID.Algorithm(); got != "ed25519" {
+		t.Errorf("Algorithm(): want %q, got %q", "ed25519", got)
+	}
+	if got := keyID.Name(); got != "a_Obwu" {
+		t.Errorf("Name(): want %q, got %q", "a_Obwu", got)
+	}
+	if err := keyID.Validate(); err != nil {
+		t.Errorf("Validate(): want no error, got %s", err)
+	}
+	for _, invalid := range []KeyID{"", "ed25519", "ed25519:", "curve25519:abc", "ED25519:abc", "ed25519:a:b"} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Validate(%q): want an error, got none", invalid)
+		}
+	}
+}
+
+func TestSignAndVerifyJSONRejectUnsupportedAlgorithm(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := []byte(`{"foo":"bar"}`)
+	if _, err = SignJSON("example.com", "curve25519:abc", privateKey, input); err == nil {
+		t.Error("SignJSON: want an error for an unsupported algorithm, got none")
+	}
+	signed, err := SignJSON("example.com", "ed25519:abc", privateKey, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Relabel the signature as though it were made with a different algorithm.
+	relabelled := bytes.Replace(signed, []byte(`"ed25519:abc"`), []byte(`"curve25519:abc"`), 1)
+	if err = VerifyJSON("example.com", "curve25519:abc", publicKey, relabelled); err == nil {
+		t.Error("VerifyJSON: want an error for an unsupported algorithm, got none")
+	}
+	if err = VerifyJSON("example.com", "ed25519:abc", publicKey, signed); err != nil {
+		t.Errorf("VerifyJSON: want no error, got %s", err)
+	}
+}
+
+func TestVerifyJSONAllowsOtherKeyNames(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := []byte(`{"foo":"bar"}`)
+	// Key IDs which we sign with must be valid.
+	if _, err = SignJSON("example.com", "ed25519:a-b.c", privateKey, input); err == nil {
+		t.Error("SignJSON: want an error for an invalid key name, got none")
+	}
+	// But other servers may have given their keys names which aren't, and
+	// their signatures must still verify.
+	signed, err := SignJSON("example.com", "ed25519:abc", privateKey, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relabelled := bytes.Replace(signed, []byte(`"ed25519:abc"`), []byte(`"ed25519:a-b.c"`), 1)
+	if err = VerifyJSON("example.com", "ed25519:a-b.c", publicKey, relabelled); err != nil {
+		t.Errorf("VerifyJSON: want no error for a key name from another server, got %s", err)
+	}
+}
@@ -16,9 +16,11 @@ package gomatrixserverlib
 
 import (
 	"container/heap"
+	"context"
 	"encoding/json"
 	"fmt"
 	"sort"
+	"time"
 )
 
 // TopologicalOrder represents how to sort a list of events, used primarily in ReverseTopologicalOrdering
@@ -30,9 +32,37 @@ const (
 	TopologicalOrderByAuthEvents
 )
 
+// ResolutionMetrics can be supplied to ResolveStateConflictsV2WithOptions in
+// order to observe how long each phase of state resolution takes and how many
+// events were involved. The durations reported for topological ordering cover
+// all of the topological sorts performed during the resolution.
+type ResolutionMetrics interface {
+	// TopologicalOrdering is called with the total time spent topologically
+	// ordering the auth, unconflicted and conflicted control events.
+	TopologicalOrdering(duration time.Duration)
+	// MainlineConstruction is called with the time spent building the power
+	// level mainline.
+	MainlineConstruction(duration time.Duration)
+	// MainlineOrdering is called with the time spent ordering the remaining
+	// conflicted events by the mainline.
+	MainlineOrdering(duration time.Duration)
+	// EventCounts is called with the number of conflicted and unconflicted
+	// events given to the resolver, and the number of conflicted events that
+	// were rejected because they failed auth checks against the partial state,
+	// as listed in StateResolutionResult.RejectedEvents.
+	EventCounts(conflicted, unconflicted, rejected int)
+}
+
 type stateResolverV2 struct {
+	ctx                       context.Context               // Used to cancel resolution early
+	metrics                   ResolutionMetrics             // Optional metrics hooks, may be nil
+	warnings                  func(Warning)                 // Optional warning callback, may be nil
+	topologicalOrderingTime   time.Duration                 // Total time spent in topological ordering
+	rejectedEvents            []*Event                      // Conflicted events that failed auth
+	recordRejected            bool                          // Whether to record rejectedEvents right now
 	allower                   *allowerContext               // Used to auth and apply events
-	authEventMap              map[string]*Event             // Map of all provided auth events
+	authChecker               AuthChecker                   // Optional replacement for the allower
+	authEventDB               EventDatabase                 // Used to look up the provided auth events
 	conflictedEventMap        map[string]*Event             // Map of all provided conflicted events
 	powerLevelContents        map[string]*PowerLevelContent // A cache of all power level contents
 	powerLevelMainline        []*Event                      // Power level events in mainline ordering
@@ -78,17 +108,141 @@ func ResolveStateConflictsV2(
 	conflicted, unconflicted []*Event,
 	authEvents, authDifference []*Event,
 ) []*Event {
+	// The background context can never be cancelled and the auth events are
+	// looked up in memory, so there is no error to handle here.
+	resolved, _ := ResolveStateConflictsV2WithOptions(
+		context.Background(), conflicted, unconflicted, authEvents, authDifference,
+		StateResolutionV2Options{},
+	)
+	return resolved
+}
+
+// StateResolutionV2Options are optional settings for
+// ResolveStateConflictsV2WithOptions. The zero value uses the defaults.
+type StateResolutionV2Options struct {
+	// Metrics hooks to report the duration of each resolution phase to.
+	// If nil then nothing is timed or reported.
+	Metrics ResolutionMetrics
+	// The database used to look up auth events by ID. If nil then the auth
+	// events given to the resolver are looked up in memory. If the database
+	// fails to look up an event then resolution stops and the error is
+	// returned, whereas an event which isn't in the database is skipped.
+	AuthEventDatabase EventDatabase
+	// Called with a warning for each event that was dropped from the state
+	// because its state key isn't valid for its type, e.g. a power levels
+	// event with a non-empty state key. If nil then nothing is reported.
+	Warnings func(Warning)
+	// Used to check whether each event is allowed by the partial state in
+	// place of the standard auth rules. If nil then Allowed is used.
+	AuthChecker AuthChecker
+	// Where to record how the state was resolved. If nil then nothing is
+	// recorded. The result is only filled in if resolution succeeds.
+	Result *StateResolutionResult
+	// Whether to record the partial state after each phase of the resolution
+	// in the Trace of the Result. This makes copies of the partial state, so
+	// it is best only used for debugging. Ignored if Result is nil.
+	Trace bool
+}
+
+// An AuthChecker checks whether an event is allowed by the given auth events,
+// returning an error if it isn't. Allowed is the AuthChecker implementing the
+// auth rules of the room version of the event. Other implementations can be
+// given to the resolver with StateResolutionV2Options, e.g. in order to try
+// out alternative auth rules.
+type AuthChecker func(event *Event, provider AuthEventProvider) error
+
+// A StateResolutionV2Trace holds the partial state after each phase of state
+// resolution v2, showing how the resolved state was built up.
+type StateResolutionV2Trace struct {
+	// The partial state after the unconflicted events were applied on top of
+	// the auth chain.
+	Unconflicted []*Event
+	// The partial state after the conflicted power events, i.e. the control
+	// events and the events related to them, were authed and applied.
+	ConflictedControl []*Event
+	// The partial state after the remaining conflicted events were ordered
+	// by the power level mainline, authed and applied.
+	Mainline []*Event
+	// The final resolved state, after the unconflicted events were reapplied.
+	Final []*Event
+}
+
+// A StateResolutionResult is the resolved state of a room along with
+// information about how it was resolved. It is filled in by
+// ResolveStateConflictsV2WithOptions when StateResolutionV2Options.Result is
+// set. The name distinguishes it from the ResolutionResult of looking up a
+// server name.
+type StateResolutionResult struct {
+	// The resolved state, including the unconflicted state events.
+	State []*Event
+	// The number of conflicted events given to the resolver.
+	Conflicted int
+	// The number of unconflicted events given to the resolver.
+	Unconflicted int
+	// The number of conflicted events which were rejected because they failed
+	// the auth checks against the partial state, i.e. len(RejectedEvents).
+	Rejected int
+	// The conflicted events which were rejected, so that they can be marked
+	// as rejected when they are stored. Events which only failed auth while
+	// the auth chain was replayed, and events which are in the resolved state,
+	// aren't included. Each rejected event is listed once, in the order in
+	// which it was rejected.
+	RejectedEvents []*Event
+	// The event IDs of the power level mainline used to order the conflicted
+	// events which aren't control events, starting closest to the create event.
+	Mainline []string
+	// The partial state after each phase, if StateResolutionV2Options.Trace
+	// was set, otherwise nil.
+	Trace *StateResolutionV2Trace
+	// The room version of the resolved state, which decides the state
+	// resolution algorithm to use. This is taken from the resolved create
+	// event, or from the first event given if there isn't one.
+	Version RoomVersion
+	// How long the resolution took.
+	Duration time.Duration
+}
+
+// ResolveStateConflictsV2WithOptions is the same as ResolveStateConflictsV2,
+// but allows the behaviour of the resolver to be customised with options.
+// The given context is checked between each phase of the resolution and while
+// authing events, so that resolution stops early if it is cancelled or its
+// deadline passes. Returns an error if the context is done or if the auth
+// event database fails.
+func ResolveStateConflictsV2WithOptions(
+	ctx context.Context,
+	conflicted, unconflicted []*Event,
+	authEvents, authDifference []*Event,
+	opts StateResolutionV2Options,
+) ([]*Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if opts.AuthEventDatabase == nil {
+		opts.AuthEventDatabase = NewMemoryEventDatabase(authEvents)
+	}
+	metrics := opts.Metrics
+	resolutionStarted := time.Now()
+	var trace *StateResolutionV2Trace
+	if opts.Result != nil && opts.Trace {
+		trace = &StateResolutionV2Trace{}
+	}
+	numConflicted, numUnconflicted := len(conflicted), len(unconflicted)
+
 	// Prepare the state resolver.
 	conflictedControlEvents := make([]*Event, 0, len(conflicted))
 	conflictedOthers := make([]*Event, 0, len(conflicted))
 	r := stateResolverV2{
-		authEventMap:              eventMapFromEvents(authEvents),
+		ctx:                       ctx,
+		metrics:                   metrics,
+		warnings:                  opts.Warnings,
+		authChecker:               opts.AuthChecker,
+		authEventDB:               opts.AuthEventDatabase,
 		conflictedEventMap:        eventMapFromEvents(conflicted),
 		powerLevelContents:        make(map[string]*PowerLevelContent),
 		powerLevelMainlinePos:     make(map[string]int),
-		resolvedThirdPartyInvites: make(map[string]*Event, len(conflicted)),
+		resolvedThirdPartyInvites: make(map[string]*Event),
 		resolvedMembers:           make(map[string]*Event, len(conflicted)),
-		resolvedOthers:            make(map[string]*Event, len(conflicted)),
+		resolvedOthers:            make(map[string]*Event),
 		result:                    make([]*Event, 0, len(conflicted)+len(unconflicted)),
 	}
 	r.allower = newAllowerContext(&r)
@@ -103,13 +257,19 @@ func ResolveStateConflictsV2(
 
 	// Get the full conflicted set, that is the conflicted events and the
 	// auth difference (events that don't appear in all auth chains).
-	fullConflictedSet := append(conflicted, authDifference...)
+	// Copy into a new slice, so that we don't write into the caller's array.
+	fullConflictedSet := make([]*Event, 0, len(conflicted)+len(authDifference))
+	fullConflictedSet = append(fullConflictedSet, conflicted...)
+	fullConflictedSet = append(fullConflictedSet, authDifference...)
 
 	// The full power set function returns the event and all of its auth
 	// events that also happen to appear in the conflicted set. This will
 	// effectively allow us to pull in all related events for any control
 	// event, even if those related events are themselves not control events.
-	visited := make(map[string]struct{}, len(conflicted)+len(authEvents))
+	// These maps only hold the control events and the events related to them,
+	// which are usually a small part of the conflicted set, so they aren't
+	// sized up front.
+	visited := make(map[string]struct{})
 	var fullControlSet func(event *Event) []*Event
 	fullControlSet = func(event *Event) []*Event {
 		events := []*Event{event}
@@ -128,8 +288,11 @@ func ResolveStateConflictsV2(
 	// First of all, work through the full conflicted set. Ignoring any
 	// events which are unconflicted (from the auth difference, for example),
 	// pull in the control events and any events directly related to them.
-	conflictedPulledIn := make(map[string]struct{}, len(conflicted)+len(authEvents))
+	conflictedPulledIn := make(map[string]struct{})
 	for _, p := range fullConflictedSet {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		if _, unconflicted := isUnconflicted[p.EventID()]; unconflicted {
 			continue
 		}
@@ -159,60 +322,136 @@ func ResolveStateConflictsV2(
 	// first need to auth and apply the entire auth chain in order. This is so that
 	// when we come to auth any future events against the partial state, we'll have
 	// the knowledge from the auth chain to help us to make a correct decision.
-	authEvents = r.reverseTopologicalOrdering(authEvents, TopologicalOrderByAuthEvents)
-	r.authAndApplyEvents(authEvents)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	authEvents, err := r.timedReverseTopologicalOrdering(authEvents)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.authAndApplyEvents(authEvents); err != nil {
+		return nil, err
+	}
 
 	// Then process the unconflicted events by ordering them topologically and then
 	// authing them. The successfully authed events will form the real initial partial
 	// state. We will then keep the successfully authed unconflicted events so that
 	// they can be reapplied later.
-	unconflicted = r.reverseTopologicalOrdering(unconflicted, TopologicalOrderByAuthEvents)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if unconflicted, err = r.timedReverseTopologicalOrdering(unconflicted); err != nil {
+		return nil, err
+	}
 	r.applyEvents(unconflicted)
+	if trace != nil {
+		trace.Unconflicted = r.appendPartialState(nil)
+	}
 
 	// Then order the conflicted power level events topologically and then also
 	// auth those too. The successfully authed events will be layered on top of
-	// the partial state.
-	conflictedControlEvents = r.reverseTopologicalOrdering(conflictedControlEvents, TopologicalOrderByAuthEvents)
-	r.authAndApplyEvents(conflictedControlEvents)
+	// the partial state. Failing auth while replaying the auth chain above
+	// doesn't make an event rejected, since the chain is replayed without the
+	// state the events were sent in, so rejections are only recorded from here.
+	r.recordRejected = true
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if conflictedControlEvents, err = r.timedReverseTopologicalOrdering(conflictedControlEvents); err != nil {
+		return nil, err
+	}
+	if err = r.authAndApplyEvents(conflictedControlEvents); err != nil {
+		return nil, err
+	}
+	if trace != nil {
+		trace.ConflictedControl = r.appendPartialState(nil)
+	}
 
 	// Then generate the mainline of power level events, order the remaining state
 	// events based on the mainline ordering and auth those too. The successfully
 	// authed events are also layered on top of the partial state.
-	r.powerLevelMainline = r.createPowerLevelMainline()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var started time.Time
+	if metrics != nil {
+		metrics.TopologicalOrdering(r.topologicalOrderingTime)
+		started = time.Now()
+	}
+	if r.powerLevelMainline, err = r.createPowerLevelMainline(); err != nil {
+		return nil, err
+	}
 	for pos, event := range r.powerLevelMainline {
 		r.powerLevelMainlinePos[event.EventID()] = pos
 	}
-	conflictedOthers = r.mainlineOrdering(conflictedOthers)
-	r.authAndApplyEvents(conflictedOthers)
+	if metrics != nil {
+		metrics.MainlineConstruction(time.Since(started))
+		started = time.Now()
+	}
+	if conflictedOthers, err = r.mainlineOrdering(conflictedOthers); err != nil {
+		return nil, err
+	}
+	if metrics != nil {
+		metrics.MainlineOrdering(time.Since(started))
+	}
+	if err = r.authAndApplyEvents(conflictedOthers); err != nil {
+		return nil, err
+	}
+	if trace != nil {
+		trace.Mainline = r.appendPartialState(nil)
+	}
 
 	// Finally we will reapply the original set of unconflicted events onto the
 	// partial state, just in case any of these were overwritten by pulling in
 	// auth events in the previous two steps, and that gives us our final resolved
 	// state.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	r.applyEvents(unconflicted)
 
 	// Now that we have our final state, populate the result array with the
 	// resolved state and return it.
-	if r.resolvedCreate != nil {
-		r.result = append(r.result, r.resolvedCreate)
+	r.result = r.appendPartialState(r.result)
+	if trace != nil {
+		trace.Final = append([]*Event(nil), r.result...)
 	}
-	if r.resolvedJoinRules != nil {
-		r.result = append(r.result, r.resolvedJoinRules)
+
+	// The rejected events are worked out once, so that the metrics and the
+	// result always agree on which events were rejected.
+	rejected := r.rejectedNotInState()
+	if metrics != nil {
+		metrics.EventCounts(numConflicted, numUnconflicted, len(rejected))
 	}
-	if r.resolvedPowerLevels != nil {
-		r.result = append(r.result, r.resolvedPowerLevels)
+	if opts.Result != nil {
+		r.fillResult(opts.Result, numConflicted, numUnconflicted, rejected, conflicted, unconflicted)
+		opts.Result.Trace = trace
+		opts.Result.Duration = time.Since(resolutionStarted)
 	}
-	for _, member := range r.resolvedMembers {
-		r.result = append(r.result, member)
-	}
-	for _, invite := range r.resolvedThirdPartyInvites {
-		r.result = append(r.result, invite)
+	return r.result, nil
+}
+
+// fillResult fills in the result of the resolution, other than the trace and
+// the duration, once the resolved state is known.
+func (r *stateResolverV2) fillResult(
+	result *StateResolutionResult, numConflicted, numUnconflicted int, rejected, conflicted, unconflicted []*Event,
+) {
+	result.State = r.result
+	result.Conflicted = numConflicted
+	result.Unconflicted = numUnconflicted
+	result.RejectedEvents = rejected
+	result.Rejected = len(rejected)
+	result.Mainline = r.mainlineEventIDs()
+	result.Version = ""
+	for _, events := range [][]*Event{r.result, conflicted, unconflicted} {
+		if len(events) > 0 {
+			result.Version = events[0].Version()
+			break
+		}
 	}
-	for _, other := range r.resolvedOthers {
-		r.result = append(r.result, other)
+	if r.resolvedCreate != nil {
+		result.Version = r.resolvedCreate.Version()
 	}
-
-	return r.result
 }
 
 // ReverseTopologicalOrdering takes a set of input events and sorts them
@@ -221,7 +460,9 @@ func ResolveStateConflictsV2(
 // first.
 func ReverseTopologicalOrdering(input []*Event, order TopologicalOrder) []*Event {
 	r := stateResolverV2{}
-	return r.reverseTopologicalOrdering(input, order)
+	// Without an auth event database there is nothing to fail to look up.
+	result, _ := r.reverseTopologicalOrdering(input, order)
+	return result
 }
 
 // HeaderedReverseTopologicalOrdering takes a set of input events and sorts
@@ -236,7 +477,9 @@ func HeaderedReverseTopologicalOrdering(events []*HeaderedEvent, order Topologic
 		input[i] = unwrapped
 	}
 	result := make([]*HeaderedEvent, len(input))
-	for i, e := range r.reverseTopologicalOrdering(input, order) {
+	// Without an auth event database there is nothing to fail to look up.
+	ordered, _ := r.reverseTopologicalOrdering(input, order)
+	for i, e := range ordered {
 		result[i] = e.Headered(e.roomVersion)
 	}
 	return result
@@ -285,13 +528,14 @@ func isControlEvent(e *Event) bool {
 // starting at the currently resolved power level event from the topological
 // ordering and working our way back to the room creation. Note that we populate
 // the result here in reverse, so that the room creation is at the beginning of
-// the list, rather than the end.
-func (r *stateResolverV2) createPowerLevelMainline() []*Event {
+// the list, rather than the end. Returns an error if an auth event couldn't be
+// looked up.
+func (r *stateResolverV2) createPowerLevelMainline() ([]*Event, error) {
 	var mainline []*Event
 
 	// Define our iterator function.
-	var iter func(event *Event)
-	iter = func(event *Event) {
+	var iter func(event *Event) error
+	iter = func(event *Event) error {
 		// Append this event to the beginning of the mainline.
 		mainline = append(mainline, nil)
 		copy(mainline[1:], mainline)
@@ -300,24 +544,46 @@ func (r *stateResolverV2) createPowerLevelMainline() []*Event {
 		for _, authEventID := range event.AuthEventIDs() {
 			// Check that we actually have the auth event in our map - we need this so
 			// that we can look up the event type.
-			if authEvent, ok := r.authEventMap[authEventID]; ok {
-				// Is the event a power event?
-				if authEvent.Type() == MRoomPowerLevels && authEvent.StateKeyEquals("") {
-					// We found a power level event in the event's auth events - start
-					// the iterator from this new event.
-					iter(authEvent)
+			authEvent, err := r.authEvent(authEventID)
+			if err != nil {
+				return err
+			}
+			// Is the event a power event?
+			if authEvent != nil && authEvent.Type() == MRoomPowerLevels && authEvent.StateKeyEquals("") {
+				// We found a power level event in the event's auth events - start
+				// the iterator from this new event.
+				if err = iter(authEvent); err != nil {
+					return err
 				}
 			}
 		}
+		return nil
 	}
 
 	// Begin the sequence from the currently resolved power level event from the
 	// topological ordering.
 	if r.resolvedPowerLevels != nil {
-		iter(r.resolvedPowerLevels)
+		if err := iter(r.resolvedPowerLevels); err != nil {
+			return nil, err
+		}
 	}
 
-	return mainline
+	return mainline, nil
+}
+
+// mainlineEventIDs returns the event IDs of the power level mainline, in order
+// from the power level event closest to the create event to the resolved power
+// level event. The mainline is only known once createPowerLevelMainline has
+// been called, before which this returns nil.
+func (r *stateResolverV2) mainlineEventIDs() []string {
+	if r.powerLevelMainline == nil {
+		return nil
+	}
+	eventIDs := make([]string, 0, len(r.powerLevelMainline))
+	for _, event := range r.powerLevelMainline {
+		eventIDs = append(eventIDs, event.EventID())
+	}
+	return eventIDs
 }
 
 // getFirstPowerLevelMainlineEvent iteratively steps through the auth events of
@@ -325,9 +591,10 @@ func (r *stateResolverV2) createPowerLevelMainline() []*Event {
 // that for this function to work, you must have first called
 // createPowerLevelMainline. This function returns three things: the event that
 // was found in the mainline, the position in the mainline of the found event
-// and the number of steps it took to reach the mainline.
+// and the number of steps it took to reach the mainline, or an error if an
+// auth event couldn't be looked up.
 func (r *stateResolverV2) getFirstPowerLevelMainlineEvent(event *Event) (
-	mainlineEvent *Event, mainlinePosition int, steps int,
+	mainlineEvent *Event, mainlinePosition int, steps int, err error,
 ) {
 	// Define a function that the iterator can use to determine whether the event
 	// is in the mainline set or not.
@@ -341,39 +608,44 @@ func (r *stateResolverV2) getFirstPowerLevelMainlineEvent(event *Event) (
 	}
 
 	// Define our iterator function.
-	var iter func(event *Event)
-	iter = func(event *Event) {
+	var iter func(event *Event) error
+	iter = func(event *Event) error {
 		// In much the same way as we do in createPowerLevelMainline, we loop
 		// through the event's auth events, checking that it exists in our supplied
 		// auth event map and finding power level events.
 		for _, authEventID := range event.AuthEventIDs() {
 			// Check that we actually have the auth event in our map - we need this so
 			// that we can look up the event type.
-			if authEvent, ok := r.authEventMap[authEventID]; ok {
-				// Is the event a power level event?
-				if authEvent.Type() == MRoomPowerLevels && authEvent.StateKeyEquals("") {
-					// Is the event in the mainline?
-					if isIn, pos := isInMainline(authEvent); isIn {
-						// It is - take a note of the event and position and stop the
-						// iterator from running any further.
-						mainlineEvent = authEvent
-						mainlinePosition = pos
-						// Cache the result so that a future request for this position will
-						// be faster.
-						r.powerLevelMainlinePos[mainlineEvent.EventID()] = mainlinePosition
-						return
-					}
-					// It isn't - increase the step count and then run the iterator again
-					// from the found auth event.
-					steps++
-					iter(authEvent)
+			authEvent, err := r.authEvent(authEventID)
+			if err != nil {
+				return err
+			}
+			// Is the event a power level event?
+			if authEvent != nil && authEvent.Type() == MRoomPowerLevels && authEvent.StateKeyEquals("") {
+				// Is the event in the mainline?
+				if isIn, pos := isInMainline(authEvent); isIn {
+					// It is - take a note of the event and position and stop the
+					// iterator from running any further.
+					mainlineEvent = authEvent
+					mainlinePosition = pos
+					// Cache the result so that a future request for this position will
+					// be faster.
+					r.powerLevelMainlinePos[mainlineEvent.EventID()] = mainlinePosition
+					return nil
+				}
+				// It isn't - increase the step count and then run the iterator again
+				// from the found auth event.
+				steps++
+				if err = iter(authEvent); err != nil {
+					return err
 				}
 			}
 		}
+		return nil
 	}
 
 	// Start the iterator with the supplied event.
-	iter(event)
+	err = iter(event)
 
 	return
 }
@@ -381,13 +653,27 @@ func (r *stateResolverV2) getFirstPowerLevelMainlineEvent(event *Event) (
 // authAndApplyEvents iterates through the supplied list of events and auths
 // them against the current partial state. If they pass the auth checks then we
 // also apply them on top of the partial state. If they fail auth checks then
-// the event is ignored and dropped. Returns two lists - the first contains the
-// accepted (authed) events and the second contains the rejected events.
-func (r *stateResolverV2) authAndApplyEvents(events []*Event) {
+// the event is ignored and dropped. If the resolver context is cancelled part
+// way through then the context error is returned.
+func (r *stateResolverV2) authAndApplyEvents(events []*Event) error {
 	for _, event := range events {
+		if r.ctx != nil {
+			if err := r.ctx.Err(); err != nil {
+				return err
+			}
+		}
 		// Check if the event is allowed based on the current partial state. If the
 		// event isn't allowed then simply ignore it and process the next one.
-		if err := r.allower.allowed(event); err != nil {
+		var err error
+		if r.authChecker != nil {
+			err = r.authChecker(event, r)
+		} else {
+			err = r.allower.allowed(event)
+		}
+		if err != nil {
+			if r.recordRejected {
+				r.rejectedEvents = append(r.rejectedEvents, event)
+			}
 			continue
 		}
 		// Apply the newly authed event to the partial state. We need to do this
@@ -400,38 +686,59 @@ func (r *stateResolverV2) authAndApplyEvents(events []*Event) {
 			r.allower = newAllowerContext(r)
 		}
 	}
+	return nil
 }
 
-// applyEvents applies the events on top of the partial state.
+// rejectedNotInState returns the conflicted events which failed auth, once
+// each in the order in which they were first rejected, leaving out any which
+// ended up in the resolved state anyway, e.g. because they were unconflicted
+// and reapplied at the end of the resolution.
+func (r *stateResolverV2) rejectedNotInState() []*Event {
+	seen := make(map[string]struct{}, len(r.rejectedEvents)+len(r.result))
+	for _, event := range r.result {
+		seen[event.EventID()] = struct{}{}
+	}
+	rejected := make([]*Event, 0, len(r.rejectedEvents))
+	for _, event := range r.rejectedEvents {
+		if _, ok := seen[event.EventID()]; ok {
+			continue
+		}
+		seen[event.EventID()] = struct{}{}
+		rejected = append(rejected, event)
+	}
+	return rejected
+}
+
+// applyEvents applies the events on top of the partial state. Events with a
+// state key that isn't valid for their type are ignored, and reported to the
+// warnings callback if there is one.
 func (r *stateResolverV2) applyEvents(events []*Event) {
 	for _, event := range events {
 		st, sk := event.Type(), event.StateKey()
+		if ValidateStateKeyForType(st, sk) != nil {
+			if r.warnings != nil {
+				stateKey := "no state key"
+				if sk != nil {
+					stateKey = fmt.Sprintf("state key %q", *sk)
+				}
+				r.warnings(Warning{
+					EventID: event.EventID(),
+					Message: fmt.Sprintf("dropped %q event with invalid %s from the resolved state", st, stateKey),
+				})
+			}
+			continue
+		}
 		switch st {
 		case MRoomCreate:
-			// Room creation events are only valid with an empty state key.
-			if sk != nil && *sk == "" {
-				r.resolvedCreate = event
-			}
+			r.resolvedCreate = event
 		case MRoomPowerLevels:
-			// Power level events are only valid with an empty state key.
-			if sk != nil && *sk == "" {
-				r.resolvedPowerLevels = event
-			}
+			r.resolvedPowerLevels = event
 		case MRoomJoinRules:
-			// Join rule events are only valid with an empty state key.
-			if sk != nil && *sk == "" {
-				r.resolvedJoinRules = event
-			}
+			r.resolvedJoinRules = event
 		case MRoomThirdPartyInvite:
-			// Third party invite events are only valid with a non-empty state key.
-			if sk != nil && *sk != "" {
-				r.resolvedThirdPartyInvites[*sk] = event
-			}
+			r.resolvedThirdPartyInvites[*sk] = event
 		case MRoomMember:
-			// Membership events are only valid with a non-empty state key.
-			if sk != nil && *sk != "" {
-				r.resolvedMembers[*sk] = event
-			}
+			r.resolvedMembers[*sk] = event
 		default:
 			// Doesn't match one of the core state types so store it by type and state
 			// key.
@@ -442,6 +749,43 @@ func (r *stateResolverV2) applyEvents(events []*Event) {
 	}
 }
 
+// appendPartialState appends the events in the partial state to the given
+// slice and returns it.
+func (r *stateResolverV2) appendPartialState(events []*Event) []*Event {
+	if r.resolvedCreate != nil {
+		events = append(events, r.resolvedCreate)
+	}
+	if r.resolvedJoinRules != nil {
+		events = append(events, r.resolvedJoinRules)
+	}
+	if r.resolvedPowerLevels != nil {
+		events = append(events, r.resolvedPowerLevels)
+	}
+	for _, member := range r.resolvedMembers {
+		events = append(events, member)
+	}
+	for _, invite := range r.resolvedThirdPartyInvites {
+		events = append(events, invite)
+	}
+	for _, other := range r.resolvedOthers {
+		events = append(events, other)
+	}
+	return events
+}
+
+// authEvent looks up the auth event with the given ID. Returns nil if the
+// event isn't known, or an error if the database failed to look it up.
+func (r *stateResolverV2) authEvent(eventID string) (*Event, error) {
+	if r.authEventDB == nil {
+		return nil, nil
+	}
+	event, err := r.authEventDB.GetEvent(eventID)
+	if err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib: failed to look up auth event %q: %w", eventID, err)
+	}
+	return event, nil
+}
+
 // eventMapFromEvents takes a list of events and returns a map, where the key
 // for each value is the event ID.
 func eventMapFromEvents(events []*Event) map[string]*Event {
@@ -457,81 +801,122 @@ func eventMapFromEvents(events []*Event) map[string]*Event {
 // wrapPowerLevelEventsForSort takes the input power level events and wraps them
 // in stateResV2ConflictedPowerLevel structs so that we have the necessary
 // information pre-calculated ahead of sorting.
-func (r *stateResolverV2) wrapPowerLevelEventsForSort(events []*Event) []*stateResV2ConflictedPowerLevel {
+func (r *stateResolverV2) wrapPowerLevelEventsForSort(events []*Event) ([]*stateResV2ConflictedPowerLevel, error) {
+	// Allocate all of the wrappers at once rather than one at a time.
+	wrapped := make([]stateResV2ConflictedPowerLevel, len(events))
 	block := make([]*stateResV2ConflictedPowerLevel, len(events))
 	for i, event := range events {
-		block[i] = &stateResV2ConflictedPowerLevel{
-			powerLevel:     r.getPowerLevelFromAuthEvents(event),
+		powerLevel, err := r.getPowerLevelFromAuthEvents(event)
+		if err != nil {
+			return nil, err
+		}
+		wrapped[i] = stateResV2ConflictedPowerLevel{
+			powerLevel:     powerLevel,
 			originServerTS: int64(event.OriginServerTS()),
 			eventID:        event.EventID(),
 			event:          event,
 		}
+		block[i] = &wrapped[i]
 	}
-	return block
+	return block, nil
 }
 
 // wrapOtherEventsForSort takes the input non-power level events and wraps them
 // in stateResV2ConflictedPowerLevel structs so that we have the necessary
 // information pre-calculated ahead of sorting.
-func (r *stateResolverV2) wrapOtherEventsForSort(events []*Event) []*stateResV2ConflictedOther {
+func (r *stateResolverV2) wrapOtherEventsForSort(events []*Event) ([]*stateResV2ConflictedOther, error) {
+	// Allocate all of the wrappers at once rather than one at a time.
+	wrapped := make([]stateResV2ConflictedOther, len(events))
 	block := make([]*stateResV2ConflictedOther, len(events))
 	for i, event := range events {
-		_, pos, _ := r.getFirstPowerLevelMainlineEvent(event)
-		block[i] = &stateResV2ConflictedOther{
+		_, pos, _, err := r.getFirstPowerLevelMainlineEvent(event)
+		if err != nil {
+			return nil, err
+		}
+		wrapped[i] = stateResV2ConflictedOther{
 			mainlinePosition: pos,
 			originServerTS:   int64(event.OriginServerTS()),
 			eventID:          event.EventID(),
 			event:            event,
 		}
+		block[i] = &wrapped[i]
 	}
-	return block
+	return block, nil
 }
 
 // reverseTopologicalOrdering takes a set of input events, prepares them using
 // wrapPowerLevelEventsForSort and then starts the Kahn's algorithm in order to
 // topologically sort them. The result that is returned is correctly ordered.
-func (r *stateResolverV2) reverseTopologicalOrdering(events []*Event, order TopologicalOrder) []*Event {
+// Returns an error if an auth event couldn't be looked up.
+func (r *stateResolverV2) reverseTopologicalOrdering(events []*Event, order TopologicalOrder) ([]*Event, error) {
 	result := make([]*Event, 0, len(events))
 	switch order {
 	case TopologicalOrderByAuthEvents:
-		block := r.wrapPowerLevelEventsForSort(events)
+		block, err := r.wrapPowerLevelEventsForSort(events)
+		if err != nil {
+			return nil, err
+		}
 		for _, s := range kahnsAlgorithmUsingAuthEvents(block) {
 			result = append(result, s.event)
 		}
 	case TopologicalOrderByPrevEvents:
-		block := r.wrapOtherEventsForSort(events)
+		block, err := r.wrapOtherEventsForSort(events)
+		if err != nil {
+			return nil, err
+		}
 		for _, s := range kahnsAlgorithmUsingPrevEvents(block) {
 			result = append(result, s.event)
 		}
 	default:
 		panic(fmt.Sprintf("gomatrixserverlib.reverseTopologicalOrdering unknown Ordering %d", order))
 	}
-	return result
+	return result, nil
+}
+
+// timedReverseTopologicalOrdering orders the events by their auth events and,
+// if metrics hooks were supplied, adds the time taken to the running total for
+// topological ordering.
+func (r *stateResolverV2) timedReverseTopologicalOrdering(events []*Event) ([]*Event, error) {
+	if r.metrics == nil {
+		return r.reverseTopologicalOrdering(events, TopologicalOrderByAuthEvents)
+	}
+	started := time.Now()
+	defer func() {
+		r.topologicalOrderingTime += time.Since(started)
+	}()
+	return r.reverseTopologicalOrdering(events, TopologicalOrderByAuthEvents)
 }
 
 // mainlineOrdering takes a set of input events, prepares them using
 // wrapOtherEventsForSort and then sorts them based on mainline ordering. The
 // result that is returned is correctly ordered.
-func (r *stateResolverV2) mainlineOrdering(events []*Event) []*Event {
-	block := r.wrapOtherEventsForSort(events)
+func (r *stateResolverV2) mainlineOrdering(events []*Event) ([]*Event, error) {
+	block, err := r.wrapOtherEventsForSort(events)
+	if err != nil {
+		return nil, err
+	}
 	result := make([]*Event, 0, len(block))
 	sort.Sort(stateResV2ConflictedOtherHeap(block))
 	for _, s := range block {
 		result = append(result, s.event)
 	}
-	return result
+	return result, nil
 }
 
 // getPowerLevelFromAuthEvents tries to determine the effective power level of
 // the sender at the time that of the given event, based on the auth events.
-// This is used in the Kahn's algorithm tiebreak.
-func (r *stateResolverV2) getPowerLevelFromAuthEvents(event *Event) int64 {
+// This is used in the Kahn's algorithm tiebreak. Returns an error if an auth
+// event couldn't be looked up.
+func (r *stateResolverV2) getPowerLevelFromAuthEvents(event *Event) (int64, error) {
 	user := event.Sender()
 	for _, authID := range event.AuthEventIDs() {
 		// Then check and see if we have the auth event in the auth map, if not
 		// then we cannot deduce the real effective power level.
-		authEvent, ok := r.authEventMap[authID]
-		if !ok {
+		authEvent, err := r.authEvent(authID)
+		if err != nil {
+			return 0, err
+		}
+		if authEvent == nil {
 			continue
 		}
 
@@ -547,7 +932,8 @@ func (r *stateResolverV2) getPowerLevelFromAuthEvents(event *Event) int64 {
 			// Try and parse the content of the event.
 			parsed, err := NewPowerLevelContentFromEvent(authEvent)
 			if err != nil {
-				return 0
+				// An unparsable power level event gives everyone level 0.
+				return 0, nil
 			}
 			content = &parsed
 
@@ -557,10 +943,10 @@ func (r *stateResolverV2) getPowerLevelFromAuthEvents(event *Event) int64 {
 
 		// Look up what the power level should be for this user. If the user is
 		// not in the list, the default user power level will be returned instead.
-		return content.UserLevel(user)
+		return content.UserLevel(user), nil
 	}
 
-	return 0
+	return 0, nil
 }
 
 // kahnsAlgorithmByAuthEvents is, predictably, an implementation of Kahn's
@@ -610,10 +996,9 @@ func kahnsAlgorithmUsingAuthEvents(events []*stateResV2ConflictedPowerLevel) []*
 		event = heap.Pop(&noIncoming).(*stateResV2ConflictedPowerLevel)
 
 		// Since there are no incoming dependencies to resolve, we can now add this
-		// event into the graph.
-		graph = append(graph, nil)
-		copy(graph[1:], graph)
-		graph[0] = event
+		// event into the graph. Events are popped newest first, so the graph is
+		// built in reverse and flipped around at the end.
+		graph = append(graph, event)
 
 		// Now we should look at the outgoing auth dependencies that this event has.
 		// Since this event is now in the graph, the event's outgoing auth
@@ -635,6 +1020,11 @@ func kahnsAlgorithmUsingAuthEvents(events []*stateResV2ConflictedPowerLevel) []*
 		}
 	}
 
+	// Put the graph into oldest first order.
+	for i, j := 0, len(graph)-1; i < j; i, j = i+1, j-1 {
+		graph[i], graph[j] = graph[j], graph[i]
+	}
+
 	// If we have stray events left over then add them into the result.
 	if len(eventMap) > 0 {
 		remaining := make(stateResV2ConflictedPowerLevelHeap, 0, len(events))
@@ -696,10 +1086,9 @@ func kahnsAlgorithmUsingPrevEvents(events []*stateResV2ConflictedOther) []*state
 		event = heap.Pop(&noIncoming).(*stateResV2ConflictedOther)
 
 		// Since there are no incoming dependencies to resolve, we can now add this
-		// event into the graph.
-		graph = append(graph, nil)
-		copy(graph[1:], graph)
-		graph[0] = event
+		// event into the graph. Events are popped newest first, so the graph is
+		// built in reverse and flipped around at the end.
+		graph = append(graph, event)
 
 		// Now we should look at the outgoing prev dependencies that this event has.
 		// Since this event is now in the graph, the event's outgoing prev
@@ -721,6 +1110,11 @@ func kahnsAlgorithmUsingPrevEvents(events []*stateResV2ConflictedOther) []*state
 		}
 	}
 
+	// Put the graph into oldest first order.
+	for i, j := 0, len(graph)-1; i < j; i, j = i+1, j-1 {
+		graph[i], graph[j] = graph[j], graph[i]
+	}
+
 	// If we have stray events left over then add them into the result.
 	if len(eventMap) > 0 {
 		remaining := make(stateResV2ConflictedOtherHeap, 0, len(events))
@@ -15,8 +15,14 @@
 package gomatrixserverlib
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -420,7 +426,10 @@ func TestReverseTopologicalEventSorting(t *testing.T) {
 	for i := range graph {
 		base = append(base, graph[i])
 	}
-	input := r.reverseTopologicalOrdering(base, TopologicalOrderByAuthEvents)
+	input, err := r.reverseTopologicalOrdering(base, TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	expected := []string{
 		"$CREATE:example.com", "$IMA:example.com", "$IPOWER:example.com",
@@ -504,6 +513,225 @@ func TestStateResolutionOtherEventDoesntOverpowerPowerEvent(t *testing.T) {
 	}
 }
 
+// countdownContext is a context which reports itself as cancelled once Err
+// has been called a given number of times, so that tests can cancel state
+// resolution part way through deterministically.
+type countdownContext struct {
+	context.Context
+	remaining int
+}
+
+func (c *countdownContext) Err() error {
+	if c.remaining <= 0 {
+		return context.Canceled
+	}
+	c.remaining--
+	return nil
+}
+
+func TestStateResolutionV2Cancellation(t *testing.T) {
+	input := getBaseStateResV2Graph()
+	conflicted, unconflicted := separate(input)
+
+	// A context which is already cancelled should stop resolution before any
+	// work is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ResolveStateConflictsV2WithOptions(ctx, conflicted, unconflicted, input, nil, StateResolutionV2Options{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled with a cancelled context, got %v", err)
+	}
+
+	// Cancelling part way through, while authing the auth events, should also
+	// stop resolution.
+	ctx = &countdownContext{Context: context.Background(), remaining: len(conflicted) + 3}
+	result, err := ResolveStateConflictsV2WithOptions(ctx, conflicted, unconflicted, input, nil, StateResolutionV2Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled when cancelled mid-resolution, got %v", err)
+	}
+	if result != nil {
+		t.Fatalf("expected no result when cancelled mid-resolution, got %d events", len(result))
+	}
+
+	// A context which is never cancelled should resolve to the same state as
+	// ResolveStateConflictsV2.
+	result, err = ResolveStateConflictsV2WithOptions(context.Background(), conflicted, unconflicted, input, nil, StateResolutionV2Options{})
+	if err != nil {
+		t.Fatalf("ResolveStateConflictsV2WithOptions failed: %s", err)
+	}
+	if expected := ResolveStateConflictsV2(conflicted, unconflicted, input, nil); len(result) != len(expected) {
+		t.Fatalf("got %d resolved events but expected %d", len(result), len(expected))
+	}
+}
+
+type recordingResolutionMetrics struct {
+	topologicalOrdering  []time.Duration
+	mainlineConstruction []time.Duration
+	mainlineOrdering     []time.Duration
+	conflicted           int
+	unconflicted         int
+	rejected             int
+	countsCalled         int
+}
+
+func (m *recordingResolutionMetrics) TopologicalOrdering(d time.Duration) {
+	m.topologicalOrdering = append(m.topologicalOrdering, d)
+}
+
+func (m *recordingResolutionMetrics) MainlineConstruction(d time.Duration) {
+	m.mainlineConstruction = append(m.mainlineConstruction, d)
+}
+
+func (m *recordingResolutionMetrics) MainlineOrdering(d time.Duration) {
+	m.mainlineOrdering = append(m.mainlineOrdering, d)
+}
+
+func (m *recordingResolutionMetrics) EventCounts(conflicted, unconflicted, rejected int) {
+	m.conflicted, m.unconflicted, m.rejected = conflicted, unconflicted, rejected
+	m.countsCalled++
+}
+
+func TestStateResolutionV2Metrics(t *testing.T) {
+	input := getBaseStateResV2Graph()
+	conflicted, unconflicted := separate(input)
+
+	// Zara has never joined the room, so Zara's topic change should be rejected.
+	conflicted = append(conflicted, &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$ZT:example.com",
+			eventFields: eventFields{
+				RoomID:         "!ROOM:example.com",
+				Type:           "m.room.topic",
+				OriginServerTS: 7,
+				Sender:         ZARA,
+				StateKey:       &emptyStateKey,
+				Content:        []byte(`{"topic": "zara was here"}`),
+			},
+			PrevEvents: []EventReference{
+				{EventID: "$IMC:example.com"},
+			},
+			AuthEvents: []EventReference{
+				{EventID: "$CREATE:example.com"},
+				{EventID: "$IPOWER:example.com"},
+			},
+		},
+	})
+
+	metrics := &recordingResolutionMetrics{}
+	result, err := ResolveStateConflictsV2WithOptions(
+		context.Background(), conflicted, unconflicted, input, nil,
+		StateResolutionV2Options{Metrics: metrics},
+	)
+	if err != nil {
+		t.Fatalf("ResolveStateConflictsV2WithOptions failed: %s", err)
+	}
+	for _, event := range result {
+		if event.EventID() == "$ZT:example.com" {
+			t.Fatal("expected the topic change from a non-member to be rejected")
+		}
+	}
+
+	for name, durations := range map[string][]time.Duration{
+		"TopologicalOrdering":  metrics.topologicalOrdering,
+		"MainlineConstruction": metrics.mainlineConstruction,
+		"MainlineOrdering":     metrics.mainlineOrdering,
+	} {
+		if len(durations) != 1 {
+			t.Fatalf("expected %s to be called once, got %d calls", name, len(durations))
+		}
+		if durations[0] < 0 {
+			t.Fatalf("expected %s duration to be non-negative, got %s", name, durations[0])
+		}
+	}
+	if metrics.countsCalled != 1 {
+		t.Fatalf("expected EventCounts to be called once, got %d calls", metrics.countsCalled)
+	}
+	if metrics.conflicted != len(conflicted) {
+		t.Fatalf("got %d conflicted events, expected %d", metrics.conflicted, len(conflicted))
+	}
+	if metrics.unconflicted != len(unconflicted) {
+		t.Fatalf("got %d unconflicted events, expected %d", metrics.unconflicted, len(unconflicted))
+	}
+	if metrics.rejected != 1 {
+		t.Fatalf("got %d rejected events, expected 1", metrics.rejected)
+	}
+}
+
+func TestStateResolutionV2ResultDetails(t *testing.T) {
+	input := getBaseStateResV2Graph()
+	conflicted, unconflicted := separate(input)
+
+	// Zara has never joined the room, so her topic change should be rejected.
+	conflicted = append(conflicted, &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$ZT:example.com",
+			eventFields: eventFields{
+				RoomID:         "!ROOM:example.com",
+				Type:           "m.room.topic",
+				OriginServerTS: 7,
+				Sender:         ZARA,
+				StateKey:       &emptyStateKey,
+				Content:        []byte(`{"topic": "zara was here"}`),
+			},
+			PrevEvents: []EventReference{
+				{EventID: "$IMC:example.com"},
+			},
+			AuthEvents: []EventReference{
+				{EventID: "$CREATE:example.com"},
+				{EventID: "$IPOWER:example.com"},
+			},
+		},
+	})
+
+	var result StateResolutionResult
+	_, err := ResolveStateConflictsV2WithOptions(
+		context.Background(), conflicted, unconflicted, input, nil, StateResolutionV2Options{Result: &result},
+	)
+	if err != nil {
+		t.Fatalf("ResolveStateConflictsV2WithOptions failed: %s", err)
+	}
+	var got, expected []string
+	for _, event := range result.State {
+		got = append(got, event.EventID())
+	}
+	for _, event := range ResolveStateConflictsV2(conflicted, unconflicted, input, nil) {
+		expected = append(expected, event.EventID())
+	}
+	sort.Strings(got)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got resolved state %v, expected %v", got, expected)
+	}
+	if result.Conflicted != len(conflicted) {
+		t.Fatalf("got %d conflicted events, expected %d", result.Conflicted, len(conflicted))
+	}
+	if result.Rejected != 1 {
+		t.Fatalf("got %d rejected events, expected 1", result.Rejected)
+	}
+	if len(result.RejectedEvents) != 1 || result.RejectedEvents[0].EventID() != "$ZT:example.com" {
+		t.Fatalf("got rejected events %v, expected [$ZT:example.com]", result.RejectedEvents)
+	}
+	if result.Unconflicted != len(unconflicted) {
+		t.Fatalf("got %d unconflicted events, expected %d", result.Unconflicted, len(unconflicted))
+	}
+	if result.Trace != nil {
+		t.Fatal("expected no trace unless one is asked for")
+	}
+	if result.Version != RoomVersionV2 {
+		t.Fatalf("got room version %q, expected %q", result.Version, RoomVersionV2)
+	}
+	if result.Duration < 0 {
+		t.Fatalf("expected a non-negative duration, got %s", result.Duration)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ResolveStateConflictsV2WithOptions(ctx, conflicted, unconflicted, input, nil, StateResolutionV2Options{Result: &result}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
 func runStateResolutionV2(t *testing.T, additional []*Event, expected []string) {
 	input := append(getBaseStateResV2Graph(), additional...)
 	conflicted, unconflicted := separate(input)
@@ -564,3 +792,729 @@ func runStateResolutionV2(t *testing.T, additional []*Event, expected []string)
 		t.Fatalf("expected to find '%s' in resolved state but didn't", missing)
 	}
 }
+
+func TestStateResolutionV2WarnsAboutInvalidStateKeys(t *testing.T) {
+	input := getBaseStateResV2Graph()
+	conflicted, unconflicted := separate(input)
+
+	// Power level events must have an empty state key, so this one can't
+	// be part of the resolved state.
+	bogusStateKey := "bogus"
+	conflicted = append(conflicted, &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$BOGUSPOWER:example.com",
+			eventFields: eventFields{
+				RoomID:         "!ROOM:example.com",
+				Type:           MRoomPowerLevels,
+				OriginServerTS: 7,
+				Sender:         ALICE,
+				StateKey:       &bogusStateKey,
+				Content:        []byte(`{"users": {"` + ALICE + `": 100}}`),
+			},
+			PrevEvents: []EventReference{
+				{EventID: "$IMC:example.com"},
+			},
+			AuthEvents: []EventReference{
+				{EventID: "$CREATE:example.com"},
+				{EventID: "$IPOWER:example.com"},
+				{EventID: "$IMA:example.com"},
+			},
+		},
+	})
+
+	var warnings []Warning
+	result, err := ResolveStateConflictsV2WithOptions(
+		context.Background(), conflicted, unconflicted, input, nil,
+		StateResolutionV2Options{
+			Warnings: func(w Warning) {
+				warnings = append(warnings, w)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("ResolveStateConflictsV2WithOptions failed: %s", err)
+	}
+	for _, event := range result {
+		if event.EventID() == "$BOGUSPOWER:example.com" {
+			t.Fatal("expected the power level event with a non-empty state key to be dropped")
+		}
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected one warning, got %d: %v", len(warnings), warnings)
+	}
+	if warnings[0].EventID != "$BOGUSPOWER:example.com" {
+		t.Errorf("expected the warning to be about $BOGUSPOWER:example.com, got %q", warnings[0].EventID)
+	}
+	if !strings.Contains(warnings[0].Message, `"bogus"`) {
+		t.Errorf("expected the warning to mention the state key, got %q", warnings[0].Message)
+	}
+}
+
+// testKahnsGraph returns n events in a tree, where each event references its
+// parent and sometimes an earlier sibling as both its prev events and its auth
+// events, so that there are lots of events to tiebreak between.
+func testKahnsGraph(n int) []*Event {
+	events := make([]*Event, n)
+	for i := range events {
+		var refs []EventReference
+		if i > 0 {
+			refs = append(refs, EventReference{EventID: events[(i-1)/2].EventID()})
+		}
+		if i%4 == 3 {
+			refs = append(refs, EventReference{EventID: events[i-2].EventID()})
+		}
+		events[i] = &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: fmt.Sprintf("$%05d:example.com", i),
+				eventFields: eventFields{
+					RoomID:         "!ROOM:example.com",
+					Type:           MRoomPowerLevels,
+					OriginServerTS: Timestamp(i % 5),
+					Sender:         ALICE,
+					StateKey:       &emptyStateKey,
+					Content:        []byte(`{}`),
+				},
+				PrevEvents: refs,
+				AuthEvents: refs,
+			},
+		}
+	}
+	return events
+}
+
+func testKahnsPowerLevelBlock(events []*Event) []*stateResV2ConflictedPowerLevel {
+	block := make([]*stateResV2ConflictedPowerLevel, len(events))
+	for i, event := range events {
+		block[i] = &stateResV2ConflictedPowerLevel{
+			powerLevel:     int64(i%3) * 50,
+			originServerTS: int64(event.OriginServerTS()),
+			eventID:        event.EventID(),
+			event:          event,
+		}
+	}
+	return block
+}
+
+func testKahnsOtherBlock(events []*Event) []*stateResV2ConflictedOther {
+	block := make([]*stateResV2ConflictedOther, len(events))
+	for i, event := range events {
+		block[i] = &stateResV2ConflictedOther{
+			mainlinePosition: i % 3,
+			originServerTS:   int64(event.OriginServerTS()),
+			eventID:          event.EventID(),
+			event:            event,
+		}
+	}
+	return block
+}
+
+func TestKahnsAlgorithmOrder(t *testing.T) {
+	events := testKahnsGraph(12)
+	// Add a pair of events which reference each other, so that they can never
+	// be sorted topologically and are left over at the end.
+	for _, ids := range [][2]string{{"$cyclea:example.com", "$cycleb:example.com"}, {"$cycleb:example.com", "$cyclea:example.com"}} {
+		refs := []EventReference{{EventID: ids[1]}}
+		events = append(events, &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: ids[0],
+				eventFields: eventFields{
+					RoomID:   "!ROOM:example.com",
+					Type:     MRoomPowerLevels,
+					Sender:   ALICE,
+					StateKey: &emptyStateKey,
+					Content:  []byte(`{}`),
+				},
+				PrevEvents: refs,
+				AuthEvents: refs,
+			},
+		})
+	}
+
+	var gotAuth, gotPrev []string
+	for _, s := range kahnsAlgorithmUsingAuthEvents(testKahnsPowerLevelBlock(events)) {
+		gotAuth = append(gotAuth, s.eventID)
+	}
+	for _, s := range kahnsAlgorithmUsingPrevEvents(testKahnsOtherBlock(events)) {
+		gotPrev = append(gotPrev, s.eventID)
+	}
+	// The orders are fixed by the tiebreaks, so these must not change.
+	wantAuth := []string{
+		"$cyclea:example.com", "$cycleb:example.com", "$00000:example.com",
+		"$00002:example.com", "$00006:example.com", "$00001:example.com",
+		"$00003:example.com", "$00004:example.com", "$00009:example.com",
+		"$00010:example.com", "$00005:example.com", "$00007:example.com",
+		"$00011:example.com", "$00008:example.com",
+	}
+	wantPrev := []string{
+		"$cyclea:example.com", "$cycleb:example.com", "$00000:example.com",
+		"$00001:example.com", "$00004:example.com", "$00009:example.com",
+		"$00003:example.com", "$00002:example.com", "$00006:example.com",
+		"$00005:example.com", "$00007:example.com", "$00010:example.com",
+		"$00008:example.com", "$00011:example.com",
+	}
+	if !reflect.DeepEqual(gotAuth, wantAuth) {
+		t.Errorf("got auth event ordering %v, want %v", gotAuth, wantAuth)
+	}
+	if !reflect.DeepEqual(gotPrev, wantPrev) {
+		t.Errorf("got prev event ordering %v, want %v", gotPrev, wantPrev)
+	}
+}
+
+func BenchmarkKahnsAlgorithmUsingAuthEvents(b *testing.B) {
+	events := testKahnsGraph(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		kahnsAlgorithmUsingAuthEvents(testKahnsPowerLevelBlock(events))
+	}
+}
+
+func BenchmarkKahnsAlgorithmUsingPrevEvents(b *testing.B) {
+	events := testKahnsGraph(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		kahnsAlgorithmUsingPrevEvents(testKahnsOtherBlock(events))
+	}
+}
+
+// testLargeConflictedMembership returns the base graph along with two
+// conflicting join events for each of n users, for benchmarking state
+// resolution on rooms with a lot of state.
+func testLargeConflictedMembership(n int) (conflicted, unconflicted, authEvents []*Event) {
+	input := getBaseStateResV2Graph()
+	conflicted, unconflicted = separate(input)
+	authEvents = input
+	for i := 0; i < n; i++ {
+		userID := fmt.Sprintf("@user%d:example.com", i)
+		for j := 0; j < 2; j++ {
+			conflicted = append(conflicted, &Event{
+				roomVersion: RoomVersionV2,
+				fields: eventFormatV1Fields{
+					EventID: fmt.Sprintf("$user%d-%d:example.com", i, j),
+					eventFields: eventFields{
+						RoomID:         "!ROOM:example.com",
+						Type:           MRoomMember,
+						OriginServerTS: Timestamp(10 + j),
+						Sender:         userID,
+						StateKey:       &userID,
+						Content:        []byte(`{"membership": "join"}`),
+					},
+					PrevEvents: []EventReference{
+						{EventID: "$IJR:example.com"},
+					},
+					AuthEvents: []EventReference{
+						{EventID: "$CREATE:example.com"},
+						{EventID: "$IJR:example.com"},
+						{EventID: "$IPOWER:example.com"},
+					},
+				},
+			})
+		}
+	}
+	return
+}
+
+func BenchmarkStateResolutionV2LargeState(b *testing.B) {
+	conflicted, unconflicted, authEvents := testLargeConflictedMembership(25000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ResolveStateConflictsV2WithOptions(
+			context.Background(), conflicted, unconflicted, authEvents, nil, StateResolutionV2Options{},
+		); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStateResolutionV2MainlineFallsBackToUnconflictedPowerLevels(t *testing.T) {
+	input := getBaseStateResV2Graph()
+	_, unconflicted := separate(input)
+
+	powerEvent := func(eventID, sender string, ts Timestamp) *Event {
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: eventID,
+				eventFields: eventFields{
+					RoomID:         "!ROOM:example.com",
+					Type:           MRoomPowerLevels,
+					OriginServerTS: ts,
+					Sender:         sender,
+					StateKey:       &emptyStateKey,
+					Content:        []byte(`{"users": {"` + sender + `": 100}}`),
+				},
+				PrevEvents: []EventReference{
+					{EventID: "$IMC:example.com"},
+				},
+				AuthEvents: []EventReference{
+					{EventID: "$CREATE:example.com"},
+					{EventID: "$IPOWER:example.com"},
+				},
+			},
+		}
+	}
+	topicEvent := func(eventID string, ts Timestamp, powerEventID string) *Event {
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: eventID,
+				eventFields: eventFields{
+					RoomID:         "!ROOM:example.com",
+					Type:           "m.room.topic",
+					OriginServerTS: ts,
+					Sender:         ALICE,
+					StateKey:       &emptyStateKey,
+					Content:        []byte(`{"topic": "` + eventID + `"}`),
+				},
+				PrevEvents: []EventReference{
+					{EventID: "$IMC:example.com"},
+				},
+				AuthEvents: []EventReference{
+					{EventID: "$CREATE:example.com"},
+					{EventID: "$IMA:example.com"},
+					{EventID: powerEventID},
+				},
+			},
+		}
+	}
+
+	// Neither Bob nor Charlie has the power to change the power levels, so
+	// both of the conflicted power level events fail auth. The mainline must
+	// then be built from the unconflicted power level event alone.
+	conflicted := []*Event{
+		powerEvent("$PB:example.com", BOB, 7),
+		powerEvent("$PC:example.com", CHARLIE, 8),
+		// The later topic cites Bob's rejected power level event. If that
+		// leaked into the mainline then the topics would have different
+		// mainline positions, rather than sharing one and being ordered by
+		// their timestamps.
+		topicEvent("$TA:example.com", 9, "$IPOWER:example.com"),
+		topicEvent("$TB:example.com", 10, "$PB:example.com"),
+	}
+	// The rejected power level events aren't part of the auth chain, but they
+	// need to be looked up when working out the mainline position of a topic.
+	authEventDB := NewMemoryEventDatabase(append(input, conflicted[0], conflicted[1]))
+
+	metrics := &recordingResolutionMetrics{}
+	result, err := ResolveStateConflictsV2WithOptions(
+		context.Background(), conflicted, unconflicted, input, nil,
+		StateResolutionV2Options{Metrics: metrics, AuthEventDatabase: authEventDB},
+	)
+	if err != nil {
+		t.Fatalf("ResolveStateConflictsV2WithOptions failed: %s", err)
+	}
+	if metrics.rejected != 2 {
+		t.Errorf("got %d rejected events, expected 2", metrics.rejected)
+	}
+	resolved := make(map[string]string, len(result))
+	for _, event := range result {
+		resolved[event.Type()] = event.EventID()
+	}
+	if got := resolved[MRoomPowerLevels]; got != "$IPOWER:example.com" {
+		t.Errorf("expected the unconflicted power levels to be resolved, got %q", got)
+	}
+	if got := resolved["m.room.topic"]; got != "$TB:example.com" {
+		t.Errorf("expected the later topic to be resolved, got %q", got)
+	}
+}
+
+func TestStateResolutionV2Trace(t *testing.T) {
+	base := getBaseStateResV2Graph()
+	event := func(eventID, eventType string, ts Timestamp, content string, authEvents ...string) *Event {
+		references := make([]EventReference, 0, len(authEvents))
+		for _, authEventID := range authEvents {
+			references = append(references, EventReference{EventID: authEventID})
+		}
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: eventID,
+				eventFields: eventFields{
+					RoomID:         "!ROOM:example.com",
+					Type:           eventType,
+					OriginServerTS: ts,
+					Sender:         ALICE,
+					StateKey:       &emptyStateKey,
+					Content:        []byte(content),
+				},
+				PrevEvents: []EventReference{
+					{EventID: "$IMC:example.com"},
+				},
+				AuthEvents: references,
+			},
+		}
+	}
+	powerA := event("$PA:example.com", MRoomPowerLevels, 7, `{"users": {"`+ALICE+`": 100, "`+BOB+`": 50}}`,
+		"$CREATE:example.com", "$IMA:example.com", "$IPOWER:example.com")
+	topicA := event("$TA:example.com", "m.room.topic", 8, `{"topic": "a"}`,
+		"$CREATE:example.com", "$IMA:example.com", "$PA:example.com")
+	topicB := event("$TB:example.com", "m.room.topic", 9, `{"topic": "b"}`,
+		"$CREATE:example.com", "$IMA:example.com", "$PA:example.com")
+
+	// The initial power levels are conflicted with the new power levels.
+	conflicted := []*Event{base[2], powerA, topicA, topicB}
+	unconflicted := append(append([]*Event{}, base[:2]...), base[3:]...)
+	var resolution StateResolutionResult
+	result, err := ResolveStateConflictsV2WithOptions(
+		context.Background(), conflicted, unconflicted, base, nil,
+		StateResolutionV2Options{
+			AuthEventDatabase: NewMemoryEventDatabase(append(append([]*Event{}, base...), conflicted...)),
+			Result:            &resolution,
+			Trace:             true,
+		},
+	)
+	if err != nil {
+		t.Fatalf("ResolveStateConflictsV2WithOptions failed: %s", err)
+	}
+	trace := resolution.Trace
+
+	check := func(phase string, state []*Event, wantPower, wantTopic string) {
+		t.Helper()
+		snapshot := NewStateSnapshot(state)
+		if got := snapshot.Event(MRoomPowerLevels, ""); got == nil || got.EventID() != wantPower {
+			t.Errorf("%s: got power levels %v, want %q", phase, got, wantPower)
+		}
+		got := snapshot.Event("m.room.topic", "")
+		switch {
+		case wantTopic == "" && got != nil:
+			t.Errorf("%s: got topic %q, want none", phase, got.EventID())
+		case wantTopic != "" && (got == nil || got.EventID() != wantTopic):
+			t.Errorf("%s: got topic %v, want %q", phase, got, wantTopic)
+		}
+	}
+	check("unconflicted", trace.Unconflicted, "$IPOWER:example.com", "")
+	check("conflicted control", trace.ConflictedControl, "$PA:example.com", "")
+	check("mainline", trace.Mainline, "$PA:example.com", "$TB:example.com")
+	check("final", trace.Final, "$PA:example.com", "$TB:example.com")
+	if len(trace.Final) != len(result) {
+		t.Errorf("got %d events in the final trace, want %d", len(trace.Final), len(result))
+	}
+	check("result", result, "$PA:example.com", "$TB:example.com")
+}
+
+func TestStateResolutionV2OptionsResult(t *testing.T) {
+	input := getBaseStateResV2Graph()
+	conflicted, unconflicted := separate(input)
+
+	var result StateResolutionResult
+	resolved, err := ResolveStateConflictsV2WithOptions(
+		context.Background(), conflicted, unconflicted, input, nil,
+		StateResolutionV2Options{Result: &result, Trace: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.State) != len(resolved) {
+		t.Fatalf("got %d events in the result, want %d", len(result.State), len(resolved))
+	}
+	if result.Trace == nil || len(result.Trace.Final) != len(resolved) {
+		t.Fatalf("expected a trace ending in the resolved state, got %v", result.Trace)
+	}
+	if len(result.Mainline) == 0 || result.Mainline[len(result.Mainline)-1] != "$IPOWER:example.com" {
+		t.Fatalf("expected the mainline to end at the resolved power levels, got %v", result.Mainline)
+	}
+
+	// Nothing is recorded if the resolution fails.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result = StateResolutionResult{}
+	if _, err = ResolveStateConflictsV2WithOptions(ctx, conflicted, unconflicted, input, nil, StateResolutionV2Options{Result: &result}); err == nil {
+		t.Fatal("expected an error from a cancelled context")
+	}
+	if result.State != nil || result.Mainline != nil {
+		t.Errorf("expected the result to be left empty, got %+v", result)
+	}
+}
+
+func TestStateResolutionV2WithoutPowerLevels(t *testing.T) {
+	// The room only has a create event and the creator's join, so there is
+	// no power level event to build a mainline from. The creator still has
+	// the power to set the topic.
+	base := getBaseStateResV2Graph()[:2]
+	topic := func(eventID string, ts Timestamp) *Event {
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: eventID,
+				eventFields: eventFields{
+					RoomID:         "!ROOM:example.com",
+					Type:           "m.room.topic",
+					OriginServerTS: ts,
+					Sender:         ALICE,
+					StateKey:       &emptyStateKey,
+					Content:        []byte(`{"topic": "` + eventID + `"}`),
+				},
+				PrevEvents: []EventReference{
+					{EventID: "$IMA:example.com"},
+				},
+				AuthEvents: []EventReference{
+					{EventID: "$CREATE:example.com"},
+					{EventID: "$IMA:example.com"},
+				},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		topics    []*Event
+		wantTopic string
+	}{
+		{"ordered by timestamp", []*Event{topic("$TB:example.com", 3), topic("$TA:example.com", 4)}, "$TA:example.com"},
+		{"ordered by event ID", []*Event{topic("$TB:example.com", 3), topic("$TA:example.com", 3)}, "$TB:example.com"},
+	} {
+		result, err := ResolveStateConflictsV2WithOptions(context.Background(), tc.topics, base, base, nil, StateResolutionV2Options{})
+		if err != nil {
+			t.Fatalf("%s: ResolveStateConflictsV2WithOptions failed: %s", tc.name, err)
+		}
+		snapshot := NewStateSnapshot(result)
+		if len(snapshot) != 3 {
+			t.Errorf("%s: got %d state events, want 3", tc.name, len(snapshot))
+		}
+		if got := snapshot.Event("m.room.topic", ""); got == nil || got.EventID() != tc.wantTopic {
+			t.Errorf("%s: got topic %v, want %q", tc.name, got, tc.wantTopic)
+		}
+	}
+}
+
+func TestStateResolutionV2RejectedEvents(t *testing.T) {
+	input := append(getBaseStateResV2Graph(),
+		// Alice bans Bob.
+		&Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: "$BAN:example.com",
+				eventFields: eventFields{
+					RoomID:         "!ROOM:example.com",
+					Type:           MRoomMember,
+					OriginServerTS: 7,
+					Sender:         ALICE,
+					StateKey:       &BOB,
+					Content:        []byte(`{"membership": "ban"}`),
+				},
+				PrevEvents: []EventReference{
+					{EventID: "$IMC:example.com"},
+				},
+				AuthEvents: []EventReference{
+					{EventID: "$CREATE:example.com"},
+					{EventID: "$IPOWER:example.com"},
+					{EventID: "$IMA:example.com"},
+					{EventID: "$IMB:example.com"},
+				},
+			},
+		},
+		// Bob changes their display name on a fork which doesn't know about
+		// the ban. This would be allowed if Bob hadn't been banned.
+		&Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: "$BJ:example.com",
+				eventFields: eventFields{
+					RoomID:         "!ROOM:example.com",
+					Type:           MRoomMember,
+					OriginServerTS: 9,
+					Sender:         BOB,
+					StateKey:       &BOB,
+					Content:        []byte(`{"membership": "join", "displayname": "Bob"}`),
+				},
+				PrevEvents: []EventReference{
+					{EventID: "$IMC:example.com"},
+				},
+				AuthEvents: []EventReference{
+					{EventID: "$CREATE:example.com"},
+					{EventID: "$IPOWER:example.com"},
+					{EventID: "$IMB:example.com"},
+				},
+			},
+		},
+	)
+	// Zara, who isn't in the room, sets the topic. This fails auth when the
+	// auth chain is replayed, but as it is unconflicted it is reapplied and
+	// ends up in the resolved state, so it mustn't be reported as rejected.
+	zaraTopic := &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$ZTOPIC:example.com",
+			eventFields: eventFields{
+				RoomID:         "!ROOM:example.com",
+				Type:           "m.room.topic",
+				OriginServerTS: 8,
+				Sender:         ZARA,
+				StateKey:       &emptyStateKey,
+				Content:        []byte(`{"topic": "Zara's topic"}`),
+			},
+			PrevEvents: []EventReference{
+				{EventID: "$IMC:example.com"},
+			},
+			AuthEvents: []EventReference{
+				{EventID: "$CREATE:example.com"},
+				{EventID: "$IPOWER:example.com"},
+			},
+		},
+	}
+	conflicted, unconflicted := separate(input)
+	unconflicted = append(unconflicted, zaraTopic)
+	input = append(input, zaraTopic)
+
+	var result StateResolutionResult
+	metrics := &recordingResolutionMetrics{}
+	if _, err := ResolveStateConflictsV2WithOptions(
+		context.Background(), conflicted, unconflicted, input, nil,
+		StateResolutionV2Options{Result: &result, Metrics: metrics},
+	); err != nil {
+		t.Fatal(err)
+	}
+	// Zara's topic fails auth while the auth chain is replayed, which mustn't
+	// be counted by the metrics either.
+	if metrics.rejected != len(result.RejectedEvents) || result.Rejected != len(result.RejectedEvents) {
+		t.Errorf(
+			"got %d rejected events in the metrics and %d in the result, want both to be %d",
+			metrics.rejected, result.Rejected, len(result.RejectedEvents),
+		)
+	}
+	rejected := make(map[string]bool)
+	for _, event := range result.RejectedEvents {
+		if rejected[event.EventID()] {
+			t.Fatalf("event %q was returned more than once", event.EventID())
+		}
+		rejected[event.EventID()] = true
+	}
+	if !rejected["$BJ:example.com"] {
+		t.Errorf("expected the banned user's event to be rejected, got %v", rejected)
+	}
+	if rejected["$BAN:example.com"] {
+		t.Error("expected the ban not to be rejected")
+	}
+	if rejected["$ZTOPIC:example.com"] {
+		t.Error("expected an unconflicted event which is in the resolved state not to be rejected")
+	}
+
+	// The rejected events must be left out of the resolved state.
+	for _, event := range ResolveStateConflictsV2(conflicted, unconflicted, input, nil) {
+		if rejected[event.EventID()] {
+			t.Errorf("rejected event %q is in the resolved state", event.EventID())
+		}
+	}
+}
+
+func TestStateResolutionV2CustomAuthChecker(t *testing.T) {
+	topic := func(eventID, sender string, ts Timestamp, authEvents ...string) *Event {
+		refs := make([]EventReference, 0, len(authEvents))
+		for _, authEventID := range authEvents {
+			refs = append(refs, EventReference{EventID: authEventID})
+		}
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: eventID,
+				eventFields: eventFields{
+					RoomID:         "!ROOM:example.com",
+					Type:           "m.room.topic",
+					OriginServerTS: ts,
+					Sender:         sender,
+					StateKey:       &emptyStateKey,
+					Content:        []byte(`{"topic": "` + eventID + `"}`),
+				},
+				PrevEvents: []EventReference{
+					{EventID: "$IMC:example.com"},
+				},
+				AuthEvents: refs,
+			},
+		}
+	}
+	input := append(getBaseStateResV2Graph(),
+		topic("$ATOPIC:example.com", ALICE, 7, "$CREATE:example.com", "$IPOWER:example.com", "$IMA:example.com"),
+		// Bob doesn't have the power to set the topic, so the standard auth
+		// rules reject this event.
+		topic("$BTOPIC:example.com", BOB, 9, "$CREATE:example.com", "$IPOWER:example.com", "$IMB:example.com"),
+	)
+	conflicted, unconflicted := separate(input)
+
+	resolvedTopic := func(opts StateResolutionV2Options) string {
+		resolved, err := ResolveStateConflictsV2WithOptions(context.Background(), conflicted, unconflicted, input, nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range resolved {
+			if event.Type() == "m.room.topic" {
+				return event.EventID()
+			}
+		}
+		t.Fatal("no topic in the resolved state")
+		return ""
+	}
+
+	if got := resolvedTopic(StateResolutionV2Options{}); got != "$ATOPIC:example.com" {
+		t.Errorf("with the default auth checker: got topic %q, want %q", got, "$ATOPIC:example.com")
+	}
+
+	checked := 0
+	permissive := func(event *Event, provider AuthEventProvider) error {
+		checked++
+		return nil
+	}
+	if got := resolvedTopic(StateResolutionV2Options{AuthChecker: permissive}); got != "$BTOPIC:example.com" {
+		t.Errorf("with a permissive auth checker: got topic %q, want %q", got, "$BTOPIC:example.com")
+	}
+	if checked == 0 {
+		t.Error("expected the custom auth checker to be called")
+	}
+}
+
+func TestStateResolutionV2ResultMainline(t *testing.T) {
+	power := func(eventID string, ts Timestamp, prevPowerID string) *Event {
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: eventID,
+				eventFields: eventFields{
+					RoomID:         "!ROOM:example.com",
+					Type:           MRoomPowerLevels,
+					OriginServerTS: ts,
+					Sender:         ALICE,
+					StateKey:       &emptyStateKey,
+					Content:        []byte(`{"users": {"` + ALICE + `": 100, "` + BOB + `": 50}}`),
+				},
+				PrevEvents: []EventReference{
+					{EventID: "$IMC:example.com"},
+				},
+				AuthEvents: []EventReference{
+					{EventID: "$CREATE:example.com"},
+					{EventID: "$IMA:example.com"},
+					{EventID: prevPowerID},
+				},
+			},
+		}
+	}
+	input := append(getBaseStateResV2Graph(),
+		power("$PA:example.com", 7, "$IPOWER:example.com"),
+		power("$PB:example.com", 8, "$PA:example.com"),
+	)
+	conflicted, unconflicted := separate(input)
+
+	var result StateResolutionResult
+	if _, err := ResolveStateConflictsV2WithOptions(
+		context.Background(), conflicted, unconflicted, input, nil, StateResolutionV2Options{Result: &result},
+	); err != nil {
+		t.Fatal(err)
+	}
+	got := result.Mainline
+	want := []string{"$IPOWER:example.com", "$PA:example.com", "$PB:example.com"}
+	if len(got) != len(want) {
+		t.Fatalf("got mainline %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got mainline %v, want %v", got, want)
+		}
+	}
+	resolved := NewStateSnapshot(result.State)
+	if powerLevels := resolved.Event(MRoomPowerLevels, ""); powerLevels == nil || powerLevels.EventID() != got[len(got)-1] {
+		t.Errorf("expected the mainline to end at the resolved power levels, got %v", powerLevels)
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gomatrixserverlib
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// A StateSnapshot is the state of a room at a point in time, keyed by the
+// event type and state key of each state event.
+type StateSnapshot map[StateKeyTuple]*Event
+
+// NewStateSnapshot returns a StateSnapshot built from the given events, e.g.
+// the output of state resolution. Events without a state key are ignored.
+// If more than one event has the same (type, state_key) then the last one wins.
+func NewStateSnapshot(events []*Event) StateSnapshot {
+	s := make(StateSnapshot, len(events))
+	for _, event := range events {
+		if event.StateKey() == nil {
+			continue
+		}
+		s[StateKeyTuple{event.Type(), *event.StateKey()}] = event
+	}
+	return s
+}
+
+// Event returns the state event with the given type and state key, or nil
+// if there is no such event in the snapshot.
+func (s StateSnapshot) Event(eventType, stateKey string) *Event {
+	return s[StateKeyTuple{eventType, stateKey}]
+}
+
+// Events returns all of the state events in the snapshot, ordered by their
+// event type and then their state key.
+func (s StateSnapshot) Events() []*Event {
+	tuples := make([]StateKeyTuple, 0, len(s))
+	for tuple := range s {
+		tuples = append(tuples, tuple)
+	}
+	sort.Slice(tuples, func(i, j int) bool {
+		if tuples[i].EventType != tuples[j].EventType {
+			return tuples[i].EventType < tuples[j].EventType
+		}
+		return tuples[i].StateKey < tuples[j].StateKey
+	})
+	events := make([]*Event, 0, len(tuples))
+	for _, tuple := range tuples {
+		events = append(events, s[tuple])
+	}
+	return events
+}
+
+// KeysOfType returns the sorted state keys of all of the state events in the
+// snapshot with the given event type, e.g. the user IDs of all m.room.member
+// events.
+func (s StateSnapshot) KeysOfType(eventType string) []string {
+	var keys []string
+	for tuple := range s {
+		if tuple.EventType == eventType {
+			keys = append(keys, tuple.StateKey)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// JoinedServers returns the sorted, unique server names of all of the users
+// in the snapshot whose membership is "join".
+func (s StateSnapshot) JoinedServers() []ServerName {
+	seen := make(map[ServerName]struct{})
+	for tuple, event := range s {
+		if tuple.EventType != MRoomMember || event == nil {
+			continue
+		}
+		if membership, err := event.Membership(); err != nil || membership != Join {
+			continue
+		}
+		_, domain, err := SplitID('@', tuple.StateKey)
+		if err != nil {
+			continue
+		}
+		seen[domain] = struct{}{}
+	}
+	servers := make([]ServerName, 0, len(seen))
+	for server := range seen {
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i] < servers[j]
+	})
+	return servers
+}
+
+// MembershipCounts returns the number of users in the snapshot with each
+// membership, e.g. for rate limiting or capacity checks. Member events with
+// content that can't be parsed or with an unknown membership aren't counted.
+func (s StateSnapshot) MembershipCounts() (joined, invited, banned, left, knocked int) {
+	for tuple, event := range s {
+		if tuple.EventType != MRoomMember || event == nil {
+			continue
+		}
+		content, err := NewMemberContentFromEvent(event)
+		if err != nil {
+			continue
+		}
+		switch content.Membership {
+		case Join:
+			joined++
+		case Invite:
+			invited++
+		case Ban:
+			banned++
+		case Leave:
+			left++
+		case Knock:
+			knocked++
+		}
+	}
+	return
+}
+
+// ApplyEventToState updates the snapshot with the given state event, which
+// replaces any existing event with the same type and state key. The event
+// must already have passed the auth checks against the snapshot, this is not
+// checked here. This can be used to build up the state of a room one event at
+// a time, e.g. when walking a linear section of the room DAG. Returns an error
+// and leaves the snapshot unchanged if the event isn't a state event or if its
+// state key isn't valid for its type, in the same way that state resolution
+// ignores such events.
+func ApplyEventToState(event *Event, snapshot StateSnapshot) error {
+	stateKey := event.StateKey()
+	if stateKey == nil {
+		return fmt.Errorf("gomatrixserverlib: event %q is not a state event", event.EventID())
+	}
+	if err := ValidateStateKeyForType(event.Type(), stateKey); err != nil {
+		return err
+	}
+	snapshot[StateKeyTuple{event.Type(), *stateKey}] = event
+	return nil
+}
+
+// ValidateResolvedState checks the invariants of a resolved room state, e.g. the
+// output of state resolution: every event must be a state event, no two events
+// may have the same (type, state_key), and there must be exactly one create,
+// power levels and join rules event. Returns an error describing the first
+// problem found.
+func ValidateResolvedState(state []*Event) error {
+	seen := make(map[StateKeyTuple]string, len(state))
+	for _, event := range state {
+		if event.StateKey() == nil {
+			return fmt.Errorf("gomatrixserverlib: event %q in the resolved state does not have a state key", event.EventID())
+		}
+		tuple := StateKeyTuple{event.Type(), *event.StateKey()}
+		if other, ok := seen[tuple]; ok {
+			return fmt.Errorf(
+				"gomatrixserverlib: duplicate state key tuple (%q, %q) for events %q and %q",
+				event.Type(), *event.StateKey(), other, event.EventID(),
+			)
+		}
+		seen[tuple] = event.EventID()
+	}
+	for _, eventType := range []string{MRoomCreate, MRoomPowerLevels, MRoomJoinRules} {
+		if _, ok := seen[StateKeyTuple{eventType, ""}]; !ok {
+			return fmt.Errorf("gomatrixserverlib: resolved state has no %s event", eventType)
+		}
+	}
+	return nil
+}
+
+// StateGroupID returns a stable ID for the given set of state events, for
+// servers which store identical room states once as a state group. The ID is
+// the SHA-256 hash, encoded as unpadded URL safe base64, of the sorted (type,
+// state_key, event_id) tuples of the events, so two sets of the same events
+// map to the same ID whatever order they are in. Events without a state key
+// are ignored.
+func StateGroupID(state []*Event) string {
+	tuples := make([][3]string, 0, len(state))
+	for _, event := range state {
+		if event.StateKey() == nil {
+			continue
+		}
+		tuples = append(tuples, [3]string{event.Type(), *event.StateKey(), event.EventID()})
+	}
+	sort.Slice(tuples, func(i, j int) bool {
+		for k := range tuples[i] {
+			if tuples[i][k] != tuples[j][k] {
+				return tuples[i][k] < tuples[j][k]
+			}
+		}
+		return false
+	})
+	// Encoding the tuples as JSON keeps the boundaries between the strings
+	// unambiguous, which simply joining them wouldn't.
+	hash := sha256.New()
+	encoder := json.NewEncoder(hash)
+	for _, tuple := range tuples {
+		// Encoding a string array to a hash can't fail.
+		_ = encoder.Encode(tuple)
+	}
+	return EncodeBase64URLUnpadded(hash.Sum(nil))
+}
+
+// DetectStateReset compares the state of a room before and after state
+// resolution and returns the (type, state_key) tuples which were present in
+// the state before but are missing from the state after, ordered by event type
+// and then state key. State resolution should only ever replace state events,
+// so a missing tuple usually means that a state event was dropped because its
+// auth events couldn't be found, which is known as a state reset. Events
+// without a state key are ignored.
+func DetectStateReset(before, after []*Event) []StateKeyTuple {
+	afterState := NewStateSnapshot(after)
+	var reset []StateKeyTuple
+	for _, event := range NewStateSnapshot(before).Events() {
+		tuple := StateKeyTuple{event.Type(), *event.StateKey()}
+		if _, ok := afterState[tuple]; !ok {
+			reset = append(reset, tuple)
+		}
+	}
+	return reset
+}
+
+// StateBeforeEvent works out the state of the room just before the event with
+// the given ID, from the given events, which must include all of the event's
+// ancestors through its prev_events back to the room creation. The state is
+// built up by walking forwards through the prev_events from the create event,
+// in topological order. Where the room DAG forks, the state after each of the
+// prev_events is merged using the state resolution algorithm for the room
+// version. The events are assumed to have already passed the auth checks,
+// since rejected events must not be part of the room state. Returns an error
+// if the event or one of its ancestors is missing, if the prev_events form a
+// cycle, or if the room version is unknown.
+func StateBeforeEvent(events []*Event, eventID string, roomVersion RoomVersion) ([]*Event, error) { // nolint: gocyclo
+	if _, err := roomVersion.StateResAlgorithm(); err != nil {
+		return nil, err
+	}
+	eventsByID := make(map[string]*Event, len(events))
+	for _, event := range events {
+		eventsByID[event.EventID()] = event
+	}
+	target, ok := eventsByID[eventID]
+	if !ok {
+		return nil, fmt.Errorf("gomatrixserverlib: event %q not found", eventID)
+	}
+
+	// Find the ancestors of the event, along with the distinct prev_events of
+	// each of them and how many of the ancestors, or the event itself, follow
+	// on from each of them.
+	prevIDs := map[string][]string{eventID: nil}
+	children := make(map[string][]string)
+	remaining := make(map[string]int)
+	queue := []*Event{target}
+	for len(queue) > 0 {
+		event := queue[0]
+		queue = queue[1:]
+		seen := make(map[string]bool)
+		for _, prevID := range event.PrevEventIDs() {
+			if seen[prevID] {
+				continue
+			}
+			seen[prevID] = true
+			prev, ok := eventsByID[prevID]
+			if !ok {
+				return nil, fmt.Errorf("gomatrixserverlib: event %q references missing prev_event %q", event.EventID(), prevID)
+			}
+			prevIDs[event.EventID()] = append(prevIDs[event.EventID()], prevID)
+			children[prevID] = append(children[prevID], event.EventID())
+			remaining[prevID]++
+			if _, ok := prevIDs[prevID]; !ok {
+				prevIDs[prevID] = nil
+				queue = append(queue, prev)
+			}
+		}
+	}
+	// prevIDs now has an entry for the event and each of its ancestors.
+	ancestors := len(prevIDs) - 1
+
+	// stateBefore works out the state before an event from the state after
+	// each of its prev_events. The state after a prev_event is only copied if
+	// other events still need it, i.e. at a fork, and is dropped once the last
+	// event which needs it has used it.
+	stateAfter := make(map[string]StateSnapshot, ancestors)
+	release := func(prevID string) (StateSnapshot, bool) {
+		state := stateAfter[prevID]
+		remaining[prevID]--
+		if remaining[prevID] > 0 {
+			return state, false
+		}
+		delete(stateAfter, prevID)
+		return state, true
+	}
+	stateBefore := func(eventID string) (StateSnapshot, error) {
+		switch len(prevIDs[eventID]) {
+		case 0:
+			return StateSnapshot{}, nil
+		case 1:
+			state, owned := release(prevIDs[eventID][0])
+			if owned {
+				return state, nil
+			}
+			copied := make(StateSnapshot, len(state))
+			for tuple, event := range state {
+				copied[tuple] = event
+			}
+			return copied, nil
+		}
+
+		// The DAG has forked, so resolve the state from each of the forks.
+		var stateEvents []*Event
+		for _, prevID := range prevIDs[eventID] {
+			state, _ := release(prevID)
+			stateEvents = append(stateEvents, state.Events()...)
+		}
+		resolved, err := ResolveConflicts(roomVersion, stateEvents, authChainFromEvents(stateEvents, eventsByID))
+		if err != nil {
+			return nil, err
+		}
+		return NewStateSnapshot(resolved), nil
+	}
+
+	// Walk forwards through the ancestors using Kahn's algorithm, so that the
+	// state after all of an event's prev_events is known before the event.
+	parents := make(map[string]int, len(prevIDs))
+	for id, ids := range prevIDs {
+		parents[id] = len(ids)
+		if len(ids) == 0 {
+			queue = append(queue, eventsByID[id])
+		}
+	}
+	sorted := 0
+	for len(queue) > 0 {
+		event := queue[0]
+		queue = queue[1:]
+		if event.EventID() == eventID {
+			continue
+		}
+		sorted++
+		state, err := stateBefore(event.EventID())
+		if err != nil {
+			return nil, err
+		}
+		// Events that aren't state events don't change the state.
+		_ = ApplyEventToState(event, state)
+		stateAfter[event.EventID()] = state
+		for _, childID := range children[event.EventID()] {
+			parents[childID]--
+			if parents[childID] == 0 {
+				queue = append(queue, eventsByID[childID])
+			}
+		}
+	}
+	if sorted != ancestors {
+		var unsorted []string
+		for id := range prevIDs {
+			if parents[id] > 0 && id != eventID {
+				unsorted = append(unsorted, id)
+			}
+		}
+		sort.Strings(unsorted)
+		return nil, fmt.Errorf("gomatrixserverlib: found a cycle in the room DAG involving event %q", unsorted[0])
+	}
+
+	state, err := stateBefore(eventID)
+	if err != nil {
+		return nil, err
+	}
+	return state.Events(), nil
+}
+
+// authChainFromEvents returns the auth chains of the given events, as far as
+// they can be followed through the known events.
+func authChainFromEvents(events []*Event, eventsByID map[string]*Event) []*Event {
+	seen := make(map[string]bool)
+	var authChain []*Event
+	queue := append([]*Event(nil), events...)
+	for len(queue) > 0 {
+		event := queue[0]
+		queue = queue[1:]
+		for _, authEventID := range event.AuthEventIDs() {
+			if seen[authEventID] {
+				continue
+			}
+			seen[authEventID] = true
+			if authEvent, ok := eventsByID[authEventID]; ok {
+				authChain = append(authChain, authEvent)
+				queue = append(queue, authEvent)
+			}
+		}
+	}
+	return authChain
+}
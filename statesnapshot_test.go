@@ -0,0 +1,516 @@
+package gomatrixserverlib
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStateSnapshotKeysOfType(t *testing.T) {
+	snapshot := NewStateSnapshot(getBaseStateResV2Graph())
+
+	got := snapshot.KeysOfType(MRoomMember)
+	want := []string{ALICE, BOB, CHARLIE}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got member state keys %v, want %v", got, want)
+	}
+
+	if got := snapshot.KeysOfType(MRoomCreate); !reflect.DeepEqual(got, []string{""}) {
+		t.Fatalf("got create state keys %v, want [\"\"]", got)
+	}
+	if got := snapshot.KeysOfType(MRoomThirdPartyInvite); len(got) != 0 {
+		t.Fatalf("got third party invite state keys %v, want none", got)
+	}
+}
+
+func TestStateSnapshotEvent(t *testing.T) {
+	events := getBaseStateResV2Graph()
+	snapshot := NewStateSnapshot(events)
+
+	if len(snapshot.Events()) != len(events) {
+		t.Fatalf("got %d events in snapshot, want %d", len(snapshot.Events()), len(events))
+	}
+	if e := snapshot.Event(MRoomCreate, ""); e == nil || e.EventID() != "$CREATE:example.com" {
+		t.Fatalf("expected to find the create event in the snapshot, got %v", e)
+	}
+	if e := snapshot.Event(MRoomMember, ZARA); e != nil {
+		t.Fatalf("expected no member event for %s, got %s", ZARA, e.EventID())
+	}
+}
+
+func TestStateSnapshotJoinedServers(t *testing.T) {
+	member := func(userID, membership string) *Event {
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: "$" + membership + userID,
+				eventFields: eventFields{
+					RoomID:   "!ROOM:one.test",
+					Type:     MRoomMember,
+					Sender:   userID,
+					StateKey: &userID,
+					Content:  []byte(`{"membership":"` + membership + `"}`),
+				},
+			},
+		}
+	}
+	snapshot := NewStateSnapshot([]*Event{
+		member("@alice:one.test", Join),
+		member("@bob:one.test", Join),
+		member("@charlie:two.test", Join),
+		member("@dave:two.test", Leave),
+		member("@evelyn:three.test", Invite),
+		member("@zara:three.test", Ban),
+		member("@frank:four.test", Join),
+	})
+
+	got := snapshot.JoinedServers()
+	want := []ServerName{"four.test", "one.test", "two.test"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got joined servers %v, want %v", got, want)
+	}
+}
+
+func TestStateSnapshotMembershipCounts(t *testing.T) {
+	member := func(userID, content string) *Event {
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: "$" + userID,
+				eventFields: eventFields{
+					RoomID:   "!ROOM:one.test",
+					Type:     MRoomMember,
+					Sender:   userID,
+					StateKey: &userID,
+					Content:  []byte(content),
+				},
+			},
+		}
+	}
+	snapshot := NewStateSnapshot(append(getBaseStateResV2Graph()[:1],
+		member("@alice:one.test", `{"membership":"join"}`),
+		member("@bob:one.test", `{"membership":"join","displayname":"Bob"}`),
+		member("@charlie:two.test", `{"membership":"invite"}`),
+		member("@dave:two.test", `{"membership":"leave"}`),
+		member("@evelyn:three.test", `{"membership":"ban"}`),
+		member("@frank:three.test", `{"membership":"ban"}`),
+		member("@george:four.test", `{"membership":"knock"}`),
+		member("@harry:four.test", `{"membership":"unknown"}`),
+		member("@ivy:four.test", `not json`),
+	))
+
+	joined, invited, banned, left, knocked := snapshot.MembershipCounts()
+	if joined != 2 || invited != 1 || banned != 2 || left != 1 || knocked != 1 {
+		t.Fatalf(
+			"got joined=%d invited=%d banned=%d left=%d knocked=%d, want 2, 1, 2, 1, 1",
+			joined, invited, banned, left, knocked,
+		)
+	}
+}
+
+func TestApplyEventToState(t *testing.T) {
+	events := getBaseStateResV2Graph()
+	snapshot := StateSnapshot{}
+	for _, event := range events {
+		if err := ApplyEventToState(event, snapshot); err != nil {
+			t.Fatalf("failed to apply %s: %s", event.EventID(), err)
+		}
+	}
+	if want := NewStateSnapshot(events); !reflect.DeepEqual(snapshot, want) {
+		t.Fatalf("got state %v, want %v", snapshot.Events(), want.Events())
+	}
+
+	// A later event with the same type and state key replaces the earlier one.
+	leave := &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$BOBLEAVE:example.com",
+			eventFields: eventFields{
+				RoomID:   "!ROOM:example.com",
+				Type:     MRoomMember,
+				Sender:   BOB,
+				StateKey: &BOB,
+				Content:  []byte(`{"membership": "leave"}`),
+			},
+		},
+	}
+	if err := ApplyEventToState(leave, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if e := snapshot.Event(MRoomMember, BOB); e != leave {
+		t.Fatalf("expected the leave to replace %s's membership, got %v", BOB, e)
+	}
+
+	// Non-state events and events with invalid state keys are rejected.
+	bogusStateKey := "bogus"
+	for _, event := range []*Event{
+		{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: "$MESSAGE:example.com",
+				eventFields: eventFields{
+					RoomID:  "!ROOM:example.com",
+					Type:    "m.room.message",
+					Sender:  ALICE,
+					Content: []byte(`{"body": "hello"}`),
+				},
+			},
+		},
+		{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: "$BOGUSPOWER:example.com",
+				eventFields: eventFields{
+					RoomID:   "!ROOM:example.com",
+					Type:     MRoomPowerLevels,
+					Sender:   ALICE,
+					StateKey: &bogusStateKey,
+					Content:  []byte(`{}`),
+				},
+			},
+		},
+	} {
+		if err := ApplyEventToState(event, snapshot); err == nil {
+			t.Errorf("expected %s to be rejected", event.EventID())
+		}
+	}
+	if e := snapshot.Event(MRoomPowerLevels, bogusStateKey); e != nil {
+		t.Errorf("expected the rejected power levels not to be applied, got %s", e.EventID())
+	}
+}
+
+func stateBeforeEventIDs(t *testing.T, events []*Event, eventID string) []string {
+	t.Helper()
+	state, err := StateBeforeEvent(events, eventID, RoomVersionV2)
+	if err != nil {
+		t.Fatalf("StateBeforeEvent(%q) failed: %s", eventID, err)
+	}
+	eventIDs := make([]string, 0, len(state))
+	for _, event := range state {
+		eventIDs = append(eventIDs, event.EventID())
+	}
+	return eventIDs
+}
+
+func TestStateBeforeEventLinearHistory(t *testing.T) {
+	message := &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$MESSAGE:example.com",
+			eventFields: eventFields{
+				RoomID:         "!ROOM:example.com",
+				Type:           "m.room.message",
+				OriginServerTS: 7,
+				Sender:         CHARLIE,
+				Content:        []byte(`{"body": "bye"}`),
+			},
+			PrevEvents: []EventReference{
+				{EventID: "$IMC:example.com"},
+			},
+			AuthEvents: []EventReference{
+				{EventID: "$CREATE:example.com"},
+				{EventID: "$IPOWER:example.com"},
+				{EventID: "$IMC:example.com"},
+			},
+		},
+	}
+	leave := &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$LEAVE:example.com",
+			eventFields: eventFields{
+				RoomID:         "!ROOM:example.com",
+				Type:           MRoomMember,
+				OriginServerTS: 8,
+				Sender:         CHARLIE,
+				StateKey:       &CHARLIE,
+				Content:        []byte(`{"membership": "leave"}`),
+			},
+			PrevEvents: []EventReference{
+				{EventID: "$MESSAGE:example.com"},
+			},
+			AuthEvents: []EventReference{
+				{EventID: "$CREATE:example.com"},
+				{EventID: "$IPOWER:example.com"},
+				{EventID: "$IMC:example.com"},
+			},
+		},
+	}
+	events := append(getBaseStateResV2Graph(), message, leave)
+
+	if got := stateBeforeEventIDs(t, events, "$CREATE:example.com"); len(got) != 0 {
+		t.Errorf("expected no state before the create event, got %v", got)
+	}
+	got := stateBeforeEventIDs(t, events, "$IMB:example.com")
+	want := []string{"$CREATE:example.com", "$IJR:example.com", "$IMA:example.com", "$IPOWER:example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got state %v before $IMB:example.com, want %v", got, want)
+	}
+	// The message isn't a state event so it doesn't change the state.
+	want = []string{
+		"$CREATE:example.com", "$IJR:example.com", "$IMA:example.com",
+		"$IMB:example.com", "$IMC:example.com", "$IPOWER:example.com",
+	}
+	if got := stateBeforeEventIDs(t, events, "$MESSAGE:example.com"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got state %v before $MESSAGE:example.com, want %v", got, want)
+	}
+	if got := stateBeforeEventIDs(t, events, "$LEAVE:example.com"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got state %v before $LEAVE:example.com, want %v", got, want)
+	}
+
+	if _, err := StateBeforeEvent(events, "$UNKNOWN:example.com", RoomVersionV2); err == nil {
+		t.Error("expected an unknown event to be rejected")
+	}
+	if _, err := StateBeforeEvent(events[1:], "$IMB:example.com", RoomVersionV2); err == nil {
+		t.Error("expected a missing prev event to be rejected")
+	}
+}
+
+func TestStateBeforeEventResolvesForks(t *testing.T) {
+	topic := func(eventID string, ts Timestamp) *Event {
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: eventID,
+				eventFields: eventFields{
+					RoomID:         "!ROOM:example.com",
+					Type:           "m.room.topic",
+					OriginServerTS: ts,
+					Sender:         ALICE,
+					StateKey:       &emptyStateKey,
+					Content:        []byte(`{"topic": "` + eventID + `"}`),
+				},
+				PrevEvents: []EventReference{
+					{EventID: "$IMC:example.com"},
+				},
+				AuthEvents: []EventReference{
+					{EventID: "$CREATE:example.com"},
+					{EventID: "$IMA:example.com"},
+					{EventID: "$IPOWER:example.com"},
+				},
+			},
+		}
+	}
+	merge := &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$MERGE:example.com",
+			eventFields: eventFields{
+				RoomID:         "!ROOM:example.com",
+				Type:           "m.room.message",
+				OriginServerTS: 9,
+				Sender:         ALICE,
+				Content:        []byte(`{"body": "hello"}`),
+			},
+			PrevEvents: []EventReference{
+				{EventID: "$TA:example.com"},
+				{EventID: "$TB:example.com"},
+			},
+			AuthEvents: []EventReference{
+				{EventID: "$CREATE:example.com"},
+				{EventID: "$IMA:example.com"},
+				{EventID: "$IPOWER:example.com"},
+			},
+		},
+	}
+	events := append(getBaseStateResV2Graph(), topic("$TA:example.com", 7), topic("$TB:example.com", 8), merge)
+
+	state, err := StateBeforeEvent(events, "$MERGE:example.com", RoomVersionV2)
+	if err != nil {
+		t.Fatalf("StateBeforeEvent failed: %s", err)
+	}
+	snapshot := NewStateSnapshot(state)
+	if len(snapshot) != 7 {
+		t.Errorf("got %d state events, want 7", len(snapshot))
+	}
+	if got := snapshot.Event("m.room.topic", ""); got == nil || got.EventID() != "$TB:example.com" {
+		t.Errorf("expected the later topic to win, got %v", got)
+	}
+
+	// Each side of the fork starts from its own copy of the state, so the
+	// topic on one side mustn't leak into the state before the other.
+	for _, eventID := range []string{"$TA:example.com", "$TB:example.com"} {
+		state, err := StateBeforeEvent(events, eventID, RoomVersionV2)
+		if err != nil {
+			t.Fatalf("StateBeforeEvent(%q) failed: %s", eventID, err)
+		}
+		if got := NewStateSnapshot(state).Event("m.room.topic", ""); got != nil {
+			t.Errorf("expected no topic before %s, got %s", eventID, got.EventID())
+		}
+	}
+}
+
+func TestStateBeforeEventLongHistory(t *testing.T) {
+	message := func(eventID, prevID string) *Event {
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: eventID,
+				eventFields: eventFields{
+					RoomID:  "!ROOM:example.com",
+					Type:    "m.room.message",
+					Sender:  ALICE,
+					Content: []byte(`{"body": "hello"}`),
+				},
+				PrevEvents: []EventReference{
+					{EventID: prevID},
+				},
+			},
+		}
+	}
+	// A long history is walked forwards without recursing through each event.
+	events := getBaseStateResV2Graph()
+	prevID := "$IMC:example.com"
+	for i := 0; i < 10000; i++ {
+		eventID := fmt.Sprintf("$M%d:example.com", i)
+		events = append(events, message(eventID, prevID))
+		prevID = eventID
+	}
+	if got := stateBeforeEventIDs(t, events, prevID); len(got) != 6 {
+		t.Errorf("got state %v before the last message, want 6 events", got)
+	}
+
+	// Prev events which form a cycle can't be walked.
+	cycle := append(getBaseStateResV2Graph(),
+		message("$CA:example.com", "$CB:example.com"),
+		message("$CB:example.com", "$CA:example.com"),
+		message("$CC:example.com", "$CB:example.com"),
+	)
+	if _, err := StateBeforeEvent(cycle, "$CC:example.com", RoomVersionV2); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+}
+
+func TestDetectStateReset(t *testing.T) {
+	// Charlie changed the topic after being given power by a power level
+	// event which has gone missing, so the topics fail auth against the
+	// resolved power levels and the topic is reset.
+	topic := func(eventID string, ts Timestamp) *Event {
+		return &Event{
+			roomVersion: RoomVersionV2,
+			fields: eventFormatV1Fields{
+				EventID: eventID,
+				eventFields: eventFields{
+					RoomID:         "!ROOM:example.com",
+					Type:           "m.room.topic",
+					OriginServerTS: ts,
+					Sender:         CHARLIE,
+					StateKey:       &emptyStateKey,
+					Content:        []byte(`{"topic": "` + eventID + `"}`),
+				},
+				PrevEvents: []EventReference{
+					{EventID: "$IMC:example.com"},
+				},
+				AuthEvents: []EventReference{
+					{EventID: "$CREATE:example.com"},
+					{EventID: "$MISSINGPOWER:example.com"},
+					{EventID: "$IMC:example.com"},
+				},
+			},
+		}
+	}
+	base := getBaseStateResV2Graph()
+	topicA, topicB := topic("$TA:example.com", 7), topic("$TB:example.com", 8)
+	before := append(append([]*Event{}, base...), topicA)
+
+	_, unconflicted := separate(base)
+	after := ResolveStateConflictsV2([]*Event{topicA, topicB}, unconflicted, base, nil)
+
+	want := []StateKeyTuple{{"m.room.topic", ""}}
+	if got := DetectStateReset(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("got reset tuples %v, want %v", got, want)
+	}
+	if got := DetectStateReset(base, after); len(got) != 0 {
+		t.Errorf("expected no reset tuples, got %v", got)
+	}
+}
+
+func TestValidateResolvedState(t *testing.T) {
+	input := getBaseStateResV2Graph()
+	conflicted, unconflicted := separate(input)
+	resolved := ResolveStateConflictsV2(conflicted, unconflicted, input, nil)
+	if err := ValidateResolvedState(resolved); err != nil {
+		t.Fatalf("expected the resolved state to be valid, got: %s", err)
+	}
+
+	without := func(eventType string) []*Event {
+		var state []*Event
+		for _, event := range resolved {
+			if event.Type() != eventType {
+				state = append(state, event)
+			}
+		}
+		return state
+	}
+	secondPowerLevels := &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$IPOWER2:example.com",
+			eventFields: eventFields{
+				RoomID:         "!ROOM:example.com",
+				Type:           MRoomPowerLevels,
+				OriginServerTS: 7,
+				Sender:         ALICE,
+				StateKey:       &emptyStateKey,
+				Content:        []byte(`{"users": {"` + ALICE + `": 100}}`),
+			},
+		},
+	}
+	for name, state := range map[string][]*Event{
+		"duplicate power levels": append(append([]*Event{}, resolved...), secondPowerLevels),
+		"message event":          append(append([]*Event{}, resolved...), roomDAGTestMessage("$M1:example.com", "$IMC:example.com")),
+		"no create event":        without(MRoomCreate),
+		"no power levels":        without(MRoomPowerLevels),
+		"no join rules":          without(MRoomJoinRules),
+	} {
+		if err := ValidateResolvedState(state); err == nil {
+			t.Errorf("%s: expected the resolved state to be rejected", name)
+		}
+	}
+}
+
+func TestStateGroupID(t *testing.T) {
+	state := getBaseStateResV2Graph()
+	id := StateGroupID(state)
+
+	reversed := make([]*Event, 0, len(state))
+	for i := len(state) - 1; i >= 0; i-- {
+		reversed = append(reversed, state[i])
+	}
+	if got := StateGroupID(reversed); got != id {
+		t.Errorf("got ID %q for the reordered state, want %q", got, id)
+	}
+	withMessage := append(append([]*Event{}, state...), roomDAGTestMessage("$M1:example.com", "$IMC:example.com"))
+	if got := StateGroupID(withMessage); got != id {
+		t.Errorf("got ID %q for the state with a message event, want %q", got, id)
+	}
+
+	if got := StateGroupID(state[:len(state)-1]); got == id {
+		t.Errorf("expected a different ID when an event is missing from the state, got %q", got)
+	}
+	otherJoinRules := &Event{
+		roomVersion: RoomVersionV2,
+		fields: eventFormatV1Fields{
+			EventID: "$IJR2:example.com",
+			eventFields: eventFields{
+				RoomID:         "!ROOM:example.com",
+				Type:           MRoomJoinRules,
+				OriginServerTS: 7,
+				Sender:         ALICE,
+				StateKey:       &emptyStateKey,
+				Content:        []byte(`{"join_rule": "public"}`),
+			},
+		},
+	}
+	var replaced []*Event
+	for _, event := range state {
+		if event.Type() == MRoomJoinRules {
+			event = otherJoinRules
+		}
+		replaced = append(replaced, event)
+	}
+	if got := StateGroupID(replaced); got == id {
+		t.Errorf("expected a different ID when an event is replaced, got %q", got)
+	}
+}
@@ -1,6 +1,13 @@
 package gomatrixserverlib
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
 
 // A Transaction is used to push data from one matrix server to another matrix
 // server.
@@ -34,3 +41,387 @@ type Transaction struct {
 // The ID must be safe to insert into a URL path segment. The ID should have a
 // format matching '^[0-9A-Za-z\-_]*$'
 type TransactionID string
+
+// Verify parses each of the PDUs in the transaction, checking their content
+// hashes and signatures. The room version of each PDU is looked up using the
+// given function. Returns one result for each PDU, in the same order as the
+// PDUs in the transaction. PDUs which fail to parse or fail signature checks
+// have the PDUInvalid outcome and should not be processed any further. The
+// outcome of the other PDUs is left unset, as they haven't been authed.
+func (t *Transaction) Verify(
+	ctx context.Context, keyRing JSONVerifier, roomVersion func(roomID string) (RoomVersion, error),
+) []TransactionPDUResult {
+	return t.verify(ctx, keyRing, roomVersion, 1)
+}
+
+// verify is the same as Verify, but verifies the signatures of up to the given
+// number of PDUs at a time.
+func (t *Transaction) verify(
+	ctx context.Context, keyRing JSONVerifier, roomVersion func(roomID string) (RoomVersion, error), concurrency int,
+) []TransactionPDUResult {
+	results := make([]TransactionPDUResult, len(t.PDUs))
+	events := make([]*Event, 0, len(t.PDUs))
+	indices := make([]int, 0, len(t.PDUs))
+	for i, pdu := range t.PDUs {
+		roomID := gjson.GetBytes(pdu, "room_id")
+		if roomID.Type != gjson.String {
+			results[i].Error = fmt.Errorf("gomatrixserverlib: PDU %d has no room ID", i)
+			continue
+		}
+		version, err := roomVersion(roomID.Str)
+		if err != nil {
+			results[i].Error = fmt.Errorf("gomatrixserverlib: failed to get room version for %q: %w", roomID.Str, err)
+			continue
+		}
+		event, err := NewEventFromUntrustedJSON(pdu, version)
+		if err != nil {
+			results[i].Error = err
+			continue
+		}
+		results[i].Event = event
+		events = append(events, event)
+		indices = append(indices, i)
+	}
+	for i, err := range verifyEventSignaturesConcurrently(ctx, events, keyRing, concurrency) {
+		if err != nil {
+			results[indices[i]].Error = fmt.Errorf(
+				"gomatrixserverlib: event %q failed signature checks: %w", events[i].EventID(), err,
+			)
+		}
+	}
+	for i := range results {
+		if results[i].Error != nil {
+			results[i].Outcome = PDUInvalid
+		}
+	}
+	return results
+}
+
+// verifyEventSignaturesConcurrently is the same as VerifyAllEventSignatures,
+// but verifies the signatures of up to the given number of events at a time.
+// The errors are in the same order as the events.
+func verifyEventSignaturesConcurrently(ctx context.Context, events []*Event, verifier JSONVerifier, concurrency int) []error {
+	if concurrency <= 1 || len(events) <= 1 {
+		return VerifyAllEventSignatures(ctx, events, verifier)
+	}
+	if concurrency > len(events) {
+		concurrency = len(events)
+	}
+	errs := make([]error, len(events))
+	indices := make(chan int, len(events))
+	for i := range events {
+		indices <- i
+	}
+	close(indices)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs[i] = events[i].VerifyEventSignatures(ctx, verifier)
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// TransactionOriginConsistency reports the PDUs in the transaction whose sender
+// is not on the origin server of the transaction. Servers are allowed to relay
+// events from other servers, e.g. join events, so this is purely informational
+// and the PDUs should still be processed as normal.
+func TransactionOriginConsistency(txn Transaction) []Warning {
+	var warnings []Warning
+	for i, pdu := range txn.PDUs {
+		sender := gjson.GetBytes(pdu, "sender").Str
+		_, domain, err := SplitID('@', sender)
+		if err != nil {
+			warnings = append(warnings, Warning{
+				EventID: gjson.GetBytes(pdu, "event_id").Str,
+				Message: fmt.Sprintf("PDU %d has an invalid sender %q", i, sender),
+			})
+			continue
+		}
+		if domain != txn.Origin {
+			warnings = append(warnings, Warning{
+				EventID: gjson.GetBytes(pdu, "event_id").Str,
+				Message: fmt.Sprintf("PDU %d was sent by %q but relayed by %q", i, sender, txn.Origin),
+			})
+		}
+	}
+	return warnings
+}
+
+// A PDUOutcome is the outcome of processing a PDU from a transaction.
+// https://spec.matrix.org/v1.4/server-server-api/#checks-performed-on-receipt-of-a-pdu
+type PDUOutcome int
+
+// The outcomes of processing a PDU.
+const (
+	// The PDU failed to parse or failed signature checks, so it was dropped.
+	PDUInvalid PDUOutcome = iota + 1
+	// The PDU isn't allowed by its auth events, so it was rejected.
+	PDURejected
+	// The PDU is allowed by its auth events but not by the current state of
+	// the room, so it was soft failed and must not change the current state.
+	PDUSoftFailed
+	// The PDU passed all of the checks and was applied to the current state.
+	PDUAccepted
+	// The PDU is for a different room to the one in the database, so it
+	// wasn't processed. It isn't known to be invalid, so it shouldn't be
+	// dropped just because of this.
+	PDUUnknownRoom
+	// The PDU was sent or relayed by a server which is denied by the server
+	// ACL of the room, so it was dropped.
+	PDUDenied
+)
+
+func (o PDUOutcome) String() string {
+	switch o {
+	case PDUInvalid:
+		return "invalid"
+	case PDURejected:
+		return "rejected"
+	case PDUSoftFailed:
+		return "soft-failed"
+	case PDUAccepted:
+		return "accepted"
+	case PDUUnknownRoom:
+		return "unknown room"
+	case PDUDenied:
+		return "denied"
+	default:
+		return fmt.Sprintf("PDUOutcome(%d)", int(o))
+	}
+}
+
+// A TransactionPDUResult is the result of verifying or processing a single PDU
+// from a transaction. It isn't to be confused with the PDUResult which is sent
+// back to the origin of the transaction.
+type TransactionPDUResult struct {
+	// The parsed event, or nil if the PDU could not be parsed. If the content
+	// hash of the PDU did not match then the event will have been redacted.
+	Event *Event
+	// What happened to the PDU.
+	Outcome PDUOutcome
+	// Why the PDU wasn't accepted, or nil if it was.
+	Error error
+}
+
+// A ProcessTransactionOption is an option for ProcessTransaction.
+type ProcessTransactionOption func(*processTransactionOptions)
+
+type processTransactionOptions struct {
+	verifyConcurrency int
+}
+
+// WithVerifyConcurrency configures ProcessTransaction to verify the signatures
+// of up to the given number of PDUs at a time. The key ring must be safe to
+// use from multiple goroutines. By default signatures are verified one PDU at
+// a time. The results are always in the same order as the PDUs.
+func WithVerifyConcurrency(concurrency int) ProcessTransactionOption {
+	return func(options *processTransactionOptions) {
+		options.verifyConcurrency = concurrency
+	}
+}
+
+// ProcessTransaction verifies, auths and applies each of the PDUs in the
+// transaction in turn. The events and current state of the room are in the
+// database, and the room ID and room version are taken from the create event
+// in its current state. PDUs for any other room are reported as
+// PDUUnknownRoom.
+//
+// PDUs are dropped as PDUDenied if the origin of the transaction or the
+// server of the sender is denied by the m.room.server_acl event in the
+// current state. Each remaining PDU is checked against its auth events and
+// then against the current state, which includes the PDUs accepted earlier in
+// the transaction, so that a PDU can refer to the PDUs before it. Accepted
+// state events simply replace the current state in the order they appear in
+// the transaction, as if each PDU followed on from the ones before it. The
+// state isn't resolved where the PDUs fork the room DAG, so callers must
+// resolve the state themselves if the prev_events of the PDUs don't follow on
+// from the current state. The database itself isn't modified; callers should
+// store the events according to the results. Returns one result for each PDU,
+// in the same order as the PDUs in the transaction, or an error if the
+// database couldn't be read or the context is done.
+func ProcessTransaction(
+	ctx context.Context, txn Transaction, db EventDatabase, keyRing *KeyRing,
+	opts ...ProcessTransactionOption,
+) ([]TransactionPDUResult, error) {
+	options := processTransactionOptions{verifyConcurrency: 1}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// Look up the room up front, so that database errors aren't mistaken for
+	// problems with the PDUs.
+	roomID, version, err := roomFromDatabase(db)
+	if err != nil {
+		return nil, err
+	}
+	roomVersion := func(id string) (RoomVersion, error) {
+		if id != roomID {
+			return "", fmt.Errorf("gomatrixserverlib: PDU is for room %q, expected %q", id, roomID)
+		}
+		return version, nil
+	}
+	state := &transactionState{
+		db:     db,
+		events: make(map[string]*Event),
+		state:  make(StateSnapshot),
+	}
+
+	verified := txn.verify(ctx, keyRing, roomVersion, options.verifyConcurrency)
+	results := make([]TransactionPDUResult, len(verified))
+	for i, v := range verified {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		pduRoomID := gjson.GetBytes(txn.PDUs[i], "room_id")
+		switch {
+		case pduRoomID.Type == gjson.String && pduRoomID.Str != roomID:
+			results[i] = TransactionPDUResult{Outcome: PDUUnknownRoom, Error: v.Error}
+			continue
+		case v.Error != nil:
+			results[i] = v
+			continue
+		}
+		var denied error
+		if denied, err = state.checkServerACL(txn.Origin, v.Event); err != nil {
+			return nil, err
+		}
+		if denied != nil {
+			results[i] = TransactionPDUResult{Event: v.Event, Outcome: PDUDenied, Error: denied}
+			continue
+		}
+		if results[i], err = state.process(v.Event); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// roomFromDatabase returns the room ID and room version from the create event
+// in the current state of the room in the database.
+func roomFromDatabase(db EventDatabase) (string, RoomVersion, error) {
+	create, err := db.GetStateEvent(MRoomCreate, "")
+	if err != nil {
+		return "", "", err
+	}
+	if create == nil {
+		return "", "", fmt.Errorf("gomatrixserverlib: no create event in the room state")
+	}
+	var createContent CreateContent
+	if err = json.Unmarshal(create.Content(), &createContent); err != nil {
+		return "", "", fmt.Errorf("gomatrixserverlib: unparsable create event content: %w", err)
+	}
+	if createContent.RoomVersion == nil {
+		return create.RoomID(), RoomVersionV1, nil
+	}
+	return create.RoomID(), *createContent.RoomVersion, nil
+}
+
+// transactionState is an EventDatabase which layers the events processed so
+// far in a transaction on top of the events in the room database.
+type transactionState struct {
+	db     EventDatabase
+	events map[string]*Event // Accepted and soft failed events, by ID
+	state  StateSnapshot     // Current state changed by accepted events
+}
+
+// checkServerACL returns an error describing why the event is denied by the
+// server ACL in the current state, either because of the origin which sent it
+// or the server of its sender, or nil if it isn't. Events from senders with an
+// invalid user ID are left to fail the auth checks. Returns an error as the
+// second value only if the database fails.
+func (s *transactionState) checkServerACL(origin ServerName, event *Event) (denied, err error) {
+	aclEvent, err := s.GetStateEvent(MRoomServerACL, "")
+	if err != nil || aclEvent == nil {
+		return nil, err
+	}
+	acl, err := NewServerACLContentFromEvent(aclEvent)
+	if err != nil {
+		// An unparsable ACL is ignored rather than denying every server.
+		return nil, nil
+	}
+	servers := []ServerName{origin}
+	if _, domain, err := SplitID('@', event.Sender()); err == nil && domain != origin {
+		servers = append(servers, domain)
+	}
+	for _, serverName := range servers {
+		if !acl.Allowed(serverName) {
+			return fmt.Errorf("gomatrixserverlib: event %q is from %q, which is denied by the server ACL", event.EventID(), serverName), nil
+		}
+	}
+	return nil, nil
+}
+
+// process auths the event against its auth events and the current state,
+// and applies it if it passes. Returns an error only if the database fails.
+func (s *transactionState) process(event *Event) (TransactionPDUResult, error) {
+	authEvents, err := s.GetEventsByID(event.AuthEventIDs())
+	if err != nil {
+		return TransactionPDUResult{}, err
+	}
+	rejected := func(err error) (TransactionPDUResult, error) {
+		return TransactionPDUResult{Event: event, Outcome: PDURejected, Error: err}, nil
+	}
+	if len(authEvents) != len(event.AuthEventIDs()) {
+		known := make(map[string]bool, len(authEvents))
+		for _, authEvent := range authEvents {
+			known[authEvent.EventID()] = true
+		}
+		for _, authEventID := range event.AuthEventIDs() {
+			if !known[authEventID] {
+				return rejected(fmt.Errorf("gomatrixserverlib: event %q has unknown auth event %q", event.EventID(), authEventID))
+			}
+		}
+	}
+	if err = ValidateAuthEvents(event, authEvents); err != nil {
+		return rejected(err)
+	}
+	provider := NewAuthEvents(authEvents)
+	if err = Allowed(event, &provider); err != nil {
+		return rejected(err)
+	}
+	s.events[event.EventID()] = event
+	if err = Allowed(event, NewAuthEventsFromDatabase(s)); err != nil {
+		return TransactionPDUResult{Event: event, Outcome: PDUSoftFailed, Error: err}, nil
+	}
+	if stateKey := event.StateKey(); stateKey != nil {
+		s.state[StateKeyTuple{event.Type(), *stateKey}] = event
+	}
+	return TransactionPDUResult{Event: event, Outcome: PDUAccepted}, nil
+}
+
+// GetEvent implements EventDatabase
+func (s *transactionState) GetEvent(eventID string) (*Event, error) {
+	if event, ok := s.events[eventID]; ok {
+		return event, nil
+	}
+	return s.db.GetEvent(eventID)
+}
+
+// GetStateEvent implements EventDatabase
+func (s *transactionState) GetStateEvent(eventType, stateKey string) (*Event, error) {
+	if event, ok := s.state[StateKeyTuple{eventType, stateKey}]; ok {
+		return event, nil
+	}
+	return s.db.GetStateEvent(eventType, stateKey)
+}
+
+// GetEventsByID implements EventDatabase
+func (s *transactionState) GetEventsByID(eventIDs []string) ([]*Event, error) {
+	events := make([]*Event, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		event, err := s.GetEvent(eventID)
+		if err != nil {
+			return nil, err
+		}
+		if event != nil {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
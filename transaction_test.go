@@ -0,0 +1,485 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/sjson"
+	"golang.org/x/crypto/ed25519"
+)
+
+// testMemoryKeyDatabase is a KeyDatabase that only knows about the keys
+// that have been stored in it. It is safe to use from multiple goroutines.
+type testMemoryKeyDatabase struct {
+	mutex sync.Mutex
+	keys  map[PublicKeyLookupRequest]PublicKeyLookupResult
+}
+
+func (db *testMemoryKeyDatabase) FetcherName() string {
+	return "testMemoryKeyDatabase"
+}
+
+func (db *testMemoryKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	for req := range requests {
+		if res, ok := db.keys[req]; ok {
+			results[req] = res
+		}
+	}
+	return results, nil
+}
+
+func (db *testMemoryKeyDatabase) StoreKeys(
+	ctx context.Context, results map[PublicKeyLookupRequest]PublicKeyLookupResult,
+) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for req, res := range results {
+		db.keys[req] = res
+	}
+	return nil
+}
+
+// testSigningServer is a server with a signing key that can build events.
+type testSigningServer struct {
+	serverName ServerName
+	keyID      KeyID
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func newTestSigningServer(t testing.TB, serverName ServerName) *testSigningServer {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigningServer{serverName, "ed25519:test", publicKey, privateKey}
+}
+
+// testKeyRingForServers returns a KeyRing that knows the public keys of the given servers.
+func testKeyRingForServers(servers ...*testSigningServer) *KeyRing {
+	db := &testMemoryKeyDatabase{keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{}}
+	for _, s := range servers {
+		db.keys[PublicKeyLookupRequest{s.serverName, s.keyID}] = PublicKeyLookupResult{
+			VerifyKey:    VerifyKey{Key: Base64Bytes(s.publicKey)},
+			ExpiredTS:    PublicKeyNotExpired,
+			ValidUntilTS: AsTimestamp(time.Now().Add(time.Hour)),
+		}
+	}
+	return &KeyRing{KeyDatabase: db}
+}
+
+func (s *testSigningServer) buildMessage(t *testing.T, roomID, body string, roomVersion RoomVersion) *Event {
+	eb := EventBuilder{
+		Sender:     fmt.Sprintf("@alice:%s", s.serverName),
+		RoomID:     roomID,
+		Type:       "m.room.message",
+		PrevEvents: []string{},
+		AuthEvents: []string{},
+		Depth:      1,
+	}
+	if err := eb.SetContent(map[string]string{"body": body}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := eb.Build(time.Now(), s.serverName, s.keyID, s.privateKey, roomVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestTransactionVerify(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	mallory := newTestSigningServer(t, "mallory.test")
+	keyRing := testKeyRingForServers(alice)
+	roomID := "!room:alice.test"
+
+	good := alice.buildMessage(t, roomID, "hello", RoomVersionV10)
+	// Mallory signs an event pretending to be from alice's server, but the
+	// key ring doesn't know about mallory's key so the signature won't match.
+	forged := (&testSigningServer{"alice.test", alice.keyID, mallory.publicKey, mallory.privateKey}).buildMessage(t, roomID, "forged", RoomVersionV10)
+	// The content of this event has been changed after it was signed, so the
+	// content hash won't match and the event should be redacted.
+	tampered := alice.buildMessage(t, roomID, "original", RoomVersionV10)
+	tamperedJSON, err := sjson.SetBytes(tampered.JSON(), "content.body", "changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn := Transaction{
+		TransactionID:  "txn1",
+		Origin:         "alice.test",
+		Destination:    "bob.test",
+		OriginServerTS: AsTimestamp(time.Now()),
+		PDUs: []json.RawMessage{
+			good.JSON(),
+			forged.JSON(),
+			tamperedJSON,
+			[]byte(`{"room_id":"!unknown:alice.test","type":"m.room.message"}`),
+			[]byte(`{"type":"m.room.message"}`),
+		},
+		EDUs: []EDU{{Type: MTyping, Origin: "alice.test"}},
+	}
+	roomVersion := func(id string) (RoomVersion, error) {
+		if id != roomID {
+			return "", fmt.Errorf("unknown room %q", id)
+		}
+		return RoomVersionV10, nil
+	}
+
+	results := txn.Verify(context.Background(), keyRing, roomVersion)
+	if len(results) != len(txn.PDUs) {
+		t.Fatalf("got %d results, want %d", len(results), len(txn.PDUs))
+	}
+	if results[0].Error != nil {
+		t.Errorf("valid PDU failed verification: %s", results[0].Error)
+	} else if results[0].Event.EventID() != good.EventID() || results[0].Event.Redacted() {
+		t.Errorf("valid PDU was not returned intact")
+	}
+	if results[1].Error == nil || results[1].Outcome != PDUInvalid {
+		t.Errorf("forged PDU should have failed verification, got outcome %s", results[1].Outcome)
+	}
+	if results[2].Error != nil {
+		t.Errorf("tampered PDU should pass signature checks once redacted, got %s", results[2].Error)
+	} else if !results[2].Event.Redacted() {
+		t.Errorf("tampered PDU should have been redacted")
+	}
+	for i := 3; i < len(results); i++ {
+		if results[i].Error == nil || results[i].Event != nil {
+			t.Errorf("PDU %d should have failed to parse", i)
+		}
+	}
+}
+
+func TestTransactionJSON(t *testing.T) {
+	input := []byte(`{"origin":"alice.test","origin_server_ts":1234,"pdus":[{"type":"m.room.message"}],"edus":[{"edu_type":"m.typing","origin":"alice.test","content":{"room_id":"!room:alice.test","user_id":"@alice:alice.test","typing":true}}]}`)
+	var txn Transaction
+	if err := json.Unmarshal(input, &txn); err != nil {
+		t.Fatal(err)
+	}
+	if txn.Origin != "alice.test" || txn.OriginServerTS != 1234 {
+		t.Fatalf("unexpected transaction: %+v", txn)
+	}
+	if len(txn.PDUs) != 1 || len(txn.EDUs) != 1 {
+		t.Fatalf("got %d PDUs and %d EDUs, want 1 of each", len(txn.PDUs), len(txn.EDUs))
+	}
+	if err := txn.EDUs[0].Validate(); err != nil {
+		t.Fatalf("EDU should be valid: %s", err)
+	}
+}
+
+func TestTransactionOriginConsistency(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	bob := newTestSigningServer(t, "bob.test")
+	roomID := "!room:alice.test"
+
+	own := alice.buildMessage(t, roomID, "from alice", RoomVersionV1)
+	relayed := bob.buildMessage(t, roomID, "from bob", RoomVersionV1)
+	txn := Transaction{
+		TransactionID: "txn1",
+		Origin:        "alice.test",
+		Destination:   "charlie.test",
+		PDUs: []json.RawMessage{
+			json.RawMessage(own.JSON()),
+			json.RawMessage(relayed.JSON()),
+			json.RawMessage(`{"type":"m.room.message","sender":"not a user ID"}`),
+		},
+	}
+
+	warnings := TransactionOriginConsistency(txn)
+	if len(warnings) != 2 {
+		t.Fatalf("got %d warnings, want 2: %v", len(warnings), warnings)
+	}
+	if warnings[0].EventID != relayed.EventID() {
+		t.Errorf("got warning for event %q, want %q", warnings[0].EventID, relayed.EventID())
+	}
+	if !strings.Contains(warnings[0].Message, "@alice:bob.test") {
+		t.Errorf("expected the warning to name the sender, got %q", warnings[0].Message)
+	}
+	if !strings.Contains(warnings[1].Message, "invalid sender") {
+		t.Errorf("expected a warning about the invalid sender, got %q", warnings[1].Message)
+	}
+
+	txn.PDUs = txn.PDUs[:1]
+	if warnings = TransactionOriginConsistency(txn); len(warnings) != 0 {
+		t.Fatalf("expected no warnings when all PDUs are from the origin, got %v", warnings)
+	}
+}
+
+func TestProcessTransaction(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	bob := newTestSigningServer(t, "bob.test")
+	keyRing := testKeyRingForServers(alice, bob)
+	roomID := "!room:alice.test"
+	aliceID, bobID := "@alice:alice.test", "@bob:bob.test"
+
+	builders, err := CreateRoom(roomID, aliceID, RoomVersionV10, WithCreateRoomJoinRule(Public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := BuildRoomEvents(builders, time.Now(), alice.serverName, alice.keyID, alice.privateKey, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create, aliceJoin, powerLevels, joinRules := room[0], room[1], room[2], room[3]
+	db := NewMemoryEventDatabase(room)
+
+	build := func(s *testSigningServer, sender, eventType string, stateKey *string, content interface{}, prev *Event, authEvents ...*Event) *Event {
+		eb := EventBuilder{
+			Sender:   sender,
+			RoomID:   roomID,
+			Type:     eventType,
+			StateKey: stateKey,
+			Depth:    prev.Depth() + 1,
+		}
+		eb.SetPrevEvents([]*Event{prev})
+		refs := make([]EventReference, 0, len(authEvents))
+		for _, authEvent := range authEvents {
+			refs = append(refs, authEvent.EventReference())
+		}
+		eb.AuthEvents = refs
+		if err := eb.SetContent(content); err != nil {
+			t.Fatal(err)
+		}
+		event, err := eb.Build(time.Now(), s.serverName, s.keyID, s.privateKey, RoomVersionV10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	message := map[string]string{"body": "hello"}
+
+	aliceMessage := build(alice, aliceID, "m.room.message", nil, message, joinRules, create, powerLevels, aliceJoin)
+	bobJoin := build(bob, bobID, MRoomMember, &bobID, MemberContent{Membership: Join}, aliceMessage, create, powerLevels, joinRules)
+	ban := build(alice, aliceID, MRoomMember, &bobID, MemberContent{Membership: Ban}, bobJoin, create, powerLevels, aliceJoin, bobJoin)
+	// Bob's message is allowed by its auth events, which predate the ban,
+	// but not by the current state once the ban has been applied.
+	bobMessage := build(bob, bobID, "m.room.message", nil, message, bobJoin, create, powerLevels, bobJoin)
+	// Charlie has never joined the room.
+	charlieMessage := build(bob, "@charlie:bob.test", "m.room.message", nil, message, ban, create, powerLevels)
+
+	// PDUs for other rooms can't be processed against the database.
+	otherRoom := alice.buildMessage(t, "!other:alice.test", "hello", RoomVersionV10)
+
+	txn := Transaction{
+		TransactionID: "txn1",
+		Origin:        "alice.test",
+		Destination:   "charlie.test",
+		PDUs: []json.RawMessage{
+			json.RawMessage(aliceMessage.JSON()),
+			json.RawMessage(bobJoin.JSON()),
+			json.RawMessage(ban.JSON()),
+			json.RawMessage(bobMessage.JSON()),
+			json.RawMessage(charlieMessage.JSON()),
+			json.RawMessage(otherRoom.JSON()),
+			json.RawMessage(`{"type":"m.room.message"}`),
+		},
+	}
+	want := []PDUOutcome{
+		PDUAccepted, PDUAccepted, PDUAccepted, PDUSoftFailed, PDURejected, PDUUnknownRoom, PDUInvalid,
+	}
+
+	results, err := ProcessTransaction(context.Background(), txn, db, keyRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, result := range results {
+		if result.Outcome != want[i] {
+			t.Errorf("PDU %d: got outcome %s (%v), want %s", i, result.Outcome, result.Error, want[i])
+		}
+		if (result.Error == nil) != (result.Outcome == PDUAccepted) {
+			t.Errorf("PDU %d: got error %v with outcome %s", i, result.Error, result.Outcome)
+		}
+	}
+
+	// The database must not be modified.
+	if member, _ := db.GetStateEvent(MRoomMember, bobID); member != nil {
+		t.Errorf("expected the database not to be modified, got member event %q", member.EventID())
+	}
+}
+
+func TestProcessTransactionServerACL(t *testing.T) {
+	alice := newTestSigningServer(t, "alice.test")
+	bob := newTestSigningServer(t, "bob.test")
+	keyRing := testKeyRingForServers(alice, bob)
+	roomID := "!room:alice.test"
+	aliceID, bobID := "@alice:alice.test", "@bob:bob.test"
+
+	builders, err := CreateRoom(roomID, aliceID, RoomVersionV10, WithCreateRoomJoinRule(Public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := BuildRoomEvents(builders, time.Now(), alice.serverName, alice.keyID, alice.privateKey, RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create, aliceJoin, powerLevels, joinRules := room[0], room[1], room[2], room[3]
+
+	build := func(s *testSigningServer, sender, eventType string, stateKey *string, content interface{}, prev *Event, authEvents ...*Event) *Event {
+		eb := EventBuilder{Sender: sender, RoomID: roomID, Type: eventType, StateKey: stateKey, Depth: prev.Depth() + 1}
+		eb.SetPrevEvents([]*Event{prev})
+		refs := make([]EventReference, 0, len(authEvents))
+		for _, authEvent := range authEvents {
+			refs = append(refs, authEvent.EventReference())
+		}
+		eb.AuthEvents = refs
+		if err := eb.SetContent(content); err != nil {
+			t.Fatal(err)
+		}
+		event, err := eb.Build(time.Now(), s.serverName, s.keyID, s.privateKey, RoomVersionV10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	bobJoin := build(bob, bobID, MRoomMember, &bobID, MemberContent{Membership: Join}, joinRules, create, powerLevels, joinRules)
+	room = append(room, bobJoin)
+	db := NewMemoryEventDatabase(room)
+	message := map[string]string{"body": "hello"}
+
+	// Bob's first message is sent before the ACL denies bob.test, and the
+	// second after it, so only the second is dropped.
+	bobBefore := build(bob, bobID, "m.room.message", nil, message, bobJoin, create, powerLevels, bobJoin)
+	acl := build(alice, aliceID, MRoomServerACL, &emptyStateKey, ServerACLContent{Allow: []string{"*"}, Deny: []string{"bob.test"}}, bobBefore, create, powerLevels, aliceJoin)
+	bobAfter := build(bob, bobID, "m.room.message", nil, message, acl, create, powerLevels, bobJoin)
+	aliceAfter := build(alice, aliceID, "m.room.message", nil, message, bobAfter, create, powerLevels, aliceJoin)
+
+	txn := Transaction{
+		TransactionID: "txn1",
+		Origin:        "alice.test",
+		Destination:   "charlie.test",
+		PDUs: []json.RawMessage{
+			json.RawMessage(bobBefore.JSON()),
+			json.RawMessage(acl.JSON()),
+			json.RawMessage(bobAfter.JSON()),
+			json.RawMessage(aliceAfter.JSON()),
+		},
+	}
+	want := []PDUOutcome{PDUAccepted, PDUAccepted, PDUDenied, PDUAccepted}
+	results, err := ProcessTransaction(context.Background(), txn, db, keyRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Outcome != want[i] {
+			t.Errorf("PDU %d: got outcome %s (%v), want %s", i, result.Outcome, result.Error, want[i])
+		}
+	}
+	if err = results[2].Error; err == nil || !strings.Contains(err.Error(), "server ACL") {
+		t.Errorf("expected bob's message to be denied by the server ACL, got %v", err)
+	}
+
+	// Once the ACL is in the room state, anything relayed by bob.test is
+	// dropped too, even if it was sent by another server.
+	db = NewMemoryEventDatabase(append(room, bobBefore, acl))
+	txn.Origin = "bob.test"
+	txn.PDUs = []json.RawMessage{json.RawMessage(aliceAfter.JSON())}
+	results, err = ProcessTransaction(context.Background(), txn, db, keyRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Outcome != PDUDenied {
+		t.Errorf("got outcome %s (%v) for a PDU relayed by a denied server, want %s", results[0].Outcome, results[0].Error, PDUDenied)
+	}
+}
+
+// buildTestTransaction returns a transaction of n messages from alice.test to
+// the room in the returned database, where every tenth message is forged and
+// so fails signature checks, along with a key ring which knows alice.test's
+// keys.
+func buildTestTransaction(tb testing.TB, n int) (Transaction, EventDatabase, *KeyRing) {
+	alice := newTestSigningServer(tb, "alice.test")
+	mallory := newTestSigningServer(tb, "mallory.test")
+	forger := &testSigningServer{"alice.test", alice.keyID, mallory.publicKey, mallory.privateKey}
+	roomID, aliceID := "!room:alice.test", "@alice:alice.test"
+
+	builders, err := CreateRoom(roomID, aliceID, RoomVersionV10)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	room, err := BuildRoomEvents(builders, time.Now(), alice.serverName, alice.keyID, alice.privateKey, RoomVersionV10)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	authEvents := []EventReference{room[0].EventReference(), room[1].EventReference(), room[2].EventReference()}
+
+	txn := Transaction{TransactionID: "txn1", Origin: "alice.test", Destination: "bob.test"}
+	prev := room[len(room)-1]
+	for i := 0; i < n; i++ {
+		signer := alice
+		if i%10 == 9 {
+			signer = forger
+		}
+		eb := EventBuilder{
+			Sender:     aliceID,
+			RoomID:     roomID,
+			Type:       "m.room.message",
+			AuthEvents: authEvents,
+			Depth:      prev.Depth() + 1,
+		}
+		eb.SetPrevEvents([]*Event{prev})
+		if err = eb.SetContent(map[string]string{"body": fmt.Sprintf("message %d", i)}); err != nil {
+			tb.Fatal(err)
+		}
+		event, err := eb.Build(time.Now(), signer.serverName, signer.keyID, signer.privateKey, RoomVersionV10)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		txn.PDUs = append(txn.PDUs, json.RawMessage(event.JSON()))
+		prev = event
+	}
+	return txn, NewMemoryEventDatabase(room), testKeyRingForServers(alice)
+}
+
+func TestProcessTransactionConcurrentVerification(t *testing.T) {
+	txn, db, keyRing := buildTestTransaction(t, 100)
+	sequential, err := ProcessTransaction(context.Background(), txn, db, keyRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	concurrent, err := ProcessTransaction(context.Background(), txn, db, keyRing, WithVerifyConcurrency(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(concurrent) != len(txn.PDUs) {
+		t.Fatalf("got %d results, want %d", len(concurrent), len(txn.PDUs))
+	}
+	for i := range concurrent {
+		want := PDUAccepted
+		if i%10 == 9 {
+			want = PDUInvalid
+		}
+		if concurrent[i].Outcome != want {
+			t.Errorf("PDU %d: got outcome %s (%v), want %s", i, concurrent[i].Outcome, concurrent[i].Error, want)
+		}
+		if concurrent[i].Outcome != sequential[i].Outcome || concurrent[i].Event.EventID() != sequential[i].Event.EventID() {
+			t.Errorf("PDU %d: got %s for %q concurrently, but %s for %q sequentially",
+				i, concurrent[i].Outcome, concurrent[i].Event.EventID(), sequential[i].Outcome, sequential[i].Event.EventID())
+		}
+	}
+}
+
+func BenchmarkProcessTransaction(b *testing.B) {
+	txn, db, keyRing := buildTestTransaction(b, 100)
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ProcessTransaction(context.Background(), txn, db, keyRing, WithVerifyConcurrency(concurrency)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package gomatrixserverlib
+
+import "fmt"
+
+// A Warning describes something unusual about an event which doesn't stop
+// it from being processed, but which may be worth logging or investigating.
+type Warning struct {
+	// The ID of the event the warning is about, if known.
+	EventID string
+	// A human readable description of the problem.
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.EventID == "" {
+		return w.Message
+	}
+	return fmt.Sprintf("%s: %s", w.EventID, w.Message)
+}